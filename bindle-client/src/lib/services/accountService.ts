@@ -90,6 +90,24 @@ export const accountService = {
         await this.getMe();
     },
 
+    // The ShareX uploader holds the account ID in a header, so it has to be fetched with
+    // it rather than linked to, and is handed to the browser as a download from here.
+    async downloadShareXConfig(): Promise<void> {
+        const response = await fetch(`${config.apiHost}/sharex/config`, {
+            headers: getHeaders(false),
+        });
+        if (!response.ok) {
+            throw new Error(`HTTP error! status: ${response.status}`);
+        }
+
+        const url = URL.createObjectURL(await response.blob());
+        const a = document.createElement("a");
+        a.href = url;
+        a.download = `bindle-${window.location.host.replace(":", "-")}.sxcu`;
+        a.click();
+        URL.revokeObjectURL(url);
+    },
+
     async initializeAccount() {
         // Transferred account ids arrive in the fragment (see QRCodeModal). The query
         // string is still read so that links shared before that change keep working,
@@ -18,6 +18,7 @@ export interface AdminFile {
     ownerId: number;
     accountId: string;
     chunkCount: number;
+    sha256: string;
     createdAt: string;
 }
 
@@ -37,6 +38,39 @@ export interface AdminStats {
     averageFileBytes: number;
     largestFileBytes: number;
     storageBackend: string;
+    /**
+     * Complete downloads. downloadRequests and downloadedBytes come from the download
+     * log, which also has every ranged request.
+     */
+    downloads: number;
+    downloadRequests: number;
+    downloadedBytes: number;
+    topFiles: AdminTopFile[];
+}
+
+export interface AdminTopFile {
+    fileId: string;
+    fileName: string;
+    accountId: string;
+    downloads: number;
+    downloadRequests: number;
+    downloadedBytes: number;
+}
+
+/**
+ * Progress of the migration of files stored in formats predating the streaming one.
+ * migrated and failed count the running or last run; remaining is counted afresh.
+ */
+export interface LegacyMigrationStatus {
+    running: boolean;
+    startedAt?: string;
+    finishedAt?: string;
+    total: number;
+    migrated: number;
+    /** Stored objects that could not be migrated, and are retried by the next run. */
+    failed: number;
+    lastError?: string;
+    remaining: number;
 }
 
 const getAdminHeaders = (password: string) => {
@@ -60,6 +94,33 @@ export const adminService = {
         return response.json();
     },
 
+    async getLegacyMigration(password: string): Promise<LegacyMigrationStatus> {
+        const response = await fetch(`${config.apiHost}/admin/migrations/legacy`, {
+            headers: getAdminHeaders(password),
+        });
+
+        if (!response.ok) {
+            const error = await response.json();
+            throw new Error(error.error || 'Failed to fetch migration progress');
+        }
+
+        return response.json();
+    },
+
+    async startLegacyMigration(password: string): Promise<LegacyMigrationStatus> {
+        const response = await fetch(`${config.apiHost}/admin/migrations/legacy`, {
+            method: 'POST',
+            headers: getAdminHeaders(password),
+        });
+
+        if (!response.ok) {
+            const error = await response.json();
+            throw new Error(error.error || 'Failed to start the migration');
+        }
+
+        return response.json();
+    },
+
     async getAllUsers(password: string): Promise<AdminUser[]> {
         const response = await fetch(`${config.apiHost}/admin/users`, {
             headers: getAdminHeaders(password),
@@ -1,6 +1,14 @@
 import { updateUploadingFile } from '../stores/uploadStore.svelte';
 import { getHeaders } from './fileService';
 import { withCredentials } from './accountService';
+import {
+	generateSealingKey,
+	importSealingKey,
+	rememberFileKey,
+	sealedSize,
+	sealedSlice,
+	type SealingKey
+} from '$lib/utils/sealing';
 
 // Only used to size the initial request. The server pins the authoritative chunk
 // layout at init and returns it; the upload loop below uses that, since the server
@@ -31,6 +39,46 @@ export interface ChunkUploadSession {
 	totalChunks: number;
 }
 
+// What GET /api/file/chunk/:sessionId reports about a session.
+export interface ChunkUploadStatus extends ChunkUploadSession {
+	fileName: string;
+	fileSize: number;
+	mimeType: string;
+	expiresAt: string;
+	receivedChunks: number[];
+}
+
+// Sessions are remembered per file so that uploading the same file again after a reload
+// or a dropped connection carries on from what the server already holds. A file is
+// recognised by name, size and modification time, which is as close to its identity as
+// the browser lets a page get without reading it. An encrypted upload is remembered
+// apart from a plain one of the same file, with its key after the session ID: the
+// chunks still to come have to be sealed with the key the others were.
+const RESUME_KEY_PREFIX = 'bindle.upload.';
+
+function resumeKey(file: File, encrypt: boolean): string {
+	const mode = encrypt ? 'sealed:' : '';
+	return `${RESUME_KEY_PREFIX}${mode}${file.name}:${file.size}:${file.lastModified}`;
+}
+
+// What is actually sent for a file: its bytes, or for an encrypted upload the ciphertext
+// they seal into, either way read a slice at a time.
+interface UploadSource {
+	size: number;
+	slice(start: number, end: number): Promise<Blob>;
+}
+
+function plainSource(file: File): UploadSource {
+	return { size: file.size, slice: async (start, end) => file.slice(start, end) };
+}
+
+function sealedSource(file: File, sealing: SealingKey): UploadSource {
+	return {
+		size: sealedSize(file.size),
+		slice: (start, end) => sealedSlice(file, sealing.key, start, end)
+	};
+}
+
 export interface ChunkUploadResult {
 	success: boolean;
 	file?: any;
@@ -38,33 +86,64 @@ export interface ChunkUploadResult {
 }
 
 /**
- * Upload a file using chunked upload
+ * Upload a file using chunked upload. With encrypt set, the file is encrypted here and
+ * the server only ever receives ciphertext; see $lib/utils/sealing.
  */
 export async function uploadFileChunked(
 	file: File,
-	uploadId: string
+	uploadId: string,
+	encrypt = false
 ): Promise<ChunkUploadResult> {
 	try {
-		// Initialize upload session
-		const session = await initChunkedUpload(file, Math.ceil(file.size / DEFAULT_CHUNK_SIZE));
+		// Pick up where an earlier attempt at this file stopped, or else start afresh.
+		const resumed = await findResumableUpload(file, encrypt);
+		const received = resumed?.status.receivedChunks ?? [];
+		let session: ChunkUploadSession | null = resumed?.status ?? null;
+		let sealing = resumed?.sealing ?? null;
 		if (!session) {
-			return { success: false, error: 'Failed to initialize upload session' };
+			sealing = encrypt ? await generateSealingKey() : null;
+			const size = sealing ? sealedSize(file.size) : file.size;
+			session = await initChunkedUpload(file, size, Math.ceil(size / DEFAULT_CHUNK_SIZE), encrypt);
+			if (!session) {
+				return { success: false, error: 'Failed to initialize upload session' };
+			}
+			const remembered = sealing ? `${session.sessionId}#${sealing.encoded}` : session.sessionId;
+			localStorage.setItem(resumeKey(file, encrypt), remembered);
 		}
+		const source = sealing ? sealedSource(file, sealing) : plainSource(file);
 
 		// The server decides how the file is split; follow its layout, not ours.
 		const chunkSize = session.chunkSize || DEFAULT_CHUNK_SIZE;
-		const totalChunks = session.totalChunks || Math.ceil(file.size / chunkSize);
+		const totalChunks = session.totalChunks || Math.ceil(source.size / chunkSize);
+
+		const done = new Set(received);
+		const pending = Array.from({ length: totalChunks }, (_, i) => i).filter((i) => !done.has(i));
+		const alreadyUploaded = received.reduce(
+			(total, i) => total + Math.min(chunkSize, source.size - i * chunkSize),
+			0
+		);
 
 		// Update upload store with session info
 		updateUploadingFile(uploadId, {
 			sessionId: session.sessionId,
 			totalChunks,
-			currentChunk: 0
+			currentChunk: done.size,
+			uploadedBytes: alreadyUploaded,
+			progress: Math.round((alreadyUploaded / source.size) * 100)
 		});
 
-		const failure = await uploadAllChunks(file, uploadId, session.sessionId, chunkSize, totalChunks);
+		const failure = await uploadAllChunks(
+			source,
+			uploadId,
+			session.sessionId,
+			chunkSize,
+			pending,
+			alreadyUploaded
+		);
+		// The session is kept rather than aborted: a chunk that failed every retry is
+		// usually a connection that went away, and uploading the file again carries on
+		// from here. One that is never come back to is released when it expires.
 		if (failure) {
-			await abortChunkedUpload(session.sessionId);
 			return { success: false, error: failure };
 		}
 
@@ -73,6 +152,10 @@ export async function uploadFileChunked(
 		if (!result) {
 			return { success: false, error: 'Failed to complete upload' };
 		}
+		localStorage.removeItem(resumeKey(file, encrypt));
+		if (sealing) {
+			rememberFileKey(result.fileId, sealing.encoded);
+		}
 
 		updateUploadingFile(uploadId, {
 			progress: 100,
@@ -87,20 +170,46 @@ export async function uploadFileChunked(
 }
 
 /**
- * Upload every chunk, keeping CONCURRENT_CHUNKS of them in flight. Returns an error
- * message if the upload could not be completed, or null on success.
+ * Look for a session this file was already being uploaded in, and ask the server which
+ * of its chunks have arrived. Returns null when there is none to carry on, forgetting a
+ * session the server no longer has.
  */
-async function uploadAllChunks(
+async function findResumableUpload(
 	file: File,
+	encrypt: boolean
+): Promise<{ status: ChunkUploadStatus; sealing: SealingKey | null } | null> {
+	const remembered = localStorage.getItem(resumeKey(file, encrypt));
+	if (!remembered) {
+		return null;
+	}
+	const [sessionId, encodedKey] = remembered.split('#');
+
+	const status = await getChunkedUploadStatus(sessionId);
+	const size = encrypt ? sealedSize(file.size) : file.size;
+	if (!status || status.fileSize !== size || (encrypt && !encodedKey)) {
+		localStorage.removeItem(resumeKey(file, encrypt));
+		return null;
+	}
+	return { status, sealing: encodedKey ? await importSealingKey(encodedKey) : null };
+}
+
+/**
+ * Upload the pending chunks, keeping CONCURRENT_CHUNKS of them in flight. Returns an
+ * error message if the upload could not be completed, or null on success.
+ */
+async function uploadAllChunks(
+	source: UploadSource,
 	uploadId: string,
 	sessionId: string,
 	chunkSize: number,
-	totalChunks: number
+	pending: number[],
+	alreadyUploaded: number
 ): Promise<string | null> {
 	const startTime = Date.now();
-	let uploadedBytes = 0;
-	let completedChunks = 0;
-	let nextChunk = 0;
+	const totalChunks = Math.ceil(source.size / chunkSize);
+	let uploadedBytes = alreadyUploaded;
+	let completedChunks = totalChunks - pending.length;
+	let next = 0;
 	let failure: string | null = null;
 
 	// Chunks that landed inside the speed window, as [completedAt, bytes]. The reported
@@ -110,24 +219,25 @@ async function uploadAllChunks(
 	const recent: Array<[number, number]> = [];
 
 	// The first failure cancels the chunks still in flight rather than letting them run
-	// out against a session that is about to be aborted.
+	// out: the attempt has failed, and a later one asks the server what it holds anyway.
 	const controller = new AbortController();
 
 	const worker = async () => {
 		while (!controller.signal.aborted) {
-			const chunkNumber = nextChunk++;
-			if (chunkNumber >= totalChunks) {
+			if (next >= pending.length) {
 				return;
 			}
+			const chunkNumber = pending[next++];
 
 			const start = chunkNumber * chunkSize;
-			const end = Math.min(start + chunkSize, file.size);
-			const chunk = file.slice(start, end);
+			const end = Math.min(start + chunkSize, source.size);
+			const chunk = await source.slice(start, end);
 
 			const success = await uploadChunkWithRetry(
 				sessionId,
 				chunkNumber,
 				chunk,
+				await chunkDigest(chunk),
 				MAX_RETRIES,
 				controller.signal
 			);
@@ -147,7 +257,7 @@ async function uploadAllChunks(
 
 			updateUploadingFile(uploadId, {
 				uploadedBytes,
-				progress: Math.round((uploadedBytes / file.size) * 100),
+				progress: Math.round((uploadedBytes / source.size) * 100),
 				speed: recordSpeedSample(recent, chunk.size, startTime),
 				currentChunk: completedChunks
 			});
@@ -155,7 +265,7 @@ async function uploadAllChunks(
 	};
 
 	await Promise.all(
-		Array.from({ length: Math.min(CONCURRENT_CHUNKS, totalChunks) }, () => worker())
+		Array.from({ length: Math.min(CONCURRENT_CHUNKS, pending.length) }, () => worker())
 	);
 
 	return failure;
@@ -200,7 +310,9 @@ function recordSpeedSample(
  */
 async function initChunkedUpload(
 	file: File,
-	totalChunks: number
+	fileSize: number,
+	totalChunks: number,
+	clientEncrypted: boolean
 ): Promise<ChunkUploadSession | null> {
 	try {
 		const response = await fetch('/api/file/chunk/init', {
@@ -209,9 +321,10 @@ async function initChunkedUpload(
 			headers: getHeaders(true),
 			body: JSON.stringify({
 				fileName: file.name,
-				fileSize: file.size,
+				fileSize,
 				mimeType: file.type,
-				totalChunks
+				totalChunks,
+				clientEncrypted
 			})
 		});
 
@@ -226,6 +339,41 @@ async function initChunkedUpload(
 	}
 }
 
+/**
+ * Ask the server how far a chunked upload has got
+ */
+async function getChunkedUploadStatus(sessionId: string): Promise<ChunkUploadStatus | null> {
+	try {
+		const response = await fetch(`/api/file/chunk/${sessionId}`, {
+			...withCredentials,
+			method: 'GET',
+			headers: getHeaders(true)
+		});
+
+		if (!response.ok) {
+			return null;
+		}
+
+		return await response.json();
+	} catch (error) {
+		console.error('Failed to fetch chunked upload status:', error);
+		return null;
+	}
+}
+
+/**
+ * The Content-Digest header for a chunk, which the server checks the chunk against
+ * before storing it. Web Crypto is only available in secure contexts, so over plain
+ * HTTP chunks go without one.
+ */
+async function chunkDigest(chunk: Blob): Promise<string | null> {
+	if (!globalThis.crypto?.subtle) {
+		return null;
+	}
+	const sum = new Uint8Array(await crypto.subtle.digest('SHA-256', await chunk.arrayBuffer()));
+	return `sha-256=:${btoa(String.fromCharCode(...sum))}:`;
+}
+
 /**
  * Upload a single chunk with retry logic
  */
@@ -233,16 +381,22 @@ async function uploadChunkWithRetry(
 	sessionId: string,
 	chunkNumber: number,
 	chunk: Blob,
+	digest: string | null,
 	retriesLeft: number,
 	signal: AbortSignal
 ): Promise<boolean> {
+	const headers = getHeaders(false);
+	if (digest) {
+		headers['Content-Digest'] = digest;
+	}
+
 	try {
 		const response = await fetch(
 			`/api/file/chunk/${sessionId}/${chunkNumber}`,
 			{
 				...withCredentials,
 				method: 'POST',
-				headers: getHeaders(false),
+				headers,
 				body: chunk,
 				signal
 			}
@@ -254,8 +408,8 @@ async function uploadChunkWithRetry(
 
 		return true;
 	} catch (error) {
-		// Another chunk already failed and took the session down with it; retrying this
-		// one would only add requests against a session that is being aborted.
+		// Another chunk already failed and ended this attempt; retrying this one would
+		// only add requests nothing is waiting for.
 		if (signal.aborted) {
 			return false;
 		}
@@ -270,7 +424,14 @@ async function uploadChunkWithRetry(
 			await new Promise((resolve) =>
 				setTimeout(resolve, (MAX_RETRIES - retriesLeft + 1) * 1000)
 			);
-			return uploadChunkWithRetry(sessionId, chunkNumber, chunk, retriesLeft - 1, signal);
+			return uploadChunkWithRetry(
+				sessionId,
+				chunkNumber,
+				chunk,
+				digest,
+				retriesLeft - 1,
+				signal
+			);
 		}
 
 		return false;
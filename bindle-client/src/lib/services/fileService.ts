@@ -1,11 +1,12 @@
 import { config } from "$lib/config";
 import { getAccount, getAccountId } from "$lib/stores/accountStore.client.svelte";
 import { addFile, deleteFile as removeFileFromStore } from "$lib/stores/fileStore.svelte";
-import { addUploadingFile, removeUploadingFile, updateUploadingFile } from '$lib/stores/uploadStore.svelte';
+import { addUploadingFile, getEncryptUploads, removeUploadingFile, updateUploadingFile } from '$lib/stores/uploadStore.svelte';
 import { setError } from "$lib/stores/errorStore.svelte";
 import type { UploadedFile } from '$lib/types';
 import { accountService, withCredentials } from "./accountService";
 import { uploadFileChunked } from "./chunkUploadService";
+import { canSeal, forgetFileKey, sealedSize } from "$lib/utils/sealing";
 
 export const getHeaders = (isJson: boolean = true, accountId?: string) => {
     const headers: Record<string, string> = {};
@@ -42,12 +43,20 @@ export const fileService = {
             throw new Error("Account not found");
         }
 
-        if (file.size > account.maxFileSizeBytes) {
+        const encrypt = getEncryptUploads();
+        if (encrypt && !canSeal()) {
+            setError("End-to-end encryption needs the page to be served over HTTPS.");
+            return;
+        }
+
+        // An encrypted file is stored, and counted, as its ciphertext.
+        const size = encrypt ? sealedSize(file.size) : file.size;
+        if (size > account.maxFileSizeBytes) {
             setError(`File is too large. Max file size is ${Math.round(account.maxFileSizeBytes / 1000 / 1000)}MB.`);
             return;
         }
 
-        if (!account.limitsUnlocked && account.uploadLimitBytes && account.uploadLimitBytes < (file.size + account.uploadedBytes)) {
+        if (!account.limitsUnlocked && account.uploadLimitBytes && account.uploadLimitBytes < (size + account.uploadedBytes)) {
             setError(`Upload limit exceeded. You may only upload up to ${Math.round(account.uploadLimitBytes / 1000 / 1000)}MB per day. Wait or delete some files.`);
             return;
         }
@@ -55,7 +64,7 @@ export const fileService = {
         const uploadingId = addUploadingFile(file);
         try {
             // Use chunked upload for all files
-            const result = await uploadFileChunked(file, uploadingId);
+            const result = await uploadFileChunked(file, uploadingId, encrypt);
 
             if (!result.success) {
                 updateUploadingFile(uploadingId, {
@@ -81,6 +90,7 @@ export const fileService = {
             headers: getHeaders(),
         });
         removeFileFromStore(fileId);
+        forgetFileKey(fileId);
         accountService.getMe();
         return response.json();
     }
@@ -1,3 +1,5 @@
+import { browser } from '$app/environment';
+
 export type UploadStatus = 'uploading' | 'paused' | 'error' | 'completed';
 
 export interface UploadingFile {
@@ -16,6 +18,21 @@ export interface UploadingFile {
 
 let uploadingFiles = $state<UploadingFile[]>([]);
 
+// Whether new uploads are encrypted in the browser. Remembered, since someone who wants
+// their files end-to-end encrypted wants it for the next visit too.
+const ENCRYPT_UPLOADS_KEY = 'bindle.encryptUploads';
+
+let encryptUploads = $state(browser && localStorage.getItem(ENCRYPT_UPLOADS_KEY) === 'true');
+
+export const getEncryptUploads = () => encryptUploads;
+
+export const setEncryptUploads = (encrypt: boolean) => {
+    if (browser) {
+        localStorage.setItem(ENCRYPT_UPLOADS_KEY, String(encrypt));
+    }
+    encryptUploads = encrypt;
+};
+
 export const getUploadingFiles = () => uploadingFiles;
 
 export const addUploadingFile = (file: File) => {
@@ -10,6 +10,82 @@ export interface UploadedFile {
     url: string;
     details?: string;
     createdAt: Date;
+    /**
+     * Hex SHA-256 of the contents, empty until the server has worked it out.
+     */
+    sha256?: string;
+    /**
+     * After this the file answers 410 Gone and is deleted. null keeps it forever.
+     */
+    expiresAt?: Date | null;
+    /**
+     * Downloads allowed before the file is gone. 0 is unlimited.
+     */
+    maxDownloads?: number;
+    downloadCount?: number;
+    passwordProtected?: boolean;
+    /**
+     * Encrypted in the uploader's browser. url serves ciphertext; the key is in this
+     * browser's storage if it uploaded the file, and nowhere else. See $lib/utils/sealing.
+     */
+    clientEncrypted?: boolean;
+    /**
+     * Only ever sent to the server, to set a new password.
+     */
+    password?: string;
+    /**
+     * Totals from the download log. Only present on the owner's own file list.
+     */
+    downloads?: DownloadSummary;
+}
+
+export interface DownloadSummary {
+    /**
+     * Every request that sent bytes, ranged ones included.
+     */
+    requests: number;
+    bytesSent: number;
+    lastDownloadedAt: Date | null;
+}
+
+/**
+ * One entry of a file's download log, from /api/file/:fileId/downloads.
+ */
+export interface Download {
+    id: number;
+    at: Date;
+    bytesSent: number;
+    range?: string;
+    shareId: string;
+    shareLabel: string;
+    /**
+     * Stands in for the client's IP address, which is not stored: entries with the
+     * same clientId came from the same address.
+     */
+    clientId: string;
+    userAgent: string;
+    referrer: string;
+}
+
+/**
+ * One of a file's public links, as listed by /api/file/:fileId/shares.
+ */
+export interface Share {
+    shareId: string;
+    label: string;
+    url: string;
+    expiresAt: Date | null;
+    /**
+     * Downloads allowed through this link. 0 is unlimited.
+     */
+    maxDownloads: number;
+    downloadCount: number;
+    passwordProtected: boolean;
+    /**
+     * False once the link has expired or used up its downloads.
+     */
+    available: boolean;
+    createdAt: Date;
 }
 
 export enum FileType {
@@ -0,0 +1,48 @@
+import { describe, it, expect } from 'vitest';
+import { generateSealingKey, sealedSize, sealedSlice } from './sealing';
+
+// Decrypts the way the server's viewer page does, which is the reader that matters.
+async function open(sealed: Uint8Array, encoded: string): Promise<Uint8Array> {
+    const raw = Uint8Array.from(atob(encoded.replace(/-/g, '+').replace(/_/g, '/')), (c) => c.charCodeAt(0));
+    const key = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+    const sealedFrame = 64 * 1024 + 16;
+    const frames = Math.max(1, Math.ceil(sealed.length / sealedFrame));
+    const parts: ArrayBuffer[] = [];
+    for (let i = 0; i < frames; i++) {
+        const iv = new Uint8Array(12);
+        new DataView(iv.buffer).setBigUint64(4, BigInt(i));
+        const additionalData = Uint8Array.of(i === frames - 1 ? 1 : 0);
+        parts.push(await crypto.subtle.decrypt({ name: 'AES-GCM', iv, additionalData }, key,
+            sealed.subarray(i * sealedFrame, (i + 1) * sealedFrame)));
+    }
+    return new Uint8Array(await new Blob(parts).arrayBuffer());
+}
+
+describe('sealedSlice', () => {
+    it('builds ciphertext chunk by chunk that the viewer opens', async () => {
+        for (const size of [0, 1, 64 * 1024, 64 * 1024 + 1, 300000]) {
+            const plain = new Uint8Array(size).map((_, i) => (i * 7) & 255);
+            const file = new Blob([plain]);
+            const { key, encoded } = await generateSealingKey();
+
+            // Chunks that do not line up with frames, as the server's never do.
+            const total = sealedSize(size);
+            const chunks: Blob[] = [];
+            for (let start = 0; start < total; start += 100003) {
+                chunks.push(await sealedSlice(file, key, start, Math.min(start + 100003, total)));
+            }
+            const sealed = new Uint8Array(await new Blob(chunks).arrayBuffer());
+
+            expect(sealed.length).toBe(total);
+            expect(await open(sealed, encoded)).toEqual(plain);
+        }
+    });
+
+    it('does not open a file cut short at a frame boundary', async () => {
+        const plain = new Uint8Array(3 * 64 * 1024);
+        const { key, encoded } = await generateSealingKey();
+        const sealed = await sealedSlice(new Blob([plain]), key, 0, 2 * (64 * 1024 + 16));
+
+        await expect(open(new Uint8Array(await sealed.arrayBuffer()), encoded)).rejects.toThrow();
+    });
+});
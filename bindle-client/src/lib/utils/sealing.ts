@@ -0,0 +1,135 @@
+// End-to-end encryption of uploads. A file uploaded this way is encrypted here, with a
+// key that only ever travels in the fragment of its share URL - browsers do not send the
+// fragment to the server, so the server stores ciphertext it has no way to open. The
+// share URL serves a page that fetches the ciphertext and decrypts it with the key from
+// the fragment (bindle-server's handlers/viewer.go), which is why the format below has
+// to stay in step with the viewer's.
+//
+// The plaintext is split into FRAME_SIZE frames sealed independently with AES-256-GCM.
+// The nonce is the frame's index, which is safe because every file gets a key of its
+// own, and the last frame is sealed with additional data 1 rather than 0, so a file cut
+// short at a frame boundary does not decrypt. Frames are what let the ciphertext be
+// produced a chunk at a time: any byte range of it can be built from the frames that
+// cover it, without reading the file from the start.
+
+const FRAME_SIZE = 64 * 1024;
+const TAG_SIZE = 16;
+const SEALED_FRAME_SIZE = FRAME_SIZE + TAG_SIZE;
+
+// Keys are kept per file ID so the link can be shown and copied again later. They stay
+// in this browser: the server never has them, so losing them loses the link.
+const KEY_PREFIX = 'bindle.key.';
+
+export interface SealingKey {
+	key: CryptoKey;
+	/** The raw key, base64url, as it goes in the share URL's fragment. */
+	encoded: string;
+}
+
+/**
+ * Whether this browser can encrypt uploads. Web Crypto is only available in secure
+ * contexts.
+ */
+export function canSeal(): boolean {
+	return !!globalThis.crypto?.subtle;
+}
+
+/**
+ * The size of the ciphertext a file of plainSize bytes seals into, which is what the
+ * upload declares and what counts against the quota.
+ */
+export function sealedSize(plainSize: number): number {
+	return plainSize + frameCount(plainSize) * TAG_SIZE;
+}
+
+function frameCount(plainSize: number): number {
+	// An empty file still seals one frame, so that it has a final frame to check.
+	return Math.max(1, Math.ceil(plainSize / FRAME_SIZE));
+}
+
+export async function generateSealingKey(): Promise<SealingKey> {
+	const raw = crypto.getRandomValues(new Uint8Array(32));
+	return importSealingKey(encodeKey(raw));
+}
+
+export async function importSealingKey(encoded: string): Promise<SealingKey> {
+	const key = await crypto.subtle.importKey('raw', decodeKey(encoded), 'AES-GCM', false, [
+		'encrypt'
+	]);
+	return { key, encoded };
+}
+
+/**
+ * Bytes [start, end) of the ciphertext of file, sealed from the frames that cover them.
+ * A frame straddling either end is sealed whole and cut; sealing is deterministic for a
+ * key, so the same frame sealed for two neighbouring chunks comes out the same.
+ */
+export async function sealedSlice(
+	file: Blob,
+	key: CryptoKey,
+	start: number,
+	end: number
+): Promise<Blob> {
+	const frames = frameCount(file.size);
+	const first = Math.floor(start / SEALED_FRAME_SIZE);
+	const last = Math.min(frames - 1, Math.floor((end - 1) / SEALED_FRAME_SIZE));
+
+	const sealed: ArrayBuffer[] = [];
+	for (let i = first; i <= last; i++) {
+		const plain = await file.slice(i * FRAME_SIZE, (i + 1) * FRAME_SIZE).arrayBuffer();
+		sealed.push(
+			await crypto.subtle.encrypt(
+				{ name: 'AES-GCM', iv: frameNonce(i), additionalData: finalFlag(i, frames) },
+				key,
+				plain
+			)
+		);
+	}
+
+	const offset = first * SEALED_FRAME_SIZE;
+	return new Blob(sealed).slice(start - offset, end - offset);
+}
+
+function frameNonce(index: number): Uint8Array {
+	const nonce = new Uint8Array(12);
+	new DataView(nonce.buffer).setBigUint64(4, BigInt(index));
+	return nonce;
+}
+
+function finalFlag(index: number, frames: number): Uint8Array {
+	return Uint8Array.of(index === frames - 1 ? 1 : 0);
+}
+
+function encodeKey(raw: Uint8Array): string {
+	return btoa(String.fromCharCode(...raw))
+		.replace(/\+/g, '-')
+		.replace(/\//g, '_')
+		.replace(/=+$/, '');
+}
+
+function decodeKey(encoded: string): Uint8Array {
+	return Uint8Array.from(atob(encoded.replace(/-/g, '+').replace(/_/g, '/')), (c) =>
+		c.charCodeAt(0)
+	);
+}
+
+export function rememberFileKey(fileId: string, encoded: string) {
+	localStorage.setItem(KEY_PREFIX + fileId, encoded);
+}
+
+export function forgetFileKey(fileId: string) {
+	localStorage.removeItem(KEY_PREFIX + fileId);
+}
+
+/**
+ * The link to share for a file: its URL, with the key in the fragment for a
+ * client-encrypted one. Without the key this browser kept at upload, the bare URL is all
+ * there is, and it only serves ciphertext.
+ */
+export function shareLink(file: { fileId: string; url: string; clientEncrypted?: boolean }): string {
+	if (!file.clientEncrypted) {
+		return file.url;
+	}
+	const encoded = localStorage.getItem(KEY_PREFIX + file.fileId);
+	return encoded ? `${file.url}#${encoded}` : file.url;
+}
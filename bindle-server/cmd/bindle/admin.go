@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nuuner/bindle-server/pkg/client"
+)
+
+const adminUsage = `usage: bindle admin <command> [arguments]
+
+Admin commands read the admin password from $BINDLE_ADMIN_PASSWORD.
+
+commands:
+  stats                      totals for the whole server
+  users                      every account, with its files and storage
+  files                      every file on the server
+  expiring [-within days]    accounts the next expiration run would delete
+  rm <file ID>...            delete files, whoever owns them
+  rm-user-files <account ID> delete every file of an account
+`
+
+func runAdmin(cfg *cliConfig, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+
+	c := newClient(cfg)
+	command, args := args[0], args[1:]
+	switch command {
+	case "stats":
+		return adminStats(c)
+	case "users":
+		return adminUsers(c)
+	case "files":
+		return adminFiles(c)
+	case "expiring":
+		return adminExpiring(c, args)
+	case "rm":
+		return adminRemove(c, args)
+	case "rm-user-files":
+		return adminRemoveUserFiles(c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "bindle admin: unknown command %q\n\n%s", command, adminUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+func adminStats(c *client.Client) error {
+	stats, err := c.AdminStats(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Storage backend:\t%s\n", stats.StorageBackend)
+	fmt.Fprintf(w, "Users:\t%d (%d with files)\n", stats.TotalUsers, stats.UsersWithFiles)
+	fmt.Fprintf(w, "Files:\t%d (%d stored)\n", stats.FileRecords, stats.UniqueFiles)
+	fmt.Fprintf(w, "Size:\t%s (%s stored, %s saved by dedup)\n", formatBytes(stats.LogicalBytes),
+		formatBytes(stats.StoredBytes), formatBytes(stats.DedupSavedBytes))
+	fmt.Fprintf(w, "Average file:\t%s\n", formatBytes(stats.AverageFileBytes))
+	fmt.Fprintf(w, "Largest file:\t%s\n", formatBytes(stats.LargestFileBytes))
+	fmt.Fprintf(w, "Downloads:\t%d (%d requests, %s sent)\n", stats.Downloads, stats.DownloadRequests,
+		formatBytes(stats.DownloadedBytes))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(stats.TopFiles) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tACCOUNT\tDOWNLOADS\tREQUESTS\tSENT")
+	for _, file := range stats.TopFiles {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", file.FileId, file.FileName, file.AccountId,
+			file.Downloads, file.DownloadRequests, formatBytes(file.DownloadedBytes))
+	}
+	return w.Flush()
+}
+
+func adminUsers(c *client.Client) error {
+	users, err := c.AdminUsers(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tFILES\tSTORAGE\tLAST LOGIN\tIPS")
+	for _, user := range users {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n", user.AccountId, user.FileCount,
+			formatBytes(user.StorageUsage), user.LastLogin, len(user.IPAddresses))
+	}
+	return w.Flush()
+}
+
+func adminFiles(c *client.Client) error {
+	files, err := c.AdminFiles(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSIZE\tACCOUNT\tUPLOADED\tPATH")
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", file.FileId, file.FileName, formatBytes(file.Size),
+			file.AccountId, file.CreatedAt, file.FilePath)
+	}
+	return w.Flush()
+}
+
+func adminExpiring(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("admin expiring", flag.ExitOnError)
+	within := flags.Int("within", 0, "also list accounts that will have expired this many days from now")
+	flags.Parse(args)
+
+	expiring, err := c.ExpiringAccounts(context.Background(), *within)
+	if err != nil {
+		return err
+	}
+	if expiring.ExpirationDays == 0 {
+		fmt.Println("Account expiration is disabled.")
+		return nil
+	}
+
+	fmt.Printf("Accounts unused since %s expire (after %d days).\n", expiring.Cutoff, expiring.ExpirationDays)
+	fmt.Printf("%d accounts, %d files, %s.\n\n", len(expiring.Accounts), expiring.TotalFiles,
+		formatBytes(expiring.TotalBytes))
+	if len(expiring.Accounts) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tLAST LOGIN\tFILES\tSTORAGE")
+	for _, account := range expiring.Accounts {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", account.AccountId, account.LastLogin, account.FileCount,
+			formatBytes(account.StorageUsage))
+	}
+	return w.Flush()
+}
+
+func adminRemove(c *client.Client, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: bindle admin rm <file ID>...")
+		os.Exit(2)
+	}
+	for _, fileID := range args {
+		if err := c.AdminDeleteFile(context.Background(), fileID); err != nil {
+			return fmt.Errorf("%s: %w", fileID, err)
+		}
+	}
+	return nil
+}
+
+func adminRemoveUserFiles(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: bindle admin rm-user-files <account ID>")
+		os.Exit(2)
+	}
+
+	count, err := c.AdminDeleteUserFiles(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d files.\n", count)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// cliConfig is what the CLI remembers between runs. The account ID is the only thing
+// that identifies an account, so the file is written readable by its owner alone.
+type cliConfig struct {
+	Server    string `json:"server"`
+	AccountID string `json:"accountId"`
+	// Uploads maps a file, by uploadKey, to the session uploading it, so running the
+	// same upload again after an interruption sends only the chunks that are missing.
+	Uploads map[string]string `json:"uploads,omitempty"`
+
+	path string
+}
+
+const defaultServer = "http://localhost:3000"
+
+// configPath is $BINDLE_CONFIG, or bindle/config.json in the user's config directory.
+func configPath() (string, error) {
+	if path := os.Getenv("BINDLE_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bindle", "config.json"), nil
+}
+
+// loadConfig reads the config file; a missing one is an empty config. $BINDLE_SERVER
+// and $BINDLE_ACCOUNT override what it holds, for scripts that should not touch it.
+func loadConfig() (*cliConfig, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &cliConfig{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if server := os.Getenv("BINDLE_SERVER"); server != "" {
+		cfg.Server = server
+	}
+	if account := os.Getenv("BINDLE_ACCOUNT"); account != "" {
+		cfg.AccountID = account
+	}
+	if cfg.Server == "" {
+		cfg.Server = defaultServer
+	}
+	if cfg.Uploads == nil {
+		cfg.Uploads = make(map[string]string)
+	}
+	return cfg, nil
+}
+
+// save writes the config through a temp file, so an interrupted write cannot lose the
+// account ID.
+func (c *cliConfig) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
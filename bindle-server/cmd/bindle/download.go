@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nuuner/bindle-server/pkg/client"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+func runDownload(cfg *cliConfig, args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bindle download [flags] <file ID or URL>")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "where to write the file, - for stdout (default: its name)")
+	password := flags.String("password", "", "the file's password, if it has one")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := newClient(cfg)
+	target := flags.Arg(0)
+	if !strings.Contains(target, "/") {
+		if cfg.AccountID == "" {
+			return errNotLoggedIn
+		}
+		file, err := c.File(context.Background(), target)
+		if err != nil {
+			return err
+		}
+		target = file.URL
+	}
+
+	return downloadFile(c, target, *output, *password)
+}
+
+// downloadFile fetches a share URL to output, checked against the digest the server
+// sent. A file that does not match is removed rather than left looking whole.
+func downloadFile(c *client.Client, url, output, password string) error {
+	download, err := c.Download(context.Background(), url, client.DownloadOptions{Password: password})
+	if err != nil {
+		return err
+	}
+	defer download.Body.Close()
+
+	if output == "" {
+		output = downloadName(download.FileName)
+	}
+
+	var dst io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	if _, err := io.Copy(dst, download.Body); err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		if errors.Is(err, utils.ErrDigestMismatch) {
+			return errors.New("the download does not match the file's SHA-256")
+		}
+		return err
+	}
+
+	if output != "-" {
+		fmt.Fprintln(os.Stderr, output)
+	}
+	return nil
+}
+
+// downloadName is the base of the name the server gave, so a name cannot write outside
+// the directory.
+func downloadName(name string) string {
+	if name = filepath.Base(name); name == "." || name == "/" {
+		return "download"
+	}
+	return name
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nuuner/bindle-server/pkg/client"
+)
+
+// runLogin stores the server and account to use. Without an account ID the server
+// creates a new account, whose ID is printed so it can be kept somewhere safe.
+func runLogin(cfg *cliConfig, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bindle login [-server URL] [account ID]")
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", cfg.Server, "the Bindle server")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg.Server = *server
+	cfg.AccountID = flags.Arg(0)
+	cfg.Uploads = make(map[string]string)
+
+	c := newClient(cfg)
+	var me *client.Me
+	var err error
+	if cfg.AccountID == "" {
+		me, err = c.CreateAccount(context.Background())
+	} else {
+		me, err = c.Me(context.Background())
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.AccountID == "" {
+		fmt.Fprintln(os.Stderr, "Created a new account. Its ID is the only way back into it:")
+		fmt.Println(me.User.AccountId)
+	}
+	cfg.AccountID = me.User.AccountId
+	if err := cfg.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Logged in to %s, saved to %s\n", cfg.Server, cfg.path)
+	return nil
+}
+
+func runMe(cfg *cliConfig, args []string) error {
+	if cfg.AccountID == "" {
+		return errNotLoggedIn
+	}
+	me, err := newClient(cfg).Me(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Account:        %s\n", me.User.AccountId)
+	fmt.Printf("Server:         %s\n", cfg.Server)
+	fmt.Printf("Files:          %d\n", len(me.User.Files))
+	if me.LimitsUnlocked {
+		fmt.Printf("Uploaded today: %s (unlocked, no limit)\n", formatBytes(me.UploadedBytes))
+	} else {
+		fmt.Printf("Uploaded today: %s of %s\n", formatBytes(me.UploadedBytes), formatBytes(me.UploadLimitBytes))
+	}
+	fmt.Printf("Max file size:  %s\n", formatBytes(me.MaxFileSizeBytes))
+	return nil
+}
+
+func runList(cfg *cliConfig, args []string) error {
+	if cfg.AccountID == "" {
+		return errNotLoggedIn
+	}
+	c := newClient(cfg)
+	files, err := c.Files(context.Background())
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.Before(files[j].CreatedAt) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSIZE\tDOWNLOADS\tUPLOADED\tURL")
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", file.FileId, file.FileName, formatBytes(file.Size),
+			file.DownloadCount, file.CreatedAt.Local().Format(time.DateTime), c.URL(file.URL))
+	}
+	return w.Flush()
+}
+
+func runRemove(cfg *cliConfig, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: bindle rm <file ID>...")
+		os.Exit(2)
+	}
+	if cfg.AccountID == "" {
+		return errNotLoggedIn
+	}
+
+	c := newClient(cfg)
+	for _, fileID := range args {
+		if err := c.DeleteFile(context.Background(), fileID); err != nil {
+			return fmt.Errorf("%s: %w", fileID, err)
+		}
+	}
+	return nil
+}
+
+func runRename(cfg *cliConfig, args []string) error {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: bindle rename <file ID> <new name>")
+		os.Exit(2)
+	}
+	if cfg.AccountID == "" {
+		return errNotLoggedIn
+	}
+
+	_, err := newClient(cfg).RenameFile(context.Background(), args[0], args[1])
+	return err
+}
@@ -0,0 +1,73 @@
+// Command bindle uploads to and manages files on a Bindle server from the command line.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nuuner/bindle-server/pkg/client"
+)
+
+const usage = `usage: bindle <command> [arguments]
+
+commands:
+  login [-server URL] [account ID]  use an account, or create one
+  me                                show the account and its upload quota
+  upload [flags] file...            upload files and print their URLs
+  download [flags] <ID or URL>      download a file and check its SHA-256
+  ls                                list the account's files
+  rm <file ID>...                   delete files
+  rename <file ID> <new name>       rename a file
+  admin <command>                   server administration, see bindle admin
+
+The config is kept in $BINDLE_CONFIG, or bindle/config.json in the user config
+directory. $BINDLE_SERVER and $BINDLE_ACCOUNT override what it holds.
+`
+
+// newClient is a client for the configured server and account, and the admin password
+// from the environment.
+func newClient(cfg *cliConfig) *client.Client {
+	c := client.New(cfg.Server, cfg.AccountID)
+	c.AdminPassword = os.Getenv("BINDLE_ADMIN_PASSWORD")
+	return c
+}
+
+var errNotLoggedIn = errors.New("no account yet, run bindle login first")
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bindle: reading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	commands := map[string]func(*cliConfig, []string) error{
+		"login":    runLogin,
+		"me":       runMe,
+		"upload":   runUpload,
+		"download": runDownload,
+		"ls":       runList,
+		"rm":       runRemove,
+		"rename":   runRename,
+		"admin":    runAdmin,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+			fmt.Fprintf(os.Stderr, "bindle: unknown command %q\n\n", os.Args[1])
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := command(cfg, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "bindle: %v\n", err)
+		os.Exit(1)
+	}
+}
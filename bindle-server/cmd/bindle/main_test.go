@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nuuner/bindle-server/internal/handlers"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/client"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+const testChunkSize = 1024
+
+// fakeServer speaks the chunked upload API, keeping chunks in memory. failChunk, when
+// not negative, is refused every time it is sent.
+type fakeServer struct {
+	t         *testing.T
+	mu        sync.Mutex
+	size      int64
+	chunks    map[int][]byte
+	sent      []int
+	failChunk int
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *httptest.Server) {
+	f := &fakeServer{t: t, chunks: make(map[int][]byte), failChunk: -1}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "account" {
+		http.Error(w, `{"error":"no account"}`, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/file/chunk/"), "/")
+	switch {
+	case r.Method == "POST" && parts[0] == "init":
+		var req handlers.InitChunkedUploadRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.size = req.FileSize
+		total := int((req.FileSize + testChunkSize - 1) / testChunkSize)
+		json.NewEncoder(w).Encode(handlers.InitChunkedUploadResponse{SessionID: "s1", ChunkSize: testChunkSize, TotalChunks: total})
+
+	case r.Method == "GET" && len(parts) == 1:
+		status := handlers.ChunkedUploadStatus{SessionID: "s1", FileSize: f.size, ChunkSize: testChunkSize,
+			TotalChunks: int((f.size + testChunkSize - 1) / testChunkSize), ReceivedChunks: []int{}}
+		for chunkNumber := range f.chunks {
+			status.ReceivedChunks = append(status.ReceivedChunks, chunkNumber)
+		}
+		json.NewEncoder(w).Encode(status)
+
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "complete":
+		var req handlers.CompleteChunkedUploadRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var plain []byte
+		for i := 0; i < len(f.chunks); i++ {
+			plain = append(plain, f.chunks[i]...)
+		}
+		if sum := sha256.Sum256(plain); hex.EncodeToString(sum[:]) != req.SHA256 || int64(len(plain)) != f.size {
+			http.Error(w, `{"error":"mismatch"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		json.NewEncoder(w).Encode(models.UploadedFileDTO{FileId: "f1", URL: "/abc.bin"})
+
+	case r.Method == "POST" && len(parts) == 2:
+		chunkNumber, _ := strconv.Atoi(parts[1])
+		f.sent = append(f.sent, chunkNumber)
+		if chunkNumber == f.failChunk {
+			http.Error(w, `{"error":"try again"}`, http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		want, err := utils.ParseContentDigest(r.Header.Get("Content-Digest"))
+		if sum := sha256.Sum256(body); err != nil || !bytes.Equal(sum[:], want) {
+			http.Error(w, `{"error":"digest"}`, http.StatusBadRequest)
+			return
+		}
+		f.chunks[chunkNumber] = body
+		w.Write([]byte(`{}`))
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+func testConfig(t *testing.T, server string) *cliConfig {
+	return &cliConfig{
+		Server:    server,
+		AccountID: "account",
+		Uploads:   make(map[string]string),
+		path:      filepath.Join(t.TempDir(), "config.json"),
+	}
+}
+
+func TestUploadResumesWhereItStopped(t *testing.T) {
+	fake, srv := newFakeServer(t)
+	cfg := testConfig(t, srv.URL)
+
+	plain := make([]byte, 5*testChunkSize+100)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, plain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := client.UploadOptions{Concurrency: 1}
+	fake.failChunk = 3
+	if _, err := uploadFile(newClient(cfg), cfg, path, opts); !client.IsStatus(err, http.StatusServiceUnavailable) {
+		t.Fatalf("first upload: got %v, want a 503", err)
+	}
+	if len(cfg.Uploads) != 1 {
+		t.Fatalf("the interrupted upload was not recorded: %v", cfg.Uploads)
+	}
+
+	// The config is read back from disk, the way the next run of the command would.
+	saved := &cliConfig{path: cfg.path}
+	data, err := os.ReadFile(cfg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.failChunk = -1
+	fake.sent = nil
+	file, err := uploadFile(newClient(saved), saved, path, opts)
+	if err != nil {
+		t.Fatalf("resumed upload: %v", err)
+	}
+	if file.FileId != "f1" {
+		t.Errorf("got file %q, want f1", file.FileId)
+	}
+	if want := []int{3, 4, 5}; !equalInts(fake.sent, want) {
+		t.Errorf("resumed upload sent chunks %v, want %v", fake.sent, want)
+	}
+	if len(saved.Uploads) != 0 {
+		t.Errorf("the finished upload is still recorded: %v", saved.Uploads)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDownloadChecksTheDigest(t *testing.T) {
+	plain := []byte("the contents of the file")
+	sum := sha256.Sum256(plain)
+	digest := utils.FormatDigest(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("a share URL was sent the account ID")
+		}
+		w.Header().Set("Content-Disposition", `inline; filename="../notes.txt"`)
+		w.Header().Set("Repr-Digest", digest)
+		if r.URL.Path == "/corrupt.txt" {
+			w.Write([]byte("something else entirely"))
+			return
+		}
+		w.Write(plain)
+	}))
+	defer srv.Close()
+	c := newClient(testConfig(t, srv.URL))
+
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := downloadFile(c, srv.URL+"/good.txt", "", ""); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "notes.txt")); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("got %q (%v), want the file under its base name", got, err)
+	}
+
+	if err := downloadFile(c, srv.URL+"/corrupt.txt", "bad.txt", ""); err == nil {
+		t.Fatal("a download that does not match its digest succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("the mismatched download was left behind: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nuuner/bindle-server/pkg/client"
+)
+
+func runUpload(cfg *cliConfig, args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bindle upload [flags] file...")
+		flags.PrintDefaults()
+	}
+	concurrency := flags.Int("c", 4, "chunks to send at once")
+	retries := flags.Int("retries", 5, "times to retry a chunk before giving up")
+	expires := flags.Duration("expires", 0, "delete the file after this long, e.g. 72h")
+	maxDownloads := flags.Int("max-downloads", 0, "delete the file after this many downloads")
+	password := flags.String("password", "", "password needed to download the file")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if cfg.AccountID == "" {
+		return errNotLoggedIn
+	}
+
+	opts := client.UploadOptions{
+		Concurrency:  max(*concurrency, 1),
+		Retries:      max(*retries, 0),
+		MaxDownloads: *maxDownloads,
+		Password:     *password,
+	}
+	if *expires > 0 {
+		at := time.Now().Add(*expires)
+		opts.ExpiresAt = &at
+	}
+
+	c := newClient(cfg)
+	for _, path := range flags.Args() {
+		file, err := uploadFile(c, cfg, path, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Println(c.URL(file.URL))
+	}
+	return nil
+}
+
+// uploadFile sends path in chunks, picking up the session a previous run left behind
+// for the same file if there is one.
+func uploadFile(c *client.Client, cfg *cliConfig, path string, opts client.UploadOptions) (*client.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	if stat.Size() == 0 {
+		return nil, errors.New("empty files cannot be uploaded")
+	}
+
+	// The config remembers uploads by their contents, so the file is hashed up front.
+	hash, err := hashFile(f)
+	if err != nil {
+		return nil, err
+	}
+	opts.FileName = filepath.Base(path)
+	opts.MimeType = detectMimeType(f, opts.FileName)
+	key := uploadKey(hash, opts.FileName)
+
+	opts.SessionID = cfg.Uploads[key]
+	opts.OnSession = func(sessionID string) {
+		if sessionID == opts.SessionID {
+			fmt.Fprintf(os.Stderr, "Resuming %s\n", opts.FileName)
+			return
+		}
+		cfg.Uploads[key] = sessionID
+		if err := cfg.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not record the upload, it will not be resumable: %v\n", err)
+		}
+	}
+	progress := newUploadProgress(opts.FileName)
+	opts.OnProgress = progress.update
+
+	file, err := c.Upload(context.Background(), f, stat.Size(), opts)
+	progress.finish()
+	// A session that completed, failed verification or is gone cannot be picked up again.
+	if err == nil || client.IsStatus(err, http.StatusNotFound, http.StatusGone, http.StatusUnprocessableEntity) {
+		delete(cfg.Uploads, key)
+		cfg.save()
+	}
+	if client.IsStatus(err, http.StatusUnprocessableEntity) {
+		return nil, fmt.Errorf("the server stored something other than this file, was it changed during the upload? (%w)", err)
+	}
+	return file, err
+}
+
+// uploadKey names an upload in the config: the same contents under the same name are
+// the same upload, wherever the file lives and whenever it was last touched.
+func uploadKey(hash, name string) string {
+	return hash + ":" + name
+}
+
+func hashFile(f *os.File) (string, error) {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// detectMimeType goes by the extension, and by the first bytes when that says nothing.
+func detectMimeType(f *os.File, name string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
+
+// uploadProgress draws a progress line on stderr when it is a terminal.
+type uploadProgress struct {
+	name     string
+	terminal bool
+}
+
+func newUploadProgress(name string) *uploadProgress {
+	return &uploadProgress{name: name, terminal: isTerminal(os.Stderr)}
+}
+
+func (p *uploadProgress) update(sent, size int64) {
+	if !p.terminal {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r%s  %3d%%  %s of %s", p.name, sent*100/size, formatBytes(sent), formatBytes(size))
+}
+
+func (p *uploadProgress) finish() {
+	if p.terminal {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/joho/godotenv"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/database"
+	"github.com/nuuner/bindle-server/internal/jobs"
+	"github.com/nuuner/bindle-server/internal/server"
+	"github.com/nuuner/bindle-server/internal/storage"
+)
+
+func main() {
+	if os.Getenv("ENVIRONMENT") != "production" {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("failed to load environment variables:", err)
+		}
+	}
+
+	config := config.GetConfig()
+
+	// Initialize database
+	db, err := database.InitDatabase()
+	if err != nil {
+		log.Fatal("failed to connect database:", err)
+	}
+
+	var storageInstance storage.Storage
+
+	if config.S3Enabled {
+		storageInstance, err = storage.NewS3Storage(config, database.NewFrameJournal(db))
+		if err != nil {
+			log.Fatal("failed to create S3 storage:", err)
+		}
+	} else {
+		storageInstance, err = storage.NewFilesystemStorage(config)
+		if err != nil {
+			log.Fatal("failed to create filesystem storage:", err)
+		}
+	}
+
+	// Releases uploads that were abandoned or orphaned by a restart, which otherwise
+	// keep their temp files or multipart uploads open indefinitely.
+	jobs.StartUploadReaper(db, storageInstance)
+
+	// Deletes what has outlived its welcome: accounts nobody has used for
+	// ACCOUNT_EXPIRATION_DAYS, and files past their expiresAt or maxDownloads.
+	jobs.StartAccountExpiry(db, storageInstance, &config)
+	jobs.StartFileExpiry(db, storageInstance)
+
+	// Hashes files stored without a content hash, which downloads are checked against.
+	jobs.StartContentHashing(db, storageInstance)
+
+	// Rewrites files encrypted with any key but ENCRYPTION_KEY_ID, so retired keys can
+	// be dropped. After the reaper, whose sweep removes rewrites a restart cut short.
+	jobs.StartReencryption(db, storageInstance, &config)
+
+	// tus uploads keep the chunk they are filling in the temp directory.
+	app, err := server.NewApp(db, &config, storageInstance, filepath.Join(os.TempDir(), "bindle-tus"))
+	if err != nil {
+		log.Fatal("failed to set up routes:", err)
+	}
+
+	// Start server
+	log.Fatal(app.Listen(":3000"))
+}
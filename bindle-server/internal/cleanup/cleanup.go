@@ -0,0 +1,94 @@
+// Package cleanup removes files and accounts. Uploads are content-addressed, so one
+// stored object can back several records, and the rule for when that object may go is
+// the same whoever is deleting: a user, an admin or a scheduled job. It lives here so
+// there is exactly one copy of it.
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ErrStoredFileKept reports that a file record was deleted but its stored object could
+// not be. The file is gone as far as any client can tell, so callers generally log it
+// rather than fail the request; the object is just unreferenced storage.
+var ErrStoredFileKept = errors.New("file record deleted but its stored object was kept")
+
+// DeleteFile removes a file record, with its share links and download log, and its stored
+// object once no other record points at it. The record goes first: if the object cannot
+// be removed, what is left is an unreferenced object rather than a record whose download
+// is broken. The record's wrapped data key is wiped before the soft delete, so the row
+// left behind cannot open the object either.
+func DeleteFile(db *gorm.DB, st storage.Storage, file *models.UploadedFile) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(file).Update("wrapped_key", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(file).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("uploaded_file_id = ?", file.ID).Delete(&models.Share{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("uploaded_file_id = ?", file.ID).Delete(&models.Download{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file record %s: %w", file.FileId, err)
+	}
+	return ReleaseStoredFile(db, st, file.FilePath)
+}
+
+// ReleaseStoredFile removes the stored object at filePath once no record points at it,
+// for callers that have just deleted a record or pointed one somewhere else.
+func ReleaseStoredFile(db *gorm.DB, st storage.Storage, filePath string) error {
+	var references int64
+	err := db.Model(&models.UploadedFile{}).Where("file_path = ?", filePath).Count(&references).Error
+	if err != nil {
+		return fmt.Errorf("failed to count references to %s: %w", filePath, err)
+	}
+	if references > 0 {
+		return nil
+	}
+
+	if err := st.DeleteFile(filePath); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrStoredFileKept, filePath, err)
+	}
+	return nil
+}
+
+// DeleteAccount removes an account with everything that hangs off it: its files, the IP
+// connections that pool its upload quota, and the user row. It returns how many files
+// were deleted.
+func DeleteAccount(db *gorm.DB, st storage.Storage, user *models.User) (int, error) {
+	var files []models.UploadedFile
+	if err := db.Where("owner_id = ?", user.ID).Find(&files).Error; err != nil {
+		return 0, fmt.Errorf("failed to fetch files of account %s: %w", user.AccountId, err)
+	}
+
+	for i := range files {
+		if err := DeleteFile(db, st, &files[i]); err != nil {
+			if !errors.Is(err, ErrStoredFileKept) {
+				return i, err
+			}
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// Both for good rather than soft-deleted: the account ID is unique, so a user row
+	// left behind would stop a client that comes back with it from getting an account
+	// again.
+	if err := db.Unscoped().Where("account_id = ?", user.ID).Delete(&models.AccountIpConnection{}).Error; err != nil {
+		return len(files), fmt.Errorf("failed to delete IP connections of account %s: %w", user.AccountId, err)
+	}
+
+	if err := db.Unscoped().Delete(&models.User{}, user.ID).Error; err != nil {
+		return len(files), fmt.Errorf("failed to delete account %s: %w", user.AccountId, err)
+	}
+
+	return len(files), nil
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"crypto/hkdf"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -34,8 +39,31 @@ type Config struct {
 	// Shared secret that lifts the daily upload limit for whoever enters it. Empty
 	// disables the feature: there is then no password to enter and no cookie is honoured.
 	UnlockPassword string
-	// Encryption
-	EncryptionKey []byte
+	// Encryption. EncryptionKey is the active key: new objects are sealed with it.
+	// EncryptionKeyID names it. EncryptionKeys holds every key by ID, retired ones
+	// included, so that what they sealed can still be read; see KeyFor.
+	EncryptionKey   []byte
+	EncryptionKeyID string
+	EncryptionKeys  map[string][]byte
+	// MACKey keys the server's HMACs - password cookies, hashed download IPs, unlock
+	// cookies. It is kept apart from the encryption keys so that rotating them does not
+	// sign everyone out or split one client's downloads in two; see parseMACKey.
+	MACKey []byte
+}
+
+// ErrUnknownKey reports an object sealed with a key the server was not given.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyFor returns the key with the given ID. The ID "" is ENCRYPTION_KEY, the key
+// everything stored before keys had IDs was sealed with.
+func (c *Config) KeyFor(id string) ([]byte, error) {
+	if id == c.EncryptionKeyID && c.EncryptionKey != nil {
+		return c.EncryptionKey, nil
+	}
+	if key, ok := c.EncryptionKeys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
 }
 
 var cfg Config
@@ -101,16 +129,36 @@ func GetConfig() Config {
 			"list the header can be spoofed by any client, bypassing rate and upload limits.")
 	}
 
-	encryptionKey := os.Getenv("ENCRYPTION_KEY")
-	if encryptionKey == "" {
-		log.Fatal("ENCRYPTION_KEY environment variable is not set")
+	keyList := strings.TrimSpace(os.Getenv("ENCRYPTION_KEYS"))
+	encryptionKeys, err := parseEncryptionKeys(os.Getenv("ENCRYPTION_KEY"), keyList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Without ENCRYPTION_KEY_ID the active key is ENCRYPTION_KEY, as it was before there
+	// could be more than one. Once ENCRYPTION_KEYS adds any, which of them seals new
+	// uploads is too important to leave to a default, so it has to be named.
+	encryptionKeyID := os.Getenv("ENCRYPTION_KEY_ID")
+	if encryptionKeyID == "" && keyList != "" {
+		log.Fatal("ENCRYPTION_KEYS is set but ENCRYPTION_KEY_ID is not. Set it to the ID of " +
+			"the key new uploads should be encrypted with.")
 	}
-	encryptionKeyBytes, err := base64.StdEncoding.DecodeString(encryptionKey)
+	encryptionKeyBytes, ok := encryptionKeys[encryptionKeyID]
+	if !ok {
+		if encryptionKeyID == "" {
+			log.Fatal("ENCRYPTION_KEY environment variable is not set")
+		}
+		log.Fatalf("ENCRYPTION_KEY_ID is %q, which is not one of the keys in ENCRYPTION_KEYS", encryptionKeyID)
+	}
+
+	macKey, err := parseMACKey(os.Getenv("MAC_KEY"), encryptionKeys, keyList)
 	if err != nil {
-		log.Fatal("ENCRYPTION_KEY is not valid base64:", err)
+		log.Fatal(err)
 	}
-	if len(encryptionKeyBytes) != 32 {
-		log.Fatal("ENCRYPTION_KEY must be 32 bytes long")
+	if source, ok := macKeySource(encryptionKeys, keyList); os.Getenv("MAC_KEY") == "" && ok && source != encryptionKeyID {
+		log.Printf("Warning: MAC_KEY is not set, so cookies and hashed download IPs are still keyed "+
+			"by encryption key %q, which is no longer the active one. If that key may have leaked, set "+
+			"MAC_KEY to a fresh key (openssl rand -base64 32); otherwise set it to that key's value "+
+			"before removing the key.", source)
 	}
 
 	cfg = Config{
@@ -132,7 +180,97 @@ func GetConfig() Config {
 		MaxFileSizeMB:         maxFileSizeMB,
 		UnlockPassword:        os.Getenv("UNLOCK_PASSWORD"),
 		EncryptionKey:         encryptionKeyBytes,
+		EncryptionKeyID:       encryptionKeyID,
+		EncryptionKeys:        encryptionKeys,
+		MACKey:                macKey,
 	}
 
 	return cfg
 }
+
+// keyIDPattern is what a key ID may look like. IDs are stored with every file, and
+// turn up in logs and in the names of re-encrypted objects, so they are kept short and
+// plain.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// parseEncryptionKeys reads the keyring: ENCRYPTION_KEY under the ID "", if it is set,
+// and ENCRYPTION_KEYS, a comma-separated list of id:base64 pairs.
+func parseEncryptionKeys(legacyKey, keyList string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if legacyKey != "" {
+		key, err := decodeEncryptionKey(legacyKey)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEY %w", err)
+		}
+		keys[""] = key
+	}
+
+	for _, entry := range strings.Split(keyList, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS entries must be id:base64, with IDs of up to 32 letters, digits, _ or -")
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS lists key %q twice", id)
+		}
+		key, err := decodeEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS key %q %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// parseMACKey derives the HMAC key from MAC_KEY or, without one, from ENCRYPTION_KEY,
+// or the first key in ENCRYPTION_KEYS if that is not set either. The secret goes through
+// HKDF rather than being used as it is, so the same secret can go on keying the MACs
+// after it stops being an encryption key: MAC_KEY set to the value of a retired
+// ENCRYPTION_KEY gives the MAC key the server had while that key was in use.
+func parseMACKey(encoded string, keys map[string][]byte, keyList string) ([]byte, error) {
+	var secret []byte
+	switch {
+	case encoded != "":
+		key, err := decodeEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("MAC_KEY %w", err)
+		}
+		secret = key
+	default:
+		if id, ok := macKeySource(keys, keyList); ok {
+			secret = keys[id]
+		}
+	}
+	if secret == nil {
+		return nil, errors.New("no key to derive the MAC key from: set MAC_KEY or ENCRYPTION_KEY")
+	}
+	return hkdf.Key(sha256.New, secret, nil, "bindle mac key", 32)
+}
+
+// macKeySource returns the ID of the encryption key the MAC key is derived from while
+// MAC_KEY is unset: ENCRYPTION_KEY's, or the first in ENCRYPTION_KEYS without it.
+func macKeySource(keys map[string][]byte, keyList string) (string, bool) {
+	if keys[""] != nil {
+		return "", true
+	}
+	for _, entry := range strings.Split(keyList, ",") {
+		if id, _, _ := strings.Cut(strings.TrimSpace(entry), ":"); keys[id] != nil {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("must be 32 bytes long")
+	}
+	return key, nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// The MAC key comes from ENCRYPTION_KEY until MAC_KEY is set, and MAC_KEY set to the
+// retired key's value keeps it as it was once the encryption keys have moved on.
+func TestMACKeyOutlivesTheEncryptionKey(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	encoded := base64.StdEncoding.EncodeToString(oldKey)
+
+	before, err := parseMACKey("", map[string][]byte{"": oldKey}, "")
+	if err != nil {
+		t.Fatalf("parseMACKey: %v", err)
+	}
+	if bytes.Equal(before, oldKey) {
+		t.Error("the encryption key itself keys the MACs")
+	}
+
+	during, _ := parseMACKey("", map[string][]byte{"": oldKey, "2026a": newKey}, "2026a:x")
+	after, _ := parseMACKey(encoded, map[string][]byte{"2026a": newKey}, "2026a:x")
+	if !bytes.Equal(during, before) || !bytes.Equal(after, before) {
+		t.Error("the MAC key changed over a rotation")
+	}
+
+	listed, _ := parseMACKey("", map[string][]byte{"2026a": newKey, "2026b": oldKey}, " 2026b:x,2026a:y")
+	if !bytes.Equal(listed, before) {
+		t.Error("without ENCRYPTION_KEY the MAC key does not come from the first listed key")
+	}
+
+	// Which is what the startup warning about a retired key goes by.
+	if source, ok := macKeySource(map[string][]byte{"": oldKey, "2026a": newKey}, "2026a:x"); !ok || source != "" {
+		t.Errorf("the MAC key is reported as coming from %q, want ENCRYPTION_KEY's", source)
+	}
+
+	if _, err := parseMACKey("", map[string][]byte{}, ""); err == nil {
+		t.Error("expected an error with no key to derive from")
+	}
+	if _, err := parseMACKey("c2hvcnQ=", map[string][]byte{"": oldKey}, ""); err == nil {
+		t.Error("expected a MAC_KEY of the wrong length to be refused")
+	}
+}
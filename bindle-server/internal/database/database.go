@@ -1,9 +1,15 @@
 package database
 
 import (
+	"crypto/sha256"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/utils"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -25,10 +31,106 @@ func InitDatabase() (*gorm.DB, error) {
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&models.UploadedFile{}, &models.User{}, &models.AccountIpConnection{}, &models.UploadSession{})
+	err = db.AutoMigrate(&models.UploadedFile{}, &models.User{}, &models.AccountIpConnection{}, &models.UploadSession{},
+		&models.Share{}, &models.Download{}, &models.Migration{}, &models.UploadFrame{},
+		&models.LegacyMigrationRun{})
 	if err != nil {
 		return nil, err
 	}
 
+	if err := backfillShares(db); err != nil {
+		return nil, err
+	}
+	if err := backfillContentHashes(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// backfillShares gives a share to every file that predates shares, so the links already
+// handed out keep working. Each keeps the URL it had - the slug is its FilePath without
+// the extension - except where several records share one stored object and therefore
+// one old URL: the oldest record keeps it and the rest get random slugs, which makes
+// the old URL belong to a single record that can revoke it.
+//
+// It also records when shares came in, the first time it runs. Objects stored before
+// then may have been linked to by their storage path, and are still served that way.
+func backfillShares(db *gorm.DB) error {
+	if err := recordSharesMigration(db); err != nil {
+		return err
+	}
+
+	var files []models.UploadedFile
+	err := db.Where("id NOT IN (?)", db.Unscoped().Model(&models.Share{}).Select("uploaded_file_id")).
+		Order("id").Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, file := range files {
+			slug := strings.TrimSuffix(file.FilePath, filepath.Ext(file.FilePath))
+			var taken int64
+			if err := tx.Unscoped().Model(&models.Share{}).Where("slug = ?", slug).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 || slug == "" {
+				slug = utils.GenerateShareSlug()
+			}
+
+			if err := tx.Create(&models.Share{Slug: slug, UploadedFileID: file.ID}).Error; err != nil {
+				return err
+			}
+		}
+		log.Printf("Created share links for %d files that predate them", len(files))
+		return nil
+	})
+}
+
+// backfillContentHashes records the content hash of single uploads that predate the
+// column. Their FilePath is that hash plus the extension, so nothing has to be read;
+// chunked uploads stored under a session path are left without one and are just never
+// matched.
+func backfillContentHashes(db *gorm.DB) error {
+	var files []models.UploadedFile
+	err := db.Where("chunk_count = 0 AND content_hash = ''").Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, file := range files {
+			hash := strings.TrimSuffix(file.FilePath, filepath.Ext(file.FilePath))
+			if len(hash) != sha256.Size*2 {
+				continue
+			}
+			if err := tx.Model(&file).UpdateColumn("content_hash", hash).Error; err != nil {
+				return err
+			}
+		}
+		log.Printf("Recorded content hashes for %d files that predate them", len(files))
+		return nil
+	})
+}
+
+// recordSharesMigration notes the time shares came in, unless that is already recorded.
+// A database that has shares from before the record was kept is dated by its oldest.
+func recordSharesMigration(db *gorm.DB) error {
+	var recorded int64
+	err := db.Model(&models.Migration{}).Where("name = ?", models.SharesMigration).Count(&recorded).Error
+	if err != nil || recorded > 0 {
+		return err
+	}
+
+	ranAt := time.Now()
+	var oldest models.Share
+	err = db.Unscoped().Order("created_at").Limit(1).Find(&oldest).Error
+	if err != nil {
+		return err
+	}
+	if oldest.ID != 0 {
+		ranAt = oldest.CreatedAt
+	}
+	return db.Create(&models.Migration{Name: models.SharesMigration, RanAt: ranAt}).Error
+}
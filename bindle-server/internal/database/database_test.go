@@ -0,0 +1,145 @@
+package database
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.UploadedFile{}, &models.Share{}, &models.Migration{}, &models.UploadFrame{}); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+// Links handed out before shares existed have to keep working, and where several
+// records share one object - and so one old URL - exactly one of them may keep it.
+func TestBackfillKeepsExistingURLs(t *testing.T) {
+	db := newTestDB(t)
+	files := []models.UploadedFile{
+		{FileId: "a", FilePath: "0a1b.png"},
+		{FileId: "b", FilePath: "0a1b.png"},
+		{FileId: "c", FilePath: "9f8e.txt"},
+	}
+	for i := range files {
+		db.Create(&files[i])
+	}
+
+	if err := backfillShares(db); err != nil {
+		t.Fatalf("backfillShares: %v", err)
+	}
+
+	slugs := make(map[string]string)
+	for _, file := range files {
+		var shares []models.Share
+		db.Where("uploaded_file_id = ?", file.ID).Find(&shares)
+		if len(shares) != 1 {
+			t.Fatalf("file %s has %d shares, want 1", file.FileId, len(shares))
+		}
+		slugs[file.FileId] = shares[0].Slug
+	}
+
+	if slugs["a"] != "0a1b" || slugs["c"] != "9f8e" {
+		t.Errorf("the oldest records did not keep their URLs: %v", slugs)
+	}
+	if slugs["b"] == "0a1b" || len(slugs["b"]) == 0 {
+		t.Errorf("the duplicate record got slug %q, want a fresh random one", slugs["b"])
+	}
+
+	// Running again, as every startup does, must not add anything.
+	if err := backfillShares(db); err != nil {
+		t.Fatalf("second backfillShares: %v", err)
+	}
+	var count int64
+	db.Model(&models.Share{}).Count(&count)
+	if count != 3 {
+		t.Errorf("a second run left %d shares, want 3", count)
+	}
+}
+
+// The time shares came in is what decides which objects are still served by their
+// storage path, so it is recorded once and later startups leave it alone.
+func TestBackfillRecordsWhenSharesCameIn(t *testing.T) {
+	db := newTestDB(t)
+	before := time.Now()
+	if err := backfillShares(db); err != nil {
+		t.Fatalf("backfillShares: %v", err)
+	}
+	var first models.Migration
+	if err := db.First(&first, "name = ?", models.SharesMigration).Error; err != nil {
+		t.Fatalf("the shares migration was not recorded: %v", err)
+	}
+	if first.RanAt.Before(before) {
+		t.Errorf("the shares migration is dated %v, before it ran", first.RanAt)
+	}
+
+	if err := backfillShares(db); err != nil {
+		t.Fatalf("second backfillShares: %v", err)
+	}
+	var second models.Migration
+	db.First(&second, "name = ?", models.SharesMigration)
+	if !second.RanAt.Equal(first.RanAt) {
+		t.Errorf("a second run moved the shares migration from %v to %v", first.RanAt, second.RanAt)
+	}
+}
+
+// Single uploads are stored at their content hash, so the hash of those that predate the
+// column can be read off the path. Chunked uploads cannot, and are left alone.
+func TestBackfillContentHashesFromPaths(t *testing.T) {
+	db := newTestDB(t)
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	files := []models.UploadedFile{
+		{FileId: "single", FilePath: hash + ".txt"},
+		{FileId: "chunked", FilePath: "3c2d.bin", ChunkCount: 2},
+	}
+	for i := range files {
+		db.Create(&files[i])
+	}
+
+	if err := backfillContentHashes(db); err != nil {
+		t.Fatalf("backfillContentHashes: %v", err)
+	}
+
+	var single, chunked models.UploadedFile
+	db.First(&single, files[0].ID)
+	db.First(&chunked, files[1].ID)
+	if single.ContentHash != hash {
+		t.Errorf("the single upload got hash %q, want %q", single.ContentHash, hash)
+	}
+	if chunked.ContentHash != "" {
+		t.Errorf("the chunked upload got hash %q, want none", chunked.ContentHash)
+	}
+}
+
+// The journal gives back what each session sealed, and refuses a frame recorded twice.
+func TestFrameJournalKeepsFramesPerSession(t *testing.T) {
+	journal := NewFrameJournal(newTestDB(t))
+	first, second := sha256.Sum256([]byte("first")), sha256.Sum256([]byte("second"))
+	if err := journal.RecordFrame("a", 0, first); err != nil {
+		t.Fatalf("RecordFrame: %v", err)
+	}
+	if err := journal.RecordFrame("b", 0, second); err != nil {
+		t.Fatalf("RecordFrame: %v", err)
+	}
+	if err := journal.RecordFrame("a", 0, second); err == nil {
+		t.Error("frame 0 of session a was recorded twice")
+	}
+
+	sealed, err := journal.SealedFrames("a")
+	if err != nil {
+		t.Fatalf("SealedFrames: %v", err)
+	}
+	if len(sealed) != 1 || sealed[0] != first {
+		t.Errorf("session a sealed %v, want frame 0 as first recorded", sealed)
+	}
+}
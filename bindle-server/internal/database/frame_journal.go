@@ -0,0 +1,37 @@
+package database
+
+import (
+	"crypto/sha256"
+
+	"github.com/nuuner/bindle-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// FrameJournal keeps the frames chunked uploads have sealed in the database, next to
+// their sessions, where a restart does not lose them. It is the storage.FrameJournal the
+// S3 backend is given.
+type FrameJournal struct {
+	db *gorm.DB
+}
+
+func NewFrameJournal(db *gorm.DB) *FrameJournal {
+	return &FrameJournal{db: db}
+}
+
+func (j *FrameJournal) RecordFrame(sessionID string, frameIndex int64, sum [sha256.Size]byte) error {
+	return j.db.Create(&models.UploadFrame{SessionID: sessionID, FrameIndex: frameIndex, Digest: sum[:]}).Error
+}
+
+func (j *FrameJournal) SealedFrames(sessionID string) (map[int64][sha256.Size]byte, error) {
+	var frames []models.UploadFrame
+	if err := j.db.Where("session_id = ?", sessionID).Find(&frames).Error; err != nil {
+		return nil, err
+	}
+	sealed := make(map[int64][sha256.Size]byte, len(frames))
+	for _, frame := range frames {
+		var sum [sha256.Size]byte
+		copy(sum[:], frame.Digest)
+		sealed[frame.FrameIndex] = sum
+	}
+	return sealed, nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/cleanup"
 	"github.com/nuuner/bindle-server/internal/config"
 	"github.com/nuuner/bindle-server/internal/models"
 	"github.com/nuuner/bindle-server/internal/storage"
@@ -30,7 +31,13 @@ func GetMe(c *fiber.Ctx, db *gorm.DB) error {
 	// Loaded here rather than by the auth middleware, which would otherwise fetch every
 	// file the account owns on every request, chunk uploads included.
 	var files []models.UploadedFile
-	if err := db.Where("owner_id = ?", user.ID).Find(&files).Error; err != nil {
+	if err := db.Preload("Shares").Where("owner_id = ?", user.ID).Find(&files).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get files",
+		})
+	}
+	if err := summarizeDownloads(db, files); err != nil {
+		log.Printf("Failed to summarize downloads of account %s: %v", user.AccountId, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to get files",
 		})
@@ -62,28 +69,7 @@ func DeleteAccount(c *fiber.Ctx, db *gorm.DB, storage storage.Storage) error {
 		})
 	}
 
-	var files []models.UploadedFile
-	if err := db.Where("owner_id = ?", user.ID).Find(&files).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch user files",
-		})
-	}
-
-	for _, file := range files {
-		if err := DeleteFile(c, db, storage, file.FileId); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to delete user files",
-			})
-		}
-	}
-
-	if err := db.Where("account_id = ?", user.ID).Delete(&models.AccountIpConnection{}).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete IP connections",
-		})
-	}
-
-	if err := db.Where("id = ?", user.ID).Delete(&models.User{}).Error; err != nil {
+	if _, err := cleanup.DeleteAccount(db, storage, &user); err != nil {
 		log.Println("Failed to delete user account:", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete user account",
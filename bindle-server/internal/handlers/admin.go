@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/cleanup"
 	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/jobs"
 	"github.com/nuuner/bindle-server/internal/models"
 	"github.com/nuuner/bindle-server/internal/storage"
 	"gorm.io/gorm"
@@ -35,6 +39,26 @@ type AdminStatsDTO struct {
 	AverageFileBytes int64  `json:"averageFileBytes"`
 	LargestFileBytes int64  `json:"largestFileBytes"`
 	StorageBackend   string `json:"storageBackend"`
+
+	// Downloads counts complete downloads, the way each file's downloadCount does;
+	// DownloadRequests and DownloadedBytes come from the download log and include every
+	// ranged request as well.
+	Downloads        int64             `json:"downloads"`
+	DownloadRequests int64             `json:"downloadRequests"`
+	DownloadedBytes  int64             `json:"downloadedBytes"`
+	TopFiles         []AdminTopFileDTO `json:"topFiles"`
+}
+
+// adminTopFiles is how many of the most downloaded files the overview lists.
+const adminTopFiles = 10
+
+type AdminTopFileDTO struct {
+	FileId           string `json:"fileId"`
+	FileName         string `json:"fileName"`
+	AccountId        string `json:"accountId"`
+	Downloads        int64  `json:"downloads"`
+	DownloadRequests int64  `json:"downloadRequests"`
+	DownloadedBytes  int64  `json:"downloadedBytes"`
 }
 
 type AdminFileDTO struct {
@@ -47,6 +71,7 @@ type AdminFileDTO struct {
 	OwnerID    uint   `json:"ownerId"`
 	AccountId  string `json:"accountId"`
 	ChunkCount int    `json:"chunkCount"`
+	SHA256     string `json:"sha256"`
 	CreatedAt  string `json:"createdAt"`
 }
 
@@ -55,7 +80,7 @@ type AdminFileDTO struct {
 // Every count goes through db.Model so GORM's soft-delete scope applies and deleted
 // records are excluded; hand-written raw SQL would silently count them.
 func ComputeAdminStats(db *gorm.DB, cfg *config.Config) (AdminStatsDTO, error) {
-	stats := AdminStatsDTO{}
+	stats := AdminStatsDTO{TopFiles: []AdminTopFileDTO{}}
 
 	// Deduplicated size: take one size per distinct file_path. The inner query stays a
 	// Model query so it keeps the soft-delete filter.
@@ -71,6 +96,20 @@ func ComputeAdminStats(db *gorm.DB, cfg *config.Config) (AdminStatsDTO, error) {
 		db.Table("(?) as unique_files", uniquePaths).Select("COALESCE(SUM(sz), 0)").Scan(&stats.StoredBytes),
 		db.Model(&models.User{}).Count(&stats.TotalUsers),
 		db.Model(&models.UploadedFile{}).Distinct("owner_id").Count(&stats.UsersWithFiles),
+		db.Model(&models.UploadedFile{}).Select("COALESCE(SUM(download_count), 0)").Scan(&stats.Downloads),
+		db.Model(&models.Download{}).Count(&stats.DownloadRequests),
+		db.Model(&models.Download{}).Select("COALESCE(SUM(bytes_sent), 0)").Scan(&stats.DownloadedBytes),
+		db.Model(&models.UploadedFile{}).
+			Select("uploaded_files.file_id, uploaded_files.file_name, users.account_id, " +
+				"uploaded_files.download_count AS downloads, COUNT(downloads.id) AS download_requests, " +
+				"COALESCE(SUM(downloads.bytes_sent), 0) AS downloaded_bytes").
+			Joins("LEFT JOIN users ON users.id = uploaded_files.owner_id").
+			Joins("LEFT JOIN downloads ON downloads.uploaded_file_id = uploaded_files.id").
+			Group("uploaded_files.id").
+			Having("COUNT(downloads.id) > 0").
+			Order("downloads DESC, downloaded_bytes DESC").
+			Limit(adminTopFiles).
+			Scan(&stats.TopFiles),
 	} {
 		if query.Error != nil {
 			return AdminStatsDTO{}, query.Error
@@ -104,6 +143,43 @@ func GetAdminStats(c *fiber.Ctx, db *gorm.DB, cfg *config.Config) error {
 	return c.JSON(stats)
 }
 
+// GetLegacyMigration returns the progress of the migration of legacy-format files
+func GetLegacyMigration(c *fiber.Ctx, db *gorm.DB) error {
+	status, err := jobs.LegacyMigrationProgress(db)
+	if err != nil {
+		log.Printf("Failed to read legacy migration progress: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read migration progress",
+		})
+	}
+
+	return c.JSON(status)
+}
+
+// StartLegacyMigration starts migrating legacy-format files in the background. Starting
+// it again after a run has stopped carries on with whatever that run left.
+func StartLegacyMigration(c *fiber.Ctx, db *gorm.DB, st storage.Storage, cfg *config.Config) error {
+	started, err := jobs.StartLegacyMigration(db, st, cfg)
+	if err != nil {
+		log.Printf("Failed to start the legacy migration: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start the migration",
+		})
+	}
+	if !started {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The migration is already running",
+		})
+	}
+	log.Printf("Admin started the legacy file migration")
+
+	status, err := jobs.LegacyMigrationProgress(db)
+	if err != nil {
+		log.Printf("Failed to read legacy migration progress: %v", err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(status)
+}
+
 // ListAllUsers returns all users with their statistics
 func ListAllUsers(c *fiber.Ctx, db *gorm.DB) error {
 	var users []models.User
@@ -144,6 +220,64 @@ func ListAllUsers(c *fiber.Ctx, db *gorm.DB) error {
 	return c.JSON(adminUsers)
 }
 
+// ExpiringAccountsDTO is the dry run of account expiration: the accounts the next run
+// would delete, and what that would free.
+type ExpiringAccountsDTO struct {
+	ExpirationDays int                  `json:"expirationDays"` // 0 when expiration is disabled
+	Cutoff         string               `json:"cutoff"`         // accounts last seen before this expire
+	Accounts       []ExpiringAccountDTO `json:"accounts"`
+	TotalFiles     int64                `json:"totalFiles"`
+	TotalBytes     int64                `json:"totalBytes"`
+}
+
+type ExpiringAccountDTO struct {
+	AccountId    string `json:"accountId"`
+	LastLogin    string `json:"lastLogin"`
+	FileCount    int64  `json:"fileCount"`
+	StorageUsage int64  `json:"storageUsage"` // in bytes
+}
+
+// ListExpiringAccounts lists the accounts the next expiration run would delete, without
+// deleting anything. withinDays looks further ahead, listing the accounts that will have
+// expired that many days from now if nobody uses them in the meantime.
+func ListExpiringAccounts(c *fiber.Ctx, db *gorm.DB, cfg *config.Config) error {
+	withinDays := c.QueryInt("withinDays", 0)
+	if withinDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "withinDays must not be negative",
+		})
+	}
+
+	result := ExpiringAccountsDTO{Accounts: make([]ExpiringAccountDTO, 0)}
+	if cfg.AccountExpirationDays <= 0 {
+		return c.JSON(result)
+	}
+
+	cutoff := jobs.ExpirationCutoff(cfg, time.Now().AddDate(0, 0, withinDays))
+	accounts, err := jobs.FindExpiredAccounts(db, cutoff)
+	if err != nil {
+		log.Printf("Failed to find expiring accounts: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to find expiring accounts",
+		})
+	}
+
+	result.ExpirationDays = cfg.AccountExpirationDays
+	result.Cutoff = cutoff.Format("2006-01-02 15:04:05")
+	for _, account := range accounts {
+		result.Accounts = append(result.Accounts, ExpiringAccountDTO{
+			AccountId:    account.User.AccountId,
+			LastLogin:    account.User.LastLogin.Format("2006-01-02 15:04:05"),
+			FileCount:    account.FileCount,
+			StorageUsage: account.StorageUsage,
+		})
+		result.TotalFiles += account.FileCount
+		result.TotalBytes += account.StorageUsage
+	}
+
+	return c.JSON(result)
+}
+
 // ListAllFiles returns all files in the system with owner information
 func ListAllFiles(c *fiber.Ctx, db *gorm.DB) error {
 	var files []models.UploadedFile
@@ -166,6 +300,7 @@ func ListAllFiles(c *fiber.Ctx, db *gorm.DB) error {
 			OwnerID:    file.OwnerID,
 			AccountId:  file.Owner.AccountId,
 			ChunkCount: file.ChunkCount,
+			SHA256:     file.ContentHash,
 			CreatedAt:  file.CreatedAt.Format("2006-01-02 15:04:05"),
 		})
 	}
@@ -187,29 +322,18 @@ func AdminDeleteFile(c *fiber.Ctx, db *gorm.DB, storage storage.Storage, fileId
 		})
 	}
 
-	filePath := uploadedFile.FilePath
-
-	// Delete the database record
-	if err := db.Delete(uploadedFile).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete file record",
-		})
-	}
-
-	log.Printf("Admin deleted file %s (ID: %s)", filePath, fileId)
-
-	// Check if any other files reference this physical file
-	var count int64
-	db.Model(&models.UploadedFile{}).Where("file_path = ?", filePath).Count(&count)
-
-	// If no other files reference it, delete the physical file
-	if count == 0 {
-		if err := storage.DeleteFile(filePath); err != nil {
-			log.Printf("Warning: Failed to delete physical file %s: %v", filePath, err)
-			// Don't return error - the database record is already deleted
+	if err := cleanup.DeleteFile(db, storage, uploadedFile); err != nil {
+		if !errors.Is(err, cleanup.ErrStoredFileKept) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete file record",
+			})
 		}
+		// Don't return error - the database record is already deleted
+		log.Printf("Warning: %v", err)
 	}
 
+	log.Printf("Admin deleted file %s (ID: %s)", uploadedFile.FilePath, fileId)
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "File deleted successfully",
 	})
@@ -239,26 +363,13 @@ func DeleteUserFiles(c *fiber.Ctx, db *gorm.DB, storage storage.Storage, account
 	}
 
 	deletedCount := 0
-	for _, file := range files {
-		filePath := file.FilePath
-
-		// Delete the database record
-		if err := db.Delete(&file).Error; err != nil {
-			log.Printf("Warning: Failed to delete file record %s: %v", file.FileId, err)
-			continue
-		}
-
-		// Check if any other files reference this physical file
-		var count int64
-		db.Model(&models.UploadedFile{}).Where("file_path = ?", filePath).Count(&count)
-
-		// If no other files reference it, delete the physical file
-		if count == 0 {
-			if err := storage.DeleteFile(filePath); err != nil {
-				log.Printf("Warning: Failed to delete physical file %s: %v", filePath, err)
+	for i := range files {
+		if err := cleanup.DeleteFile(db, storage, &files[i]); err != nil {
+			log.Printf("Warning: %v", err)
+			if !errors.Is(err, cleanup.ErrStoredFileKept) {
+				continue
 			}
 		}
-
 		deletedCount++
 	}
 
@@ -286,12 +397,24 @@ func DeleteAllFiles(c *fiber.Ctx, db *gorm.DB, storage storage.Storage) error {
 		uniqueFilePaths[file.FilePath] = true
 	}
 
-	// Delete all file records from database
+	// Delete all file records from database, with their wrapped data keys, and the share
+	// links and download log hanging off them
+	if err := db.Model(&models.UploadedFile{}).Where("1 = 1").Update("wrapped_key", nil).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete file records",
+		})
+	}
 	if err := db.Where("1 = 1").Delete(&models.UploadedFile{}).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete file records",
 		})
 	}
+	if err := db.Where("1 = 1").Delete(&models.Share{}).Error; err != nil {
+		log.Printf("Warning: Failed to delete share links: %v", err)
+	}
+	if err := db.Where("1 = 1").Delete(&models.Download{}).Error; err != nil {
+		log.Printf("Warning: Failed to delete the download log: %v", err)
+	}
 
 	// Delete all physical files
 	deletedCount := 0
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/nuuner/bindle-server/internal/config"
@@ -17,7 +18,8 @@ func newTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("failed to open test database: %v", err)
 	}
 	if err := db.AutoMigrate(&models.UploadedFile{}, &models.User{},
-		&models.AccountIpConnection{}, &models.UploadSession{}); err != nil {
+		&models.AccountIpConnection{}, &models.UploadSession{}, &models.Share{}, &models.Download{},
+		&models.Migration{}, &models.LegacyMigrationRun{}); err != nil {
 		t.Fatalf("failed to migrate test database: %v", err)
 	}
 	return db
@@ -30,7 +32,7 @@ func TestComputeAdminStatsEmptyDatabase(t *testing.T) {
 	}
 
 	// Notably AverageFileBytes must not divide by a zero file count.
-	if stats != (AdminStatsDTO{StorageBackend: "Filesystem"}) {
+	if !reflect.DeepEqual(stats, AdminStatsDTO{StorageBackend: "Filesystem", TopFiles: []AdminTopFileDTO{}}) {
 		t.Errorf("expected zeroed stats on an empty database, got %+v", stats)
 	}
 }
@@ -86,8 +88,54 @@ func TestComputeAdminStatsDeduplicatesAndIgnoresDeleted(t *testing.T) {
 		AverageFileBytes: 833,  // 2500 / 3, integer division
 		LargestFileBytes: 1000, // not the soft-deleted 99999
 		StorageBackend:   "S3",
+		TopFiles:         []AdminTopFileDTO{},
 	}
-	if stats != want {
+	if !reflect.DeepEqual(stats, want) {
 		t.Errorf("stats mismatch\n got: %+v\nwant: %+v", stats, want)
 	}
 }
+
+func TestComputeAdminStatsCountsDownloads(t *testing.T) {
+	db := newTestDB(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	if err := db.Create(&owner).Error; err != nil {
+		t.Fatalf("failed to seed user: %v", err)
+	}
+	popular := models.UploadedFile{FileId: "popular", FileName: "a.bin", FilePath: "a.bin", Size: 100, OwnerID: owner.ID, DownloadCount: 2}
+	ranged := models.UploadedFile{FileId: "ranged", FileName: "b.bin", FilePath: "b.bin", Size: 100, OwnerID: owner.ID}
+	unread := models.UploadedFile{FileId: "unread", FileName: "c.bin", FilePath: "c.bin", Size: 100, OwnerID: owner.ID}
+	for _, file := range []*models.UploadedFile{&popular, &ranged, &unread} {
+		if err := db.Create(file).Error; err != nil {
+			t.Fatalf("failed to seed file: %v", err)
+		}
+	}
+	for _, download := range []models.Download{
+		{UploadedFileID: popular.ID, BytesSent: 100},
+		{UploadedFileID: popular.ID, BytesSent: 100},
+		{UploadedFileID: ranged.ID, BytesSent: 10, Range: "bytes=50-59"},
+		{UploadedFileID: ranged.ID, BytesSent: 10, Range: "bytes=60-69"},
+		{UploadedFileID: ranged.ID, BytesSent: 10, Range: "bytes=70-79"},
+	} {
+		if err := db.Create(&download).Error; err != nil {
+			t.Fatalf("failed to seed download: %v", err)
+		}
+	}
+
+	stats, err := ComputeAdminStats(db, &config.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if stats.Downloads != 2 || stats.DownloadRequests != 5 || stats.DownloadedBytes != 230 {
+		t.Errorf("got %d downloads, %d requests and %d bytes, want 2, 5 and 230",
+			stats.Downloads, stats.DownloadRequests, stats.DownloadedBytes)
+	}
+	want := []AdminTopFileDTO{
+		{FileId: "popular", FileName: "a.bin", AccountId: owner.AccountId, Downloads: 2, DownloadRequests: 2, DownloadedBytes: 200},
+		{FileId: "ranged", FileName: "b.bin", AccountId: owner.AccountId, Downloads: 0, DownloadRequests: 3, DownloadedBytes: 30},
+	}
+	if !reflect.DeepEqual(stats.TopFiles, want) {
+		t.Errorf("top files mismatch\n got: %+v\nwant: %+v", stats.TopFiles, want)
+	}
+}
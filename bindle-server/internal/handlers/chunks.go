@@ -2,13 +2,17 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -32,16 +36,40 @@ func sessionFilePath(sessionID, fileName string) (hash string, path string) {
 	return hash, hash + filepath.Ext(fileName)
 }
 
+// InitChunkedUploadRequest declares a file to be uploaded in chunks, with the limits the
+// file will have once it is complete.
+type InitChunkedUploadRequest struct {
+	FileName    string `json:"fileName"`
+	FileSize    int64  `json:"fileSize"`
+	MimeType    string `json:"mimeType"`
+	TotalChunks int    `json:"totalChunks"`
+
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads"`
+	Password     string     `json:"password"`
+
+	// ClientEncrypted declares that the chunks are ciphertext the browser has already
+	// sealed, which the server is to store as it is. FileSize is the ciphertext's.
+	ClientEncrypted bool `json:"clientEncrypted"`
+}
+
+// InitChunkedUploadResponse is the layout the server chose for an upload: the client
+// sends chunk i as bytes [i*ChunkSize, (i+1)*ChunkSize) of the file.
+type InitChunkedUploadResponse struct {
+	SessionID   string `json:"sessionId"`
+	ChunkSize   int64  `json:"chunkSize"`
+	TotalChunks int    `json:"totalChunks"`
+}
+
+// CompleteChunkedUploadRequest is the optional body of a completion: the SHA-256 the
+// client read from its file, which the stored file has to match.
+type CompleteChunkedUploadRequest struct {
+	SHA256 string `json:"sha256"`
+}
+
 // InitChunkedUpload initializes a new chunked upload session
 func InitChunkedUpload(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage) error {
-	type InitRequest struct {
-		FileName    string `json:"fileName"`
-		FileSize    int64  `json:"fileSize"`
-		MimeType    string `json:"mimeType"`
-		TotalChunks int    `json:"totalChunks"`
-	}
-
-	req := new(InitRequest)
+	req := new(InitChunkedUploadRequest)
 	if err := c.BodyParser(req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
@@ -51,60 +79,112 @@ func InitChunkedUpload(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid file metadata"})
 	}
 
-	if req.FileSize > cfg.MaxFileSizeMB*1000*1000 {
-		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "File exceeds maximum allowed size"})
+	// Checked now rather than at completion, so a client does not upload a whole file
+	// only to have its limits refused.
+	limits := fileLimits{ExpiresAt: req.ExpiresAt, MaxDownloads: req.MaxDownloads}
+	if err := limits.validate(time.Now()); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := limits.setPassword(req.Password); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to set password"})
+	}
+
+	// req.TotalChunks is accepted for compatibility but ignored; see openUploadSession.
+	uploadSession, failure := openUploadSession(c, db, cfg, st, req.FileName, req.FileSize, req.MimeType, limits, req.ClientEncrypted)
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+	sessionID, chunkSize, totalChunks := uploadSession.SessionID, uploadSession.ChunkSize, uploadSession.TotalChunks
+
+	log.Printf("Initialized upload session %s for file %s (%d bytes, %d chunks)", sessionID, req.FileName, req.FileSize, totalChunks)
+
+	return c.Status(fiber.StatusOK).JSON(InitChunkedUploadResponse{
+		SessionID:   sessionID,
+		ChunkSize:   chunkSize,
+		TotalChunks: totalChunks,
+	})
+}
+
+// openUploadSession checks a declared upload against the size limit and the quota and
+// opens its session, in the database and in storage. Every upload protocol that sends a
+// file in pieces starts here, so they all enforce the same rules. A clientEncrypted
+// upload is checked by its ciphertext's size, which is what it will take up.
+func openUploadSession(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage,
+	fileName string, fileSize int64, mimeType string, limits fileLimits, clientEncrypted bool) (*models.UploadSession, *fiber.Error) {
+
+	if fileSize > cfg.MaxFileSizeMB*1000*1000 {
+		return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, "File exceeds maximum allowed size")
 	}
 
 	// Check upload limits
-	if limiter.ShouldThrottle(c, db, cfg, req.FileSize) {
-		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Upload limit exceeded"})
+	if limiter.ShouldThrottle(c, db, cfg, fileSize) {
+		return nil, fiber.NewError(fiber.StatusTooManyRequests, "Upload limit exceeded")
 	}
 
 	// The chunk layout is derived from the declared size rather than taken from the
 	// request: it is what bounds every subsequent chunk, so the client must not get
-	// to pick it. req.TotalChunks is accepted for compatibility but ignored.
+	// to pick it.
 	chunkSize := cfg.ChunkSizeMB * 1024 * 1024
-	totalChunks := int((req.FileSize + chunkSize - 1) / chunkSize)
+	totalChunks := int((fileSize + chunkSize - 1) / chunkSize)
+
+	key := storage.ObjectKey{ClientSealed: true}
+	if !clientEncrypted {
+		var err error
+		if key, err = storage.NewObjectKey(cfg); err != nil {
+			log.Printf("Failed to create data key: %v", err)
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to initialize upload")
+		}
+	}
 
 	// Generate session ID
 	sessionID := uuid.New().String()
-	hash, filePath := sessionFilePath(sessionID, req.FileName)
+	hash, filePath := sessionFilePath(sessionID, fileName)
 
 	// Create upload session in database
 	user := utils.GetUser(c)
 	uploadSession := &models.UploadSession{
 		SessionID:   sessionID,
 		AccountID:   user.ID,
-		FileName:    req.FileName,
-		FileSize:    req.FileSize,
-		MimeType:    req.MimeType,
+		FileName:    fileName,
+		FileSize:    fileSize,
+		MimeType:    mimeType,
 		ChunkSize:   chunkSize,
 		TotalChunks: totalChunks,
 		FilePath:    filePath,
 		FileHash:    hash,
 		Status:      models.UploadSessionStatusActive,
 		ExpiresAt:   time.Now().Add(24 * time.Hour), // 24 hour expiration
+
+		FileExpiresAt:    limits.ExpiresAt,
+		FileMaxDownloads: limits.MaxDownloads,
+		FilePasswordHash: limits.PasswordHash,
+		EncryptionKeyID:  key.KeyID,
+		WrappedKey:       key.Wrapped,
+		StreamSalt:       key.Salt,
+		ClientEncrypted:  clientEncrypted,
 	}
 
 	result := db.Create(uploadSession)
 	if result.Error != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create upload session"})
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload session")
 	}
 
 	// Initialize storage for chunked upload
-	err := st.InitChunkedUpload(sessionID, filePath, totalChunks, chunkSize)
+	uploadID, err := st.InitChunkedUpload(sessionID, filePath, totalChunks, chunkSize, key)
 	if err != nil {
 		log.Printf("Failed to initialize chunked upload: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to initialize upload")
 	}
 
-	log.Printf("Initialized upload session %s for file %s (%d bytes, %d chunks)", sessionID, req.FileName, req.FileSize, totalChunks)
+	// Recorded so a restart in the middle of the upload does not strand it; see
+	// jobs.ResumeUploads.
+	if err := db.Model(uploadSession).Update("storage_upload_id", uploadID).Error; err != nil {
+		log.Printf("Failed to record storage upload for session %s: %v", sessionID, err)
+		st.AbortChunkedUpload(sessionID)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to initialize upload")
+	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"sessionId":   sessionID,
-		"chunkSize":   chunkSize,
-		"totalChunks": totalChunks,
-	})
+	return uploadSession, nil
 }
 
 // maxChunkBytes returns how many bytes chunk chunkNumber is allowed to carry: the
@@ -155,7 +235,7 @@ func UploadChunk(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error {
 
 	// Check if session has expired
 	if time.Now().After(uploadSession.ExpiresAt) {
-		uploadSession.Status = models.UploadSessionStatusExpired
+		uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusExpired, nil
 		db.Save(uploadSession)
 		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Upload session expired"})
 	}
@@ -177,14 +257,47 @@ func UploadChunk(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error {
 		})
 	}
 
+	digest, err := utils.ParseContentDigest(c.Get("Content-Digest"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid Content-Digest: " + err.Error()})
+	}
+
 	// Save chunk to storage straight from the request body: it is encrypted and
 	// forwarded as the backend pulls, so a chunk is never held in memory whole and
-	// back pressure from storage reaches the client's socket.
-	if err := st.SaveChunk(sessionID, chunkNumber, requestBodyReader(c, expected), expected); err != nil {
+	// back pressure from storage reaches the client's socket. A chunk sent with a
+	// digest is checked on the way through, and fails before its last frame is written
+	// if it does not match.
+	//
+	// Under frame-index nonces the frames written before the mismatch showed could never
+	// be written again with the right bytes, and the chunk could not be sent again. So
+	// there it is taken in and checked first, and only reaches storage once it matches.
+	body := requestBodyReader(c, expected)
+	if digest != nil {
+		body = utils.NewDigestVerifier(body, digest, expected)
+		if len(uploadSession.StreamSalt) > 0 && !uploadSession.ClientEncrypted {
+			spool, _, err := spoolBody(body, expected)
+			if err != nil {
+				log.Printf("Failed to take in chunk %d for session %s: %v", chunkNumber, sessionID, err)
+				if errors.Is(err, utils.ErrDigestMismatch) {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Chunk does not match its Content-Digest"})
+				}
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save chunk"})
+			}
+			defer spool.Close()
+			body = spool
+		}
+	}
+	if err := st.SaveChunk(sessionID, chunkNumber, body, expected); err != nil {
 		log.Printf("Failed to save chunk %d for session %s: %v", chunkNumber, sessionID, err)
 		if errors.Is(err, utils.ErrShortSource) {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Chunk body ended early"})
 		}
+		if errors.Is(err, utils.ErrDigestMismatch) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Chunk does not match its Content-Digest"})
+		}
+		if errors.Is(err, storage.ErrChunkConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Chunk differs from the one already stored"})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save chunk"})
 	}
 
@@ -208,33 +321,203 @@ func requestBodyReader(c *fiber.Ctx, limit int64) io.Reader {
 	return bytes.NewReader(c.Body())
 }
 
+var errBodyTooLarge = errors.New("body exceeds the size limit")
+
+// spoolBody reads a body, up to limit bytes, into a temporary file and returns it for
+// reading back along with its size. What lands on disk is sealed, frame
+// by frame as the tus spool is, under a key that lives only as long as the request, so an
+// upload is never written out in the clear on its way to storage.
+func spoolBody(body io.Reader, limit int64) (io.ReadCloser, int64, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.CreateTemp("", "bindle-body-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	discard := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	frame := make([]byte, utils.FrameSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(body, frame)
+		if n > 0 {
+			if size+int64(n) > limit {
+				discard()
+				return nil, 0, errBodyTooLarge
+			}
+			sealed, sealErr := utils.NewEncryptingReader(bytes.NewReader(frame[:n]), key,
+				utils.EncryptionVersionStream, int64(n), size/utils.FrameSize)
+			if sealErr == nil {
+				_, sealErr = io.Copy(file, sealed)
+			}
+			if sealErr != nil {
+				discard()
+				return nil, 0, fmt.Errorf("failed to spool frame: %w", sealErr)
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			discard()
+			return nil, 0, err
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		discard()
+		return nil, 0, err
+	}
+	plain, err := utils.NewDecryptingReader(file, key, utils.EncryptionVersionStream, size)
+	if err != nil {
+		discard()
+		return nil, 0, err
+	}
+	return &spooledBody{Reader: plain, discard: discard}, size, nil
+}
+
+// spooledBody reads a spooled body back, and removes its file once closed.
+type spooledBody struct {
+	io.Reader
+	discard func()
+}
+
+func (s *spooledBody) Close() error {
+	s.discard()
+	return nil
+}
+
+// ChunkedUploadStatus is what a client needs to pick an upload back up: the layout the
+// session was opened with and the chunks storage already holds.
+type ChunkedUploadStatus struct {
+	SessionID      string    `json:"sessionId"`
+	FileName       string    `json:"fileName"`
+	FileSize       int64     `json:"fileSize"`
+	MimeType       string    `json:"mimeType"`
+	ChunkSize      int64     `json:"chunkSize"`
+	TotalChunks    int       `json:"totalChunks"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	ReceivedChunks []int     `json:"receivedChunks"`
+}
+
+// GetChunkedUploadStatus reports how far an upload has got, for a client that lost its
+// connection or its page and would otherwise have to send every chunk again. Which
+// chunks are in is asked of the storage backend, for the same reason completeness is.
+func GetChunkedUploadStatus(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error {
+	sessionID := c.Params("sessionId")
+
+	uploadSession, err := loadActiveSession(c, db, sessionID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload session not found"})
+	}
+
+	received, err := st.ReceivedChunks(sessionID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUploadGone) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload session not found"})
+		}
+		log.Printf("Failed to read the progress of session %s: %v", sessionID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to read upload progress"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(ChunkedUploadStatus{
+		SessionID:      uploadSession.SessionID,
+		FileName:       uploadSession.FileName,
+		FileSize:       uploadSession.FileSize,
+		MimeType:       uploadSession.MimeType,
+		ChunkSize:      uploadSession.ChunkSize,
+		TotalChunks:    uploadSession.TotalChunks,
+		ExpiresAt:      uploadSession.ExpiresAt,
+		ReceivedChunks: received,
+	})
+}
+
 // CompleteChunkedUpload finalizes the chunked upload
 func CompleteChunkedUpload(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error {
 	sessionID := c.Params("sessionId")
 
+	// The body is optional: a client that hashed the file as it read it sends the
+	// SHA-256 it got, and the upload only completes if the stored file has the same.
+	var req CompleteChunkedUploadRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	expectedHash := strings.ToLower(req.SHA256)
+	if expectedHash != "" {
+		if sum, err := hex.DecodeString(expectedHash); err != nil || len(sum) != sha256.Size {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "sha256 must be a hex SHA-256"})
+		}
+	}
+
 	uploadSession, err := loadActiveSession(c, db, sessionID)
 	if err != nil {
 		log.Printf("Session not found: %s, error: %v", sessionID, err)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload session not found"})
 	}
 
+	fileToCreate, failure := finishUploadSession(db, st, uploadSession, expectedHash)
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+
+	log.Printf("Completed chunked upload for session %s: %s (%d bytes)", sessionID, fileToCreate.FilePath, uploadSession.FileSize)
+
+	return c.Status(fiber.StatusOK).JSON(fileToCreate)
+}
+
+// finishUploadSession publishes a session whose chunks have all arrived and records the
+// file, deduplicated against what is already stored. When expectedHash is set, the file
+// must have that SHA-256; one that does not is deleted and the session fails.
+func finishUploadSession(db *gorm.DB, st storage.Storage, uploadSession *models.UploadSession,
+	expectedHash string) (*models.UploadedFile, *fiber.Error) {
+	sessionID := uploadSession.SessionID
+
 	// Publishes the object where it was already written. Whether every chunk arrived is
 	// the storage backend's answer, since it is the only place that knows which indexes
 	// it holds.
-	finalPath, err := st.FinalizeChunkedUpload(sessionID)
+	hash, err := st.FinalizeChunkedUpload(sessionID)
 	if err != nil {
 		if errors.Is(err, storage.ErrIncompleteUpload) {
 			log.Printf("Complete failed for session %s: %v", sessionID, err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 		log.Printf("Failed to finalize upload for session %s: %v", sessionID, err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to finalize upload"})
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to finalize upload")
+	}
+
+	// The hash is of what storage holds, read as it was written or back from the
+	// object, so it vouches for the file end to end. Every chunk is in by now and the
+	// object is published, so a mismatch cannot be repaired by resending a chunk: the
+	// upload starts over.
+	if expectedHash != "" && hash != expectedHash {
+		if hash == "" {
+			log.Printf("Could not verify session %s: its file was not hashed", sessionID)
+		} else {
+			log.Printf("Session %s hashed to %s, but the client sent %s", sessionID, hash, expectedHash)
+		}
+		if err := st.DeleteFile(uploadSession.FilePath); err != nil {
+			log.Printf("Warning: failed to remove unverified upload %s: %v", uploadSession.FilePath, err)
+		}
+		uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusFailed, nil
+		db.Save(uploadSession)
+		if hash == "" {
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify upload")
+		}
+		return nil, fiber.NewError(fiber.StatusUnprocessableEntity, "File does not match its SHA-256")
 	}
 
 	// Create file record in database
 	guid, err := uuid.NewV7()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate file ID"})
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to generate file ID")
 	}
 
 	fileToCreate := &models.UploadedFile{
@@ -245,23 +528,43 @@ func CompleteChunkedUpload(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error
 		Type:              utils.GetFileType(uploadSession.MimeType),
 		MimeType:          uploadSession.MimeType,
 		ChunkCount:        uploadSession.TotalChunks,
-		EncryptionVersion: utils.EncryptionVersionStream,
+		EncryptionVersion: sessionKey(uploadSession).EncryptionVersion(),
+		EncryptionKeyID:   uploadSession.EncryptionKeyID,
+		WrappedKey:        uploadSession.WrappedKey,
+		ContentHash:       hash,
+		ClientEncrypted:   uploadSession.ClientEncrypted,
 		OwnerID:           uploadSession.AccountID,
+		ExpiresAt:         uploadSession.FileExpiresAt,
+		MaxDownloads:      uploadSession.FileMaxDownloads,
+		PasswordHash:      uploadSession.FilePasswordHash,
 	}
 
-	result := db.Create(fileToCreate)
-	if result.Error != nil {
-		log.Printf("Failed to create file record: %v", result.Error)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create file record"})
+	// The object could only be named after its contents once they had all arrived, so
+	// it was written under the session's path. When the same contents are already
+	// stored, the record points at that object and this one is dropped.
+	if hash != "" {
+		ext := filepath.Ext(uploadSession.FilePath)
+		if existing, err := findStoredContent(db, hash, ext, uploadSession.FileSize, uploadSession.ClientEncrypted); err == nil {
+			if err := st.DeleteFile(uploadSession.FilePath); err != nil {
+				log.Printf("Warning: failed to remove duplicate upload %s: %v", uploadSession.FilePath, err)
+			}
+			fileToCreate.FilePath = existing.FilePath
+			fileToCreate.ChunkCount = existing.ChunkCount
+			fileToCreate.EncryptionVersion = existing.EncryptionVersion
+			fileToCreate.EncryptionKeyID, fileToCreate.WrappedKey = existing.EncryptionKeyID, existing.WrappedKey
+		}
+	}
+
+	if err := createFileRecord(db, fileToCreate); err != nil {
+		log.Printf("Failed to create file record: %v", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to create file record")
 	}
 
 	// Update session status
-	uploadSession.Status = models.UploadSessionStatusCompleted
+	uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusCompleted, nil
 	db.Save(uploadSession)
 
-	log.Printf("Completed chunked upload for session %s: %s (%d bytes)", sessionID, finalPath, uploadSession.FileSize)
-
-	return c.Status(fiber.StatusOK).JSON(fileToCreate)
+	return fileToCreate, nil
 }
 
 // AbortChunkedUpload cancels an upload session
@@ -280,7 +583,7 @@ func AbortChunkedUpload(c *fiber.Ctx, db *gorm.DB, st storage.Storage) error {
 	}
 
 	// Update session status
-	uploadSession.Status = models.UploadSessionStatusCancelled
+	uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusCancelled, nil
 	db.Save(uploadSession)
 
 	log.Printf("Aborted upload session %s", sessionID)
@@ -1,9 +1,21 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
 	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
 )
 
 func TestMaxChunkBytes(t *testing.T) {
@@ -59,3 +71,224 @@ func TestMaxChunkBytesSumsToDeclaredSize(t *testing.T) {
 		}
 	}
 }
+
+// A client coming back to an upload is told exactly which chunks to skip, by storage
+// rather than by anything the session counted.
+func TestChunkedUploadStatusListsStoredChunks(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := fiber.New()
+	app.Get("/api/file/chunk/:sessionId", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return GetChunkedUploadStatus(c, db, st)
+	})
+
+	session := models.UploadSession{
+		SessionID:   "session",
+		AccountID:   owner.ID,
+		FileName:    "status.bin",
+		FileSize:    3 * testChunkSize,
+		ChunkSize:   testChunkSize,
+		TotalChunks: 3,
+		FilePath:    "status.bin",
+		Status:      models.UploadSessionStatusActive,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	db.Create(&session)
+	if _, err := st.InitChunkedUpload(session.SessionID, session.FilePath, 3, testChunkSize, storage.ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	for _, i := range []int{2, 0} {
+		if err := st.SaveChunk(session.SessionID, i, bytes.NewReader(testContent(testChunkSize)), testChunkSize); err != nil {
+			t.Fatalf("SaveChunk(%d): %v", i, err)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/api/file/chunk/session", nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("asking for the status failed: %v, status %v", err, res.StatusCode)
+	}
+	var status ChunkedUploadStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding the status: %v", err)
+	}
+	if !reflect.DeepEqual(status.ReceivedChunks, []int{0, 2}) || status.TotalChunks != 3 || status.ChunkSize != testChunkSize {
+		t.Errorf("got status %+v, want chunks 0 and 2 of 3", status)
+	}
+
+	if err := st.AbortChunkedUpload(session.SessionID); err != nil {
+		t.Fatalf("AbortChunkedUpload: %v", err)
+	}
+	res, _ = app.Test(httptest.NewRequest("GET", "/api/file/chunk/session", nil), -1)
+	if res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("a session whose upload storage no longer holds gave %d, want 404", res.StatusCode)
+	}
+}
+
+func postChunk(t *testing.T, app *fiber.App, path string, body []byte, digestOf []byte) int {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	sum := sha256.Sum256(digestOf)
+	req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	return res.StatusCode
+}
+
+// A chunk that does not match its Content-Digest is refused, and a bad retry of a chunk
+// that was already stored takes it back out, since it was written over in place. A file
+// that does not match the SHA-256 sent at completion is not published.
+func TestChunkedUploadVerifiesDigests(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	app.Post("/api/file/chunk/:sessionId/complete", func(c *fiber.Ctx) error {
+		return CompleteChunkedUpload(c, db, st)
+	})
+	app.Post("/api/file/chunk/:sessionId/:chunkNumber", func(c *fiber.Ctx) error {
+		return UploadChunk(c, db, st)
+	})
+
+	plain := testContent(testChunkSize + 1000)
+	first, last := plain[:testChunkSize], plain[testChunkSize:]
+	flipped := bytes.Clone(first)
+	flipped[len(flipped)/2] ^= 1
+
+	open := func(sessionID string) {
+		t.Helper()
+		db.Create(&models.UploadSession{
+			SessionID:   sessionID,
+			AccountID:   owner.ID,
+			FileName:    "digest.bin",
+			FileSize:    int64(len(plain)),
+			MimeType:    "application/octet-stream",
+			ChunkSize:   testChunkSize,
+			TotalChunks: 2,
+			FilePath:    sessionID + ".bin",
+			Status:      models.UploadSessionStatusActive,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		})
+		if _, err := st.InitChunkedUpload(sessionID, sessionID+".bin", 2, testChunkSize, storage.ObjectKey{}); err != nil {
+			t.Fatalf("InitChunkedUpload: %v", err)
+		}
+	}
+
+	open("good")
+	if status := postChunk(t, app, "/api/file/chunk/good/0", first, first); status != fiber.StatusOK {
+		t.Fatalf("a matching chunk gave %d", status)
+	}
+	if status := postChunk(t, app, "/api/file/chunk/good/0", flipped, first); status != fiber.StatusBadRequest {
+		t.Fatalf("a chunk with a flipped bit gave %d, want 400", status)
+	}
+	if received, _ := st.ReceivedChunks("good"); len(received) != 0 {
+		t.Fatalf("after a bad retry storage still holds chunks %v", received)
+	}
+	postChunk(t, app, "/api/file/chunk/good/0", first, first)
+	postChunk(t, app, "/api/file/chunk/good/1", last, last)
+
+	sum := sha256.Sum256(plain)
+	complete := httptest.NewRequest("POST", "/api/file/chunk/good/complete",
+		bytes.NewReader([]byte(`{"sha256":"`+hex.EncodeToString(sum[:])+`"}`)))
+	complete.Header.Set("Content-Type", "application/json")
+	if res, err := app.Test(complete, -1); err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("completing with the right SHA-256 failed: %v, status %v", err, res.StatusCode)
+	}
+
+	open("bad")
+	postChunk(t, app, "/api/file/chunk/bad/0", first, first)
+	postChunk(t, app, "/api/file/chunk/bad/1", last, last)
+	wrong := sha256.Sum256(last)
+	complete = httptest.NewRequest("POST", "/api/file/chunk/bad/complete",
+		bytes.NewReader([]byte(`{"sha256":"`+hex.EncodeToString(wrong[:])+`"}`)))
+	complete.Header.Set("Content-Type", "application/json")
+	if res, err := app.Test(complete, -1); err != nil || res.StatusCode != fiber.StatusUnprocessableEntity {
+		t.Fatalf("completing with the wrong SHA-256 gave %v, status %v, want 422", err, res.StatusCode)
+	}
+	var session models.UploadSession
+	db.Where("session_id = ?", "bad").First(&session)
+	if session.Status != models.UploadSessionStatusFailed {
+		t.Errorf("the mismatched session is %s, want failed", session.Status)
+	}
+	stored := storage.StoredFile{EncryptionVersion: utils.EncryptionVersionStream, PlainSize: int64(len(plain))}
+	if r, _, err := st.GetFileStream("bad.bin", stored); err == nil {
+		r.Close()
+		t.Errorf("the mismatched file was left in storage")
+	}
+	var files int64
+	db.Model(&models.UploadedFile{}).Count(&files)
+	if files != 1 {
+		t.Errorf("%d files were recorded, want only the verified one", files)
+	}
+}
+
+// Under frame-index nonces a chunk that fails its Content-Digest is checked before any of
+// it is sealed, so the right bytes can still follow it. Once a chunk is stored, sending
+// other bytes for it is refused and the stored chunk kept.
+func TestSubkeyChunkIsCheckedBeforeItIsSealed(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	app.Post("/api/file/chunk/:sessionId/:chunkNumber", func(c *fiber.Ctx) error {
+		return UploadChunk(c, db, st)
+	})
+
+	key, err := storage.NewObjectKey(&config.Config{EncryptionKey: bytes.Repeat([]byte{0x3c}, 32)})
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	plain := testContent(testChunkSize + 1000)
+	first := plain[:testChunkSize]
+	flipped := bytes.Clone(first)
+	flipped[len(flipped)/2] ^= 1
+	db.Create(&models.UploadSession{
+		SessionID:   "salted",
+		AccountID:   owner.ID,
+		FileName:    "salted.bin",
+		FileSize:    int64(len(plain)),
+		MimeType:    "application/octet-stream",
+		ChunkSize:   testChunkSize,
+		TotalChunks: 2,
+		FilePath:    "salted.bin",
+		StreamSalt:  key.Salt,
+		Status:      models.UploadSessionStatusActive,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	if _, err := st.InitChunkedUpload("salted", "salted.bin", 2, testChunkSize, key); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+
+	if status := postChunk(t, app, "/api/file/chunk/salted/0", flipped, first); status != fiber.StatusBadRequest {
+		t.Fatalf("a chunk with a flipped bit gave %d, want 400", status)
+	}
+	if status := postChunk(t, app, "/api/file/chunk/salted/0", first, first); status != fiber.StatusOK {
+		t.Fatalf("the right bytes after a mismatch gave %d", status)
+	}
+	if status := postChunk(t, app, "/api/file/chunk/salted/0", flipped, flipped); status != fiber.StatusConflict {
+		t.Errorf("other bytes for a stored chunk gave %d, want 409", status)
+	}
+	if received, _ := st.ReceivedChunks("salted"); !reflect.DeepEqual(received, []int{0}) {
+		t.Errorf("storage holds chunks %v, want [0]", received)
+	}
+}
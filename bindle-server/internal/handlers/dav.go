@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/cleanup"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/limiter"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// WebDAV (RFC 4918) class 1 over an account's files, so they can be mounted as a drive.
+// The account is one flat directory, /dav/, with a file in it for each record: there
+// are no folders, and no locks. Reads go through the same code as share links, and
+// writes through the same storage, dedup and ref-counted deletion as every other upload.
+const (
+	// DAVPrefix is where the account's directory is mounted.
+	DAVPrefix = "/dav/"
+
+	davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, MOVE"
+)
+
+// DAVMethods are the methods WebDAV adds that the router has to be told about.
+var DAVMethods = []string{"PROPFIND", "MOVE"}
+
+// davFile is a record as the directory shows it.
+type davFile struct {
+	name string
+	file models.UploadedFile
+}
+
+// listDAVFiles is the directory of owner's files. File names need not be unique in an
+// account but must be in a directory, so a name already taken by an older file gets the
+// end of the file's ID added to it, which stays the same whatever else is uploaded or
+// deleted.
+func listDAVFiles(db *gorm.DB, owner uint) ([]davFile, error) {
+	var files []models.UploadedFile
+	if err := db.Where("owner_id = ?", owner).Order("id").Find(&files).Error; err != nil {
+		return nil, err
+	}
+
+	taken := make(map[string]bool, len(files))
+	entries := make([]davFile, 0, len(files))
+	for _, file := range files {
+		name := strings.ReplaceAll(file.FileName, "/", "_")
+		if name == "" {
+			name = file.FileId
+		}
+		if taken[name] {
+			ext := filepath.Ext(name)
+			name = strings.TrimSuffix(name, ext) + " (" + file.FileId[len(file.FileId)-8:] + ")" + ext
+		}
+		taken[name] = true
+		entries = append(entries, davFile{name: name, file: file})
+	}
+	return entries, nil
+}
+
+// findDAVFile finds the file called name in owner's directory.
+func findDAVFile(db *gorm.DB, owner uint, name string) (*models.UploadedFile, error) {
+	entries, err := listDAVFiles(db, owner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].name == name {
+			return &entries[i].file, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// davName is the file a request path under DAVPrefix names, empty for the directory
+// itself. ok is false for a path into a folder, which cannot exist here.
+func davName(path string) (name string, ok bool) {
+	name, err := url.PathUnescape(strings.TrimSuffix(path, "/"))
+	if err != nil || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+// davHref is the escaped path of the file called name, or of the directory.
+func davHref(name string) string {
+	return DAVPrefix + url.PathEscape(name)
+}
+
+// DAVOptions tells a client what is served here. Clients ask before they log in, so it
+// is answered for everyone.
+func DAVOptions(c *fiber.Ctx) error {
+	c.Set("DAV", "1")
+	c.Set(fiber.HeaderAllow, davAllow)
+	c.Set("MS-Author-Via", "DAV")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	CreationDate  string          `xml:"D:creationdate"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func davFileResponse(entry *davFile) davResponse {
+	return davResponse{
+		Href: davHref(entry.name),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:   entry.name,
+				ContentLength: &entry.file.Size,
+				ContentType:   entry.file.MimeType,
+				CreationDate:  entry.file.CreatedAt.UTC().Format(time.RFC3339),
+				LastModified:  entry.file.CreatedAt.UTC().Format(http.TimeFormat),
+				ETag:          fileETag(&entry.file),
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// DAVPropfind describes the directory, with its files unless Depth is 0, or one file.
+// Every property is sent whatever the request asked for, which RFC 4918 allows and every
+// client copes with: there are only a handful and they are all cheap.
+func DAVPropfind(c *fiber.Ctx, db *gorm.DB, path string) error {
+	name, ok := davName(path)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	entries, err := listDAVFiles(db, utils.GetUser(c).ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	status := davMultistatus{Namespace: "DAV:"}
+	if name != "" {
+		for i := range entries {
+			if entries[i].name == name {
+				status.Responses = append(status.Responses, davFileResponse(&entries[i]))
+			}
+		}
+		if len(status.Responses) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+		}
+	} else {
+		// The directory changes whenever a file in it does, and is as old as the newest.
+		var modified time.Time
+		for i := range entries {
+			if entries[i].file.CreatedAt.After(modified) {
+				modified = entries[i].file.CreatedAt
+			}
+		}
+		status.Responses = append(status.Responses, davResponse{
+			Href: DAVPrefix,
+			Propstat: davPropstat{
+				Prop: davProp{
+					DisplayName:  "Bindle",
+					ResourceType: davResourceType{Collection: &struct{}{}},
+					CreationDate: utils.GetUser(c).CreatedAt.UTC().Format(time.RFC3339),
+					LastModified: modified.UTC().Format(http.TimeFormat),
+				},
+				Status: "HTTP/1.1 200 OK",
+			},
+		})
+		if c.Get("Depth") != "0" {
+			for i := range entries {
+				status.Responses = append(status.Responses, davFileResponse(&entries[i]))
+			}
+		}
+	}
+
+	body, err := xml.Marshal(status)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list files"})
+	}
+	c.Set(fiber.HeaderContentType, "application/xml; charset=utf-8")
+	return c.Status(fiber.StatusMultiStatus).Send(append([]byte(xml.Header), body...))
+}
+
+// DAVGet sends a file, ranges and all, as its share link would. It is the owner reading
+// their own file, so no password is asked for and the download is not counted or logged.
+func DAVGet(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage, path string) error {
+	name, ok := davName(path)
+	if ok && name == "" {
+		c.Set(fiber.HeaderAllow, davAllow)
+		return c.Status(fiber.StatusMethodNotAllowed).JSON(fiber.Map{"error": "List the directory with PROPFIND"})
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	file, err := findDAVFile(db, utils.GetUser(c).ID, name)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "private")
+	return serveFile(c, db, cfg, st, nil, file)
+}
+
+// DAVPut stores the body as the file called name, streaming it through encryption into
+// storage like a PUT upload. Writing over an existing file keeps its record, and with it
+// its ID and share links, and points it at the new contents; the old contents are
+// deleted once nothing else uses them. An overwrite is a new upload as far as the upload
+// limit is concerned, so its date moves to now.
+func DAVPut(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage, path string) error {
+	name, ok := davName(path)
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Folders are not supported"})
+	}
+	if name == "" {
+		c.Set(fiber.HeaderAllow, davAllow)
+		return c.Status(fiber.StatusMethodNotAllowed).JSON(fiber.Map{"error": "Cannot write to the directory"})
+	}
+
+	maxSize := cfg.MaxFileSizeMB * 1000 * 1000
+	size := int64(c.Request().Header.ContentLength())
+	var source io.Reader
+	if size < 0 {
+		// Finder and davfs2 send their files chunked, with no length up front; the body is
+		// taken in first so the size is known before storage is asked for it.
+		spool, spooled, err := spoolBody(requestBodyReader(c, maxSize+1), maxSize)
+		if errors.Is(err, errBodyTooLarge) {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "File exceeds maximum allowed size"})
+		}
+		if err != nil {
+			log.Printf("Failed to spool WebDAV upload: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to receive file"})
+		}
+		defer spool.Close()
+		source, size = spool, spooled
+	} else {
+		if size > maxSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "File exceeds maximum allowed size"})
+		}
+		source = requestBodyReader(c, size)
+	}
+
+	user := utils.GetUser(c)
+	existing, err := findDAVFile(db, user.ID, name)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	// 507 is how WebDAV says the drive is full, which clients show as such.
+	if limiter.ShouldThrottle(c, db, cfg, size) {
+		return c.Status(fiber.StatusInsufficientStorage).JSON(fiber.Map{"error": "Upload limit exceeded"})
+	}
+
+	body := bufio.NewReader(source)
+	mimeType := putMimeType(c.Get(fiber.HeaderContentType), name, body)
+
+	if existing == nil {
+		file, failure := storeFile(db, cfg, st, body, size, name, mimeType, user, fileLimits{})
+		if failure != nil {
+			return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+		}
+		log.Printf("Stored WebDAV upload %s (%d bytes)", file.FilePath, size)
+		return c.SendStatus(fiber.StatusCreated)
+	}
+
+	// The extension stays the record's own: share links end in it.
+	content, failure := storeContent(db, cfg, st, body, size, filepath.Ext(existing.FilePath))
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+	oldPath := existing.FilePath
+	content.apply(existing)
+	existing.Size = size
+	existing.MimeType = mimeType
+	existing.Type = utils.GetFileType(mimeType)
+	existing.CreatedAt = time.Now()
+	err = db.Model(existing).
+		Select("file_path", "content_hash", "encryption_version", "chunk_count", "encryption_key_id", "wrapped_key",
+			"client_encrypted", "size", "mime_type", "type", "created_at").
+		Updates(existing).Error
+	if err != nil {
+		log.Printf("Failed to point file %s at its new contents: %v", existing.FileId, err)
+		if err := cleanup.ReleaseStoredFile(db, st, content.FilePath); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update file"})
+	}
+	if oldPath != existing.FilePath {
+		if err := cleanup.ReleaseStoredFile(db, st, oldPath); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	log.Printf("Replaced file %s over WebDAV with %s (%d bytes)", existing.FileId, existing.FilePath, size)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DAVDelete deletes a file the way DELETE /api/file/:fileId does.
+func DAVDelete(c *fiber.Ctx, db *gorm.DB, st storage.Storage, path string) error {
+	name, ok := davName(path)
+	if ok && name == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Cannot delete the directory"})
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	file, err := findDAVFile(db, utils.GetUser(c).ID, name)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+	if err := deleteDAVFile(db, st, file); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete file"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// deleteDAVFile deletes file, counting it done once the record is gone.
+func deleteDAVFile(db *gorm.DB, st storage.Storage, file *models.UploadedFile) error {
+	err := cleanup.DeleteFile(db, st, file)
+	if errors.Is(err, cleanup.ErrStoredFileKept) {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to delete file %s over WebDAV: %v", file.FileId, err)
+		return err
+	}
+	log.Printf("Deleted file %s over WebDAV", file.FilePath)
+	return nil
+}
+
+// DAVMove renames a file to the name its Destination header gives. A file already called
+// that is replaced, unless the client sent Overwrite: F.
+func DAVMove(c *fiber.Ctx, db *gorm.DB, st storage.Storage, path string) error {
+	name, ok := davName(path)
+	if !ok || name == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only files can be moved"})
+	}
+
+	destination, err := url.Parse(c.Get("Destination"))
+	if err != nil || !strings.HasPrefix(destination.EscapedPath(), DAVPrefix) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Destination must be in " + DAVPrefix})
+	}
+	newName, ok := davName(strings.TrimPrefix(destination.EscapedPath(), DAVPrefix))
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Folders are not supported"})
+	}
+	if newName == "" || newName == name {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Destination must be another file"})
+	}
+
+	user := utils.GetUser(c)
+	file, err := findDAVFile(db, user.ID, name)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	status := fiber.StatusCreated
+	if replaced, err := findDAVFile(db, user.ID, newName); err == nil {
+		if c.Get("Overwrite") == "F" {
+			return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{"error": "Destination exists"})
+		}
+		if err := deleteDAVFile(db, st, replaced); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete file"})
+		}
+		status = fiber.StatusNoContent
+	}
+
+	if err := db.Model(file).Update("file_name", newName).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update file"})
+	}
+	log.Printf("Renamed file %s over WebDAV", file.FileId)
+	return c.SendStatus(status)
+}
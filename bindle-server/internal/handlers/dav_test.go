@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+func davTestApp(db *gorm.DB, st storage.Storage, owner models.User) *fiber.App {
+	cfg := &config.Config{
+		MaxFileSizeMB:       100,
+		UploadLimitMBPerDay: 100,
+		EncryptionKey:       bytes.Repeat([]byte{0x3c}, 32),
+	}
+
+	app := fiber.New(fiber.Config{
+		RequestMethods: append(append([]string{}, fiber.DefaultMethods...), DAVMethods...),
+	})
+	app.Get("/files/:filePath", func(c *fiber.Ctx) error {
+		return GetFile(c, db, cfg, st, c.Params("filePath"))
+	})
+	dav := app.Group("/dav", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	dav.Add("PROPFIND", "/*", func(c *fiber.Ctx) error {
+		return DAVPropfind(c, db, c.Params("*"))
+	})
+	dav.Get("/*", func(c *fiber.Ctx) error {
+		return DAVGet(c, db, cfg, st, c.Params("*"))
+	})
+	dav.Put("/*", func(c *fiber.Ctx) error {
+		return DAVPut(c, db, cfg, st, c.Params("*"))
+	})
+	dav.Delete("/*", func(c *fiber.Ctx) error {
+		return DAVDelete(c, db, st, c.Params("*"))
+	})
+	dav.Add("MOVE", "/*", func(c *fiber.Ctx) error {
+		return DAVMove(c, db, st, c.Params("*"))
+	})
+	return app
+}
+
+func davRequest(t *testing.T, app *fiber.App, method, path string, body []byte, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	answer, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading the response failed: %v", err)
+	}
+	return res, answer
+}
+
+// A file written, listed, read in part, written over, renamed and deleted over WebDAV:
+// writing over it keeps its record and link, and its old contents go with the last
+// record that used them.
+func TestDAVFileLifecycle(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	dir := t.TempDir()
+	st, err := storage.NewFilesystemStorage(config.Config{
+		FilesystemPath: dir,
+		EncryptionKey:  bytes.Repeat([]byte{0x3c}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := davTestApp(db, st, owner)
+
+	first := testContent(70_000)
+	if res, _ := davRequest(t, app, "PUT", "/dav/my%20notes.txt", first, nil); res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("PUT of a new file gave %d", res.StatusCode)
+	}
+	var file models.UploadedFile
+	if err := db.Preload("Shares").Where("owner_id = ?", owner.ID).First(&file).Error; err != nil {
+		t.Fatalf("the upload has no record: %v", err)
+	}
+	if file.FileName != "my notes.txt" {
+		t.Errorf("the upload was named %q", file.FileName)
+	}
+
+	// Another file of the same name shows up beside it rather than hiding it.
+	twin := file
+	twin.ID, twin.FileId, twin.Shares = 0, "0190aaaa-bbbb-7ccc-8ddd-eeeeffff0001", nil
+	db.Create(&twin)
+
+	res, listing := davRequest(t, app, "PROPFIND", "/dav/", nil, map[string]string{"Depth": "1"})
+	if res.StatusCode != fiber.StatusMultiStatus {
+		t.Fatalf("PROPFIND gave %d", res.StatusCode)
+	}
+	for _, want := range []string{"<D:href>/dav/</D:href>", "<D:collection></D:collection>",
+		"<D:href>/dav/my%20notes.txt</D:href>", "<D:href>/dav/my%20notes%20%28ffff0001%29.txt</D:href>",
+		"<D:getcontentlength>70000</D:getcontentlength>"} {
+		if !strings.Contains(string(listing), want) {
+			t.Errorf("the listing lacks %s:\n%s", want, listing)
+		}
+	}
+	db.Delete(&twin)
+
+	res, part := davRequest(t, app, "GET", "/dav/my%20notes.txt", nil, map[string]string{"Range": "bytes=100-199"})
+	if res.StatusCode != fiber.StatusPartialContent || !bytes.Equal(part, first[100:200]) {
+		t.Errorf("a ranged GET gave %d and %d bytes", res.StatusCode, len(part))
+	}
+
+	second := testContent(90_000)[1000:]
+	if res, _ := davRequest(t, app, "PUT", "/dav/my%20notes.txt", second, nil); res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("PUT over the file gave %d", res.StatusCode)
+	}
+	var replaced models.UploadedFile
+	db.Where("owner_id = ?", owner.ID).First(&replaced)
+	if replaced.ID != file.ID || replaced.Size != int64(len(second)) || replaced.DownloadCount != 0 {
+		t.Errorf("writing over the file left record %d of %d bytes, %d downloads",
+			replaced.ID, replaced.Size, replaced.DownloadCount)
+	}
+	if res, body := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, second) {
+		t.Errorf("the file's link gave %d, want the new contents", res.StatusCode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("storage holds %d objects, want only the new contents", len(entries))
+	}
+
+	res, _ = davRequest(t, app, "MOVE", "/dav/my%20notes.txt", nil, map[string]string{
+		"Destination": "http://example.com/dav/renamed.txt",
+	})
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("MOVE gave %d", res.StatusCode)
+	}
+	if res, body := davRequest(t, app, "GET", "/dav/renamed.txt", nil, nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, second) {
+		t.Errorf("GET after the rename gave %d", res.StatusCode)
+	}
+	if res, _ := davRequest(t, app, "PROPFIND", "/dav/my%20notes.txt", nil, nil); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("the old name still answers %d", res.StatusCode)
+	}
+
+	if res, _ := davRequest(t, app, "DELETE", "/dav/renamed.txt", nil, nil); res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("DELETE gave %d", res.StatusCode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("storage still holds %d objects after the delete", len(entries))
+	}
+}
+
+// Writing a second name with the same contents stores them once, and deleting one of the
+// two leaves the contents for the other.
+func TestDAVDeleteKeepsSharedContents(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := davTestApp(db, st, owner)
+
+	plain := testContent(5000)
+	davRequest(t, app, "PUT", "/dav/a.bin", plain, nil)
+	davRequest(t, app, "PUT", "/dav/b.bin", plain, nil)
+	if res, _ := davRequest(t, app, "DELETE", "/dav/a.bin", nil, nil); res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("DELETE gave %d", res.StatusCode)
+	}
+	if res, body := davRequest(t, app, "GET", "/dav/b.bin", nil, nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("the other file gave %d after the delete, want its contents", res.StatusCode)
+	}
+
+	res, _ := davRequest(t, app, "MOVE", "/dav/b.bin", nil, map[string]string{
+		"Destination": "/dav/sub/b.bin",
+	})
+	if res.StatusCode != fiber.StatusConflict {
+		t.Errorf("MOVE into a folder gave %d, want 409", res.StatusCode)
+	}
+}
+
+// Finder and davfs2 write files chunked, with no Content-Length: the body is taken in
+// whole before it is stored, and one over the size limit is refused.
+func TestDAVPutWithoutContentLength(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := davTestApp(db, st, owner)
+
+	put := func(path string, body []byte) int {
+		req := httptest.NewRequest("PUT", path, io.MultiReader(bytes.NewReader(body)))
+		req.TransferEncoding = []string{"chunked"}
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("PUT %s failed: %v", path, err)
+		}
+		return res.StatusCode
+	}
+
+	plain := testContent(200_000)
+	if status := put("/dav/chunked.bin", plain); status != fiber.StatusCreated {
+		t.Fatalf("a chunked PUT gave %d", status)
+	}
+	var file models.UploadedFile
+	if err := db.Where("owner_id = ?", owner.ID).First(&file).Error; err != nil {
+		t.Fatalf("the upload has no record: %v", err)
+	}
+	if file.Size != int64(len(plain)) {
+		t.Errorf("the upload was recorded at %d bytes, want %d", file.Size, len(plain))
+	}
+	if res, body := davRequest(t, app, "GET", "/dav/chunked.bin", nil, nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("GET gave %d and %d bytes, want the contents written", res.StatusCode, len(body))
+	}
+
+	if _, _, err := spoolBody(bytes.NewReader(plain), int64(len(plain))-1); !errors.Is(err, errBodyTooLarge) {
+		t.Errorf("spooling a body over the limit gave %v, want errBodyTooLarge", err)
+	}
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// maxLoggedHeader caps the user agent and referrer kept per download, both of which the
+// client chooses freely.
+const maxLoggedHeader = 512
+
+// fileDownload is one request for a recorded file's bytes. It counts the download
+// against the file's and the share's limits once storage has opened, and logs it with
+// the bytes that went out once the body is done. A nil one does neither, for reads that are not downloads.
+type fileDownload struct {
+	db    *gorm.DB
+	share *models.Share
+	file  *models.UploadedFile
+	entry models.Download
+}
+
+// newFileDownload takes what the log needs from c up front: by the time the body has
+// been sent, the handler has returned and c belongs to another request.
+func newFileDownload(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, share *models.Share,
+	file *models.UploadedFile, rangeHeader string) *fileDownload {
+
+	return &fileDownload{
+		db:    db,
+		share: share,
+		file:  file,
+		entry: models.Download{
+			UploadedFileID: file.ID,
+			ShareID:        share.ID,
+			Range:          rangeHeader,
+			IPHash:         hashClientIP(cfg, c.IP()),
+			UserAgent:      truncate(c.Get(fiber.HeaderUserAgent), maxLoggedHeader),
+			Referrer:       truncate(c.Get(fiber.HeaderReferer), maxLoggedHeader),
+		},
+	}
+}
+
+// sameDownloadWindow is how long after a client's last request for a file through a
+// share its next one is still taken as part of the same download: a player seeking
+// through a video, or a download picking up again after a dropped connection.
+const sameDownloadWindow = 30 * time.Minute
+
+// opened counts the download once storage has opened, so a failed read does not spend a
+// limited file's budget, and enters it in the log. ranges are the ones being served, nil
+// for the whole file.
+//
+// Under a download limit a download is what one client fetches, in however many
+// requests: one counts unless the same client made another within sameDownloadWindow,
+// whatever range it asks for, so splitting the file into ranges gets no more out of the
+// limit than asking for it whole. Without a limit the count is only a statistic, and a
+// request counts when it includes the first byte.
+func (d *fileDownload) opened(ranges []byteRange, reader io.Closer) error {
+	if d == nil {
+		return nil
+	}
+	count := coversStart(ranges)
+	if d.limited() {
+		continued, err := continuesDownload(d.db, d.share, d.file, d.entry.IPHash, time.Now())
+		if err != nil {
+			reader.Close()
+			return err
+		}
+		count = !continued
+	}
+	if count {
+		if err := countDownload(d.db, d.share, d.file); err != nil {
+			reader.Close()
+			return err
+		}
+	}
+	// Entered now rather than once the body has gone out, so that the client's next
+	// request finds it while this one is still streaming.
+	if err := d.db.Create(&d.entry).Error; err != nil {
+		log.Printf("Failed to log a download of file %s: %v", d.file.FileId, err)
+	}
+	return nil
+}
+
+// continuesDownload reports whether the client ipHash stands for requested file through
+// share within sameDownloadWindow of now, making its next request part of that download.
+func continuesDownload(db *gorm.DB, share *models.Share, file *models.UploadedFile, ipHash string,
+	now time.Time) (bool, error) {
+
+	var count int64
+	err := db.Model(&models.Download{}).
+		Where("share_id = ? AND uploaded_file_id = ? AND ip_hash = ? AND created_at > ?",
+			share.ID, file.ID, ipHash, now.Add(-sameDownloadWindow)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// limited reports whether the file or the share it is downloaded through only serves a
+// set number of downloads.
+func (d *fileDownload) limited() bool {
+	return d.file.MaxDownloads > 0 || d.share.MaxDownloads > 0
+}
+
+func coversStart(ranges []byteRange) bool {
+	if ranges == nil {
+		return true
+	}
+	for _, r := range ranges {
+		if r.start == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// body wraps the response body so that, when it is closed, the download's log entry gets
+// the bytes that were actually read from it.
+func (d *fileDownload) body(reader io.ReadCloser) io.ReadCloser {
+	if d == nil {
+		return reader
+	}
+	return &loggedBody{ReadCloser: reader, download: d}
+}
+
+type loggedBody struct {
+	io.ReadCloser
+	download *fileDownload
+	// sent is set once a read has succeeded. A body that failed on its first read was
+	// answered with an error instead, and is not a download.
+	sent   bool
+	closed bool
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.download.entry.BytesSent += int64(n)
+	if n > 0 || err == io.EOF {
+		b.sent = true
+	}
+	return n, err
+}
+
+// Close completes the log entry opened made with the bytes sent, or takes it back if
+// nothing was.
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	entry := &b.download.entry
+	if b.closed || entry.ID == 0 {
+		return err
+	}
+	b.closed = true
+
+	db := b.download.db
+	var logErr error
+	if b.sent {
+		logErr = db.Model(entry).UpdateColumn("bytes_sent", entry.BytesSent).Error
+	} else {
+		logErr = db.Delete(entry).Error
+	}
+	if logErr != nil {
+		log.Printf("Failed to log a download of file %s: %v", b.download.file.FileId, logErr)
+	}
+	return err
+}
+
+// hashClientIP turns a client address into a value that tells downloads from one client
+// apart from another's without recording the address. It is keyed with the server's
+// secret, since a plain hash of an IPv4 address is undone by hashing all of them.
+func hashClientIP(cfg *config.Config, ip string) string {
+	mac := hmac.New(sha256.New, cfg.MACKey)
+	mac.Write([]byte("download-ip\x00" + ip))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// summarizeDownloads fills in Downloads on each of files from the download log, in one
+// query however many there are.
+func summarizeDownloads(db *gorm.DB, files []models.UploadedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(files))
+	for i := range files {
+		ids[i] = files[i].ID
+	}
+
+	// The last download is taken as the highest ID rather than MAX(created_at): an
+	// aggregate loses the column's type, and SQLite hands it back as text.
+	var rows []struct {
+		UploadedFileID uint
+		Requests       int64
+		BytesSent      int64
+		LastID         uint
+	}
+	err := db.Model(&models.Download{}).
+		Select("uploaded_file_id, COUNT(*) AS requests, SUM(bytes_sent) AS bytes_sent, MAX(id) AS last_id").
+		Where("uploaded_file_id IN ?", ids).
+		Group("uploaded_file_id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	lastIDs := make([]uint, len(rows))
+	for i, row := range rows {
+		lastIDs[i] = row.LastID
+	}
+	var last []models.Download
+	if len(lastIDs) > 0 {
+		if err := db.Select("id", "created_at").Find(&last, lastIDs).Error; err != nil {
+			return err
+		}
+	}
+	lastAt := make(map[uint]time.Time, len(last))
+	for _, download := range last {
+		lastAt[download.ID] = download.CreatedAt
+	}
+
+	summaries := make(map[uint]*models.DownloadSummary, len(rows))
+	for _, row := range rows {
+		at := lastAt[row.LastID]
+		summaries[row.UploadedFileID] = &models.DownloadSummary{
+			Requests:         row.Requests,
+			BytesSent:        row.BytesSent,
+			LastDownloadedAt: &at,
+		}
+	}
+	for i := range files {
+		if summary, ok := summaries[files[i].ID]; ok {
+			files[i].Downloads = summary
+		} else {
+			files[i].Downloads = &models.DownloadSummary{}
+		}
+	}
+	return nil
+}
+
+type DownloadDTO struct {
+	Id        uint      `json:"id"`
+	At        time.Time `json:"at"`
+	BytesSent int64     `json:"bytesSent"`
+	Range     string    `json:"range,omitempty"`
+	// ShareId and ShareLabel say which link the download came through. A link that has
+	// since been revoked is still named.
+	ShareId    string `json:"shareId"`
+	ShareLabel string `json:"shareLabel"`
+	ClientId   string `json:"clientId"`
+	UserAgent  string `json:"userAgent"`
+	Referrer   string `json:"referrer"`
+}
+
+// ListFileDownloads returns the download log of one of the user's files, newest first.
+// ?limit picks how many entries, up to 500, and ?before continues after the last id of
+// a previous page.
+func ListFileDownloads(c *fiber.Ctx, db *gorm.DB, fileId string) error {
+	file, err := ownedFile(c, db, fileId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be a positive number"})
+		}
+		limit = min(parsed, 500)
+	}
+
+	query := db.Where("uploaded_file_id = ?", file.ID)
+	if value := c.Query("before"); value != "" {
+		before, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "before must be a download ID"})
+		}
+		query = query.Where("id < ?", before)
+	}
+
+	var downloads []models.Download
+	if err := query.Order("id DESC").Limit(limit).Find(&downloads).Error; err != nil {
+		log.Printf("Failed to fetch the downloads of file %s: %v", fileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch downloads"})
+	}
+
+	var shares []models.Share
+	if err := db.Unscoped().Where("uploaded_file_id = ?", file.ID).Find(&shares).Error; err != nil {
+		log.Printf("Failed to fetch the shares of file %s: %v", fileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch downloads"})
+	}
+	sharesByID := make(map[uint]models.Share, len(shares))
+	for _, share := range shares {
+		sharesByID[share.ID] = share
+	}
+
+	dtos := make([]DownloadDTO, len(downloads))
+	for i, download := range downloads {
+		share := sharesByID[download.ShareID]
+		dtos[i] = DownloadDTO{
+			Id:         download.ID,
+			At:         download.CreatedAt,
+			BytesSent:  download.BytesSent,
+			Range:      download.Range,
+			ShareId:    share.Slug,
+			ShareLabel: share.Label,
+			ClientId:   download.IPHash,
+			UserAgent:  download.UserAgent,
+			Referrer:   download.Referrer,
+		}
+	}
+
+	return c.JSON(dtos)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+func TestGetFileLogsWhatItSent(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	file := storeTestFile(t, db, st, testContent(1000))
+
+	app := downloadTestApp(db, st)
+	app.Get("/api/file/:fileId/downloads", func(c *fiber.Ctx) error {
+		c.Locals("user", models.User{})
+		return ListFileDownloads(c, db, c.Params("fileId"))
+	})
+
+	download(t, app, shareURL(file), map[string]string{"User-Agent": "curl/8.0", "Referer": "https://example.com/"})
+	download(t, app, shareURL(file), map[string]string{"Range": "bytes=100-199"})
+	if res, _ := download(t, app, shareURL(file), map[string]string{"Range": "bytes=5000-"}); res.StatusCode != fiber.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("an unsatisfiable range gave %d", res.StatusCode)
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/api/file/"+file.FileId+"/downloads", nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("listing downloads failed: %v, status %v", err, res.StatusCode)
+	}
+	var downloads []DownloadDTO
+	if err := json.NewDecoder(res.Body).Decode(&downloads); err != nil {
+		t.Fatalf("decoding the downloads: %v", err)
+	}
+
+	if len(downloads) != 2 {
+		t.Fatalf("logged %d downloads, want 2: nothing is sent for a 416", len(downloads))
+	}
+	ranged, whole := downloads[0], downloads[1]
+	if whole.BytesSent != 1000 || whole.Range != "" || whole.UserAgent != "curl/8.0" || whole.Referrer != "https://example.com/" {
+		t.Errorf("the whole download was logged as %+v", whole)
+	}
+	if ranged.BytesSent != 100 || ranged.Range != "bytes=100-199" {
+		t.Errorf("the ranged download was logged as %+v", ranged)
+	}
+	if whole.ClientId == "" || whole.ClientId != ranged.ClientId {
+		t.Errorf("one client was logged as %q and %q", whole.ClientId, ranged.ClientId)
+	}
+
+	files := []models.UploadedFile{file}
+	if err := summarizeDownloads(db, files); err != nil {
+		t.Fatalf("summarizeDownloads: %v", err)
+	}
+	if summary := files[0].Downloads; summary.Requests != 2 || summary.BytesSent != 1100 || summary.LastDownloadedAt == nil {
+		t.Errorf("summarized the log as %+v", summary)
+	}
+}
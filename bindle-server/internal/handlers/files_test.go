@@ -0,0 +1,908 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+const testChunkSize = 1024 * 1024
+
+func newTestStorage(t *testing.T) *storage.FilesystemStorage {
+	t.Helper()
+	st, err := storage.NewFilesystemStorage(config.Config{
+		FilesystemPath: t.TempDir(),
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x3c}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	return st
+}
+
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*13 + i/251)
+	}
+	return data
+}
+
+// storeTestFile writes plain through the chunked upload path and records it the way
+// CompleteChunkedUpload does, so downloads are tested against a real stored object.
+func storeTestFile(t *testing.T, db *gorm.DB, st storage.Storage, plain []byte) models.UploadedFile {
+	t.Helper()
+
+	sessionID := uuid.New().String()
+	_, filePath := sessionFilePath(sessionID, "test.bin")
+	totalChunks := (len(plain) + testChunkSize - 1) / testChunkSize
+
+	if _, err := st.InitChunkedUpload(sessionID, filePath, totalChunks, testChunkSize, storage.ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	for i := 0; i < totalChunks; i++ {
+		start := i * testChunkSize
+		end := min(start+testChunkSize, len(plain))
+		if err := st.SaveChunk(sessionID, i, bytes.NewReader(plain[start:end]), int64(end-start)); err != nil {
+			t.Fatalf("SaveChunk(%d): %v", i, err)
+		}
+	}
+	hash, err := st.FinalizeChunkedUpload(sessionID)
+	if err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	file := models.UploadedFile{
+		FileId:            uuid.New().String(),
+		FilePath:          filePath,
+		FileName:          "test.bin",
+		Size:              int64(len(plain)),
+		MimeType:          "application/octet-stream",
+		ChunkCount:        totalChunks,
+		EncryptionVersion: utils.EncryptionVersionStream,
+		ContentHash:       hash,
+	}
+	if err := createFileRecord(db, &file); err != nil {
+		t.Fatalf("failed to record file: %v", err)
+	}
+	return file
+}
+
+// setTestEnv provides what config.GetConfig insists on, for tests whose handlers
+// serialize a file - its JSON carries a URL built from FILE_HOST.
+func setTestEnv(t *testing.T) {
+	t.Setenv("REQUEST_SIZE_LIMIT_MB", "100")
+	t.Setenv("ACCOUNT_EXPIRATION_DAYS", "30")
+	t.Setenv("ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x3c}, 32)))
+	t.Setenv("FILE_HOST", "/files/")
+}
+
+// shareURL is where file is downloaded from.
+func shareURL(file models.UploadedFile) string {
+	return file.URL("/files/")
+}
+
+func downloadTestApp(db *gorm.DB, st storage.Storage) *fiber.App {
+	cfg := &config.Config{
+		EncryptionKey: bytes.Repeat([]byte{0x3c}, 32),
+		MACKey:        bytes.Repeat([]byte{0x5a}, 32),
+	}
+	app := fiber.New()
+	app.Get("/files/:filePath", func(c *fiber.Ctx) error {
+		return GetFile(c, db, cfg, st, c.Params("filePath"))
+	})
+	app.Post("/files/:filePath", func(c *fiber.Ctx) error {
+		return UnlockFile(c, db, cfg, c.Params("filePath"))
+	})
+	return app
+}
+
+func download(t *testing.T, app *fiber.App, path string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading the response failed: %v", err)
+	}
+	return res, body
+}
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-99", []byteRange{{0, 99}}, nil},
+		{"bytes=900-", []byteRange{{900, 999}}, nil},
+		{"bytes=-100", []byteRange{{900, 999}}, nil},
+		{"bytes=-5000", []byteRange{{0, 999}}, nil},
+		{"bytes=990-5000", []byteRange{{990, 999}}, nil},
+		// Clients put a space after the comma; fiber's parser reads that as a suffix.
+		{"bytes=0-9, 20-29", []byteRange{{0, 9}, {20, 29}}, nil},
+		// A range past the end is dropped; if that leaves nothing it is a 416.
+		{"bytes=0-9,5000-6000", []byteRange{{0, 9}}, nil},
+		{"bytes=1000-", nil, errRangeUnsatisfiable},
+		{"bytes=-0", nil, errRangeUnsatisfiable},
+		// Anything unparseable is ignored, which means the whole file is sent.
+		{"bytes=9-0", nil, nil},
+		{"bytes=abc", nil, nil},
+		{"bytes=+5-9", nil, nil},
+		{"items=0-9", nil, nil},
+		{"0-9", nil, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, size)
+		if err != tt.err {
+			t.Errorf("parseRange(%q) error = %v, want %v", tt.header, err, tt.err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGetFileServesASingleRange(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(testChunkSize + 5000)
+	file := storeTestFile(t, db, st, plain)
+	app := downloadTestApp(db, st)
+
+	res, body := download(t, app, shareURL(file), map[string]string{"Range": "bytes=1048000-1049000"})
+	if res.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+	if want := fmt.Sprintf("bytes 1048000-1049000/%d", len(plain)); res.Header.Get("Content-Range") != want {
+		t.Errorf("Content-Range is %q, want %q", res.Header.Get("Content-Range"), want)
+	}
+	if !bytes.Equal(body, plain[1048000:1049001]) {
+		t.Error("the range served differs from the stored bytes")
+	}
+
+	res, body = download(t, app, shareURL(file), map[string]string{"Range": "bytes=-10"})
+	if res.StatusCode != fiber.StatusPartialContent || !bytes.Equal(body, plain[len(plain)-10:]) {
+		t.Errorf("a suffix range was not served as the final bytes (status %d)", res.StatusCode)
+	}
+}
+
+func TestGetFileServesSeveralRangesAsMultipart(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(300000)
+	file := storeTestFile(t, db, st, plain)
+	app := downloadTestApp(db, st)
+
+	res, body := download(t, app, shareURL(file), map[string]string{"Range": "bytes=0-9, 262140-262150"})
+	if res.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected a multipart/byteranges body, got %q", res.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	want := []struct {
+		contentRange string
+		data         []byte
+	}{
+		{fmt.Sprintf("bytes 0-9/%d", len(plain)), plain[0:10]},
+		{fmt.Sprintf("bytes 262140-262150/%d", len(plain)), plain[262140:262151]},
+	}
+	for i, w := range want {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got := part.Header.Get("Content-Range"); got != w.contentRange {
+			t.Errorf("part %d has Content-Range %q, want %q", i, got, w.contentRange)
+		}
+		data, _ := io.ReadAll(part)
+		if !bytes.Equal(data, w.data) {
+			t.Errorf("part %d carries different bytes than were stored", i)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected exactly two parts, the third read gave %v", err)
+	}
+}
+
+func TestGetFileRejectsAnUnsatisfiableRange(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	file := storeTestFile(t, db, st, testContent(1000))
+	app := downloadTestApp(db, st)
+
+	res, _ := download(t, app, shareURL(file), map[string]string{"Range": "bytes=5000-"})
+	if res.StatusCode != fiber.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Range"); got != "bytes */1000" {
+		t.Errorf("Content-Range is %q, want the file size as bytes */1000", got)
+	}
+}
+
+func TestGetFileHonoursValidators(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(5000)
+	file := storeTestFile(t, db, st, plain)
+	app := downloadTestApp(db, st)
+
+	res, _ := download(t, app, shareURL(file), nil)
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expected ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+
+	res, body := download(t, app, shareURL(file), map[string]string{"If-None-Match": etag})
+	if res.StatusCode != fiber.StatusNotModified || len(body) != 0 {
+		t.Errorf("a matching If-None-Match gave %d with %d bytes, want an empty 304", res.StatusCode, len(body))
+	}
+
+	res, _ = download(t, app, shareURL(file), map[string]string{"If-Modified-Since": lastModified})
+	if res.StatusCode != fiber.StatusNotModified {
+		t.Errorf("If-Modified-Since at Last-Modified gave %d, want 304", res.StatusCode)
+	}
+
+	// A resume against the file it started with gets the range...
+	res, body = download(t, app, shareURL(file), map[string]string{"Range": "bytes=4000-", "If-Range": etag})
+	if res.StatusCode != fiber.StatusPartialContent || !bytes.Equal(body, plain[4000:]) {
+		t.Errorf("a matching If-Range gave %d, want the 206 range", res.StatusCode)
+	}
+
+	// ...and a resume against anything else gets the whole file, never a spliced one.
+	res, body = download(t, app, shareURL(file), map[string]string{"Range": "bytes=4000-", "If-Range": `"stale"`})
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("a stale If-Range gave %d, want the whole file with 200", res.StatusCode)
+	}
+}
+
+// A download carries the file's SHA-256: as its ETag, and as Repr-Digest on any
+// response. Content-Digest, which covers the body, only goes out when the body is the
+// whole file.
+func TestGetFileCarriesItsDigest(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(testChunkSize + 5000)
+	file := storeTestFile(t, db, st, plain)
+	app := downloadTestApp(db, st)
+
+	sum := sha256.Sum256(plain)
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	res, _ := download(t, app, shareURL(file), nil)
+	if got := res.Header.Get("ETag"); got != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("ETag is %s, want the file's SHA-256", got)
+	}
+	if res.Header.Get("Repr-Digest") != digest || res.Header.Get("Content-Digest") != digest {
+		t.Errorf("the whole file came with Repr-Digest %q and Content-Digest %q, want %q",
+			res.Header.Get("Repr-Digest"), res.Header.Get("Content-Digest"), digest)
+	}
+
+	res, _ = download(t, app, shareURL(file), map[string]string{"Range": "bytes=10-20"})
+	if res.Header.Get("Repr-Digest") != digest || res.Header.Get("Content-Digest") != "" {
+		t.Errorf("a range came with Repr-Digest %q and Content-Digest %q, want only the first",
+			res.Header.Get("Repr-Digest"), res.Header.Get("Content-Digest"))
+	}
+}
+
+// A burn-after-read file serves exactly its allowance of downloads and then answers 410.
+// The requests one client makes in quick succession, ranged or not, are one download.
+func TestGetFileStopsAtMaxDownloads(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(5000)
+	file := storeTestFile(t, db, st, plain)
+	db.Model(&file).Update("max_downloads", 2)
+	app := downloadTestApp(db, st)
+
+	res, body := download(t, app, shareURL(file), nil)
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Fatalf("the first download gave %d", res.StatusCode)
+	}
+	res, _ = download(t, app, shareURL(file), map[string]string{"Range": "bytes=100-"})
+	if res.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("a resumed range gave %d, want 206", res.StatusCode)
+	}
+
+	ageDownloads(t, db)
+	res, _ = download(t, app, shareURL(file), nil)
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("the second download gave %d", res.StatusCode)
+	}
+
+	ageDownloads(t, db)
+	res, _ = download(t, app, shareURL(file), nil)
+	if res.StatusCode != fiber.StatusGone {
+		t.Errorf("a download past maxDownloads gave %d, want 410", res.StatusCode)
+	}
+
+	var stored models.UploadedFile
+	db.First(&stored, file.ID)
+	if stored.DownloadCount != 2 {
+		t.Errorf("download count is %d, want 2", stored.DownloadCount)
+	}
+}
+
+// A client that has spent a one-time file's download can go on seeking through it for a
+// while, but once that is over no range gets anything more out of it, including ones
+// that leave out the first byte.
+func TestGetFileCountsOneDownloadPerClient(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(5000)
+	file := storeTestFile(t, db, st, plain)
+	db.Model(&file).Update("max_downloads", 1)
+	app := downloadTestApp(db, st)
+
+	res, body := download(t, app, shareURL(file), map[string]string{"Range": "bytes=1-,0-0"})
+	if res.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("the ranges gave %d, want 206", res.StatusCode)
+	}
+	if !bytes.Contains(body, plain[1:]) {
+		t.Fatal("the multipart body does not hold the ranges asked for")
+	}
+
+	headers := []string{"bytes=1-,0-0", "bytes=1-", ""}
+	get := func(header string) *http.Response {
+		t.Helper()
+		h := map[string]string{}
+		if header != "" {
+			h["Range"] = header
+		}
+		res, _ := download(t, app, shareURL(file), h)
+		return res
+	}
+
+	for _, header := range headers {
+		if res := get(header); res.StatusCode == fiber.StatusGone {
+			t.Errorf("Range %q right after the download gave 410, want it served", header)
+		}
+	}
+	var stored models.UploadedFile
+	db.First(&stored, file.ID)
+	if stored.DownloadCount != 1 {
+		t.Errorf("download count is %d after one client's requests, want 1", stored.DownloadCount)
+	}
+
+	ageDownloads(t, db)
+	for _, header := range headers {
+		if res := get(header); res.StatusCode != fiber.StatusGone {
+			t.Errorf("Range %q after the download was over gave %d, want 410", header, res.StatusCode)
+		}
+	}
+}
+
+// ageDownloads moves the download log back past sameDownloadWindow, so the next request
+// is a new download rather than the last one going on.
+func ageDownloads(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	err := db.Model(&models.Download{}).Where("1 = 1").
+		Update("created_at", time.Now().Add(-2*sameDownloadWindow)).Error
+	if err != nil {
+		t.Fatalf("ageing the download log: %v", err)
+	}
+}
+
+func TestGetFileIsGoneAfterExpiry(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	file := storeTestFile(t, db, st, testContent(1000))
+	app := downloadTestApp(db, st)
+
+	db.Model(&file).Update("expires_at", time.Now().Add(-time.Second))
+	res, _ := download(t, app, shareURL(file), nil)
+	if res.StatusCode != fiber.StatusGone {
+		t.Errorf("an expired file gave %d, want 410", res.StatusCode)
+	}
+
+	// Once the sweep has deleted the record the link is not found, like any other
+	// deleted file's, and does not fall through to the lookup for files stored before
+	// uploads were recorded either.
+	db.Delete(&file)
+	res, _ = download(t, app, shareURL(file), nil)
+	if res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("a swept file gave %d, want 404", res.StatusCode)
+	}
+}
+
+func TestGetFileChallengesForAPassword(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(2000)
+	file := storeTestFile(t, db, st, plain)
+	hash, err := filepassword.Hash("hunter2")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	db.Model(&file).Update("password_hash", hash)
+	app := downloadTestApp(db, st)
+	url := shareURL(file)
+
+	res, body := download(t, app, url, nil)
+	if res.StatusCode != fiber.StatusUnauthorized || !strings.Contains(res.Header.Get("Content-Type"), "json") {
+		t.Errorf("an API client without the password got %d %s, want a JSON 401", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if bytes.Contains(body, plain[:100]) {
+		t.Error("the challenge leaked the file")
+	}
+
+	res, body = download(t, app, url, map[string]string{"Accept": "text/html,application/xhtml+xml"})
+	if res.StatusCode != fiber.StatusUnauthorized || !bytes.Contains(body, []byte(`<form method="post">`)) {
+		t.Errorf("a browser without the password got %d, want the password form", res.StatusCode)
+	}
+
+	res, _ = download(t, app, url, map[string]string{filepassword.HeaderName: "wrong"})
+	if res.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("a wrong password in the header gave %d, want 401", res.StatusCode)
+	}
+
+	res, body = download(t, app, url, map[string]string{filepassword.HeaderName: "hunter2"})
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("the right password in the header gave %d, want the file", res.StatusCode)
+	}
+}
+
+// The form earns a cookie scoped to the file, and the cookie alone then opens it.
+func TestPasswordFormGrantsACookie(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(2000)
+	file := storeTestFile(t, db, st, plain)
+	hash, _ := filepassword.Hash("hunter2")
+	db.Model(&file).Update("password_hash", hash)
+	app := downloadTestApp(db, st)
+	url := shareURL(file)
+
+	post := func(password string) *http.Response {
+		req := httptest.NewRequest("POST", url, strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("posting the form failed: %v", err)
+		}
+		return res
+	}
+
+	if res := post("wrong"); res.StatusCode != fiber.StatusUnauthorized || len(res.Cookies()) != 0 {
+		t.Errorf("a wrong password gave %d with %d cookies, want 401 and none", res.StatusCode, len(res.Cookies()))
+	}
+
+	res := post("hunter2")
+	if res.StatusCode != fiber.StatusSeeOther {
+		t.Fatalf("the right password gave %d, want a 303 back to the file", res.StatusCode)
+	}
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Path != url {
+		t.Fatalf("expected one cookie scoped to %s, got %+v", url, cookies)
+	}
+
+	res, body := download(t, app, url, map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value})
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("the cookie gave %d, want the file", res.StatusCode)
+	}
+}
+
+// The storage path of a recorded file is a content hash for single uploads, so it must
+// not answer: that would confirm to anyone holding the same bytes that they are hosted.
+func TestGetFileDoesNotServeTheStoragePath(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	file := storeTestFile(t, db, st, testContent(1000))
+	app := downloadTestApp(db, st)
+
+	res, _ := download(t, app, "/files/"+file.FilePath, nil)
+	if res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("the storage path gave %d, want 404", res.StatusCode)
+	}
+}
+
+// Objects stored before shares came in are still served by their storage path, as
+// their links were. Nothing stored since is, recorded or not: a temp object, or one
+// deduplication dropped, was never meant to be reachable.
+func TestGetFileServesOnlyObjectsThatPredateShares(t *testing.T) {
+	db := newTestDB(t)
+	cfg := config.Config{
+		FilesystemPath: t.TempDir(),
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x3c}, 32),
+	}
+	st, err := storage.NewFilesystemStorage(cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	app := downloadTestApp(db, st)
+
+	sharesCameIn := time.Now().Add(-time.Hour)
+	db.Create(&models.Migration{Name: models.SharesMigration, RanAt: sharesCameIn})
+
+	plain := testContent(1000)
+	sealed, err := utils.EncryptFile(&cfg, plain)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	for _, name := range []string{"old.bin", "new.bin"} {
+		if err := os.WriteFile(filepath.Join(cfg.FilesystemPath, name), sealed, 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	before := sharesCameIn.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(cfg.FilesystemPath, "old.bin"), before, before); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	tempPath, _, err := st.SaveFile(bytes.NewReader(plain), int64(len(plain)), storage.ObjectKey{})
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	res, body := download(t, app, "/files/old.bin", nil)
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("an object from before shares gave %d, want it served", res.StatusCode)
+	}
+	for _, path := range []string{"new.bin", tempPath} {
+		if res, _ := download(t, app, "/files/"+path, nil); res.StatusCode != fiber.StatusNotFound {
+			t.Errorf("%s, stored since shares came in, gave %d, want 404", path, res.StatusCode)
+		}
+	}
+}
+
+// Two records of the same bytes share the stored object but not a URL: rotating or
+// deleting one must leave the other's link working.
+func TestShareURLsAreRevokedPerRecord(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(1000)
+	first := storeTestFile(t, db, st, plain)
+
+	second := first
+	second.ID, second.FileId, second.Shares = 0, uuid.New().String(), nil
+	second.CreatedAt, second.UpdatedAt = time.Time{}, time.Time{}
+	if err := createFileRecord(db, &second); err != nil {
+		t.Fatalf("createFileRecord: %v", err)
+	}
+	if shareURL(first) == shareURL(second) {
+		t.Fatal("two records of the same bytes were given the same URL")
+	}
+
+	app := downloadTestApp(db, st)
+	app.Post("/rotate/:fileId", func(c *fiber.Ctx) error {
+		c.Locals("user", models.User{})
+		return RotateFileURL(c, db, c.Params("fileId"))
+	})
+
+	res, err := app.Test(httptest.NewRequest("POST", "/rotate/"+first.FileId, nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("rotating failed: %v, status %v", err, res.StatusCode)
+	}
+	var rotated models.UploadedFile
+	db.Preload("Shares").First(&rotated, first.ID)
+
+	if res, _ := download(t, app, shareURL(first), nil); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("a rotated-away URL gave %d, want 404", res.StatusCode)
+	}
+	if res, body := download(t, app, shareURL(rotated), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("the new URL gave %d, want the file", res.StatusCode)
+	}
+	if res, body := download(t, app, shareURL(second), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("the other record's URL gave %d after the rotation, want the file", res.StatusCode)
+	}
+}
+
+// uploadTestFile sends plain as a single-request upload, the way the client does for
+// small files.
+func uploadTestFile(t *testing.T, db *gorm.DB, app *fiber.App, name string, plain []byte) models.UploadedFile {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename="%s"`, name)},
+		"Content-Type":        {"application/octet-stream"},
+	})
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	part.Write(plain)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/file", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	res, err := app.Test(req, -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("upload failed: %v, status %v", err, res.StatusCode)
+	}
+
+	var dto models.UploadedFileDTO
+	if err := json.NewDecoder(res.Body).Decode(&dto); err != nil {
+		t.Fatalf("decoding the upload: %v", err)
+	}
+	var file models.UploadedFile
+	if err := db.Preload("Shares").Where("file_id = ?", dto.FileId).First(&file).Error; err != nil {
+		t.Fatalf("the upload was not recorded: %v", err)
+	}
+	return file
+}
+
+// A single upload is hashed while it is encrypted into a temp object, which then either
+// becomes the content-addressed object or, for contents already stored, goes away.
+func TestUploadFileStoresByContentInOnePass(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	dir := t.TempDir()
+	st, err := storage.NewFilesystemStorage(config.Config{
+		FilesystemPath: dir,
+		EncryptionKey:  bytes.Repeat([]byte{0x3c}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := downloadTestApp(db, st)
+	app.Post("/api/file", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return UploadFile(c, db, &config.Config{UploadLimitMBPerDay: 100, EncryptionKey: bytes.Repeat([]byte{0x3c}, 32)}, st)
+	})
+
+	plain := testContent(3*utils.FrameSize + 17)
+	first := uploadTestFile(t, db, app, "first.bin", plain)
+	second := uploadTestFile(t, db, app, "second.bin", plain)
+
+	sum := sha256.Sum256(plain)
+	if want := hex.EncodeToString(sum[:]) + ".bin"; first.FilePath != want || second.FilePath != want {
+		t.Errorf("stored at %q and %q, want both at %q", first.FilePath, second.FilePath, want)
+	}
+	if first.EncryptionVersion != utils.EncryptionVersionSubkey {
+		t.Errorf("recorded encryption version %d, want %d", first.EncryptionVersion, utils.EncryptionVersionSubkey)
+	}
+	if len(first.WrappedKey) == 0 || !bytes.Equal(first.WrappedKey, second.WrappedKey) {
+		t.Error("the records do not share the stored object's data key")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("storage holds %v, want just the one object", names)
+	}
+
+	for _, file := range []models.UploadedFile{first, second} {
+		if res, body := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+			t.Errorf("downloading %s gave %d, want the file", file.FileName, res.StatusCode)
+		}
+	}
+}
+
+// A chunked upload can only be hashed once all of it has arrived, by which time it is
+// stored under its session's path. When those contents are already stored, completing
+// it points the record at that object and drops the new one.
+func TestChunkedUploadCollapsesOntoStoredContent(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	dir := t.TempDir()
+	st, err := storage.NewFilesystemStorage(config.Config{
+		FilesystemPath: dir,
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x3c}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := downloadTestApp(db, st)
+	app.Use("/api", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	app.Post("/api/file", func(c *fiber.Ctx) error {
+		return UploadFile(c, db, &config.Config{UploadLimitMBPerDay: 100, EncryptionKey: bytes.Repeat([]byte{0x3c}, 32)}, st)
+	})
+	app.Post("/api/file/chunk/:sessionId/complete", func(c *fiber.Ctx) error {
+		return CompleteChunkedUpload(c, db, st)
+	})
+
+	plain := testContent(testChunkSize + testChunkSize/2)
+	single := uploadTestFile(t, db, app, "single.bin", plain)
+
+	sessionID := uuid.New().String()
+	_, filePath := sessionFilePath(sessionID, "chunked.bin")
+	if _, err := st.InitChunkedUpload(sessionID, filePath, 2, testChunkSize, storage.ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	// Last chunk first, so the hash cannot be built as the chunks arrive and has to be
+	// read back from the finished object.
+	for _, i := range []int{1, 0} {
+		start, end := i*testChunkSize, min((i+1)*testChunkSize, len(plain))
+		if err := st.SaveChunk(sessionID, i, bytes.NewReader(plain[start:end]), int64(end-start)); err != nil {
+			t.Fatalf("SaveChunk(%d): %v", i, err)
+		}
+	}
+	db.Create(&models.UploadSession{
+		SessionID:   sessionID,
+		AccountID:   owner.ID,
+		FileName:    "chunked.bin",
+		FileSize:    int64(len(plain)),
+		MimeType:    "application/octet-stream",
+		ChunkSize:   testChunkSize,
+		TotalChunks: 2,
+		FilePath:    filePath,
+		Status:      models.UploadSessionStatusActive,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	res, err := app.Test(httptest.NewRequest("POST", "/api/file/chunk/"+sessionID+"/complete", nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("completing the upload failed: %v, status %v", err, res.StatusCode)
+	}
+	var dto models.UploadedFileDTO
+	if err := json.NewDecoder(res.Body).Decode(&dto); err != nil {
+		t.Fatalf("decoding the upload: %v", err)
+	}
+	var chunked models.UploadedFile
+	db.Preload("Shares").Where("file_id = ?", dto.FileId).First(&chunked)
+
+	if chunked.FilePath != single.FilePath || chunked.ContentHash != single.ContentHash {
+		t.Errorf("the chunked upload is stored at %q with hash %q, want %q with %q",
+			chunked.FilePath, chunked.ContentHash, single.FilePath, single.ContentHash)
+	}
+	if chunked.ChunkCount != 0 {
+		t.Errorf("the record reads its object as %d chunks, but it was stored whole", chunked.ChunkCount)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("storage holds %d objects, want just the one", len(entries))
+	}
+	if res, body := download(t, app, shareURL(chunked), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("downloading the chunked upload gave %d, want the file", res.StatusCode)
+	}
+}
+
+// A client-encrypted upload is ciphertext the server cannot open: it is stored and
+// served byte for byte, a browser gets the page that decrypts it instead, and it never
+// collapses onto a server-encrypted object holding the same bytes.
+func TestClientEncryptedUploadIsStoredAndServedVerbatim(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		FilesystemPath:      dir,
+		ChunkSizeMB:         testChunkSize / 1024 / 1024,
+		MaxFileSizeMB:       100,
+		UploadLimitMBPerDay: 100,
+		EncryptionKey:       bytes.Repeat([]byte{0x3c}, 32),
+	}
+	st, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := downloadTestApp(db, st)
+	app.Use("/api", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	app.Post("/api/file", func(c *fiber.Ctx) error {
+		return UploadFile(c, db, cfg, st)
+	})
+	app.Post("/api/file/chunk/init", func(c *fiber.Ctx) error {
+		return InitChunkedUpload(c, db, cfg, st)
+	})
+	app.Post("/api/file/chunk/:sessionId/complete", func(c *fiber.Ctx) error {
+		return CompleteChunkedUpload(c, db, st)
+	})
+	app.Post("/api/file/chunk/:sessionId/:chunkNumber", func(c *fiber.Ctx) error {
+		return UploadChunk(c, db, st)
+	})
+
+	sealed := testContent(testChunkSize + 4321)
+	initReq := httptest.NewRequest("POST", "/api/file/chunk/init", strings.NewReader(fmt.Sprintf(
+		`{"fileName":"photo.png","fileSize":%d,"mimeType":"image/png","clientEncrypted":true}`, len(sealed))))
+	initReq.Header.Set("Content-Type", "application/json")
+	res, err := app.Test(initReq, -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("init failed: %v, status %v", err, res.StatusCode)
+	}
+	var session InitChunkedUploadResponse
+	json.NewDecoder(res.Body).Decode(&session)
+	for i := 0; i < session.TotalChunks; i++ {
+		chunk := sealed[i*testChunkSize : min((i+1)*testChunkSize, len(sealed))]
+		if status := postChunk(t, app, fmt.Sprintf("/api/file/chunk/%s/%d", session.SessionID, i), chunk, chunk); status != fiber.StatusOK {
+			t.Fatalf("chunk %d gave %d", i, status)
+		}
+	}
+	res, err = app.Test(httptest.NewRequest("POST", "/api/file/chunk/"+session.SessionID+"/complete", nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("completing the upload failed: %v, status %v", err, res.StatusCode)
+	}
+	var dto models.UploadedFileDTO
+	json.NewDecoder(res.Body).Decode(&dto)
+	if !dto.ClientEncrypted || dto.Size != int64(len(sealed)) {
+		t.Errorf("the upload reads as clientEncrypted %v with %d bytes, want true with %d", dto.ClientEncrypted, dto.Size, len(sealed))
+	}
+	var file models.UploadedFile
+	db.Preload("Shares").Where("file_id = ?", dto.FileId).First(&file)
+	if file.EncryptionVersion != utils.EncryptionVersionClient || len(file.WrappedKey) != 0 {
+		t.Errorf("the record is at version %d with a %d byte key, want %d and none",
+			file.EncryptionVersion, len(file.WrappedKey), utils.EncryptionVersionClient)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(dir, file.FilePath)); !bytes.Equal(stored, sealed) {
+		t.Error("the stored object is not the ciphertext as it was sent")
+	}
+
+	res, body := download(t, app, shareURL(file), map[string]string{"Range": "bytes=100-199"})
+	if res.StatusCode != fiber.StatusPartialContent || !bytes.Equal(body, sealed[100:200]) {
+		t.Errorf("a ranged download gave %d, want the ciphertext's bytes", res.StatusCode)
+	}
+	res, body = download(t, app, shareURL(file), map[string]string{"Accept": "application/octet-stream"})
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, sealed) {
+		t.Errorf("a download gave %d, want the ciphertext", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Type"); got != fiber.MIMEOctetStream {
+		t.Errorf("the ciphertext went out as %q", got)
+	}
+
+	res, body = download(t, app, shareURL(file), map[string]string{"Accept": "text/html"})
+	if res.StatusCode != fiber.StatusOK || !strings.Contains(string(body), `data-type="image/png"`) {
+		t.Fatalf("a browser got %d, want the viewer page", res.StatusCode)
+	}
+	script := string(body)
+	script = script[strings.Index(script, "<script>")+len("<script>"):]
+	script = script[:strings.Index(script, "</script>")]
+	sum := sha256.Sum256([]byte(script))
+	if policy := res.Header.Get("Content-Security-Policy"); !strings.Contains(policy, "'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'") {
+		t.Errorf("the page's policy %q does not allow the script it carries", policy)
+	}
+
+	plain := uploadTestFile(t, db, app, "photo.png", sealed)
+	if plain.FilePath == file.FilePath || plain.ClientEncrypted {
+		t.Errorf("a server-encrypted upload of the same bytes collapsed onto the client-encrypted one")
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"gorm.io/gorm"
+)
+
+// errFileGone reports a file that existed but has expired or used up its downloads,
+// which is answered with 410 rather than 404 so the person holding the link learns it
+// was taken down on purpose.
+var errFileGone = errors.New("file has expired")
+
+// errDownloadsUsedUp is the errFileGone of a file or share that has served all its
+// downloads. A client still in the middle of one of them is let through; see
+// continuesDownload.
+var errDownloadsUsedUp = fmt.Errorf("%w: its downloads are used up", errFileGone)
+
+// fileLimits are the optional restrictions an upload or a share link can ask for: when
+// it expires, how often it may be downloaded, and the password downloading it needs.
+type fileLimits struct {
+	ExpiresAt    *time.Time
+	MaxDownloads int
+	PasswordHash string
+}
+
+// setPassword protects the file with password; an empty one leaves it unprotected.
+func (l *fileLimits) setPassword(password string) error {
+	if password == "" {
+		return nil
+	}
+	hash, err := filepassword.Hash(password)
+	if err != nil {
+		return err
+	}
+	l.PasswordHash = hash
+	return nil
+}
+
+// validate rejects limits that would leave the file unavailable from the start.
+func (l fileLimits) validate(now time.Time) error {
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(now) {
+		return errors.New("expiresAt must be in the future")
+	}
+	if l.MaxDownloads < 0 {
+		return errors.New("maxDownloads must not be negative")
+	}
+	return nil
+}
+
+func (l fileLimits) apply(file *models.UploadedFile) {
+	file.ExpiresAt = l.ExpiresAt
+	file.MaxDownloads = l.MaxDownloads
+	file.PasswordHash = l.PasswordHash
+}
+
+func (l fileLimits) applyToShare(share *models.Share) {
+	share.ExpiresAt = l.ExpiresAt
+	share.MaxDownloads = l.MaxDownloads
+	share.PasswordHash = l.PasswordHash
+}
+
+// formFileLimits reads the limits from the form fields of a multipart upload. All are
+// optional; expiresAt is an RFC 3339 timestamp.
+func formFileLimits(c *fiber.Ctx) (fileLimits, error) {
+	return parseFileLimits(c.FormValue("expiresAt"), c.FormValue("maxDownloads"), c.FormValue("password"))
+}
+
+// parseFileLimits builds limits from their text form, where an empty value leaves that
+// limit unset.
+func parseFileLimits(expiresAtValue, maxDownloadsValue, password string) (fileLimits, error) {
+	var limits fileLimits
+
+	if expiresAtValue != "" {
+		expiresAt, err := time.Parse(time.RFC3339, expiresAtValue)
+		if err != nil {
+			return limits, errors.New("expiresAt must be an RFC 3339 timestamp")
+		}
+		limits.ExpiresAt = &expiresAt
+	}
+
+	if maxDownloadsValue != "" {
+		maxDownloads, err := strconv.Atoi(maxDownloadsValue)
+		if err != nil {
+			return limits, errors.New("maxDownloads must be a whole number")
+		}
+		limits.MaxDownloads = maxDownloads
+	}
+
+	if err := limits.validate(time.Now()); err != nil {
+		return limits, err
+	}
+	return limits, limits.setPassword(password)
+}
+
+// countDownload records one download through share of file, against both their
+// counts. Each limit is checked in the statement that moves its count, so concurrent
+// downloads with one left cannot both get it; the loser sees errFileGone, and the
+// transaction takes back the count it did move.
+func countDownload(db *gorm.DB, share *models.Share, file *models.UploadedFile) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, update := range []*gorm.DB{
+			tx.Model(&models.UploadedFile{}).
+				Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", file.ID).
+				UpdateColumn("download_count", gorm.Expr("download_count + 1")),
+			tx.Model(&models.Share{}).
+				Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", share.ID).
+				UpdateColumn("download_count", gorm.Expr("download_count + 1")),
+		} {
+			if update.Error != nil {
+				return update.Error
+			}
+			if update.RowsAffected == 0 {
+				return errFileGone
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"gorm.io/gorm"
+)
+
+// passwordPage is the challenge a browser gets for a protected file. It posts back to
+// the file's own URL, so the cookie it earns is scoped to exactly that URL. There is no
+// script on it: downloads are served with script-src 'none'.
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.FileName}} - password required</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form { display: flex; flex-direction: column; gap: 0.75rem; width: 20rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post">
+<h1>Password required</h1>
+<p><strong>{{.FileName}}</strong> is protected. Enter its password to open it.</p>
+{{if .Wrong}}<p class="error">That password is not correct.</p>{{end}}
+<input type="password" name="password" autofocus required autocomplete="current-password">
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+// wantsHTML reports whether the request comes from a browser navigating to the file.
+// Fiber's Accepts is not used: curl and most libraries send */*, which it would match
+// against text/html, and they should get JSON rather than a form they cannot fill in.
+func wantsHTML(c *fiber.Ctx) bool {
+	return strings.Contains(c.Get(fiber.HeaderAccept), "text/html")
+}
+
+// challengePassword answers a request for a protected file that has not shown the
+// password: a form for a browser, a 401 with JSON for anything else, which is told the
+// header to send it in.
+func challengePassword(c *fiber.Ctx, fileName string, wrong bool) error {
+	c.Status(fiber.StatusUnauthorized)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if !wantsHTML(c) {
+		message := "Password required"
+		if wrong {
+			message = "Incorrect password"
+		}
+		return c.JSON(fiber.Map{"error": message, "passwordHeader": filepassword.HeaderName})
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return passwordPage.Execute(c.Response().BodyWriter(), struct {
+		FileName string
+		Wrong    bool
+	}{fileName, wrong})
+}
+
+// sharePasswordHash is the password a download through share has to show: the
+// share's own, or the file's when the share has none.
+func sharePasswordHash(share *models.Share, file *models.UploadedFile) string {
+	if share.PasswordHash != "" {
+		return share.PasswordHash
+	}
+	return file.PasswordHash
+}
+
+// UnlockFile takes the password form posted from the challenge page. The right password
+// earns a cookie for the file, and the browser is sent back to download it.
+func UnlockFile(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, sharePath string) error {
+	share, file, err := findShare(db, sharePath, time.Now())
+	if errors.Is(err, errFileGone) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "File has expired"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	if passwordHash := sharePasswordHash(&share, &file); passwordHash != "" {
+		if !filepassword.Matches(passwordHash, c.FormValue("password")) {
+			return challengePassword(c, file.FileName, true)
+		}
+		filepassword.SetCookie(c, cfg, c.Path(), share.Slug, passwordHash)
+	}
+
+	// 303 so the browser follows with a GET rather than posting the form again.
+	return c.Redirect(c.Path(), fiber.StatusSeeOther)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"bufio"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"github.com/nuuner/bindle-server/pkg/limiter"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// headerAccountID tells a PUT sent without an account which account it created, so the
+// file can be managed later.
+const headerAccountID = "Bindle-Account-Id"
+
+// PutFile stores the request body as a file called name, for uploads from a terminal:
+//
+//	curl -T notes.txt https://files.example.com/
+//
+// curl sends the file to /notes.txt, and the body streams through encryption into
+// storage the way a chunk does, so nothing of it is held in memory. The answer is the
+// file's URL as plain text. The limits can be set with the expiresAt and maxDownloads
+// query parameters and the password with X-File-Password.
+func PutFile(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage, name string) error {
+	fileName, err := url.PathUnescape(name)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid file name"})
+	}
+	if fileName = filepath.Base(fileName); fileName == "." || fileName == "/" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid file name"})
+	}
+
+	// The stored object's size is fixed before its first byte is written, so a body of
+	// unknown length, such as curl's upload from stdin, cannot be taken.
+	size := int64(c.Request().Header.ContentLength())
+	if size < 0 {
+		return c.Status(fiber.StatusLengthRequired).JSON(fiber.Map{"error": "Content-Length is required"})
+	}
+	if size == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No file uploaded"})
+	}
+	if size > cfg.MaxFileSizeMB*1000*1000 {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "File exceeds maximum allowed size"})
+	}
+
+	limits, err := parseFileLimits(c.Query("expiresAt"), c.Query("maxDownloads"), c.Get(filepassword.HeaderName))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if limiter.ShouldThrottle(c, db, cfg, size) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Upload limit exceeded"})
+	}
+
+	body := bufio.NewReader(requestBodyReader(c, size))
+	mimeType := putMimeType(c.Get(fiber.HeaderContentType), fileName, body)
+
+	file, failure := storeFile(db, cfg, st, body, size, fileName, mimeType, utils.GetUser(c), limits)
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+	log.Printf("Stored PUT upload %s (%d bytes)", file.FilePath, size)
+
+	fileURL := absoluteURL(c, file.URL(cfg.FileHost))
+	c.Set(headerFileID, file.FileId)
+	if c.Get(fiber.HeaderAuthorization) == "" {
+		c.Set(headerAccountID, file.Owner.AccountId)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Status(fiber.StatusCreated).SendString(fileURL + "\n")
+}
+
+// absoluteURL puts the request's scheme and host in front of u when FILE_HOST left it a
+// path, for clients that take the URL as it is rather than resolving it against a page.
+func absoluteURL(c *fiber.Ctx, u string) string {
+	if strings.HasPrefix(u, "/") {
+		return c.BaseURL() + u
+	}
+	return u
+}
+
+// putMimeType is the Content-Type the upload was sent with, unless it is missing or
+// curl's generic one, in which case the extension decides, and failing that the first
+// bytes of the body.
+func putMimeType(contentType, fileName string, body *bufio.Reader) string {
+	if contentType != "" && contentType != "application/octet-stream" &&
+		contentType != "application/x-www-form-urlencoded" {
+		return contentType
+	}
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		return mimeType
+	}
+	head, _ := body.Peek(512)
+	return http.DetectContentType(head)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+func putTestApp(db *gorm.DB, st storage.Storage, owner models.User) *fiber.App {
+	cfg := &config.Config{
+		MaxFileSizeMB:       100,
+		UploadLimitMBPerDay: 100,
+		EncryptionKey:       bytes.Repeat([]byte{0x3c}, 32),
+		FileHost:            "/files/",
+	}
+
+	app := downloadTestApp(db, st)
+	app.Put("/:name", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return PutFile(c, db, cfg, st, c.Params("name"))
+	})
+	return app
+}
+
+func put(t *testing.T, app *fiber.App, path string, body io.Reader, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("PUT", path, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("PUT %s failed: %v", path, err)
+	}
+	answer, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading the response failed: %v", err)
+	}
+	return res, string(answer)
+}
+
+// curl -T sends the file to /<name> with its length and a generic type; the answer is
+// the file's absolute URL, and the file downloads under the name it was sent with.
+func TestPutStoresTheBody(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := putTestApp(db, st, owner)
+
+	plain := testContent(300_000)
+	res, answer := put(t, app, "/build%20log.txt?maxDownloads=2", bytes.NewReader(plain), map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	})
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("PUT gave %d: %s", res.StatusCode, answer)
+	}
+
+	var file models.UploadedFile
+	if err := db.Preload("Shares").Where("file_id = ?", res.Header.Get("Bindle-File-Id")).First(&file).Error; err != nil {
+		t.Fatalf("the upload has no record: %v", err)
+	}
+	if file.FileName != "build log.txt" || !strings.HasPrefix(file.MimeType, "text/plain") || file.MaxDownloads != 2 {
+		t.Errorf("the upload was recorded as %q, %q, %d downloads", file.FileName, file.MimeType, file.MaxDownloads)
+	}
+	if want := "http://example.com" + shareURL(file) + "\n"; answer != want {
+		t.Errorf("PUT answered %q, want %q", answer, want)
+	}
+	if got := res.Header.Get("Bindle-Account-Id"); got != owner.AccountId {
+		t.Errorf("PUT without an account named account %q, want %q", got, owner.AccountId)
+	}
+	if res, body := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("downloading the PUT upload gave %d, want the file", res.StatusCode)
+	}
+
+	res, _ = put(t, app, "/again.txt", bytes.NewReader(plain), map[string]string{"Authorization": owner.AccountId})
+	if res.StatusCode != fiber.StatusCreated || res.Header.Get("Bindle-Account-Id") != "" {
+		t.Errorf("PUT with an account gave %d and account header %q", res.StatusCode, res.Header.Get("Bindle-Account-Id"))
+	}
+}
+
+func TestPutRefusesABodyOfUnknownLength(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := putTestApp(db, st, owner)
+
+	// What curl sends for -T - : a chunked body with no length.
+	req := httptest.NewRequest("PUT", "/stdin.txt", strings.NewReader("from a pipe"))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("chunked PUT failed: %v", err)
+	}
+	if res.StatusCode != fiber.StatusLengthRequired {
+		t.Errorf("a chunked PUT gave %d, want 411", res.StatusCode)
+	}
+	if res, _ := put(t, app, "/empty.txt", bytes.NewReader(nil), nil); res.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("an empty PUT gave %d, want 400", res.StatusCode)
+	}
+
+	var count int64
+	db.Model(&models.UploadedFile{}).Count(&count)
+	if count != 0 {
+		t.Errorf("refused PUTs left %d file records", count)
+	}
+}
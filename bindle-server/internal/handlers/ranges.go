@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// maxRanges caps how many ranges one request may ask for. Each range is a separate
+// ranged read against storage, so without a cap a single header could fan out into
+// thousands of them; past the cap the header is ignored and the whole file is sent,
+// which RFC 9110 allows.
+const maxRanges = 16
+
+// errRangeUnsatisfiable reports a Range header none of whose ranges overlap the file,
+// which is answered with a 416 rather than the whole file.
+var errRangeUnsatisfiable = errors.New("no requested range overlaps the file")
+
+// byteRange is an inclusive span of plaintext bytes, the way a Range header states it.
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange reads a Range header against a size-byte file. A header it cannot parse,
+// or one in a unit other than bytes, yields no ranges and no error: the request is then
+// answered with the whole file, as RFC 9110 directs for a Range it does not understand.
+// Ranges that start past the end are dropped, and if that leaves none the request is
+// unsatisfiable.
+//
+// fiber's own c.Range is not used because it misreads whitespace after a comma, which
+// real clients send, as a suffix range.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	unit, spec, found := strings.Cut(header, "=")
+	if !found || strings.TrimSpace(unit) != "bytes" {
+		return nil, nil
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	for _, part := range specs {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// A suffix range: the final n bytes, however long the file is.
+			n, err := strconv.ParseUint(last, 10, 63)
+			if err != nil {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if int64(n) > size {
+				n = uint64(size)
+			}
+			ranges = append(ranges, byteRange{start: size - int64(n), end: size - 1})
+			continue
+		}
+
+		start, err := strconv.ParseUint(first, 10, 63)
+		if err != nil {
+			return nil, nil
+		}
+		end := uint64(size - 1)
+		if last != "" {
+			if end, err = strconv.ParseUint(last, 10, 63); err != nil || end < start {
+				return nil, nil
+			}
+			if end > uint64(size-1) {
+				end = uint64(size - 1)
+			}
+		}
+		if int64(start) >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: int64(start), end: int64(end)})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeUnsatisfiable
+	}
+	return ranges, nil
+}
+
+// fileETag is the validator a download is revalidated and resumed against. Stored files
+// never change once written - a new upload is a new row - so it is strong: the same tag
+// always means the same bytes. It is the content hash, which a client can check what it
+// fetched against. Until a file has been hashed, a tag built from what locates and sizes
+// its stored object stands in, hashed so it does not hand out the storage path itself.
+func fileETag(file *models.UploadedFile) string {
+	if file.ContentHash != "" {
+		return `"` + file.ContentHash + `"`
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", file.FilePath, file.Size, file.EncryptionVersion)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// fileDigest is the file's SHA-256 as Repr-Digest and Content-Digest carry it, or empty
+// while it is not known.
+func fileDigest(file *models.UploadedFile) string {
+	sum, err := hex.DecodeString(file.ContentHash)
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return utils.FormatDigest(sum)
+}
+
+// etagListMatches reports whether an If-None-Match style list names etag. The
+// comparison is the weak one RFC 9110 prescribes for If-None-Match, so a W/ prefix on
+// either side is ignored.
+func etagListMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is no
+// If-None-Match, which is the precedence RFC 9110 gives them.
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if header := c.Get(fiber.HeaderIfNoneMatch); header != "" {
+		return etagListMatches(header, etag)
+	}
+	if header := c.Get(fiber.HeaderIfModifiedSince); header != "" {
+		since, err := http.ParseTime(header)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// ifRangeHolds reports whether a Range header should be honoured. If-Range lets a client
+// resuming a download say "only if it is still the file I started with"; when the
+// validator it sends no longer matches, the range is ignored and the whole file is sent
+// instead of splicing bytes of a different file onto what it already has. An entity tag
+// has to match strongly, so a weak tag never does.
+func ifRangeHolds(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfRange))
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return header == etag
+	}
+	date, err := http.ParseTime(header)
+	return err == nil && date.Equal(lastModified.Truncate(time.Second))
+}
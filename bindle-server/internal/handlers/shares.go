@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// createFileRecord records a finished upload together with the share its URL comes
+// from, so no file ever exists without a way to reach it.
+func createFileRecord(db *gorm.DB, file *models.UploadedFile) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(file).Error; err != nil {
+			return err
+		}
+		share := models.Share{Slug: utils.GenerateShareSlug(), UploadedFileID: file.ID}
+		if err := tx.Create(&share).Error; err != nil {
+			return err
+		}
+		file.Shares = []models.Share{share}
+		return nil
+	})
+}
+
+// findShare resolves the last segment of a download URL to its share and file. A share
+// that was revoked, or whose file was deleted, by its owner or by the sweep, is reported
+// as not found; a live share or file that expired or used up its downloads as
+// errFileGone, which is errDownloadsUsedUp for the latter.
+func findShare(db *gorm.DB, path string, now time.Time) (models.Share, models.UploadedFile, error) {
+	var share models.Share
+	var file models.UploadedFile
+
+	err := db.Unscoped().Where("slug = ?", utils.ShareSlugFromPath(path)).First(&share).Error
+	if err != nil {
+		return share, file, err
+	}
+	if err := db.Unscoped().First(&file, share.UploadedFileID).Error; err != nil {
+		return share, file, err
+	}
+
+	// Checked before the limits, so that a revoked link looks like one that never
+	// existed rather than telling whoever holds it that it used to work.
+	if share.DeletedAt.Valid || file.DeletedAt.Valid {
+		return share, file, gorm.ErrRecordNotFound
+	}
+	if file.Expired(now) || share.Expired(now) {
+		return share, file, errFileGone
+	}
+	if !file.Available(now) || !share.Available(now) {
+		return share, file, errDownloadsUsedUp
+	}
+	return share, file, nil
+}
+
+// isRecordedPath reports whether path names a stored object that a file record owns,
+// live or deleted. Such an object is only ever served through a share: its path is, for
+// single uploads, the hash of the contents, and answering it would let anyone holding
+// the same bytes confirm that they are hosted here.
+func isRecordedPath(db *gorm.DB, path string) (bool, error) {
+	var count int64
+	err := db.Unscoped().Model(&models.UploadedFile{}).Where("file_path = ?", path).Count(&count).Error
+	return count > 0, err
+}
+
+// predatesShares reports whether the object at path was stored before shares came in,
+// when it could have been linked to by that path. Anything stored since - a temp
+// object, an upload still in progress, one deduplication dropped - never was, and is
+// never served that way.
+func predatesShares(db *gorm.DB, st storage.Storage, path string) (bool, error) {
+	var migration models.Migration
+	if err := db.Where("name = ?", models.SharesMigration).First(&migration).Error; err != nil {
+		return false, err
+	}
+	storedAt, err := st.ModTime(path)
+	if err != nil {
+		return false, err
+	}
+	return storedAt.Before(migration.RanAt), nil
+}
+
+// RotateFileURL revokes every URL a file has and gives it a new one. The stored object
+// is untouched; anyone holding an old link just stops being able to use it.
+func RotateFileURL(c *fiber.Ctx, db *gorm.DB, fileId string) error {
+	file, err := ownedFile(c, db, fileId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("uploaded_file_id = ?", file.ID).Delete(&models.Share{}).Error; err != nil {
+			return err
+		}
+		share := models.Share{Slug: utils.GenerateShareSlug(), UploadedFileID: file.ID}
+		if err := tx.Create(&share).Error; err != nil {
+			return err
+		}
+		file.Shares = []models.Share{share}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to rotate the URL of file %s: %v", fileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to rotate the file URL"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(file)
+}
+
+// ownedFile loads the file fileId of the requesting user.
+func ownedFile(c *fiber.Ctx, db *gorm.DB, fileId string) (*models.UploadedFile, error) {
+	file := &models.UploadedFile{}
+	err := db.Where("file_id = ? AND owner_id = ?", fileId, utils.GetUser(c).ID).First(file).Error
+	return file, err
+}
+
+// ListShares lists the live share links of a file, oldest first, including those that
+// have expired or run out of downloads but have not been revoked.
+func ListShares(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, fileId string) error {
+	file, err := ownedFile(c, db, fileId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	var shares []models.Share
+	if err := db.Where("uploaded_file_id = ?", file.ID).Order("id").Find(&shares).Error; err != nil {
+		log.Printf("Failed to list the shares of file %s: %v", fileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list shares"})
+	}
+
+	now := time.Now()
+	dtos := make([]models.ShareDTO, len(shares))
+	for i := range shares {
+		dtos[i] = shares[i].DTO(cfg.FileHost, file, now)
+	}
+	return c.Status(fiber.StatusOK).JSON(dtos)
+}
+
+// CreateShare mints another link to a file. It points at the same stored object as the
+// file's other links; only the label and the limits are its own.
+func CreateShare(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, fileId string) error {
+	type CreateShareRequest struct {
+		Label        string     `json:"label"`
+		ExpiresAt    *time.Time `json:"expiresAt"`
+		MaxDownloads int        `json:"maxDownloads"`
+		Password     string     `json:"password"`
+	}
+
+	req := new(CreateShareRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	file, err := ownedFile(c, db, fileId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	limits := fileLimits{ExpiresAt: req.ExpiresAt, MaxDownloads: req.MaxDownloads}
+	if err := limits.validate(time.Now()); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := limits.setPassword(req.Password); err != nil {
+		log.Printf("Failed to hash share password: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create share"})
+	}
+
+	share := models.Share{Slug: utils.GenerateShareSlug(), UploadedFileID: file.ID, Label: req.Label}
+	limits.applyToShare(&share)
+	if err := db.Create(&share).Error; err != nil {
+		log.Printf("Failed to create a share for file %s: %v", fileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create share"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(share.DTO(cfg.FileHost, file, time.Now()))
+}
+
+// RevokeShare deletes one link to a file. The file and its other links are untouched,
+// even when this was the last one; the owner can mint a new link later.
+func RevokeShare(c *fiber.Ctx, db *gorm.DB, fileId, shareId string) error {
+	file, err := ownedFile(c, db, fileId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	result := db.Where("slug = ? AND uploaded_file_id = ?", shareId, file.ID).Delete(&models.Share{})
+	if result.Error != nil {
+		log.Printf("Failed to revoke share %s of file %s: %v", shareId, fileId, result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke share"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
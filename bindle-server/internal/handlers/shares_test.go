@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+)
+
+func TestSharesHaveTheirOwnLimitsAndCounts(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	plain := testContent(1000)
+	file := storeTestFile(t, db, st, plain)
+
+	cfg := &config.Config{FileHost: "/files/"}
+	app := downloadTestApp(db, st)
+	app.Use("/api", func(c *fiber.Ctx) error {
+		c.Locals("user", models.User{})
+		return c.Next()
+	})
+	app.Get("/api/file/:fileId/shares", func(c *fiber.Ctx) error {
+		return ListShares(c, db, cfg, c.Params("fileId"))
+	})
+	app.Post("/api/file/:fileId/shares", func(c *fiber.Ctx) error {
+		return CreateShare(c, db, cfg, c.Params("fileId"))
+	})
+	app.Delete("/api/file/:fileId/shares/:shareId", func(c *fiber.Ctx) error {
+		return RevokeShare(c, db, c.Params("fileId"), c.Params("shareId"))
+	})
+
+	createShare := func(body string) models.ShareDTO {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/file/"+file.FileId+"/shares", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil || res.StatusCode != fiber.StatusCreated {
+			t.Fatalf("creating a share failed: %v, status %v", err, res.StatusCode)
+		}
+		var share models.ShareDTO
+		if err := json.NewDecoder(res.Body).Decode(&share); err != nil {
+			t.Fatalf("decoding the share: %v", err)
+		}
+		return share
+	}
+
+	once := createShare(`{"label": "once", "maxDownloads": 1}`)
+	locked := createShare(`{"label": "locked", "password": "hunter2"}`)
+
+	if res, _ := download(t, app, once.URL, nil); res.StatusCode != fiber.StatusOK {
+		t.Fatalf("the first download through a one-time share gave %d", res.StatusCode)
+	}
+	ageDownloads(t, db)
+	if res, _ := download(t, app, once.URL, nil); res.StatusCode != fiber.StatusGone {
+		t.Errorf("the second download through a one-time share gave %d, want 410", res.StatusCode)
+	}
+	if res, _ := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK {
+		t.Errorf("the file's own URL gave %d after another share ran out", res.StatusCode)
+	}
+
+	if res, _ := download(t, app, locked.URL, nil); res.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("a share with a password gave %d without it, want 401", res.StatusCode)
+	}
+	headers := map[string]string{filepassword.HeaderName: "hunter2"}
+	if res, _ := download(t, app, locked.URL, headers); res.StatusCode != fiber.StatusOK {
+		t.Errorf("a share with a password gave %d with it", res.StatusCode)
+	}
+
+	res, err := app.Test(httptest.NewRequest("DELETE", "/api/file/"+file.FileId+"/shares/"+locked.ShareId, nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("revoking a share failed: %v, status %v", err, res.StatusCode)
+	}
+	if res, _ := download(t, app, locked.URL, headers); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("a revoked share gave %d, want 404", res.StatusCode)
+	}
+
+	res, err = app.Test(httptest.NewRequest("GET", "/api/file/"+file.FileId+"/shares", nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("listing shares failed: %v, status %v", err, res.StatusCode)
+	}
+	var shares []models.ShareDTO
+	if err := json.NewDecoder(res.Body).Decode(&shares); err != nil {
+		t.Fatalf("decoding the shares: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, share := range shares {
+		counts[share.Label] = share.DownloadCount
+		if share.Label == "once" && share.Available {
+			t.Error("a share with no downloads left was listed as available")
+		}
+	}
+	if len(shares) != 2 || counts["once"] != 1 || counts[""] != 1 {
+		t.Errorf("listed %d shares with counts %v, want the file's own and \"once\" with one download each", len(shares), counts)
+	}
+
+	// A share that ran out before it was revoked gives nothing more away than one that
+	// never existed.
+	res, err = app.Test(httptest.NewRequest("DELETE", "/api/file/"+file.FileId+"/shares/"+once.ShareId, nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("revoking a share failed: %v, status %v", err, res.StatusCode)
+	}
+	if res, _ := download(t, app, once.URL, nil); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("a spent share that was revoked gave %d, want 404", res.StatusCode)
+	}
+
+	var stored models.UploadedFile
+	db.First(&stored, file.ID)
+	if stored.DownloadCount != 3 {
+		t.Errorf("the file counted %d downloads, want 3 across its shares", stored.DownloadCount)
+	}
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/cleanup"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// ShareXResponse is the answer to an upload from a screenshot tool. ShareX, and the
+// tools that copied its custom uploaders, are told by the config to read these fields.
+type ShareXResponse struct {
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	DeletionURL  string `json:"deletion_url"`
+}
+
+// ShareXConfig is a ShareX custom uploader, the .sxcu file that ShareX imports by
+// opening it.
+type ShareXConfig struct {
+	Version         string            `json:"Version"`
+	Name            string            `json:"Name"`
+	DestinationType string            `json:"DestinationType"`
+	RequestMethod   string            `json:"RequestMethod"`
+	RequestURL      string            `json:"RequestURL"`
+	Headers         map[string]string `json:"Headers"`
+	Body            string            `json:"Body"`
+	FileFormName    string            `json:"FileFormName"`
+	URL             string            `json:"URL"`
+	ThumbnailURL    string            `json:"ThumbnailURL"`
+	DeletionURL     string            `json:"DeletionURL"`
+	ErrorMessage    string            `json:"ErrorMessage"`
+}
+
+// ShareXUpload stores an upload from a screenshot tool. It takes the same form as
+// POST /api/file, and answers with the URLs the tool shows: the file's, a thumbnail for
+// images, which is the image itself, and a deletion URL. The deletion URL holds a token
+// for this one file, so the tool's history can delete it without being able to touch the
+// rest of the account.
+func ShareXUpload(c *fiber.Ctx, db *gorm.DB, cfg *config.Config, st storage.Storage) error {
+	file, failure := uploadFormFile(c, db, cfg, st)
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+
+	token := utils.GenerateDeletionToken()
+	if err := db.Model(file).Update("deletion_token_hash", utils.HashDeletionToken(token)).Error; err != nil {
+		log.Printf("Failed to set the deletion token of file %s: %v", file.FileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create file"})
+	}
+
+	response := ShareXResponse{
+		URL:         absoluteURL(c, file.URL(cfg.FileHost)),
+		DeletionURL: c.BaseURL() + "/api/sharex/delete/" + token,
+	}
+	if file.Type == models.FileTypeImage {
+		response.ThumbnailURL = response.URL
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// GetShareXConfig answers with a ShareX custom uploader for the request's account. It
+// holds the account ID, which is all anyone needs to use the account, so it is sent as
+// a download and never cached.
+func GetShareXConfig(c *fiber.Ctx) error {
+	user := utils.GetUser(c)
+	host := c.Hostname()
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	// Windows, where ShareX runs, does not allow the colon before a port in a file name.
+	c.Attachment("bindle-" + strings.ReplaceAll(host, ":", "-") + ".sxcu")
+	return c.JSON(ShareXConfig{
+		Version:         "15.0.0",
+		Name:            "Bindle (" + host + ")",
+		DestinationType: "ImageUploader, TextUploader, FileUploader",
+		RequestMethod:   "POST",
+		RequestURL:      c.BaseURL() + "/api/sharex/upload",
+		Headers:         map[string]string{"Authorization": user.AccountId},
+		Body:            "MultipartFormData",
+		FileFormName:    "file",
+		URL:             "{json:url}",
+		ThumbnailURL:    "{json:thumbnail_url}",
+		DeletionURL:     "{json:deletion_url}",
+		ErrorMessage:    "{json:error}",
+	})
+}
+
+// deletePage is what a browser opening a deletion URL gets. ShareX opens the URL from
+// its history, but so can anything that previews links, so the GET only asks and the
+// form's POST deletes.
+var deletePage = template.Must(template.New("delete").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Deleted}}File deleted{{else if .FileName}}Delete {{.FileName}}{{else}}File not found{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form, div { display: flex; flex-direction: column; gap: 0.75rem; width: 20rem; }
+</style>
+</head>
+<body>
+{{if .Deleted}}<div>
+<h1>File deleted</h1>
+<p><strong>{{.FileName}}</strong> has been deleted.</p>
+</div>
+{{else if .FileName}}<form method="post">
+<h1>Delete file</h1>
+<p>Delete <strong>{{.FileName}}</strong>? Its links stop working at once.</p>
+<button type="submit">Delete</button>
+</form>
+{{else}}<div>
+<h1>File not found</h1>
+<p>It has already been deleted, or has expired.</p>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// findByDeletionToken finds the file token deletes.
+func findByDeletionToken(db *gorm.DB, token string) (*models.UploadedFile, error) {
+	file := &models.UploadedFile{}
+	if err := db.Where("deletion_token_hash = ?", utils.HashDeletionToken(token)).First(file).Error; err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ShowShareXDelete asks whether to delete the file a deletion URL belongs to.
+func ShowShareXDelete(c *fiber.Ctx, db *gorm.DB, token string) error {
+	file, err := findByDeletionToken(db, token)
+	if err != nil {
+		return sendDeletePage(c, fiber.StatusNotFound, "", false)
+	}
+	return sendDeletePage(c, fiber.StatusOK, file.FileName, false)
+}
+
+// ShareXDelete deletes the file a deletion URL belongs to, whoever asks: having the
+// token is the permission.
+func ShareXDelete(c *fiber.Ctx, db *gorm.DB, st storage.Storage, token string) error {
+	file, err := findByDeletionToken(db, token)
+	if err != nil {
+		if wantsHTML(c) {
+			return sendDeletePage(c, fiber.StatusNotFound, "", false)
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	if err := cleanup.DeleteFile(db, st, file); err != nil {
+		log.Printf("Failed to delete file %s by its deletion token: %v", file.FileId, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete file"})
+	}
+	log.Printf("Deleted file %s by its deletion token", file.FilePath)
+
+	if wantsHTML(c) {
+		return sendDeletePage(c, fiber.StatusOK, file.FileName, true)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "File deleted"})
+}
+
+func sendDeletePage(c *fiber.Ctx, status int, fileName string, deleted bool) error {
+	c.Status(status)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return deletePage.Execute(c.Response().BodyWriter(), struct {
+		FileName string
+		Deleted  bool
+	}{fileName, deleted})
+}
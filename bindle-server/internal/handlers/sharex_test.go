@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+// A screenshot tool gets URLs it can use as they are, and the deletion URL deletes the
+// file it came with - after asking, when it is opened in a browser - without the account.
+func TestShareXUploadDeletesByToken(t *testing.T) {
+	setTestEnv(t)
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	cfg := &config.Config{UploadLimitMBPerDay: 100, FileHost: "/files/", EncryptionKey: bytes.Repeat([]byte{0x3c}, 32)}
+	app := downloadTestApp(db, st)
+	app.Post("/api/sharex/upload", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return ShareXUpload(c, db, cfg, st)
+	})
+	app.Get("/api/sharex/delete/:token", func(c *fiber.Ctx) error {
+		return ShowShareXDelete(c, db, c.Params("token"))
+	})
+	app.Post("/api/sharex/delete/:token", func(c *fiber.Ctx) error {
+		return ShareXDelete(c, db, st, c.Params("token"))
+	})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="screenshot.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	plain := testContent(5000)
+	part.Write(plain)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/sharex/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	res, err := app.Test(req, -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("upload failed: %v, status %v", err, res.StatusCode)
+	}
+	var uploaded ShareXResponse
+	if err := json.NewDecoder(res.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("decoding the upload: %v", err)
+	}
+
+	var file models.UploadedFile
+	if err := db.Preload("Shares").Where("owner_id = ?", owner.ID).First(&file).Error; err != nil {
+		t.Fatalf("the upload was not recorded: %v", err)
+	}
+	if want := "http://example.com" + shareURL(file); uploaded.URL != want || uploaded.ThumbnailURL != want {
+		t.Errorf("got URL %q and thumbnail %q, want both %q", uploaded.URL, uploaded.ThumbnailURL, want)
+	}
+	deletePath := strings.TrimPrefix(uploaded.DeletionURL, "http://example.com")
+	if !strings.HasPrefix(deletePath, "/api/sharex/delete/") || strings.Contains(deletePath, owner.AccountId) {
+		t.Fatalf("got deletion URL %q", uploaded.DeletionURL)
+	}
+
+	res, page := download(t, app, deletePath, map[string]string{"Accept": "text/html"})
+	if res.StatusCode != fiber.StatusOK || !bytes.Contains(page, []byte("screenshot.png")) {
+		t.Errorf("opening the deletion URL gave %d: %s", res.StatusCode, page)
+	}
+	if res, _ := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK {
+		t.Fatalf("opening the deletion URL deleted the file: %d", res.StatusCode)
+	}
+
+	if res, _ := app.Test(httptest.NewRequest("POST", deletePath+"x", nil), -1); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("deleting with a wrong token gave %d, want 404", res.StatusCode)
+	}
+	res, err = app.Test(httptest.NewRequest("POST", deletePath, nil), -1)
+	if err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("deleting gave %v, status %v", err, res.StatusCode)
+	}
+	if res, _ := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("the deleted file still answers %d", res.StatusCode)
+	}
+	if res, _ := app.Test(httptest.NewRequest("POST", deletePath, nil), -1); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("deleting again gave %d, want 404", res.StatusCode)
+	}
+}
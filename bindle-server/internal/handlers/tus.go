@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// tus 1.0 (https://tus.io/protocols/resumable-upload), with the creation, expiration and
+// termination extensions, on top of the same sessions and storage chunk API as
+// /api/file/chunk.
+//
+// The two protocols disagree on who decides where the pieces of a file start. Here the
+// client sends whatever it likes from the current offset, while storage takes whole
+// chunks on the session's layout, each sealed on the frame grid. So the bytes of the
+// chunk being filled are spooled to local disk, sealed a frame at a time, and handed to
+// storage once the chunk is whole. Only the part of a frame a PATCH ends in is held in
+// memory, until the next PATCH completes it.
+//
+// The spool is sealed in version 2 whatever the session's object is in: it is emptied
+// for every chunk and refilled at the same frame indexes, so version 3's nonces, which
+// are those indexes, would repeat under the spool's key.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	// Tus headers the client needs to read, and the headers a finished upload is
+	// answered with so the client learns what it created.
+	headerTusResumable   = "Tus-Resumable"
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadLength   = "Upload-Length"
+	headerUploadMetadata = "Upload-Metadata"
+	headerUploadExpires  = "Upload-Expires"
+	headerFileID         = "Bindle-File-Id"
+	headerFileURL        = "Bindle-File-Url"
+
+	tusContentType = "application/offset+octet-stream"
+)
+
+// TusServer serves the tus endpoints. It keeps the state of the uploads it is filling;
+// all of it but the partial frame is on disk or in storage, and is recovered from there
+// after a restart.
+type TusServer struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	st       storage.Storage
+	spoolDir string
+
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+// tusUpload is the progress of one session: chunks [0, chunkNumber) are in storage, the
+// first spooled bytes of chunk chunkNumber are sealed in spool, and partial follows them.
+type tusUpload struct {
+	mu          sync.Mutex
+	session     *models.UploadSession
+	chunkNumber int
+	spool       *os.File
+	spoolKey    []byte
+	spooled     int64
+	partial     []byte
+}
+
+// NewTusServer serves tus uploads, spooling partial chunks under spoolDir. Spools whose
+// session is no longer active are left over from before a restart and are removed.
+func NewTusServer(db *gorm.DB, cfg *config.Config, st storage.Storage, spoolDir string) (*TusServer, error) {
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	server := &TusServer{db: db, cfg: cfg, st: st, spoolDir: spoolDir, uploads: make(map[string]*tusUpload)}
+
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		var active int64
+		db.Model(&models.UploadSession{}).
+			Where("session_id = ? AND status = ?", entry.Name(), models.UploadSessionStatusActive).
+			Count(&active)
+		if active == 0 {
+			os.Remove(filepath.Join(spoolDir, entry.Name()))
+		}
+	}
+	return server, nil
+}
+
+// tusResumable marks the response as tus and reports whether the request is too. A
+// client that does not speak the version served here is refused before anything else
+// happens.
+func tusResumable(c *fiber.Ctx) bool {
+	c.Set(headerTusResumable, tusVersion)
+	if c.Get(headerTusResumable) != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return false
+	}
+	return true
+}
+
+// Options answers tus discovery.
+func (s *TusServer) Options(c *fiber.Ctx) error {
+	c.Set(headerTusResumable, tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(s.cfg.MaxFileSizeMB*1000*1000, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Create opens an upload of Upload-Length bytes. The file is named from the filename
+// (or name) metadata and typed from filetype (or type), which is what tus-js-client and
+// Uppy send.
+func (s *TusServer) Create(c *fiber.Ctx) error {
+	if !tusResumable(c) {
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+	if c.Get("Upload-Defer-Length") != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Upload-Defer-Length is not supported"})
+	}
+
+	length, err := strconv.ParseInt(c.Get(headerUploadLength), 10, 64)
+	if err != nil || length <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Upload-Length must be a positive number"})
+	}
+	metadata, err := parseTusMetadata(c.Get(headerUploadMetadata))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	fileName := firstNonEmpty(metadata["filename"], metadata["name"])
+	if fileName == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Upload-Metadata must carry a filename"})
+	}
+	mimeType := firstNonEmpty(metadata["filetype"], metadata["type"], "application/octet-stream")
+
+	s.forgetInactive()
+
+	uploadSession, failure := openUploadSession(c, s.db, s.cfg, s.st, fileName, length, mimeType, fileLimits{}, false)
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+
+	log.Printf("Initialized tus upload session %s for file %s (%d bytes)", uploadSession.SessionID, fileName, length)
+
+	c.Set(fiber.HeaderLocation, strings.TrimSuffix(c.Path(), "/")+"/"+uploadSession.SessionID)
+	c.Set(headerUploadExpires, uploadSession.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// Head reports how much of an upload the server holds. A finished upload reports all of
+// it, so a client that lost the response to its last PATCH knows it is done.
+func (s *TusServer) Head(c *fiber.Ctx) error {
+	if !tusResumable(c) {
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	var uploadSession models.UploadSession
+	err := s.db.Where("session_id = ? AND account_id = ?", c.Params("sessionId"), utils.GetUser(c).ID).
+		First(&uploadSession).Error
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	c.Set(headerUploadLength, strconv.FormatInt(uploadSession.FileSize, 10))
+	switch uploadSession.Status {
+	case models.UploadSessionStatusCompleted:
+		c.Set(headerUploadOffset, strconv.FormatInt(uploadSession.FileSize, 10))
+		return c.SendStatus(fiber.StatusOK)
+	case models.UploadSessionStatusActive:
+	default:
+		return c.SendStatus(fiber.StatusGone)
+	}
+
+	upload, err := s.upload(&uploadSession)
+	if err != nil {
+		log.Printf("Failed to load tus upload %s: %v", uploadSession.SessionID, err)
+		return c.SendStatus(tusLoadFailureStatus(err))
+	}
+	upload.mu.Lock()
+	offset := upload.offset()
+	upload.mu.Unlock()
+
+	c.Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	c.Set(headerUploadExpires, uploadSession.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Patch appends the body at Upload-Offset, which has to be where the upload stands. The
+// PATCH that brings the upload to its length also completes it, and answers with the
+// file it created in Bindle-File-Id and Bindle-File-Url.
+func (s *TusServer) Patch(c *fiber.Ctx) error {
+	if !tusResumable(c) {
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), tusContentType) {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Content-Type must be " + tusContentType})
+	}
+	offset, err := strconv.ParseInt(c.Get(headerUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Upload-Offset must be a number"})
+	}
+
+	uploadSession, err := loadActiveSession(c, s.db, c.Params("sessionId"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload session not found"})
+	}
+	if time.Now().After(uploadSession.ExpiresAt) {
+		uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusExpired, nil
+		s.db.Save(uploadSession)
+		s.forget(uploadSession.SessionID)
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Upload session expired"})
+	}
+	upload, err := s.upload(uploadSession)
+	if err != nil {
+		log.Printf("Failed to load tus upload %s: %v", uploadSession.SessionID, err)
+		return c.SendStatus(tusLoadFailureStatus(err))
+	}
+
+	// tus uploads are strictly sequential, so a second PATCH while one is running is a
+	// client that gave up on the first and will be told the offset it left behind.
+	if !upload.mu.TryLock() {
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{"error": "Another PATCH is writing to this upload"})
+	}
+	defer upload.mu.Unlock()
+
+	if current := upload.offset(); offset != current {
+		c.Set(headerUploadOffset, strconv.FormatInt(current, 10))
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Upload-Offset does not match the upload"})
+	}
+	remaining := uploadSession.FileSize - offset
+	if declared := int64(c.Request().Header.ContentLength()); declared > remaining {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Body runs past Upload-Length"})
+	}
+
+	// Whatever arrived is kept even when the request fails partway, as tus asks: the
+	// offset reports it, and the client carries on from there.
+	writeErr := upload.write(s.st, requestBodyReader(c, remaining))
+	if err := upload.spool.Sync(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	c.Set(headerUploadOffset, strconv.FormatInt(upload.offset(), 10))
+	if writeErr != nil {
+		log.Printf("Failed to write to tus upload %s: %v", uploadSession.SessionID, writeErr)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save upload"})
+	}
+
+	if upload.offset() < uploadSession.FileSize {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	file, failure := finishUploadSession(s.db, s.st, uploadSession, "")
+	if failure != nil {
+		return c.Status(failure.Code).JSON(fiber.Map{"error": failure.Message})
+	}
+	s.forget(uploadSession.SessionID)
+
+	log.Printf("Completed tus upload for session %s: %s (%d bytes)", uploadSession.SessionID, file.FilePath, file.Size)
+
+	c.Set(headerFileID, file.FileId)
+	c.Set(headerFileURL, file.URL(s.cfg.FileHost))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Terminate cancels an upload and releases everything held for it.
+func (s *TusServer) Terminate(c *fiber.Ctx) error {
+	if !tusResumable(c) {
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	uploadSession, err := loadActiveSession(c, s.db, c.Params("sessionId"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload session not found"})
+	}
+
+	if err := s.st.AbortChunkedUpload(uploadSession.SessionID); err != nil {
+		log.Printf("Failed to abort upload for session %s: %v", uploadSession.SessionID, err)
+	}
+	s.forget(uploadSession.SessionID)
+
+	uploadSession.Status, uploadSession.WrappedKey = models.UploadSessionStatusCancelled, nil
+	s.db.Save(uploadSession)
+
+	log.Printf("Terminated tus upload session %s", uploadSession.SessionID)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func tusLoadFailureStatus(err error) int {
+	if errors.Is(err, storage.ErrUploadGone) {
+		return fiber.StatusGone
+	}
+	return fiber.StatusInternalServerError
+}
+
+// upload returns the state of an active session, recovering it from storage and the
+// spool the first time the session is seen by this process.
+func (s *TusServer) upload(uploadSession *models.UploadSession) (*tusUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if upload, ok := s.uploads[uploadSession.SessionID]; ok {
+		return upload, nil
+	}
+
+	// Chunks are only ever handed to storage in order, so those it holds are a prefix.
+	received, err := s.st.ReceivedChunks(uploadSession.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	chunkNumber := 0
+	for chunkNumber < len(received) && received[chunkNumber] == chunkNumber {
+		chunkNumber++
+	}
+
+	spoolKey, err := s.spoolKey(uploadSession)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := os.OpenFile(s.spoolPath(uploadSession.SessionID), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := spool.Stat()
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	// The spool holds whole sealed frames, except when it holds a whole chunk whose last
+	// frame is short. Anything after the last whole frame is a write a crash cut off.
+	chunkPlain := maxChunkBytes(uploadSession, chunkNumber)
+	spooled := stat.Size() / (utils.FrameSize + utils.FrameOverhead) * utils.FrameSize
+	if chunkPlain > 0 && stat.Size() == utils.EncryptedSize(utils.EncryptionVersionStream, chunkPlain) {
+		spooled = chunkPlain
+	}
+	spooled = min(spooled, chunkPlain)
+	if err := spool.Truncate(utils.EncryptedSize(utils.EncryptionVersionStream, spooled)); err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	upload := &tusUpload{
+		session:     uploadSession,
+		chunkNumber: chunkNumber,
+		spool:       spool,
+		spoolKey:    spoolKey,
+		spooled:     spooled,
+	}
+	s.uploads[uploadSession.SessionID] = upload
+	return upload, nil
+}
+
+// spoolKey seals one session's spool. It is derived per session, so frames from one
+// spool cannot be passed off as another's, and from the session's key rather than the
+// active one, so a spool written before a key change can still be read after it.
+func (s *TusServer) spoolKey(uploadSession *models.UploadSession) ([]byte, error) {
+	key, err := s.cfg.KeyFor(uploadSession.EncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tus-spool\x00" + uploadSession.SessionID))
+	return mac.Sum(nil), nil
+}
+
+func (s *TusServer) spoolPath(sessionID string) string {
+	return filepath.Join(s.spoolDir, filepath.Base(sessionID))
+}
+
+// forget drops a session's state and its spool, once it is finished or cancelled.
+func (s *TusServer) forget(sessionID string) {
+	s.mu.Lock()
+	upload, ok := s.uploads[sessionID]
+	delete(s.uploads, sessionID)
+	s.mu.Unlock()
+
+	if ok {
+		upload.spool.Close()
+	}
+	os.Remove(s.spoolPath(sessionID))
+}
+
+// forgetInactive drops the state of sessions that ended without this server finishing
+// them - expired by the reaper, or cancelled through the chunk API - so abandoned
+// uploads do not pile up in memory.
+func (s *TusServer) forgetInactive() {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.uploads))
+	for id := range s.uploads {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	var active []string
+	err := s.db.Model(&models.UploadSession{}).
+		Where("session_id IN ? AND status = ?", ids, models.UploadSessionStatusActive).
+		Pluck("session_id", &active).Error
+	if err != nil {
+		return
+	}
+	isActive := make(map[string]bool, len(active))
+	for _, id := range active {
+		isActive[id] = true
+	}
+	for _, id := range ids {
+		if !isActive[id] {
+			s.forget(id)
+		}
+	}
+}
+
+// offset is how many bytes of the file the server holds. Past the last chunk that is
+// all of them, though the last chunk is usually shorter than the rest.
+func (u *tusUpload) offset() int64 {
+	return min(int64(u.chunkNumber)*u.session.ChunkSize+u.spooled+int64(len(u.partial)), u.session.FileSize)
+}
+
+// write takes body into the upload: filling the partial frame, sealing each frame into
+// the spool as it completes, and handing each chunk to storage as it completes. It
+// stops at the end of body or the first error, with everything before it kept.
+func (u *tusUpload) write(st storage.Storage, body io.Reader) error {
+	for {
+		if err := u.flushChunk(st); err != nil {
+			return err
+		}
+
+		chunkPlain := maxChunkBytes(u.session, u.chunkNumber)
+		if chunkPlain == 0 {
+			return nil
+		}
+		frameLen := min(utils.FrameSize, chunkPlain-u.spooled)
+		if cap(u.partial) < utils.FrameSize {
+			u.partial = append(make([]byte, 0, utils.FrameSize), u.partial...)
+		}
+
+		n, err := io.ReadFull(body, u.partial[len(u.partial):frameLen])
+		u.partial = u.partial[:len(u.partial)+n]
+		if int64(len(u.partial)) == frameLen {
+			if err := u.sealFrame(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sealFrame moves the partial frame, now complete, into the spool.
+func (u *tusUpload) sealFrame() error {
+	sealed, err := utils.NewEncryptingReader(bytes.NewReader(u.partial), u.spoolKey,
+		utils.EncryptionVersionStream, int64(len(u.partial)), u.spooled/utils.FrameSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(u.spool, utils.EncryptedSize(utils.EncryptionVersionStream, u.spooled)), sealed); err != nil {
+		return fmt.Errorf("failed to spool frame: %w", err)
+	}
+	u.spooled += int64(len(u.partial))
+	u.partial = u.partial[:0]
+	return nil
+}
+
+// flushChunk hands a complete chunk to storage and empties the spool for the next. A
+// chunk storage refused stays spooled and is offered again by the next PATCH.
+func (u *tusUpload) flushChunk(st storage.Storage) error {
+	chunkPlain := maxChunkBytes(u.session, u.chunkNumber)
+	if chunkPlain == 0 || u.spooled < chunkPlain {
+		return nil
+	}
+
+	spooled := io.NopCloser(io.NewSectionReader(u.spool, 0, utils.EncryptedSize(utils.EncryptionVersionStream, chunkPlain)))
+	plain, err := utils.NewDecryptingReader(spooled, u.spoolKey, utils.EncryptionVersionStream, chunkPlain)
+	if err != nil {
+		return err
+	}
+	if err := st.SaveChunk(u.session.SessionID, u.chunkNumber, plain, chunkPlain); err != nil {
+		return fmt.Errorf("failed to save chunk %d: %w", u.chunkNumber, err)
+	}
+
+	if err := u.spool.Truncate(0); err != nil {
+		return err
+	}
+	u.chunkNumber++
+	u.spooled = 0
+	return nil
+}
+
+// parseTusMetadata decodes Upload-Metadata: comma-separated pairs of a key and, unless
+// it is empty, its base64 value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata has an empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value of %s is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+func tusTestApp(t *testing.T, db *gorm.DB, st storage.Storage, spoolDir string, owner models.User) *fiber.App {
+	t.Helper()
+
+	cfg := &config.Config{
+		MaxFileSizeMB:       100,
+		UploadLimitMBPerDay: 100,
+		ChunkSizeMB:         testChunkSize / 1024 / 1024,
+		EncryptionKey:       bytes.Repeat([]byte{0x3c}, 32),
+		FileHost:            "/files/",
+	}
+	tus, err := NewTusServer(db, cfg, st, spoolDir)
+	if err != nil {
+		t.Fatalf("NewTusServer: %v", err)
+	}
+
+	app := downloadTestApp(db, st)
+	app.Use("/api", func(c *fiber.Ctx) error {
+		c.Locals("user", owner)
+		return c.Next()
+	})
+	app.Post("/api/tus", tus.Create)
+	app.Head("/api/tus/:sessionId", tus.Head)
+	app.Patch("/api/tus/:sessionId", tus.Patch)
+	app.Delete("/api/tus/:sessionId", tus.Terminate)
+	return app
+}
+
+func tusRequest(t *testing.T, app *fiber.App, method, path string, body []byte, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	return res
+}
+
+func tusPatch(t *testing.T, app *fiber.App, location string, offset int64, body []byte) *http.Response {
+	t.Helper()
+	return tusRequest(t, app, "PATCH", location, body, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+	})
+}
+
+func tusOffset(t *testing.T, app *fiber.App, location string) int64 {
+	t.Helper()
+	res := tusRequest(t, app, "HEAD", location, nil, nil)
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("HEAD %s gave %d", location, res.StatusCode)
+	}
+	offset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		t.Fatalf("HEAD %s reported offset %q", location, res.Header.Get("Upload-Offset"))
+	}
+	return offset
+}
+
+// PATCHes that start and end anywhere - mid-frame, across a chunk boundary - still
+// store a file on the session's chunk layout, and a restart between them loses no more
+// than the frame that was being filled.
+func TestTusUploadLandsOnTheChunkLayout(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	spoolDir := t.TempDir()
+
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := tusTestApp(t, db, st, spoolDir, owner)
+
+	plain := testContent(2*testChunkSize + 12345)
+	res := tusRequest(t, app, "POST", "/api/tus", nil, map[string]string{
+		"Upload-Length": strconv.Itoa(len(plain)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("tus.bin")) +
+			",filetype " + base64.StdEncoding.EncodeToString([]byte("application/x-test")),
+	})
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("creating the upload gave %d", res.StatusCode)
+	}
+	location := res.Header.Get("Location")
+	if res.Header.Get("Tus-Resumable") != "1.0.0" || res.Header.Get("Upload-Expires") == "" {
+		t.Errorf("creation answered without the tus headers: %v", res.Header)
+	}
+
+	// Ends mid-frame, then crosses into the second chunk and ends mid-frame again.
+	cuts := []int64{100_001, testChunkSize + utils.FrameSize + 7}
+	var offset int64
+	for _, cut := range cuts {
+		if res := tusPatch(t, app, location, offset, plain[offset:cut]); res.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("PATCH at %d gave %d", offset, res.StatusCode)
+		}
+		offset = cut
+		if got := tusOffset(t, app, location); got != offset {
+			t.Fatalf("HEAD after PATCH reports offset %d, want %d", got, offset)
+		}
+	}
+
+	if res := tusPatch(t, app, location, offset-1, plain[offset-1:]); res.StatusCode != fiber.StatusConflict {
+		t.Errorf("PATCH at a stale offset gave %d, want 409", res.StatusCode)
+	}
+
+	// A restart keeps the first chunk, in storage, and the whole frames of the second,
+	// in the spool; the seven bytes of the frame being filled were only in memory.
+	app = tusTestApp(t, db, st, spoolDir, owner)
+	offset = tusOffset(t, app, location)
+	if want := int64(testChunkSize + utils.FrameSize); offset != want {
+		t.Fatalf("HEAD after a restart reports offset %d, want %d", offset, want)
+	}
+
+	res = tusPatch(t, app, location, offset, plain[offset:])
+	if res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("the final PATCH gave %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Upload-Offset"); got != strconv.Itoa(len(plain)) {
+		t.Errorf("the final PATCH reports offset %s, want %d", got, len(plain))
+	}
+
+	var file models.UploadedFile
+	if err := db.Preload("Shares").Where("file_id = ?", res.Header.Get("Bindle-File-Id")).First(&file).Error; err != nil {
+		t.Fatalf("the finished upload has no record: %v", err)
+	}
+	if file.FileName != "tus.bin" || file.MimeType != "application/x-test" || file.ChunkCount != 3 {
+		t.Errorf("the upload was recorded as %q, %q in %d chunks", file.FileName, file.MimeType, file.ChunkCount)
+	}
+	if got := res.Header.Get("Bindle-File-Url"); got != shareURL(file) {
+		t.Errorf("the final PATCH points at %q, want %q", got, shareURL(file))
+	}
+	if res, body := download(t, app, shareURL(file), nil); res.StatusCode != fiber.StatusOK || !bytes.Equal(body, plain) {
+		t.Errorf("downloading the tus upload gave %d, want the file", res.StatusCode)
+	}
+	if got := tusOffset(t, app, location); got != int64(len(plain)) {
+		t.Errorf("HEAD on the finished upload reports %d, want %d", got, len(plain))
+	}
+}
+
+func TestTusRefusesOtherVersions(t *testing.T) {
+	db := newTestDB(t)
+	owner := models.User{AccountId: "aaaaaaaaaaaaaaaaaaaaaa"}
+	db.Create(&owner)
+	app := tusTestApp(t, db, newTestStorage(t), t.TempDir(), owner)
+
+	req := httptest.NewRequest("POST", "/api/tus", nil)
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	req.Header.Set("Upload-Length", "10")
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	if res.StatusCode != fiber.StatusPreconditionFailed || res.Header.Get("Tus-Version") != "1.0.0" {
+		t.Errorf("an unsupported version gave %d with Tus-Version %q", res.StatusCode, res.Header.Get("Tus-Version"))
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+// viewerScript decrypts a client-encrypted file in the browser. The key is the share
+// URL's fragment, base64url, which never reaches the server. The format is the one
+// bindle-client's sealing.ts writes: 64 KiB frames of plaintext, each sealed with
+// AES-256-GCM under the frame's index as nonce and followed by its tag, with the last
+// frame's additional data set to 1 so that a file cut short at a frame boundary fails.
+//
+// It is hashed into the page's Content-Security-Policy, so it has to stay exactly the
+// bytes that are served.
+const viewerScript = `(async () => {
+	const FRAME_SIZE = 65536;
+	const TAG_SIZE = 16;
+	const BATCH_FRAMES = 64;
+	const main = document.querySelector("main");
+	const status = document.getElementById("status");
+	const fail = (message) => {
+		status.textContent = message;
+		status.className = "error";
+	};
+
+	const encoded = location.hash.slice(1);
+	if (!encoded) {
+		return fail("This link is missing the key the file is encrypted with.");
+	}
+	if (!window.crypto || !crypto.subtle) {
+		return fail("Your browser can only decrypt this file over HTTPS.");
+	}
+
+	let response;
+	try {
+		response = await fetch(location.pathname, { headers: { Accept: "application/octet-stream" } });
+	} catch (e) {
+		return fail("The file could not be fetched.");
+	}
+	if (!response.ok || !response.body) {
+		return fail("The file could not be fetched (" + response.status + ").");
+	}
+
+	// Frames are decrypted as they arrive and moved into a Blob a batch at a time, so
+	// neither the ciphertext nor the plaintext is ever held whole by the page; the
+	// browser keeps the Blob, on disk if it is large. Whether a frame is the last one
+	// is only known once the response ends, so one sealed frame is always held back.
+	const sealedFrame = FRAME_SIZE + TAG_SIZE;
+	const total = Number(response.headers.get("Content-Length")) || 0;
+	let blob = new Blob([]);
+	try {
+		const raw = Uint8Array.from(atob(encoded.replace(/-/g, "+").replace(/_/g, "/")), (c) => c.charCodeAt(0));
+		const key = await crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["decrypt"]);
+		let index = 0;
+		let batch = [];
+		const open = async (frame, last) => {
+			const iv = new Uint8Array(12);
+			new DataView(iv.buffer).setBigUint64(4, BigInt(index));
+			const additionalData = Uint8Array.of(last ? 1 : 0);
+			batch.push(await crypto.subtle.decrypt({ name: "AES-GCM", iv, additionalData }, key, frame));
+			index++;
+			if (last || batch.length === BATCH_FRAMES) {
+				blob = new Blob([blob, ...batch]);
+				batch = [];
+				if (total) {
+					status.textContent = "Decrypting… " + Math.min(100, Math.floor(index * sealedFrame * 100 / total)) + "%";
+				}
+			}
+		};
+
+		const reader = response.body.getReader();
+		let pending = new Uint8Array(0);
+		for (;;) {
+			const { done, value } = await reader.read();
+			if (done) {
+				break;
+			}
+			const joined = new Uint8Array(pending.length + value.length);
+			joined.set(pending);
+			joined.set(value, pending.length);
+			let offset = 0;
+			while (joined.length - offset > sealedFrame) {
+				await open(joined.subarray(offset, offset + sealedFrame), false);
+				offset += sealedFrame;
+			}
+			pending = joined.slice(offset);
+		}
+		await open(pending, true);
+	} catch (e) {
+		return fail("The file could not be decrypted. The link may be incomplete, or the file was changed.");
+	}
+
+	const type = main.dataset.type || "application/octet-stream";
+	const url = URL.createObjectURL(new Blob([blob], { type }));
+	const kind = type.split("/")[0];
+	if (kind === "image" || kind === "video" || kind === "audio") {
+		const media = document.createElement(kind === "image" ? "img" : kind);
+		media.src = url;
+		if (kind === "image") {
+			media.alt = main.dataset.name;
+		} else {
+			media.controls = true;
+		}
+		document.getElementById("preview").append(media);
+	}
+	const save = document.getElementById("save");
+	save.href = url;
+	save.download = main.dataset.name;
+	save.hidden = false;
+	status.textContent = "Decrypted in your browser. The server only ever had the encrypted file.";
+})();`
+
+// viewerPolicy lets the page run viewerScript and nothing else, fetch the file from its
+// own origin and show what it decrypted, which it hands to media elements as blob: URLs.
+var viewerPolicy = func() string {
+	sum := sha256.Sum256([]byte(viewerScript))
+	return "default-src 'none'; script-src 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'; " +
+		"style-src 'unsafe-inline'; connect-src 'self'; img-src blob:; media-src blob:; base-uri 'none'; form-action 'none'"
+}()
+
+// viewerPage is what a browser gets for a client-encrypted file: the name and type it was
+// uploaded with, and viewerScript to fetch and decrypt the rest. Nothing it decrypted is
+// rendered as a document, only handed to an image, video or audio element or saved, so a
+// file cannot run script in the page.
+var viewerPage = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="referrer" content="no-referrer">
+<title>{{.FileName}}</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 10vh; }
+main { display: flex; flex-direction: column; align-items: center; gap: 0.75rem; max-width: 90vw; }
+#preview img, #preview video { max-width: 90vw; max-height: 65vh; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<main data-name="{{.FileName}}" data-type="{{.MimeType}}">
+<h1>{{.FileName}}</h1>
+<p id="status">Decrypting…</p>
+<noscript><p class="error">This file is end-to-end encrypted and can only be opened with JavaScript.</p></noscript>
+<div id="preview"></div>
+<a id="save" hidden>Download</a>
+</main>
+<script>{{.Script}}</script>
+</body>
+</html>
+`))
+
+// sendViewer answers a browser navigating to a client-encrypted file with viewerPage. The
+// file's own URL serves both the page and the ciphertext, told apart by Accept, so the
+// key in the fragment stays with the page that reads it.
+func sendViewer(c *fiber.Ctx, file *models.UploadedFile) error {
+	c.Set(fiber.HeaderContentSecurityPolicy, viewerPolicy)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return viewerPage.Execute(c.Response().BodyWriter(), struct {
+		FileName string
+		MimeType string
+		Script   template.JS
+	}{file.FileName, file.MimeType, template.JS(viewerScript)})
+}
@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/cleanup"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// accountExpiryInterval is how often expired accounts are looked for. The window is
+// configured in days, so an hour of slack is invisible.
+const accountExpiryInterval = time.Hour
+
+// ExpiringAccount is an account past the expiration cutoff, with what deleting it frees.
+type ExpiringAccount struct {
+	User         models.User
+	FileCount    int64
+	StorageUsage int64
+}
+
+// ExpirySummary is what one expiration run removed.
+type ExpirySummary struct {
+	Accounts int
+	Files    int
+	Bytes    int64
+}
+
+// ExpirationCutoff is the LastLogin before which an account counts as abandoned.
+func ExpirationCutoff(cfg *config.Config, now time.Time) time.Time {
+	return now.AddDate(0, 0, -cfg.AccountExpirationDays)
+}
+
+// StartAccountExpiry deletes accounts nobody has used for AccountExpirationDays, along
+// with their files. Accounts are anonymous - whoever loses the ID loses the account - so
+// without this every abandoned account keeps its files forever. A window of zero or less
+// turns expiration off.
+func StartAccountExpiry(db *gorm.DB, st storage.Storage, cfg *config.Config) {
+	if cfg.AccountExpirationDays <= 0 {
+		log.Println("Account expiration is disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(accountExpiryInterval)
+		defer ticker.Stop()
+		for {
+			summary, err := ExpireAccounts(db, st, ExpirationCutoff(cfg, time.Now()))
+			if err != nil {
+				log.Printf("Failed to expire accounts: %v", err)
+			}
+			if summary.Accounts > 0 {
+				log.Printf("Expired %d accounts inactive for %d days, deleting %d files (%d bytes)",
+					summary.Accounts, cfg.AccountExpirationDays, summary.Files, summary.Bytes)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// FindExpiredAccounts lists the accounts last seen before cutoff, oldest first. It
+// changes nothing, so it also answers what the next run would delete.
+func FindExpiredAccounts(db *gorm.DB, cutoff time.Time) ([]ExpiringAccount, error) {
+	var users []models.User
+	if err := db.Where("last_login < ?", cutoff).Order("last_login").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	accounts := make([]ExpiringAccount, 0, len(users))
+	for _, user := range users {
+		account := ExpiringAccount{User: user}
+		err := db.Model(&models.UploadedFile{}).
+			Where("owner_id = ?", user.ID).
+			Select("COUNT(*), COALESCE(SUM(size), 0)").
+			Row().Scan(&account.FileCount, &account.StorageUsage)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// ExpireAccounts deletes every account last seen before cutoff. A failure on one account
+// is logged and the rest still run; the error returned is only for the lookup itself.
+func ExpireAccounts(db *gorm.DB, st storage.Storage, cutoff time.Time) (ExpirySummary, error) {
+	var summary ExpirySummary
+
+	accounts, err := FindExpiredAccounts(db, cutoff)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, account := range accounts {
+		// Checked again right before deleting: an account that came back since the
+		// lookup has a fresh LastLogin and must be left alone.
+		var user models.User
+		if err := db.Where("id = ? AND last_login < ?", account.User.ID, cutoff).First(&user).Error; err != nil {
+			continue
+		}
+
+		files, err := cleanup.DeleteAccount(db, st, &user)
+		summary.Files += files
+		if err != nil {
+			log.Printf("Failed to expire account %s: %v", user.AccountId, err)
+			continue
+		}
+		summary.Accounts++
+		summary.Bytes += account.StorageUsage
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,192 @@
+package jobs
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/nuuner/bindle-server/internal/middleware"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// storeBlob writes data to filePath through the chunked upload path, the way every
+// stored object is written.
+func storeBlob(t *testing.T, st storage.Storage, filePath string, data []byte) {
+	t.Helper()
+	sessionID := uuid.New().String()
+	if _, err := st.InitChunkedUpload(sessionID, filePath, 1, testChunkSize, storage.ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk(sessionID, 0, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("SaveChunk: %v", err)
+	}
+	if _, err := st.FinalizeChunkedUpload(sessionID); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+}
+
+func blobExists(st storage.Storage, filePath string, size int64) bool {
+	r, _, err := st.GetFileStream(filePath, storage.StoredFile{
+		EncryptionVersion: utils.EncryptionVersionStream,
+		ChunkCount:        1,
+		PlainSize:         size,
+	})
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+func seedAccount(t *testing.T, db *gorm.DB, accountId string, lastLogin time.Time, filePaths ...string) models.User {
+	t.Helper()
+	user := models.User{AccountId: accountId, LastLogin: lastLogin}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("failed to seed user: %v", err)
+	}
+	db.Create(&models.AccountIpConnection{AccountID: user.ID, IPAddress: "192.0.2.1"})
+	for _, filePath := range filePaths {
+		file := models.UploadedFile{
+			FileId:            uuid.New().String(),
+			FilePath:          filePath,
+			FileName:          filePath,
+			Size:              100,
+			OwnerID:           user.ID,
+			ChunkCount:        1,
+			EncryptionVersion: utils.EncryptionVersionStream,
+		}
+		if err := db.Create(&file).Error; err != nil {
+			t.Fatalf("failed to seed file: %v", err)
+		}
+	}
+	return user
+}
+
+// An expired account takes its files with it, but a blob another account still
+// references has to survive: uploads are deduplicated across accounts. The deleted
+// records keep no copy of their data keys.
+func TestExpireAccountsDeletesOnlyWhatNobodyElseUses(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -30)
+
+	storeBlob(t, st, "exclusive.bin", bytes.Repeat([]byte{0xa5}, 100))
+	storeBlob(t, st, "shared.bin", bytes.Repeat([]byte{0xa5}, 100))
+
+	stale := seedAccount(t, db, "stale", now.AddDate(0, 0, -31), "exclusive.bin", "shared.bin")
+	active := seedAccount(t, db, "active", now.AddDate(0, 0, -1), "shared.bin")
+	db.Model(&models.UploadedFile{}).Where("1 = 1").Update("wrapped_key", []byte("wrapped"))
+
+	summary, err := ExpireAccounts(db, st, cutoff)
+	if err != nil {
+		t.Fatalf("ExpireAccounts: %v", err)
+	}
+	if summary != (ExpirySummary{Accounts: 1, Files: 2, Bytes: 200}) {
+		t.Errorf("summary is %+v, want one account with two files of 200 bytes", summary)
+	}
+
+	var users int64
+	db.Model(&models.User{}).Where("id = ?", stale.ID).Count(&users)
+	if users != 0 {
+		t.Error("the expired account still exists")
+	}
+	var connections int64
+	db.Model(&models.AccountIpConnection{}).Where("account_id = ?", stale.ID).Count(&connections)
+	if connections != 0 {
+		t.Error("the expired account's IP connections were kept")
+	}
+	var files int64
+	db.Model(&models.UploadedFile{}).Where("owner_id = ?", stale.ID).Count(&files)
+	if files != 0 {
+		t.Errorf("%d of the expired account's files were kept", files)
+	}
+	db.Unscoped().Model(&models.UploadedFile{}).Where("owner_id = ? AND wrapped_key IS NOT NULL", stale.ID).Count(&files)
+	if files != 0 {
+		t.Errorf("%d of the expired account's deleted files kept their data key", files)
+	}
+
+	if blobExists(st, "exclusive.bin", 100) {
+		t.Error("a blob only the expired account used was kept")
+	}
+	if !blobExists(st, "shared.bin", 100) {
+		t.Error("a blob an active account still uses was deleted")
+	}
+
+	db.Model(&models.UploadedFile{}).Where("owner_id = ? AND wrapped_key IS NOT NULL", active.ID).Count(&files)
+	if files != 1 {
+		t.Error("the active account lost its file or its data key")
+	}
+}
+
+// A client that comes back after its account expired is given a fresh, empty account
+// under the same ID, rather than tripping over the old one.
+func TestReturningClientGetsAnAccountAfterExpiry(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	accountId := utils.GenerateAccountId()
+	stale := seedAccount(t, db, accountId, time.Now().AddDate(0, 0, -31))
+
+	if _, err := ExpireAccounts(db, st, time.Now().AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("ExpireAccounts: %v", err)
+	}
+
+	app := fiber.New()
+	app.Use(middleware.AuthMiddleware(db))
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.JSON(c.Locals("user").(models.User).ID)
+	})
+	req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+	req.Header.Set("Authorization", accountId)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatalf("the returning client got %d: %s", res.StatusCode, body)
+	}
+
+	var user models.User
+	if err := db.Where("account_id = ?", accountId).First(&user).Error; err != nil {
+		t.Fatalf("no account was created: %v", err)
+	}
+	if user.ID == stale.ID {
+		t.Error("the expired account was brought back rather than replaced")
+	}
+}
+
+// The dry run has to list exactly what a run would delete, and delete nothing itself.
+func TestFindExpiredAccountsIsADryRun(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	seedAccount(t, db, "newer", now.AddDate(0, 0, -40), "a.bin", "b.bin")
+	seedAccount(t, db, "older", now.AddDate(0, 0, -90))
+	seedAccount(t, db, "recent", now.AddDate(0, 0, -2), "c.bin")
+
+	accounts, err := FindExpiredAccounts(db, now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatalf("FindExpiredAccounts: %v", err)
+	}
+	if len(accounts) != 2 || accounts[0].User.AccountId != "older" || accounts[1].User.AccountId != "newer" {
+		t.Fatalf("expected the two stale accounts oldest first, got %+v", accounts)
+	}
+	if accounts[1].FileCount != 2 || accounts[1].StorageUsage != 200 {
+		t.Errorf("the stale account with files reports %d files of %d bytes, want 2 of 200",
+			accounts[1].FileCount, accounts[1].StorageUsage)
+	}
+
+	var users int64
+	db.Model(&models.User{}).Count(&users)
+	if users != 3 {
+		t.Errorf("the dry run left %d accounts, want all 3", users)
+	}
+}
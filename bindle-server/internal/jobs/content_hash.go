@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// contentHashInterval is how often files without a content hash are looked for. After
+// the first pass only uploads whose hash could not be read back at completion turn up,
+// and they are rare.
+const contentHashInterval = time.Hour
+
+// StartContentHashing works out the SHA-256 of every file stored without one: chunked
+// uploads from before hashes were recorded, and any whose hash failed when it was
+// finalized. Downloads carry the hash so they can be checked, and dedup matches on it,
+// so neither should depend on when a file happened to be uploaded.
+func StartContentHashing(db *gorm.DB, st storage.Storage) {
+	go func() {
+		ticker := time.NewTicker(contentHashInterval)
+		defer ticker.Stop()
+		for {
+			if hashed, err := HashStoredFiles(db, st); err != nil {
+				log.Printf("Failed to hash stored files: %v", err)
+			} else if hashed > 0 {
+				log.Printf("Recorded content hashes for %d stored files", hashed)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// HashStoredFiles reads back every stored object that has a record without a content
+// hash and records the hash on all of that object's records. An object that cannot be
+// read is logged and tried again on the next pass. It returns how many objects it hashed.
+func HashStoredFiles(db *gorm.DB, st storage.Storage) (int, error) {
+	var files []models.UploadedFile
+	if err := db.Where("content_hash = ''").Order("id").Find(&files).Error; err != nil {
+		return 0, err
+	}
+
+	hashed := 0
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		if seen[file.FilePath] {
+			continue
+		}
+		seen[file.FilePath] = true
+
+		hash, err := hashStoredFile(st, &file)
+		if err != nil {
+			log.Printf("Failed to hash %s: %v", file.FilePath, err)
+			continue
+		}
+		err = db.Model(&models.UploadedFile{}).
+			Where("file_path = ? AND content_hash = ''", file.FilePath).
+			UpdateColumn("content_hash", hash).Error
+		if err != nil {
+			return hashed, err
+		}
+		hashed++
+	}
+	return hashed, nil
+}
+
+func hashStoredFile(st storage.Storage, file *models.UploadedFile) (string, error) {
+	reader, _, err := st.GetFileStream(file.FilePath, storage.StoredFile{
+		EncryptionVersion: file.EncryptionVersion,
+		ChunkCount:        file.ChunkCount,
+		PlainSize:         file.Size,
+		Key:               storage.ObjectKey{KeyID: file.EncryptionKeyID, Wrapped: file.WrappedKey},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,45 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+// Files stored without a hash get one read back from storage, every record of a shared
+// object included, and a file that cannot be read is left to try again.
+func TestHashStoredFilesFillsInMissingHashes(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	data := bytes.Repeat([]byte{0x5a}, 100)
+	storeBlob(t, st, "shared.bin", data)
+	seedAccount(t, db, "first", time.Now(), "shared.bin")
+	seedAccount(t, db, "second", time.Now(), "shared.bin", "missing.bin")
+
+	hashed, err := HashStoredFiles(db, st)
+	if err != nil {
+		t.Fatalf("HashStoredFiles: %v", err)
+	}
+	if hashed != 1 {
+		t.Errorf("hashed %d objects, want 1", hashed)
+	}
+
+	sum := sha256.Sum256(data)
+	var shared []models.UploadedFile
+	db.Where("file_path = ?", "shared.bin").Find(&shared)
+	for _, file := range shared {
+		if file.ContentHash != hex.EncodeToString(sum[:]) {
+			t.Errorf("a record of shared.bin has hash %q, want its SHA-256", file.ContentHash)
+		}
+	}
+	var missing models.UploadedFile
+	db.Where("file_path = ?", "missing.bin").First(&missing)
+	if missing.ContentHash != "" {
+		t.Errorf("an unreadable file was given hash %q", missing.ContentHash)
+	}
+}
@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/cleanup"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// fileExpiryInterval is how often expired files are swept. A file past its limits is
+// refused from the moment it reaches them, so the sweep only decides how long its bytes
+// linger in storage.
+const fileExpiryInterval = 5 * time.Minute
+
+// StartFileExpiry deletes files that have passed their expiresAt or used up their
+// maxDownloads.
+func StartFileExpiry(db *gorm.DB, st storage.Storage) {
+	go func() {
+		ticker := time.NewTicker(fileExpiryInterval)
+		defer ticker.Stop()
+		for {
+			if deleted, err := SweepExpiredFiles(db, st, time.Now()); err != nil {
+				log.Printf("Failed to sweep expired files: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d expired files", deleted)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// SweepExpiredFiles deletes every file that is no longer available at now, and its
+// stored object once nothing else references it. It returns how many files it deleted.
+func SweepExpiredFiles(db *gorm.DB, st storage.Storage, now time.Time) (int, error) {
+	var files []models.UploadedFile
+	err := db.Where("expires_at <= ? OR (max_downloads > 0 AND download_count >= max_downloads)", now).
+		Find(&files).Error
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := range files {
+		if err := cleanup.DeleteFile(db, st, &files[i]); err != nil {
+			log.Printf("Failed to delete expired file %s: %v", files[i].FileId, err)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+func TestSweepDeletesOnlyFilesPastTheirLimits(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	now := time.Now()
+
+	for _, path := range []string{"expired.bin", "spent.bin", "live.bin"} {
+		storeBlob(t, st, path, bytes.Repeat([]byte{0x5a}, 100))
+	}
+	user := seedAccount(t, db, "owner", now, "expired.bin", "spent.bin", "live.bin")
+
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	db.Model(&models.UploadedFile{}).Where("file_path = ?", "expired.bin").Update("expires_at", past)
+	db.Model(&models.UploadedFile{}).Where("file_path = ?", "spent.bin").
+		Updates(map[string]any{"max_downloads": 3, "download_count": 3})
+	db.Model(&models.UploadedFile{}).Where("file_path = ?", "live.bin").
+		Updates(map[string]any{"expires_at": future, "max_downloads": 3, "download_count": 2})
+
+	deleted, err := SweepExpiredFiles(db, st, now)
+	if err != nil {
+		t.Fatalf("SweepExpiredFiles: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("swept %d files, want 2", deleted)
+	}
+
+	var remaining []models.UploadedFile
+	db.Where("owner_id = ?", user.ID).Find(&remaining)
+	if len(remaining) != 1 || remaining[0].FilePath != "live.bin" {
+		t.Errorf("expected only live.bin to remain, got %+v", remaining)
+	}
+	if blobExists(st, "expired.bin", 100) || blobExists(st, "spent.bin", 100) {
+		t.Error("a swept file's blob was kept")
+	}
+	if !blobExists(st, "live.bin", 100) {
+		t.Error("a file still within its limits lost its blob")
+	}
+}
@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// LegacyMigrationStatus is the progress of the migration of files out of the formats
+// predating the streaming one, as shown on the admin panel. Migrated and Failed count the
+// current run, or the last one if none is running; Remaining counts what is still left,
+// runs or not.
+type LegacyMigrationStatus struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Total is how many files were left when the run started.
+	Total    int64 `json:"total"`
+	Migrated int   `json:"migrated"`
+	// Failed counts stored objects, each of which may hold several files. They are left
+	// as they were and tried again by the next run.
+	Failed    int    `json:"failed"`
+	LastError string `json:"lastError,omitempty"`
+	Remaining int64  `json:"remaining"`
+}
+
+// errMigrationInterrupted is reported for a run that was going when the server stopped.
+var errMigrationInterrupted = errors.New("stopped by a server restart; migrate again to carry on")
+
+// legacyMigration tells whether this process is running the migration. Everything else
+// about a run is kept on its models.LegacyMigrationRun.
+var legacyMigration struct {
+	sync.Mutex
+	running bool
+}
+
+// StartLegacyMigration rewrites every file still in a legacy format in the background,
+// and reports false without starting anything if a run is already going. Progress is kept
+// on the records - a file is done once its version is no longer 0 - so a run stopped
+// partway, by a restart or a failure, is resumed by starting another.
+func StartLegacyMigration(db *gorm.DB, st storage.Storage, cfg *config.Config) (bool, error) {
+	legacyMigration.Lock()
+	defer legacyMigration.Unlock()
+	if legacyMigration.running {
+		return false, nil
+	}
+
+	total, err := countLegacyFiles(db)
+	if err != nil {
+		return false, err
+	}
+	run := models.LegacyMigrationRun{StartedAt: time.Now(), Total: total}
+	if err := db.Create(&run).Error; err != nil {
+		return false, err
+	}
+	legacyMigration.running = true
+
+	go func() {
+		migrated, err := migrateLegacyFiles(db, st, cfg, func(migrated int, err error) {
+			updates := map[string]any{"migrated": gorm.Expr("migrated + ?", migrated)}
+			if err != nil {
+				updates["failed"] = gorm.Expr("failed + 1")
+				updates["last_error"] = err.Error()
+			}
+			if err := db.Model(&run).Updates(updates).Error; err != nil {
+				log.Printf("Failed to record legacy migration progress: %v", err)
+			}
+		})
+
+		updates := map[string]any{"finished_at": time.Now()}
+		if err != nil {
+			log.Printf("Failed to migrate legacy files: %v", err)
+			updates["last_error"] = err.Error()
+		}
+		if err := db.Model(&run).Updates(updates).Error; err != nil {
+			log.Printf("Failed to record the end of the legacy migration: %v", err)
+		}
+		log.Printf("Migrated %d legacy files", migrated)
+
+		legacyMigration.Lock()
+		defer legacyMigration.Unlock()
+		legacyMigration.running = false
+	}()
+	return true, nil
+}
+
+// LegacyMigrationProgress returns the state of the latest run of the legacy migration,
+// with Remaining counted afresh. A run that never finished and is not going in this
+// process was cut short by a restart.
+func LegacyMigrationProgress(db *gorm.DB) (LegacyMigrationStatus, error) {
+	legacyMigration.Lock()
+	running := legacyMigration.running
+	legacyMigration.Unlock()
+
+	var status LegacyMigrationStatus
+	var run models.LegacyMigrationRun
+	err := db.Order("id DESC").Limit(1).Find(&run).Error
+	if err != nil {
+		return status, err
+	}
+	if run.ID != 0 {
+		status = LegacyMigrationStatus{
+			Running:    running,
+			StartedAt:  &run.StartedAt,
+			FinishedAt: run.FinishedAt,
+			Total:      run.Total,
+			Migrated:   run.Migrated,
+			Failed:     run.Failed,
+			LastError:  run.LastError,
+		}
+		if !running && run.FinishedAt == nil {
+			status.LastError = errMigrationInterrupted.Error()
+		}
+	}
+
+	remaining, err := countLegacyFiles(db)
+	if err != nil {
+		return status, err
+	}
+	status.Remaining = remaining
+	return status, nil
+}
+
+// MigrateLegacyFiles rewrites every file in a format predating the streaming one -
+// sealed whole, or in chunks whose size is read from the current config - into the format
+// new uploads get, and returns how many files it moved. Each object is rewritten the way
+// key rotation rewrites one, at a new path under a data key of its own, and verified
+// before its records move over; overwriting it in place would leave nothing readable if
+// the rewrite were cut short. Once nothing is left at version 0, the legacy readers have
+// nothing to read.
+func MigrateLegacyFiles(db *gorm.DB, st storage.Storage, cfg *config.Config) (int, error) {
+	return migrateLegacyFiles(db, st, cfg, func(int, error) {})
+}
+
+// migrateLegacyFiles is MigrateLegacyFiles, calling report after each object with how
+// many files it moved, or why it could not.
+func migrateLegacyFiles(db *gorm.DB, st storage.Storage, cfg *config.Config, report func(int, error)) (int, error) {
+	var files []models.UploadedFile
+	if err := db.Where("encryption_version = ?", 0).Order("id").Find(&files).Error; err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	seen := make(map[string]bool, len(files))
+	for i := range files {
+		file := &files[i]
+		if seen[file.FilePath] {
+			continue
+		}
+		seen[file.FilePath] = true
+
+		moved, err := reencryptStoredFile(db, st, cfg, file)
+		if err != nil {
+			log.Printf("Failed to migrate %s: %v", file.FilePath, err)
+		}
+		report(moved, err)
+		migrated += moved
+	}
+	return migrated, nil
+}
+
+func countLegacyFiles(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Model(&models.UploadedFile{}).Where("encryption_version = ?", 0).Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// Files sealed whole and files sealed in chunks are both rewritten into the streaming
+// format, after which they read back without depending on the chunk size they were
+// written with. An object that cannot be read stays at version 0 for the next run.
+func TestMigrateLegacyFilesRewritesThemIntoTheStreamingFormat(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		FilesystemPath: dir,
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x33}, 32),
+	}
+	st, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("legacy "), testChunkSize/4)
+	whole, err := utils.EncryptFile(cfg, data)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	var chunked []byte
+	for i := 0; i*testChunkSize < len(data); i++ {
+		chunk, err := utils.EncryptChunk(cfg, data[i*testChunkSize:min((i+1)*testChunkSize, len(data))], i)
+		if err != nil {
+			t.Fatalf("EncryptChunk: %v", err)
+		}
+		chunked = append(chunked, chunk...)
+	}
+	os.WriteFile(filepath.Join(dir, "whole.bin"), whole, 0o600)
+	os.WriteFile(filepath.Join(dir, "chunked.bin"), chunked, 0o600)
+
+	user := seedAccount(t, db, "owner", time.Now())
+	for _, path := range []string{"whole.bin", "whole.bin", "chunked.bin", "missing.bin"} {
+		file := models.UploadedFile{
+			FileId:   uuid.New().String(),
+			FilePath: path,
+			Size:     int64(len(data)),
+			OwnerID:  user.ID,
+		}
+		if path == "chunked.bin" {
+			file.ChunkCount = 2
+		}
+		db.Create(&file)
+	}
+
+	migrated, err := MigrateLegacyFiles(db, st, cfg)
+	if err != nil {
+		t.Fatalf("MigrateLegacyFiles: %v", err)
+	}
+	if migrated != 3 {
+		t.Errorf("migrated %d files, want 3", migrated)
+	}
+	for _, path := range []string{"whole.bin", "chunked.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("the legacy object %s is still there: %v", path, err)
+		}
+	}
+
+	// A different chunk size would have broken the chunked file before.
+	resized := *cfg
+	resized.ChunkSizeMB = 5
+	after, err := storage.NewFilesystemStorage(resized)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	var files []models.UploadedFile
+	db.Where("encryption_version <> ?", 0).Order("id").Find(&files)
+	if len(files) != 3 || files[0].FilePath != files[1].FilePath {
+		t.Fatalf("%d files migrated, want whole.bin's two on one object and chunked.bin", len(files))
+	}
+	for _, file := range files {
+		if file.EncryptionVersion != utils.EncryptionVersionSubkey || file.ChunkCount != 0 || len(file.WrappedKey) == 0 {
+			t.Errorf("%s is at version %d with %d chunks", file.FilePath, file.EncryptionVersion, file.ChunkCount)
+		}
+		reader, _, err := after.GetFileStream(file.FilePath, storage.StoredFile{
+			EncryptionVersion: file.EncryptionVersion,
+			PlainSize:         file.Size,
+			Key:               storage.ObjectKey{KeyID: file.EncryptionKeyID, Wrapped: file.WrappedKey},
+		})
+		if err != nil {
+			t.Fatalf("GetFileStream(%s): %v", file.FilePath, err)
+		}
+		if got, _ := io.ReadAll(reader); !bytes.Equal(got, data) {
+			t.Errorf("%s does not read back as the original contents", file.FilePath)
+		}
+		reader.Close()
+	}
+
+	if left, _ := countLegacyFiles(db); left != 1 {
+		t.Errorf("%d files left at version 0, want only the unreadable one", left)
+	}
+	if migrated, _ := MigrateLegacyFiles(db, st, cfg); migrated != 0 {
+		t.Errorf("a second run migrated %d files, want none", migrated)
+	}
+}
+
+// An object that does not decrypt is not touched: its records keep the old path and
+// version, and the bytes stay as they were for the next run to try.
+func TestMigrateLegacyFilesLeavesAFailedObjectAsItWas(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		FilesystemPath: dir,
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x33}, 32),
+	}
+	st, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	corrupt := bytes.Repeat([]byte("not sealed "), 100)
+	os.WriteFile(filepath.Join(dir, "corrupt.bin"), corrupt, 0o600)
+	user := seedAccount(t, db, "owner", time.Now())
+	file := models.UploadedFile{
+		FileId:   uuid.New().String(),
+		FilePath: "corrupt.bin",
+		Size:     int64(len(corrupt)),
+		OwnerID:  user.ID,
+	}
+	db.Create(&file)
+
+	if migrated, err := MigrateLegacyFiles(db, st, cfg); err != nil || migrated != 0 {
+		t.Fatalf("MigrateLegacyFiles migrated %d files (err %v), want none", migrated, err)
+	}
+
+	var after models.UploadedFile
+	db.First(&after, file.ID)
+	if after.FilePath != "corrupt.bin" || after.EncryptionVersion != 0 || len(after.WrappedKey) != 0 || after.Size != file.Size {
+		t.Errorf("the record moved to %s at version %d", after.FilePath, after.EncryptionVersion)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "corrupt.bin")); !bytes.Equal(got, corrupt) {
+		t.Error("the object that failed was changed")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() != "corrupt.bin" {
+			t.Errorf("the failed rewrite left %s behind", entry.Name())
+		}
+	}
+}
+
+// The admin panel reads a run from the database, so what it shows survives a restart,
+// and a run the restart cut short is reported as stopped rather than still going.
+func TestLegacyMigrationProgressSurvivesARestart(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		FilesystemPath: dir,
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x33}, 32),
+	}
+	st, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	data := []byte("legacy contents")
+	sealed, err := utils.EncryptFile(cfg, data)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "whole.bin"), sealed, 0o600)
+	user := seedAccount(t, db, "owner", time.Now())
+	for _, path := range []string{"whole.bin", "missing.bin"} {
+		db.Create(&models.UploadedFile{FileId: uuid.New().String(), FilePath: path, Size: int64(len(data)), OwnerID: user.ID})
+	}
+
+	if started, err := StartLegacyMigration(db, st, cfg); !started || err != nil {
+		t.Fatalf("StartLegacyMigration = %v, %v", started, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var status LegacyMigrationStatus
+	for {
+		if status, err = LegacyMigrationProgress(db); err != nil {
+			t.Fatalf("LegacyMigrationProgress: %v", err)
+		}
+		if !status.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the migration did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.FinishedAt == nil || status.Total != 2 || status.Migrated != 1 || status.Failed != 1 ||
+		status.Remaining != 1 || status.LastError == "" {
+		t.Errorf("after the run the status is %+v", status)
+	}
+
+	// A run that was going when the server stopped has no end recorded.
+	db.Create(&models.LegacyMigrationRun{StartedAt: time.Now(), Total: 1})
+	if status, err = LegacyMigrationProgress(db); err != nil {
+		t.Fatalf("LegacyMigrationProgress: %v", err)
+	}
+	if status.Running || status.FinishedAt != nil || status.LastError != errMigrationInterrupted.Error() {
+		t.Errorf("a run cut short by a restart is reported as %+v", status)
+	}
+}
@@ -0,0 +1,302 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nuuner/bindle-server/internal/cleanup"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// reencryptionInterval is how often files under other keys are looked for. After the
+// first pass only objects whose rewrite failed turn up, or ones an upload was pointed at
+// while they were being moved.
+const reencryptionInterval = time.Hour
+
+// StartReencryption moves every file under a master key other than the active one to
+// the active key, so that a retired key - a leaked one, say - can be dropped from the
+// keyring once nothing needs it. Uploads still in progress have their data keys
+// rewrapped too, or they could not be finished once the old key is gone. Progress is
+// kept on the records: a file is done once it names the active key, so a restart carries
+// on with what is left.
+func StartReencryption(db *gorm.DB, st storage.Storage, cfg *config.Config) {
+	go func() {
+		ticker := time.NewTicker(reencryptionInterval)
+		defer ticker.Stop()
+		for {
+			if moved, err := ReencryptUploadSessions(db, cfg); err != nil {
+				log.Printf("Failed to rewrap the keys of upload sessions: %v", err)
+			} else if moved > 0 {
+				log.Printf("Moved %d upload sessions to key %q", moved, cfg.EncryptionKeyID)
+			}
+			if moved, err := ReencryptStoredFiles(db, st, cfg); err != nil {
+				log.Printf("Failed to re-encrypt stored files: %v", err)
+			} else if moved > 0 {
+				log.Printf("Moved %d files to key %q", moved, cfg.EncryptionKeyID)
+			}
+
+			files, sessions, err := countUnderOtherKeys(db, cfg)
+			if err != nil {
+				log.Printf("Failed to count files under other keys: %v", err)
+			} else if files > 0 || sessions > 0 {
+				log.Printf("%d files and %d uploads in progress are still encrypted with a key other than %q",
+					files, sessions, cfg.EncryptionKeyID)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// countUnderOtherKeys counts the files and the uploads in progress that still need a
+// master key other than the active one. Client-encrypted ones need none of the server's.
+func countUnderOtherKeys(db *gorm.DB, cfg *config.Config) (files, sessions int64, err error) {
+	err = db.Model(&models.UploadedFile{}).
+		Where("encryption_key_id <> ? AND client_encrypted = ?", cfg.EncryptionKeyID, false).
+		Count(&files).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	err = activeSessionsUnderOtherKeys(db, cfg).Model(&models.UploadSession{}).Count(&sessions).Error
+	return files, sessions, err
+}
+
+// activeSessionsUnderOtherKeys selects the uploads in progress whose chunks are sealed
+// under a master key other than the active one.
+func activeSessionsUnderOtherKeys(db *gorm.DB, cfg *config.Config) *gorm.DB {
+	return db.Where("status = ? AND encryption_key_id <> ? AND client_encrypted = ?",
+		models.UploadSessionStatusActive, cfg.EncryptionKeyID, false)
+}
+
+// ReencryptUploadSessions rewraps the data key of every upload in progress under another
+// master key, so that the chunks still to come, and the file the upload becomes, can be
+// sealed and read once the old key is gone. A session that predates data keys has its
+// chunks sealed with the old master key itself; it is left to finish, and the file it
+// becomes is moved like any other. It returns how many sessions it moved.
+func ReencryptUploadSessions(db *gorm.DB, cfg *config.Config) (int, error) {
+	var sessions []models.UploadSession
+	err := activeSessionsUnderOtherKeys(db, cfg).Where("wrapped_key IS NOT NULL AND length(wrapped_key) > 0").
+		Order("id").Find(&sessions).Error
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, session := range sessions {
+		wrapped, err := rewrapDataKey(cfg, session.EncryptionKeyID, session.WrappedKey)
+		if err != nil {
+			log.Printf("Failed to rewrap the key of upload session %s: %v", session.SessionID, err)
+			continue
+		}
+		// Only if the session still holds the key just unwrapped: one that ended
+		// meanwhile has had it wiped.
+		result := db.Model(&models.UploadSession{}).
+			Where("id = ? AND encryption_key_id = ? AND wrapped_key = ?", session.ID, session.EncryptionKeyID, session.WrappedKey).
+			Updates(map[string]any{"encryption_key_id": cfg.EncryptionKeyID, "wrapped_key": wrapped})
+		if result.Error != nil {
+			log.Printf("Failed to rewrap the key of upload session %s: %v", session.SessionID, result.Error)
+			continue
+		}
+		moved += int(result.RowsAffected)
+	}
+	return moved, nil
+}
+
+// ReencryptStoredFiles moves every file under another master key to the active one. A
+// file with a data key of its own only has that key rewrapped. One sealed with the old
+// master key itself has its object rewritten under a new data key, and every record of
+// the object moves with it. A file that cannot be moved is logged and tried again on the
+// next pass. Client-encrypted files are under no key of the server's and are left out.
+// It returns how many files it moved.
+func ReencryptStoredFiles(db *gorm.DB, st storage.Storage, cfg *config.Config) (int, error) {
+	var files []models.UploadedFile
+	err := db.Where("encryption_key_id <> ? AND client_encrypted = ?", cfg.EncryptionKeyID, false).
+		Order("id").Find(&files).Error
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	seen := make(map[string]bool, len(files))
+	for i := range files {
+		file := &files[i]
+		if len(file.WrappedKey) > 0 {
+			if err := rewrapKey(db, cfg, file); err != nil {
+				log.Printf("Failed to rewrap the key of %s: %v", file.FileId, err)
+				continue
+			}
+			moved++
+			continue
+		}
+
+		if seen[file.FilePath] {
+			continue
+		}
+		seen[file.FilePath] = true
+
+		rewritten, err := reencryptStoredFile(db, st, cfg, file)
+		if err != nil {
+			log.Printf("Failed to re-encrypt %s: %v", file.FilePath, err)
+			continue
+		}
+		moved += rewritten
+	}
+	return moved, nil
+}
+
+// rewrapKey wraps file's data key under the active master key. The object itself is
+// untouched: it was never sealed with the master key.
+func rewrapKey(db *gorm.DB, cfg *config.Config, file *models.UploadedFile) error {
+	wrapped, err := rewrapDataKey(cfg, file.EncryptionKeyID, file.WrappedKey)
+	if err != nil {
+		return err
+	}
+	// Only if the record still holds the key just unwrapped: one written over meanwhile
+	// has a new key already.
+	return db.Model(&models.UploadedFile{}).
+		Where("id = ? AND encryption_key_id = ?", file.ID, file.EncryptionKeyID).
+		Updates(map[string]any{"encryption_key_id": cfg.EncryptionKeyID, "wrapped_key": wrapped}).Error
+}
+
+// rewrapDataKey unwraps a data key wrapped under the master key keyID and wraps it again
+// under the active one.
+func rewrapDataKey(cfg *config.Config, keyID string, wrapped []byte) ([]byte, error) {
+	dataKey, err := storage.ObjectKey{KeyID: keyID, Wrapped: wrapped}.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return utils.WrapDataKey(cfg.EncryptionKey, dataKey)
+}
+
+// reencryptStoredFile decrypts the object file points at and writes it back out under a
+// new data key at a new path, and returns how many records it moved there. The new path
+// is what makes the switch safe: the records move over in one update, and until they do,
+// downloads keep reading the old object with the key it was sealed with. The old object
+// goes once nothing points at it, and not before the new one has been read back and
+// found to hold the same bytes.
+//
+// The object is written as a chunked upload, as that is the one way into storage with
+// no limit on size; a single S3 PUT stops at 5 GB.
+func reencryptStoredFile(db *gorm.DB, st storage.Storage, cfg *config.Config, file *models.UploadedFile) (int, error) {
+	reader, _, err := st.GetFileStream(file.FilePath, storage.StoredFile{
+		EncryptionVersion: file.EncryptionVersion,
+		ChunkCount:        file.ChunkCount,
+		PlainSize:         file.Size,
+		Key:               storage.ObjectKey{KeyID: file.EncryptionKeyID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	source := sha256.New()
+
+	key, err := storage.NewObjectKey(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	newPath := reencryptedPath(file.FilePath)
+	chunkSize := cfg.ChunkSizeMB * 1024 * 1024
+	totalChunks := max(1, int((file.Size+chunkSize-1)/chunkSize))
+	sessionID := uuid.NewString()
+	if _, err := st.InitChunkedUpload(sessionID, newPath, totalChunks, chunkSize, key); err != nil {
+		return 0, err
+	}
+
+	hash, err := copyChunks(st, sessionID, io.TeeReader(reader, source), file.Size, chunkSize, totalChunks)
+	if err != nil {
+		if abortErr := st.AbortChunkedUpload(sessionID); abortErr != nil {
+			log.Printf("Warning: failed to abort the rewrite of %s: %v", file.FilePath, abortErr)
+		}
+		return 0, err
+	}
+	if file.ContentHash != "" && hash != "" && hash != file.ContentHash {
+		st.DeleteFile(newPath)
+		return 0, fmt.Errorf("contents hash to %s, but the record says %s", hash, file.ContentHash)
+	}
+	rewritten := models.UploadedFile{
+		FilePath:          newPath,
+		Size:              file.Size,
+		EncryptionKeyID:   key.KeyID,
+		WrappedKey:        key.Wrapped,
+		EncryptionVersion: key.EncryptionVersion(),
+	}
+	written, err := hashStoredFile(st, &rewritten)
+	if err != nil {
+		st.DeleteFile(newPath)
+		return 0, fmt.Errorf("failed to read back %s: %w", newPath, err)
+	}
+	if read := hex.EncodeToString(source.Sum(nil)); written != read {
+		st.DeleteFile(newPath)
+		return 0, fmt.Errorf("%s reads back as %s, but %s was written", newPath, written, read)
+	}
+
+	updates := map[string]any{
+		"file_path":          newPath,
+		"encryption_key_id":  key.KeyID,
+		"wrapped_key":        key.Wrapped,
+		"encryption_version": key.EncryptionVersion(),
+		"chunk_count":        0,
+	}
+	if file.ContentHash == "" && hash != "" {
+		updates["content_hash"] = hash
+	}
+	// Only the records still pointing at the old object under the old key: one written
+	// over or deleted meanwhile has moved on, and its new contents are not these.
+	result := db.Model(&models.UploadedFile{}).
+		Where("file_path = ? AND encryption_key_id = ?", file.FilePath, file.EncryptionKeyID).
+		Updates(updates)
+	if result.Error != nil {
+		st.DeleteFile(newPath)
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		st.DeleteFile(newPath)
+		return 0, nil
+	}
+
+	if err := cleanup.ReleaseStoredFile(db, st, file.FilePath); err != nil {
+		if !errors.Is(err, cleanup.ErrStoredFileKept) {
+			return 0, err
+		}
+		log.Printf("Warning: %v", err)
+	}
+	log.Printf("Re-encrypted %s as %s with key %q", file.FilePath, newPath, cfg.EncryptionKeyID)
+	return int(result.RowsAffected), nil
+}
+
+// copyChunks writes size bytes from r into an open chunked upload and publishes it,
+// returning the hash FinalizeChunkedUpload reports. A reader that does not end where the
+// record says the file does is refused rather than cut short or padded.
+func copyChunks(st storage.Storage, sessionID string, r io.Reader, size, chunkSize int64, totalChunks int) (string, error) {
+	for i := range totalChunks {
+		plainSize := min(chunkSize, size-int64(i)*chunkSize)
+		if err := st.SaveChunk(sessionID, i, r, plainSize); err != nil {
+			return "", err
+		}
+	}
+	if n, _ := io.ReadFull(r, make([]byte, 1)); n > 0 {
+		return "", fmt.Errorf("stored object is longer than the %d bytes recorded", size)
+	}
+	return st.FinalizeChunkedUpload(sessionID)
+}
+
+// reencryptedPath names the object a file is rewritten to: its own path with a random
+// suffix before the extension, which share links end in and dedup matches on. A suffix
+// left by an earlier rotation is replaced rather than added to.
+func reencryptedPath(filePath string) string {
+	ext := filepath.Ext(filePath)
+	stem, _, _ := strings.Cut(strings.TrimSuffix(filePath, ext), "~")
+	return stem + "~" + uuid.NewString()[:8] + ext
+}
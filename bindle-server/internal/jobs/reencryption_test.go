@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// After a new master key is made active, a file with a data key of its own has just that
+// key rewrapped, while an object sealed with the old master key itself is rewritten under
+// a data key at a new path, with all of its records moved over and the old object
+// removed. Either way the old key is no longer needed. An object that cannot be read is
+// left to try again.
+func TestReencryptStoredFilesMovesEverythingToTheActiveKey(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	oldCfg := config.Config{FilesystemPath: dir, EncryptionKey: bytes.Repeat([]byte{0x19}, 32)}
+	old, err := storage.NewFilesystemStorage(oldCfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("rotate me "), testChunkSize/4)
+	sum := sha256.Sum256(data)
+	storeBlob(t, old, "shared.bin", data)
+	dataKey, err := storage.NewObjectKey(&oldCfg)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	sessionID := uuid.New().String()
+	old.InitChunkedUpload(sessionID, "enveloped.bin", 1, testChunkSize, dataKey)
+	old.SaveChunk(sessionID, 0, bytes.NewReader(data), int64(len(data)))
+	if _, err := old.FinalizeChunkedUpload(sessionID); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	user := seedAccount(t, db, "owner", time.Now())
+	for _, path := range []string{"shared.bin", "shared.bin", "missing.bin", "enveloped.bin"} {
+		file := models.UploadedFile{
+			FileId:            uuid.New().String(),
+			FilePath:          path,
+			Size:              int64(len(data)),
+			OwnerID:           user.ID,
+			EncryptionVersion: utils.EncryptionVersionStream,
+			ContentHash:       hex.EncodeToString(sum[:]),
+		}
+		if path == "enveloped.bin" {
+			file.WrappedKey, file.EncryptionVersion = dataKey.Wrapped, dataKey.EncryptionVersion()
+		}
+		db.Create(&file)
+	}
+
+	newKey := bytes.Repeat([]byte{0x2a}, 32)
+	cfg := &config.Config{
+		FilesystemPath:  dir,
+		ChunkSizeMB:     testChunkSize / 1024 / 1024,
+		EncryptionKey:   newKey,
+		EncryptionKeyID: "next",
+		EncryptionKeys:  map[string][]byte{"": oldCfg.EncryptionKey, "next": newKey},
+	}
+	rotated, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	moved, err := ReencryptStoredFiles(db, rotated, cfg)
+	if err != nil {
+		t.Fatalf("ReencryptStoredFiles: %v", err)
+	}
+	if moved != 3 {
+		t.Errorf("moved %d files, want 3", moved)
+	}
+
+	var files []models.UploadedFile
+	db.Where("encryption_key_id = ?", "next").Order("id").Find(&files)
+	if len(files) != 3 || files[0].FilePath != files[1].FilePath || files[2].FilePath != "enveloped.bin" {
+		t.Fatalf("%d files moved to the new key, want shared.bin's two on one object and enveloped.bin in place", len(files))
+	}
+	if newPath := files[0].FilePath; !strings.HasPrefix(newPath, "shared~") || filepath.Ext(newPath) != ".bin" {
+		t.Errorf("the object was rewritten to %q", newPath)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared.bin")); !os.IsNotExist(err) {
+		t.Errorf("the object under the old key is still there: %v", err)
+	}
+	if bytes.Equal(files[2].WrappedKey, dataKey.Wrapped) {
+		t.Error("enveloped.bin's data key was not rewrapped")
+	}
+
+	// Read back with only the new key, as once the old one has been removed.
+	retired, err := storage.NewFilesystemStorage(config.Config{FilesystemPath: dir, EncryptionKey: newKey, EncryptionKeyID: "next"})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	for _, file := range files[1:] {
+		if len(file.WrappedKey) == 0 {
+			t.Errorf("%s was left without a data key", file.FilePath)
+		}
+		reader, _, err := retired.GetFileStream(file.FilePath, storage.StoredFile{
+			EncryptionVersion: file.EncryptionVersion,
+			PlainSize:         file.Size,
+			Key:               storage.ObjectKey{KeyID: file.EncryptionKeyID, Wrapped: file.WrappedKey},
+		})
+		if err != nil {
+			t.Fatalf("GetFileStream(%s): %v", file.FilePath, err)
+		}
+		if got, _ := io.ReadAll(reader); !bytes.Equal(got, data) {
+			t.Errorf("%s does not read back as the original contents", file.FilePath)
+		}
+		reader.Close()
+	}
+
+	var missing models.UploadedFile
+	db.Where("file_path = ?", "missing.bin").First(&missing)
+	if missing.EncryptionKeyID != "" {
+		t.Errorf("an unreadable file was moved to key %q", missing.EncryptionKeyID)
+	}
+	if moved, _ := ReencryptStoredFiles(db, rotated, cfg); moved != 0 {
+		t.Errorf("a second pass moved %d files, want none", moved)
+	}
+}
+
+// An upload in progress when the master key changes has its data key rewrapped, so it
+// can still be resumed, finished and read once the old key has been removed. Nothing
+// client-encrypted is reported as waiting for the old key: none of it ever needs one.
+func TestReencryptUploadSessionsKeepsUploadsFinishable(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	oldCfg := config.Config{FilesystemPath: dir, EncryptionKey: bytes.Repeat([]byte{0x19}, 32)}
+	old, err := storage.NewFilesystemStorage(oldCfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("in flight "), testChunkSize/5)
+	key, err := storage.NewObjectKey(&oldCfg)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	session := models.UploadSession{
+		SessionID:       uuid.New().String(),
+		FileSize:        int64(len(data)),
+		ChunkSize:       testChunkSize,
+		TotalChunks:     2,
+		FilePath:        "upload.bin",
+		Status:          models.UploadSessionStatusActive,
+		ExpiresAt:       time.Now().Add(time.Hour),
+		EncryptionKeyID: key.KeyID,
+		WrappedKey:      key.Wrapped,
+		StreamSalt:      key.Salt,
+	}
+	session.StorageUploadID, err = old.InitChunkedUpload(session.SessionID, session.FilePath, 2, testChunkSize, key)
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := old.SaveChunk(session.SessionID, 0, bytes.NewReader(data[:testChunkSize]), testChunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+	db.Create(&session)
+	db.Create(&models.UploadedFile{FileId: uuid.New().String(), FilePath: "sealed.bin", ClientEncrypted: true})
+
+	newKey := bytes.Repeat([]byte{0x2a}, 32)
+	cfg := &config.Config{
+		FilesystemPath:  dir,
+		ChunkSizeMB:     testChunkSize / 1024 / 1024,
+		EncryptionKey:   newKey,
+		EncryptionKeyID: "next",
+		EncryptionKeys:  map[string][]byte{"": oldCfg.EncryptionKey, "next": newKey},
+	}
+	if moved, err := ReencryptUploadSessions(db, cfg); err != nil || moved != 1 {
+		t.Fatalf("ReencryptUploadSessions moved %d sessions, %v; want 1", moved, err)
+	}
+	if files, sessions, err := countUnderOtherKeys(db, cfg); err != nil || files != 0 || sessions != 0 {
+		t.Errorf("%d files and %d sessions left under other keys (%v), want none", files, sessions, err)
+	}
+
+	// A restart with only the new key.
+	retiredCfg := config.Config{FilesystemPath: dir, ChunkSizeMB: cfg.ChunkSizeMB, EncryptionKey: newKey, EncryptionKeyID: "next"}
+	retired, err := storage.NewFilesystemStorage(retiredCfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	if resumed, err := ResumeUploads(db, retired); err != nil || resumed != 1 {
+		t.Fatalf("ResumeUploads resumed %d sessions, %v; want 1", resumed, err)
+	}
+	rest := data[testChunkSize:]
+	if err := retired.SaveChunk(session.SessionID, 1, bytes.NewReader(rest), int64(len(rest))); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if _, err := retired.FinalizeChunkedUpload(session.SessionID); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	var moved models.UploadSession
+	db.First(&moved, session.ID)
+	reader, _, err := retired.GetFileStream(session.FilePath, storage.StoredFile{
+		EncryptionVersion: key.EncryptionVersion(),
+		PlainSize:         int64(len(data)),
+		Key:               storage.ObjectKey{KeyID: moved.EncryptionKeyID, Wrapped: moved.WrappedKey, Salt: moved.StreamSalt},
+	})
+	if err != nil {
+		t.Fatalf("GetFileStream: %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, data) {
+		t.Error("the upload does not read back as what was sent")
+	}
+}
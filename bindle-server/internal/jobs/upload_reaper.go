@@ -0,0 +1,183 @@
+// Package jobs holds the work the server does on a schedule rather than in answer to a
+// request: everything here would otherwise only happen if a client came back to trigger
+// it, and the cases it covers are exactly the ones where none does.
+package jobs
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/gorm"
+)
+
+// uploadReapInterval is how often expired sessions are looked for. Sessions live for a
+// day, so releasing one a quarter of an hour after its deadline costs nothing.
+const uploadReapInterval = 15 * time.Minute
+
+// StartUploadReaper releases abandoned chunked uploads. Expiry used to be noticed only
+// when a client sent another chunk to the session, so an upload that was simply walked
+// away from stayed active forever, holding its multipart upload or temp file open.
+//
+// Before the schedule starts, the uploads of active sessions are picked back up, and
+// storage is swept once for uploads with no session at all. Both are what a crash or a
+// deploy leaves behind: the backend's in-memory state is gone, and only the first kind
+// still has a session pointing at it.
+func StartUploadReaper(db *gorm.DB, st storage.Storage) {
+	if resumed, err := ResumeUploads(db, st); err != nil {
+		log.Printf("Failed to resume chunked uploads: %v", err)
+	} else if resumed > 0 {
+		log.Printf("Resumed %d chunked uploads", resumed)
+	}
+
+	if aborted, err := AbortOrphanedUploads(db, st); err != nil {
+		log.Printf("Failed to sweep storage for orphaned uploads: %v", err)
+	} else if aborted > 0 {
+		log.Printf("Aborted %d orphaned uploads", aborted)
+	}
+
+	go func() {
+		ticker := time.NewTicker(uploadReapInterval)
+		defer ticker.Stop()
+		for {
+			if reaped, err := ReapExpiredSessions(db, st, time.Now()); err != nil {
+				log.Printf("Failed to reap expired upload sessions: %v", err)
+			} else if reaped > 0 {
+				log.Printf("Expired %d abandoned upload sessions", reaped)
+			}
+			if _, err := DeleteEndedUploadFrames(db); err != nil {
+				log.Printf("Failed to delete the frames of ended upload sessions: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// ReapExpiredSessions marks every active session past its deadline as expired and
+// releases what storage holds for it. It returns how many sessions it expired.
+func ReapExpiredSessions(db *gorm.DB, st storage.Storage, now time.Time) (int, error) {
+	var sessions []models.UploadSession
+	err := db.Where("status = ? AND expires_at <= ?", models.UploadSessionStatusActive, now).
+		Find(&sessions).Error
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, session := range sessions {
+		// The status flips first and only if it is still active, so a session that
+		// completed in the meantime is left alone, and once it has flipped no further
+		// chunk can be written into the upload being torn down.
+		result := db.Model(&models.UploadSession{}).
+			Where("id = ? AND status = ?", session.ID, models.UploadSessionStatusActive).
+			Updates(map[string]any{"status": models.UploadSessionStatusExpired, "wrapped_key": nil})
+		if result.Error != nil {
+			log.Printf("Failed to expire upload session %s: %v", session.SessionID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		if err := st.AbortChunkedUpload(session.SessionID); err != nil {
+			log.Printf("Failed to abort storage for expired session %s: %v", session.SessionID, err)
+		}
+		reaped++
+	}
+
+	return reaped, nil
+}
+
+// DeleteEndedUploadFrames deletes the frames recorded for every upload that is no longer
+// in progress, however it ended: only a resumed upload needs them. It returns how many it
+// deleted.
+func DeleteEndedUploadFrames(db *gorm.DB) (int64, error) {
+	active := db.Model(&models.UploadSession{}).Select("session_id").
+		Where("status = ?", models.UploadSessionStatusActive)
+	result := db.Where("session_id NOT IN (?)", active).Delete(&models.UploadFrame{})
+	return result.RowsAffected, result.Error
+}
+
+// AbortOrphanedUploads aborts every upload storage holds open whose destination no
+// active session is writing to. It returns how many it aborted.
+func AbortOrphanedUploads(db *gorm.DB, st storage.Storage) (int, error) {
+	uploads, err := st.ListIncompleteUploads()
+	if err != nil {
+		return 0, err
+	}
+	if len(uploads) == 0 {
+		return 0, nil
+	}
+
+	var activePaths []string
+	err = db.Model(&models.UploadSession{}).
+		Where("status = ?", models.UploadSessionStatusActive).
+		Pluck("file_path", &activePaths).Error
+	if err != nil {
+		return 0, err
+	}
+
+	active := make(map[string]bool, len(activePaths))
+	for _, path := range activePaths {
+		active[path] = true
+	}
+
+	aborted := 0
+	for _, upload := range uploads {
+		if active[upload.FilePath] {
+			continue
+		}
+		if err := st.AbortIncompleteUpload(upload); err != nil {
+			log.Printf("Failed to abort orphaned upload %s: %v", upload.ID, err)
+			continue
+		}
+		aborted++
+	}
+
+	return aborted, nil
+}
+
+// ResumeUploads hands storage every active session's upload, so a client that was
+// partway through one when the server went down can carry on where it left off. This
+// includes sessions past their deadline: the reaper can only release what storage knows
+// about. A session whose upload storage no longer has can never be finished, and is
+// expired. It returns how many uploads were resumed.
+func ResumeUploads(db *gorm.DB, st storage.Storage) (int, error) {
+	var sessions []models.UploadSession
+	if err := db.Where("status = ?", models.UploadSessionStatusActive).Find(&sessions).Error; err != nil {
+		return 0, err
+	}
+
+	resumed := 0
+	for _, session := range sessions {
+		key := storage.ObjectKey{KeyID: session.EncryptionKeyID, Wrapped: session.WrappedKey, Salt: session.StreamSalt}
+		if session.ClientEncrypted {
+			key = storage.ObjectKey{ClientSealed: true}
+		}
+		err := st.ResumeChunkedUpload(storage.ResumedUpload{
+			SessionID:   session.SessionID,
+			FilePath:    session.FilePath,
+			UploadID:    session.StorageUploadID,
+			TotalChunks: session.TotalChunks,
+			ChunkSize:   session.ChunkSize,
+			FileSize:    session.FileSize,
+			Key:         key,
+		})
+		if errors.Is(err, storage.ErrUploadGone) {
+			log.Printf("Upload of session %s is gone, expiring it: %v", session.SessionID, err)
+			db.Model(&models.UploadSession{}).
+				Where("id = ? AND status = ?", session.ID, models.UploadSessionStatusActive).
+				Updates(map[string]any{"status": models.UploadSessionStatusExpired, "wrapped_key": nil})
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to resume the upload of session %s: %v", session.SessionID, err)
+			continue
+		}
+		resumed++
+	}
+
+	return resumed, nil
+}
@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const testChunkSize = 1024 * 1024
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	// Each connection gets its own private in-memory database.
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.UploadedFile{}, &models.User{},
+		&models.AccountIpConnection{}, &models.UploadSession{}, &models.Share{}, &models.Download{},
+		&models.UploadFrame{}, &models.LegacyMigrationRun{}); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+func newTestStorage(t *testing.T) *storage.FilesystemStorage {
+	t.Helper()
+	st, err := storage.NewFilesystemStorage(config.Config{
+		FilesystemPath: t.TempDir(),
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x19}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	return st
+}
+
+// openSession starts an upload in storage and records its session the way
+// InitChunkedUpload does, expiring at expiresAt.
+func openSession(t *testing.T, db *gorm.DB, st storage.Storage, sessionID string, expiresAt time.Time) models.UploadSession {
+	t.Helper()
+
+	session := models.UploadSession{
+		SessionID:   sessionID,
+		FileName:    sessionID + ".bin",
+		FileSize:    testChunkSize,
+		ChunkSize:   testChunkSize,
+		TotalChunks: 1,
+		FilePath:    sessionID + ".bin",
+		Status:      models.UploadSessionStatusActive,
+		ExpiresAt:   expiresAt,
+	}
+	if err := db.Create(&session).Error; err != nil {
+		t.Fatalf("failed to seed session: %v", err)
+	}
+	uploadID, err := st.InitChunkedUpload(sessionID, session.FilePath, 1, testChunkSize, storage.ObjectKey{})
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	session.StorageUploadID = uploadID
+	db.Save(&session)
+	return session
+}
+
+func tempFileExists(st *storage.FilesystemStorage, t *testing.T, filePath string) bool {
+	t.Helper()
+	uploads, err := st.ListIncompleteUploads()
+	if err != nil {
+		t.Fatalf("ListIncompleteUploads: %v", err)
+	}
+	for _, upload := range uploads {
+		if upload.FilePath == filePath {
+			_, err := os.Stat(upload.ID)
+			return err == nil
+		}
+	}
+	return false
+}
+
+// A session nobody comes back to has to be released by the reaper, since expiry used to
+// be noticed only when the next chunk arrived.
+func TestReapExpiresAbandonedSessions(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	now := time.Now()
+
+	abandoned := openSession(t, db, st, "abandoned", now.Add(-time.Minute))
+	live := openSession(t, db, st, "live", now.Add(time.Hour))
+
+	reaped, err := ReapExpiredSessions(db, st, now)
+	if err != nil {
+		t.Fatalf("ReapExpiredSessions: %v", err)
+	}
+	if reaped != 1 {
+		t.Errorf("reaped %d sessions, want 1", reaped)
+	}
+
+	var got models.UploadSession
+	db.First(&got, abandoned.ID)
+	if got.Status != models.UploadSessionStatusExpired {
+		t.Errorf("the abandoned session is %q, want expired", got.Status)
+	}
+	if tempFileExists(st, t, abandoned.FilePath) {
+		t.Error("the abandoned session's temp file is still on disk")
+	}
+
+	var stillLive models.UploadSession
+	db.First(&stillLive, live.ID)
+	if stillLive.Status != models.UploadSessionStatusActive {
+		t.Errorf("a session still inside its deadline is %q, want active", got.Status)
+	}
+	if !tempFileExists(st, t, live.FilePath) {
+		t.Error("a live session's temp file was removed")
+	}
+}
+
+// The frames recorded for an upload are only needed while it can still be resumed.
+func TestDeleteEndedUploadFramesKeepsThoseOfLiveSessions(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+	now := time.Now()
+
+	ended := openSession(t, db, st, "ended", now.Add(time.Hour))
+	db.Model(&ended).Update("status", models.UploadSessionStatusCompleted)
+	live := openSession(t, db, st, "live", now.Add(time.Hour))
+	for _, sessionID := range []string{ended.SessionID, live.SessionID, "forgotten"} {
+		db.Create(&models.UploadFrame{SessionID: sessionID, FrameIndex: 0, Digest: make([]byte, 32)})
+	}
+
+	deleted, err := DeleteEndedUploadFrames(db)
+	if err != nil {
+		t.Fatalf("DeleteEndedUploadFrames: %v", err)
+	}
+	var left []string
+	db.Model(&models.UploadFrame{}).Pluck("session_id", &left)
+	if deleted != 2 || len(left) != 1 || left[0] != live.SessionID {
+		t.Errorf("deleted %d frames and kept those of %v, want 2 deleted and the live session's kept", deleted, left)
+	}
+}
+
+// After a restart the backend has forgotten every upload, so anything left open that no
+// active session writes to is an orphan - but one a session still owns is not.
+func TestAbortOrphanedUploadsKeepsOnlyThoseWithASession(t *testing.T) {
+	db := newTestDB(t)
+	st := newTestStorage(t)
+
+	owned := openSession(t, db, st, "owned", time.Now().Add(time.Hour))
+	if _, err := st.InitChunkedUpload("forgotten", "orphan.bin", 1, testChunkSize, storage.ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+
+	aborted, err := AbortOrphanedUploads(db, st)
+	if err != nil {
+		t.Fatalf("AbortOrphanedUploads: %v", err)
+	}
+	if aborted != 1 {
+		t.Errorf("aborted %d uploads, want 1", aborted)
+	}
+	if tempFileExists(st, t, "orphan.bin") {
+		t.Error("the orphaned temp file is still on disk")
+	}
+	if !tempFileExists(st, t, owned.FilePath) {
+		t.Error("an upload with an active session was aborted")
+	}
+}
+
+// A restart must not strand an upload whose session is still active, and a session whose
+// upload storage no longer has cannot be finished and is expired instead.
+func TestResumeUploadsPicksUpActiveSessions(t *testing.T) {
+	db := newTestDB(t)
+	cfg := config.Config{
+		FilesystemPath: t.TempDir(),
+		ChunkSizeMB:    testChunkSize / 1024 / 1024,
+		EncryptionKey:  bytes.Repeat([]byte{0x19}, 32),
+	}
+	before, _ := storage.NewFilesystemStorage(cfg)
+
+	live := openSession(t, db, before, "live", time.Now().Add(time.Hour))
+	lost := openSession(t, db, before, "lost", time.Now().Add(time.Hour))
+	if err := before.AbortChunkedUpload(lost.SessionID); err != nil {
+		t.Fatalf("AbortChunkedUpload: %v", err)
+	}
+
+	after, _ := storage.NewFilesystemStorage(cfg)
+	resumed, err := ResumeUploads(db, after)
+	if err != nil {
+		t.Fatalf("ResumeUploads: %v", err)
+	}
+	if resumed != 1 {
+		t.Errorf("resumed %d uploads, want 1", resumed)
+	}
+
+	if err := after.SaveChunk(live.SessionID, 0, bytes.NewReader(make([]byte, testChunkSize)), testChunkSize); err != nil {
+		t.Errorf("a chunk for the resumed session failed: %v", err)
+	}
+	if _, err := after.FinalizeChunkedUpload(live.SessionID); err != nil {
+		t.Errorf("the resumed session could not be finished: %v", err)
+	}
+
+	var got models.UploadSession
+	db.First(&got, lost.ID)
+	if got.Status != models.UploadSessionStatusExpired {
+		t.Errorf("a session whose upload is gone is %q, want expired", got.Status)
+	}
+}
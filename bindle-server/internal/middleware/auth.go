@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"encoding/base64"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -45,25 +47,59 @@ func AuthMiddleware(db *gorm.DB) fiber.Handler {
 			})
 		}
 
-		// Only touched when it has gone stale. An upload is a long run of requests from
-		// one account, and writing this on each of them put a synchronous database write
-		// on the critical path of every chunk to move a timestamp by milliseconds. It
-		// feeds account expiration, which is measured in days.
-		if time.Since(user.LastLogin) > lastLoginResolution {
-			user.LastLogin = time.Now()
-			db.Save(&user)
-		}
+		recordLogin(c, db, &user)
+		c.Locals("user", user)
+		return c.Next()
+	}
+}
 
-		// Check if IP connection already exists
-		ipAddress := c.IP()
-		var existingConnection models.AccountIpConnection
-		result = db.Where("account_id = ? AND ip_address = ?", user.ID, ipAddress).First(&existingConnection)
+// recordLogin notes that user made the request c: the time, for account expiration, and
+// the IP address, which pools the upload quota of the accounts that share it.
+func recordLogin(c *fiber.Ctx, db *gorm.DB, user *models.User) {
+	// Only touched when it has gone stale. An upload is a long run of requests from
+	// one account, and writing this on each of them put a synchronous database write
+	// on the critical path of every chunk to move a timestamp by milliseconds. It
+	// feeds account expiration, which is measured in days.
+	if time.Since(user.LastLogin) > lastLoginResolution {
+		user.LastLogin = time.Now()
+		db.Save(user)
+	}
 
-		// Only create new connection if it doesn't exist
-		if result.Error == gorm.ErrRecordNotFound {
-			db.Create(&models.AccountIpConnection{AccountID: user.ID, IPAddress: ipAddress})
+	// Check if IP connection already exists
+	ipAddress := c.IP()
+	var existingConnection models.AccountIpConnection
+	result := db.Where("account_id = ? AND ip_address = ?", user.ID, ipAddress).First(&existingConnection)
+
+	// Only create new connection if it doesn't exist
+	if result.Error == gorm.ErrRecordNotFound {
+		db.Create(&models.AccountIpConnection{AccountID: user.ID, IPAddress: ipAddress})
+	}
+}
+
+// BasicAuthMiddleware authenticates WebDAV clients, which only know how to send a user
+// name and password. The account ID is the user name and the password is not checked:
+// the ID is already the secret. Unlike AuthMiddleware it never creates an account, since
+// a mounted drive that quietly switched to a new, empty account on a typo would look like
+// every file had been lost.
+func BasicAuthMiddleware(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		accountId := ""
+		if scheme, credentials, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " "); ok &&
+			strings.EqualFold(scheme, "Basic") {
+			if decoded, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+				accountId, _, _ = strings.Cut(string(decoded), ":")
+			}
+		}
+
+		var user models.User
+		if !utils.AccountIdIsValid(accountId) || db.Where("account_id = ?", accountId).First(&user).Error != nil {
+			c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="Bindle", charset="UTF-8"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Log in with your account ID as the user name",
+			})
 		}
 
+		recordLogin(c, db, &user)
 		c.Locals("user", user)
 		return c.Next()
 	}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"path/filepath"
 	"time"
 
 	"github.com/nuuner/bindle-server/internal/config"
@@ -27,6 +28,9 @@ const (
 	UploadSessionStatusCompleted UploadSessionStatus = "completed"
 	UploadSessionStatusCancelled UploadSessionStatus = "cancelled"
 	UploadSessionStatusExpired   UploadSessionStatus = "expired"
+	// UploadSessionStatusFailed marks an upload whose assembled file did not match the
+	// SHA-256 the client declared for it.
+	UploadSessionStatusFailed UploadSessionStatus = "failed"
 )
 
 // Upload Session models
@@ -48,10 +52,42 @@ type UploadSession struct {
 	// FilePath is the object the session writes to, decided at init so the storage
 	// backend can open the upload against its final destination and never move the
 	// data afterwards.
-	FilePath  string              `json:"filePath"`
-	FileHash  string              `json:"fileHash"`
-	Status    UploadSessionStatus `json:"status"`
-	ExpiresAt time.Time           `json:"expiresAt"`
+	FilePath string `json:"filePath"`
+	// StorageUploadID is the storage backend's name for the upload, kept so it can be
+	// picked up again after a restart: the multipart upload id on S3, the temp file on
+	// the filesystem.
+	StorageUploadID string              `json:"-"`
+	FileHash        string              `json:"fileHash"`
+	Status          UploadSessionStatus `json:"status"`
+	ExpiresAt       time.Time           `json:"expiresAt"`
+	// The limits asked for at init, carried over to the file when the upload completes.
+	// ExpiresAt above is the session's own deadline, not the file's.
+	FileExpiresAt    *time.Time `json:"fileExpiresAt"`
+	FileMaxDownloads int        `json:"fileMaxDownloads"`
+	// FilePasswordHash is hashed at init, so the password itself is never stored.
+	FilePasswordHash string `json:"-"`
+	// EncryptionKeyID and WrappedKey are the data key the session's chunks are sealed
+	// with, drawn at init. Chunks arriving after a restart have to use the same one, as
+	// the file is a single stream, and the file's record takes it over. The session's copy
+	// is wiped when it ends, however it ends.
+	EncryptionKeyID string `json:"-"`
+	WrappedKey      []byte `json:"-"`
+	// StreamSalt is the salt the upload's subkey is derived with, which its object
+	// carries in its header too; see storage.ObjectKey. Sessions opened before it write
+	// version 2 and have none.
+	StreamSalt []byte `json:"-"`
+	// ClientEncrypted is set when the uploader's browser encrypts the file before
+	// sending it; see UploadedFile.ClientEncrypted. FileSize is then the ciphertext's.
+	ClientEncrypted bool `json:"-"`
+}
+
+// UploadFrame is a frame a chunked upload has sealed, by the SHA-256 of its plaintext;
+// see storage.FrameJournal. The rows of a session go once it has ended.
+type UploadFrame struct {
+	ID         uint   `gorm:"primarykey"`
+	SessionID  string `gorm:"uniqueIndex:idx_upload_frames_session_frame"`
+	FrameIndex int64  `gorm:"uniqueIndex:idx_upload_frames_session_frame"`
+	Digest     []byte
 }
 
 // User related models
@@ -91,9 +127,163 @@ type UploadedFile struct {
 	// EncryptionVersion selects the reader used to decrypt this file. 0 is everything
 	// stored before the framed streaming format, which is why the default matters:
 	// rows that predate the column have to keep decoding the way they were written.
-	EncryptionVersion int  `json:"-" gorm:"default:0"`
-	OwnerID           uint `json:"ownerId" gorm:"index"`
-	Owner             User
+	EncryptionVersion int `json:"-" gorm:"default:0"`
+	// EncryptionKeyID names the master key the stored object's key is wrapped with. ""
+	// is ENCRYPTION_KEY, which every row predating the column used. Rows under any key
+	// but the active one are moved to it by jobs.StartReencryption.
+	EncryptionKeyID string `json:"-" gorm:"index"`
+	// WrappedKey is the object's own data key, wrapped by that master key; see
+	// utils.WrapDataKey. Every record of an object holds a copy, and deleting a record
+	// wipes its copy, so once the last one is gone nothing can read the object - even
+	// where the storage backend keeps it around. Empty for objects stored before data
+	// keys, which are sealed with the master key itself.
+	WrappedKey []byte `json:"-"`
+	// ClientEncrypted marks a file encrypted in the uploader's browser with a key that
+	// only ever travels in the fragment of its share URL, which browsers do not send.
+	// The server stores and serves the ciphertext as it arrived - Size, ContentHash and
+	// the quota all count the ciphertext - and a browser opening the file gets a page
+	// that decrypts it; see handlers.GetFile.
+	ClientEncrypted bool `json:"-" gorm:"default:false"`
+	// ContentHash is the hex SHA-256 of the plaintext. Uploads with the same contents
+	// and extension are stored once, whichever way they were uploaded, and downloads
+	// carry it for checking. It is empty only until jobs.HashStoredFiles has read back
+	// a file that was stored without one.
+	ContentHash string `json:"-" gorm:"index"`
+	OwnerID     uint   `json:"ownerId" gorm:"index"`
+	Owner       User
+	// ExpiresAt and MaxDownloads make a file temporary: once either is reached it is
+	// answered with 410 Gone, and the expiry sweep deletes it. nil and 0 mean the file
+	// lives until someone deletes it.
+	ExpiresAt     *time.Time `json:"-" gorm:"index"`
+	MaxDownloads  int        `json:"-" gorm:"default:0"`
+	DownloadCount int        `json:"-" gorm:"default:0"`
+	// PasswordHash is set when downloading the file needs a password; see
+	// pkg/filepassword for its format.
+	PasswordHash string `json:"-"`
+	// DeletionTokenHash is set on uploads from screenshot tools, which delete a file by
+	// opening a URL holding the token rather than with the account ID; see
+	// utils.HashDeletionToken.
+	DeletionTokenHash string `json:"-" gorm:"index"`
+	// Shares are the public URLs the file is reachable at. FilePath is a storage key
+	// and, for single uploads, a hash of the contents, so it is never handed out.
+	Shares []Share `json:"-"`
+	// Downloads is filled in by handlers that show the file to its owner, and sent along
+	// when it is; it is not a column.
+	Downloads *DownloadSummary `json:"-" gorm:"-"`
+}
+
+// Migration records when a one-off data migration first ran, for code that has to tell
+// what came before it from what came after.
+type Migration struct {
+	Name  string `gorm:"primarykey"`
+	RanAt time.Time
+}
+
+// SharesMigration names the migration that gave every file a share. Objects stored
+// before it are the only ones still served by their storage path.
+const SharesMigration = "shares"
+
+// LegacyMigrationRun is a run of the migration of files out of the legacy formats, kept
+// so the admin panel can report the last one after a restart.
+type LegacyMigrationRun struct {
+	ID         uint `gorm:"primarykey"`
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Total      int64
+	Migrated   int
+	Failed     int
+	LastError  string
+}
+
+// Share is a public URL for a file: FileHost + Slug, with the file's extension on the
+// end. Slugs are random, so a URL says nothing about what it points at, and each one
+// belongs to one record - deleting a share revokes that URL alone, however many records
+// share the stored object.
+//
+// A file can have several, each with its own label and limits. The limits work like the
+// file's and apply on top of them: a download through a share needs both to allow it,
+// and the share's password, when it has one, is asked for instead of the file's.
+type Share struct {
+	gorm.Model
+	Slug           string `gorm:"uniqueIndex"`
+	UploadedFileID uint   `gorm:"index"`
+	UploadedFile   UploadedFile
+
+	Label         string
+	ExpiresAt     *time.Time
+	MaxDownloads  int `gorm:"default:0"`
+	DownloadCount int `gorm:"default:0"`
+	PasswordHash  string
+}
+
+// Expired reports whether the share's expiry has passed at now.
+func (s *Share) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !s.ExpiresAt.After(now)
+}
+
+// Available reports whether the share may still be used at now.
+func (s *Share) Available(now time.Time) bool {
+	return !s.Expired(now) && (s.MaxDownloads == 0 || s.DownloadCount < s.MaxDownloads)
+}
+
+type ShareDTO struct {
+	ShareId           string     `json:"shareId"`
+	Label             string     `json:"label"`
+	URL               string     `json:"url"`
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	MaxDownloads      int        `json:"maxDownloads"`
+	DownloadCount     int        `json:"downloadCount"`
+	PasswordProtected bool       `json:"passwordProtected"`
+	// Available is false once the share has expired or used up its downloads. It stays
+	// listed so its owner can see what happened to it.
+	Available bool      `json:"available"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DTO describes the share to its owner. The slug doubles as its ID: only the owner ever
+// sees this, and it is in the URL anyway.
+func (s *Share) DTO(fileHost string, file *UploadedFile, now time.Time) ShareDTO {
+	return ShareDTO{
+		ShareId:           s.Slug,
+		Label:             s.Label,
+		URL:               s.URL(fileHost, file),
+		ExpiresAt:         s.ExpiresAt,
+		MaxDownloads:      s.MaxDownloads,
+		DownloadCount:     s.DownloadCount,
+		PasswordProtected: s.PasswordHash != "",
+		Available:         s.Available(now),
+		CreatedAt:         s.CreatedAt,
+	}
+}
+
+// URL is the share's public address for file.
+func (s *Share) URL(fileHost string, file *UploadedFile) string {
+	return fileHost + s.Slug + filepath.Ext(file.FilePath)
+}
+
+// URL is the file's public address: that of its oldest live share, or empty when
+// Shares was not loaded or every share has been revoked.
+func (uf *UploadedFile) URL(fileHost string) string {
+	if len(uf.Shares) == 0 {
+		return ""
+	}
+	oldest := uf.Shares[0]
+	for _, share := range uf.Shares[1:] {
+		if share.ID < oldest.ID {
+			oldest = share
+		}
+	}
+	return oldest.URL(fileHost, uf)
+}
+
+// Expired reports whether the file's expiry has passed at now.
+func (uf *UploadedFile) Expired(now time.Time) bool {
+	return uf.ExpiresAt != nil && !uf.ExpiresAt.After(now)
+}
+
+// Available reports whether the file may still be downloaded at now.
+func (uf *UploadedFile) Available(now time.Time) bool {
+	return !uf.Expired(now) && (uf.MaxDownloads == 0 || uf.DownloadCount < uf.MaxDownloads)
 }
 
 type UploadedFileDTO struct {
@@ -105,6 +295,22 @@ type UploadedFileDTO struct {
 	URL       string    `json:"url"`
 	Details   *string   `json:"details,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
+	// SHA256 is the hex SHA-256 of the file's contents, empty while it is not yet known.
+	SHA256 string `json:"sha256"`
+	// The limits are sent back unchanged by the client when it renames a file, so a PUT
+	// carries the complete set: null and 0 clear them.
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	MaxDownloads  int        `json:"maxDownloads"`
+	DownloadCount int        `json:"downloadCount"`
+	// PasswordProtected reports whether a password is set. On a PUT, Password sets a
+	// new one and PasswordProtected false removes it; the password is never sent out.
+	PasswordProtected bool   `json:"passwordProtected"`
+	Password          string `json:"password,omitempty"`
+	// ClientEncrypted reports that the file can only be read with the key its uploader
+	// holds, so url serves ciphertext.
+	ClientEncrypted bool `json:"clientEncrypted"`
+
+	Downloads *DownloadSummary `json:"downloads,omitempty"`
 }
 
 func (uf *UploadedFile) MarshalJSON() ([]byte, error) {
@@ -115,13 +321,52 @@ func (uf *UploadedFile) MarshalJSON() ([]byte, error) {
 		Size:      uf.Size,
 		Type:      uf.Type,
 		MimeType:  uf.MimeType,
-		URL:       cfg.FileHost + uf.FilePath,
+		URL:       uf.URL(cfg.FileHost),
 		Details:   uf.Details,
 		CreatedAt: uf.CreatedAt,
+		SHA256:    uf.ContentHash,
+
+		ExpiresAt:     uf.ExpiresAt,
+		MaxDownloads:  uf.MaxDownloads,
+		DownloadCount: uf.DownloadCount,
+
+		PasswordProtected: uf.PasswordHash != "",
+		ClientEncrypted:   uf.ClientEncrypted,
+
+		Downloads: uf.Downloads,
 	}
 	return json.Marshal(dto)
 }
 
+// Download is one request that sent a file's bytes, whole or in part: a player seeking
+// through a video leaves one per range it fetched. Unlike DownloadCount, which only
+// counts requests from the first byte because it spends a file's limit, the log is for
+// reading, so it keeps all of them.
+//
+// It has no DeletedAt: entries go with their file rather than lingering soft-deleted,
+// because they hold details about the people who downloaded it.
+type Download struct {
+	ID             uint      `gorm:"primarykey"`
+	CreatedAt      time.Time `gorm:"index"`
+	UploadedFileID uint      `gorm:"index"`
+	ShareID        uint      `gorm:"index"`
+	BytesSent      int64
+	// Range is the Range header the request was answered with; empty for the whole file.
+	Range string
+	// IPHash identifies a client across entries without storing its address; see
+	// handlers.hashClientIP.
+	IPHash    string
+	UserAgent string
+	Referrer  string
+}
+
+// DownloadSummary aggregates a file's download log.
+type DownloadSummary struct {
+	Requests         int64      `json:"requests"`
+	BytesSent        int64      `json:"bytesSent"`
+	LastDownloadedAt *time.Time `json:"lastDownloadedAt"`
+}
+
 // Response models
 type MeResponse struct {
 	User             UserDTO `json:"user"`
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/handlers"
+	"github.com/nuuner/bindle-server/internal/middleware"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"gorm.io/gorm"
+)
+
+// NewApp builds the Fiber app with every route the server answers. It starts nothing:
+// the background jobs and the listener are the caller's, so tests can run the same
+// routes in-process. tusSpoolDir is where tus uploads keep the chunk being filled.
+func NewApp(db *gorm.DB, cfg *config.Config, st storage.Storage, tusSpoolDir string) (*fiber.App, error) {
+	// Initialize Fiber with config
+	// The rate limiter and the upload quota are both keyed on c.IP(). Behind a proxy
+	// that is the proxy's address for every request, which collapses all users into a
+	// single limit and a single quota pool, so the real client IP is read from
+	// ProxyHeader instead - but only for requests arriving from TrustedProxies, since
+	// otherwise any client could set the header and shed both limits.
+	//
+	// StreamRequestBody hands the handler the connection instead of a fully buffered
+	// body, so an upload chunk is encrypted and forwarded to storage as it arrives
+	// rather than being held in memory first.
+	app := fiber.New(fiber.Config{
+		BodyLimit:               int(cfg.RequestSizeLimitMB) * 1024 * 1024,
+		StreamRequestBody:       true,
+		ProxyHeader:             cfg.ProxyHeader,
+		EnableTrustedProxyCheck: len(cfg.TrustedProxies) > 0,
+		TrustedProxies:          cfg.TrustedProxies,
+		EnableIPValidation:      true,
+		RequestMethods:          append(append([]string{}, fiber.DefaultMethods...), handlers.DAVMethods...),
+	})
+
+	// Add middleware
+	// Browser tus clients read the upload's state from response headers, and scripts
+	// check downloads against their digests, neither of which CORS lets them see unless
+	// the headers are exposed.
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     cfg.ClientOrigin,
+		AllowCredentials: true,
+		ExposeHeaders: "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size," +
+			"Upload-Offset,Upload-Length,Upload-Expires,Bindle-File-Id,Bindle-File-Url," +
+			"ETag,Content-Digest,Repr-Digest",
+	}))
+	app.Use(logger.New())
+
+	// Global rate limiter for all routes (except chunk uploads which have their own limit)
+	app.Use(limiter.New(limiter.Config{
+		Max:        100, // 100 requests
+		Expiration: 1 * time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP() // Rate limit by IP address
+		},
+		SkipFailedRequests:     false,
+		SkipSuccessfulRequests: false,
+		Next: func(c *fiber.Ctx) bool {
+			// Skip rate limiting for chunk upload endpoints and file downloads
+			path := c.Path()
+			return path == "/api/file/chunk/init" ||
+				(len(path) > 16 && path[:16] == "/api/file/chunk/") ||
+				strings.HasPrefix(path, "/api/tus") ||
+				strings.HasPrefix(path, "/dav") ||
+				(len(path) > 7 && path[:7] == "/files/")
+		},
+	}))
+
+	// More aggressive rate limiting for sensitive operations
+	sensitiveRateLimiter := limiter.New(limiter.Config{
+		Max:        5, // 5 requests
+		Expiration: 1 * time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+	})
+
+	// Downloads skip the global limiter, but a password guess must not: failed attempts
+	// at a protected file, by header or through the form, count against a tight limit
+	// of their own. Successful requests are not counted, so a client that has the
+	// password can still fetch as many ranges as it likes.
+	filePasswordRateLimiter := limiter.New(limiter.Config{
+		Max:        10,
+		Expiration: 1 * time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+		SkipSuccessfulRequests: true,
+		Next: func(c *fiber.Ctx) bool {
+			return c.Method() != fiber.MethodPost && c.Get(filepassword.HeaderName) == ""
+		},
+	})
+
+	// Setup static file serving for uploaded files
+	app.Get("/files/:share", filePasswordRateLimiter, func(c *fiber.Ctx) error {
+		// Disable scripts on possible html files
+		c.Set("Content-Security-Policy", "script-src 'none'")
+
+		return handlers.GetFile(c, db, cfg, st, c.Params("share"))
+	})
+	app.Post("/files/:share", filePasswordRateLimiter, func(c *fiber.Ctx) error {
+		c.Set("Content-Security-Policy", "script-src 'none'")
+
+		return handlers.UnlockFile(c, db, cfg, c.Params("share"))
+	})
+
+	// Serve static files from the React build
+	app.Static("/", "./static")
+
+	// API routes
+	api := app.Group("/api")
+
+	// AuthMiddleware mints a new account (and a users row) whenever the Authorization
+	// header is absent. Admin routes authenticate with X-Admin-Password instead and never
+	// send one, so they must skip it or every admin request would create a phantom user.
+	authMiddleware := middleware.AuthMiddleware(db)
+	api.Use(func(c *fiber.Ctx) error {
+		if strings.HasPrefix(c.Path(), "/api/admin") {
+			return c.Next()
+		}
+		// A deletion URL is opened by whoever holds it, with the token as the only
+		// credential.
+		if strings.HasPrefix(c.Path(), "/api/sharex/delete/") {
+			return c.Next()
+		}
+		// tus discovery is answered the same for everyone.
+		if c.Method() == fiber.MethodOptions && strings.HasPrefix(c.Path(), "/api/tus") {
+			return c.Next()
+		}
+		return authMiddleware(c)
+	})
+
+	api.Get("/me", func(c *fiber.Ctx) error {
+		return handlers.GetMe(c, db)
+	})
+	api.Delete("/me", sensitiveRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.DeleteAccount(c, db, st)
+	})
+	// Unlocking is a password guess against a single shared secret, so it sits behind the
+	// aggressive rate limiter rather than the global one.
+	api.Post("/unlock", sensitiveRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.UnlockLimits(c, cfg)
+	})
+	api.Delete("/unlock", func(c *fiber.Ctx) error {
+		return handlers.LockLimits(c, cfg)
+	})
+	api.Post("/file", func(c *fiber.Ctx) error {
+		return handlers.UploadFile(c, db, cfg, st)
+	})
+	api.Post("/sharex/upload", func(c *fiber.Ctx) error {
+		return handlers.ShareXUpload(c, db, cfg, st)
+	})
+	api.Get("/sharex/config", func(c *fiber.Ctx) error {
+		return handlers.GetShareXConfig(c)
+	})
+	api.Get("/sharex/delete/:token", func(c *fiber.Ctx) error {
+		return handlers.ShowShareXDelete(c, db, c.Params("token"))
+	})
+	api.Post("/sharex/delete/:token", func(c *fiber.Ctx) error {
+		return handlers.ShareXDelete(c, db, st, c.Params("token"))
+	})
+	api.Delete("/file/:fileId", func(c *fiber.Ctx) error {
+		return handlers.DeleteFile(c, db, st, c.Params("fileId"))
+	})
+	api.Put("/file", func(c *fiber.Ctx) error {
+		return handlers.UpdateFile(c, db)
+	})
+	api.Put("/file/:name", func(c *fiber.Ctx) error {
+		return handlers.PutFile(c, db, cfg, st, c.Params("name"))
+	})
+	api.Post("/file/:fileId/rotate", func(c *fiber.Ctx) error {
+		return handlers.RotateFileURL(c, db, c.Params("fileId"))
+	})
+	api.Get("/file/:fileId/shares", func(c *fiber.Ctx) error {
+		return handlers.ListShares(c, db, cfg, c.Params("fileId"))
+	})
+	api.Post("/file/:fileId/shares", func(c *fiber.Ctx) error {
+		return handlers.CreateShare(c, db, cfg, c.Params("fileId"))
+	})
+	api.Delete("/file/:fileId/shares/:shareId", func(c *fiber.Ctx) error {
+		return handlers.RevokeShare(c, db, c.Params("fileId"), c.Params("shareId"))
+	})
+	api.Get("/file/:fileId/downloads", func(c *fiber.Ctx) error {
+		return handlers.ListFileDownloads(c, db, c.Params("fileId"))
+	})
+
+	// Chunked upload routes
+	// Note: More specific routes must come BEFORE generic parameterized routes
+	// These routes are exempt from the global rate limiter to allow large file uploads
+	// They still respect daily upload quotas enforced in the handlers
+	chunkRateLimiter := limiter.New(limiter.Config{
+		Max:        3000, // Allow 3000 requests per minute for chunk uploads (enough for ~30GB/min)
+		Expiration: 1 * time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+	})
+
+	api.Post("/file/chunk/init", chunkRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.InitChunkedUpload(c, db, cfg, st)
+	})
+	api.Post("/file/chunk/:sessionId/complete", chunkRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.CompleteChunkedUpload(c, db, st)
+	})
+	api.Post("/file/chunk/:sessionId/:chunkNumber", chunkRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.UploadChunk(c, db, st)
+	})
+	api.Get("/file/chunk/:sessionId", chunkRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.GetChunkedUploadStatus(c, db, st)
+	})
+	api.Delete("/file/chunk/:sessionId", chunkRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.AbortChunkedUpload(c, db, st)
+	})
+
+	// tus uploads share the chunk API's sessions, quota and rate limit.
+	tus, err := handlers.NewTusServer(db, cfg, st, tusSpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	api.Options("/tus", tus.Options)
+	api.Options("/tus/:sessionId", tus.Options)
+	api.Post("/tus", chunkRateLimiter, tus.Create)
+	api.Head("/tus/:sessionId", chunkRateLimiter, tus.Head)
+	api.Patch("/tus/:sessionId", chunkRateLimiter, tus.Patch)
+	api.Delete("/tus/:sessionId", chunkRateLimiter, tus.Terminate)
+
+	// Admin routes
+	admin := api.Group("/admin")
+	admin.Use(middleware.AdminAuthMiddleware())
+
+	admin.Get("/stats", func(c *fiber.Ctx) error {
+		return handlers.GetAdminStats(c, db, cfg)
+	})
+	admin.Get("/users", func(c *fiber.Ctx) error {
+		return handlers.ListAllUsers(c, db)
+	})
+	admin.Get("/files", func(c *fiber.Ctx) error {
+		return handlers.ListAllFiles(c, db)
+	})
+	admin.Get("/accounts/expiring", func(c *fiber.Ctx) error {
+		return handlers.ListExpiringAccounts(c, db, cfg)
+	})
+	admin.Get("/migrations/legacy", func(c *fiber.Ctx) error {
+		return handlers.GetLegacyMigration(c, db)
+	})
+	admin.Post("/migrations/legacy", sensitiveRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.StartLegacyMigration(c, db, st, cfg)
+	})
+	admin.Delete("/files/:fileId", func(c *fiber.Ctx) error {
+		return handlers.AdminDeleteFile(c, db, st, c.Params("fileId"))
+	})
+	admin.Delete("/users/:accountId/files", func(c *fiber.Ctx) error {
+		return handlers.DeleteUserFiles(c, db, st, c.Params("accountId"))
+	})
+	admin.Delete("/files", sensitiveRateLimiter, func(c *fiber.Ctx) error {
+		return handlers.DeleteAllFiles(c, db, st)
+	})
+
+	// WebDAV clients list a folder with a burst of PROPFINDs, one per file for some of
+	// them, and read files in many small ranges, which would use up the global limit in
+	// seconds. They get one of their own instead, loose enough for that.
+	davRateLimiter := limiter.New(limiter.Config{
+		Max:        600,
+		Expiration: 1 * time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+	})
+	davAuth := middleware.BasicAuthMiddleware(db)
+	dav := app.Group("/dav", davRateLimiter)
+	dav.Options("/*", handlers.DAVOptions)
+	dav.Add("PROPFIND", "/*", davAuth, func(c *fiber.Ctx) error {
+		return handlers.DAVPropfind(c, db, c.Params("*"))
+	})
+	dav.Get("/*", davAuth, func(c *fiber.Ctx) error {
+		return handlers.DAVGet(c, db, cfg, st, c.Params("*"))
+	})
+	dav.Put("/*", davAuth, func(c *fiber.Ctx) error {
+		return handlers.DAVPut(c, db, cfg, st, c.Params("*"))
+	})
+	dav.Delete("/*", davAuth, func(c *fiber.Ctx) error {
+		return handlers.DAVDelete(c, db, st, c.Params("*"))
+	})
+	dav.Add("MOVE", "/*", davAuth, func(c *fiber.Ctx) error {
+		return handlers.DAVMove(c, db, st, c.Params("*"))
+	})
+
+	// curl -T uploads to the root rather than under /api, so this route brings the
+	// account handling along: the request's account if it names one, a new one if not.
+	app.Put("/:name", authMiddleware, func(c *fiber.Ctx) error {
+		return handlers.PutFile(c, db, cfg, st, c.Params("name"))
+	})
+
+	// Serve admin page (must come before catch-all route)
+	app.Get("/admin", func(c *fiber.Ctx) error {
+		return c.SendFile("./static/admin.html")
+	})
+
+	// Handle SPA routing - serve index.html for all non-API routes
+	app.Get("/*", func(c *fiber.Ctx) error {
+		return c.SendFile("./static/index.html")
+	})
+
+	return app, nil
+}
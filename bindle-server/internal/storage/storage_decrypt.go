@@ -1,18 +1,40 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 
 	localconfig "github.com/nuuner/bindle-server/internal/config"
 	"github.com/nuuner/bindle-server/pkg/utils"
 )
 
+// legacyOverhead is what the oldest format adds to the plaintext: the GCM nonce in front
+// and the tag at the end.
+const legacyOverhead = 12 + 16
+
 // decryptStream wraps an encrypted object body in the reader matching the format it was
 // written in, and returns the plaintext length to advertise to the client. Shared by
-// both backends so the three formats are dispatched in exactly one place.
+// both backends so the formats, and the key, are picked in exactly one place.
 func decryptStream(body io.ReadCloser, encryptedSize int64, cfg *localconfig.Config, file StoredFile) (io.ReadCloser, int64, error) {
+	// Only the uploader's browser can open a client-sealed object, so it goes out
+	// exactly as it is stored.
+	if file.EncryptionVersion == utils.EncryptionVersionClient {
+		return body, encryptedSize, nil
+	}
+
+	cfg, err := keyedConfig(cfg, file.Key)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	if file.EncryptionVersion >= utils.EncryptionVersionStream {
-		reader, err := utils.NewDecryptingReader(body, cfg.EncryptionKey, file.PlainSize)
+		key := cfg.EncryptionKey
+		if file.EncryptionVersion == utils.EncryptionVersionSubkey {
+			if key, err = readSubkey(body, key); err != nil {
+				return nil, 0, err
+			}
+		}
+		reader, err := utils.NewDecryptingReader(body, key, file.EncryptionVersion, file.PlainSize)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -23,10 +45,98 @@ func decryptStream(body io.ReadCloser, encryptedSize int64, cfg *localconfig.Con
 	// file for the oldest, one chunk for the other - which is why they are reachable
 	// only for files already stored that way.
 	if file.ChunkCount == 0 {
-		return utils.NewLegacyDecryptionReader(body, cfg), encryptedSize, nil
+		return utils.NewLegacyDecryptionReader(body, cfg), max(encryptedSize-legacyOverhead, 0), nil
 	}
 
 	return utils.NewChunkedDecryptionReader(body, cfg, file.ChunkCount),
 		utils.CalculateDecryptedSize(encryptedSize, file.ChunkCount, cfg.ChunkSizeMB),
 		nil
 }
+
+// keyedConfig returns cfg with the object's key in place of the active master key. The
+// readers for the older formats take the key from the config they are given.
+func keyedConfig(cfg *localconfig.Config, objectKey ObjectKey) (*localconfig.Config, error) {
+	if len(objectKey.Wrapped) == 0 && objectKey.KeyID == cfg.EncryptionKeyID {
+		return cfg, nil
+	}
+	key, err := objectKey.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keyed := *cfg
+	keyed.EncryptionKey = key
+	return &keyed, nil
+}
+
+// readSubkey reads the salt heading a version 3 object and derives the object's subkey
+// from it.
+func readSubkey(header io.Reader, key []byte) ([]byte, error) {
+	salt := make([]byte, utils.StreamSaltSize)
+	if _, err := io.ReadFull(header, salt); err != nil {
+		return nil, fmt.Errorf("failed to read the object header: %w", err)
+	}
+	return utils.DeriveSubkey(key, salt)
+}
+
+// decryptRange returns plaintext bytes [offset, offset+length) of a stored file. For the
+// framed formats openSpan is asked for just the sealed bytes of the frames covering the
+// range, and for the header first if the format has one. Older formats have no frame grid
+// to seek on, so openWhole streams the file from the start and the bytes before the range
+// are read and dropped.
+func decryptRange(cfg *localconfig.Config, file StoredFile, offset, length int64,
+	openSpan func(offset, length int64) (io.ReadCloser, error),
+	openWhole func() (io.ReadCloser, int64, error)) (io.ReadCloser, error) {
+
+	if length <= 0 || offset < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	if file.EncryptionVersion == utils.EncryptionVersionClient {
+		if offset+length > file.PlainSize {
+			return nil, fmt.Errorf("range %d+%d is outside a %d byte file", offset, length, file.PlainSize)
+		}
+		return openSpan(offset, length)
+	}
+
+	cfg, err := keyedConfig(cfg, file.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if file.EncryptionVersion < utils.EncryptionVersionStream {
+		reader, _, err := openWhole()
+		if err != nil {
+			return nil, err
+		}
+		return utils.NewSectionReadCloser(reader, offset, length)
+	}
+
+	if offset+length > file.PlainSize {
+		return nil, fmt.Errorf("range %d+%d is outside a %d byte file", offset, length, file.PlainSize)
+	}
+
+	key := cfg.EncryptionKey
+	if file.EncryptionVersion == utils.EncryptionVersionSubkey {
+		header, err := openSpan(0, utils.StreamSaltSize)
+		if err != nil {
+			return nil, err
+		}
+		key, err = readSubkey(header, key)
+		header.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, sealedOffset, sealedLength := utils.FrameSpan(file.EncryptionVersion, file.PlainSize, offset, length)
+	body, err := openSpan(sealedOffset, sealedLength)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := utils.NewRangeDecryptingReader(body, key, file.EncryptionVersion, file.PlainSize, offset, length)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return reader, nil
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	localconfig "github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// ObjectKey is the key an object is sealed with, in the form the database keeps it: a
+// data key wrapped by the master key KeyID names; see utils.WrapDataKey. With nothing
+// wrapped it stands for that master key itself, which is what every object stored
+// before data keys was sealed with.
+type ObjectKey struct {
+	KeyID   string
+	Wrapped []byte
+	// Salt is what a new object's subkey is derived with; see utils.DeriveSubkey. Only
+	// writing takes it: a stored object carries its salt in its header, so records do
+	// not keep one, but an upload session does, to resume with. With none the object is
+	// written in version 2, as sessions opened before version 3 were.
+	Salt []byte
+	// ClientSealed marks an object its uploader encrypted before sending it: it is
+	// written as it arrives, in utils.EncryptionVersionClient, and no key of the
+	// server's is involved. The other fields are empty.
+	ClientSealed bool
+}
+
+// NewObjectKey draws a data key for a new object and wraps it under the active master
+// key.
+func NewObjectKey(cfg *localconfig.Config) (ObjectKey, error) {
+	dataKey, err := utils.NewDataKey()
+	if err != nil {
+		return ObjectKey{}, err
+	}
+	wrapped, err := utils.WrapDataKey(cfg.EncryptionKey, dataKey)
+	if err != nil {
+		return ObjectKey{}, err
+	}
+	salt, err := utils.NewStreamSalt()
+	if err != nil {
+		return ObjectKey{}, err
+	}
+	return ObjectKey{KeyID: cfg.EncryptionKeyID, Wrapped: wrapped, Salt: salt}, nil
+}
+
+// EncryptionVersion is the format an object written with k is in.
+func (k ObjectKey) EncryptionVersion() int {
+	if k.ClientSealed {
+		return utils.EncryptionVersionClient
+	}
+	if len(k.Salt) == 0 {
+		return utils.EncryptionVersionStream
+	}
+	return utils.EncryptionVersionSubkey
+}
+
+// Open returns the AES key the object's bytes are sealed with.
+func (k ObjectKey) Open(cfg *localconfig.Config) ([]byte, error) {
+	masterKey, err := cfg.KeyFor(k.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Wrapped) == 0 {
+		return masterKey, nil
+	}
+	return utils.UnwrapDataKey(masterKey, k.Wrapped)
+}
+
+// objectSeal is k ready for writing an object with: the format, the key its frames are
+// sealed with, and the header that goes ahead of them.
+type objectSeal struct {
+	version int
+	key     []byte
+	header  []byte
+}
+
+func (k ObjectKey) seal(cfg *localconfig.Config) (objectSeal, error) {
+	if k.ClientSealed {
+		return objectSeal{version: utils.EncryptionVersionClient}, nil
+	}
+	key, err := k.Open(cfg)
+	if err != nil {
+		return objectSeal{}, err
+	}
+	if len(k.Salt) == 0 {
+		return objectSeal{version: utils.EncryptionVersionStream, key: key}, nil
+	}
+	subkey, err := utils.DeriveSubkey(key, k.Salt)
+	if err != nil {
+		return objectSeal{}, err
+	}
+	return objectSeal{version: utils.EncryptionVersionSubkey, key: subkey, header: k.Salt}, nil
+}
+
+// encryptedSize is the length of a whole object sealing plainSize bytes, header included.
+func (s objectSeal) encryptedSize(plainSize int64) int64 {
+	return int64(len(s.header)) + utils.EncryptedSize(s.version, plainSize)
+}
+
+// chunkOffset is where chunk chunkNumber starts in an object of chunkSize chunks.
+func (s objectSeal) chunkOffset(chunkNumber int, chunkSize int64) int64 {
+	return int64(len(s.header)) + int64(chunkNumber)*utils.EncryptedSize(s.version, chunkSize)
+}
+
+// encryptChunk returns a reader over the frames sealing chunk chunkNumber, which holds
+// plainSize bytes from r, with each frame passed through check before it is sealed.
+func (s objectSeal) encryptChunk(r io.Reader, chunkNumber int, chunkSize, plainSize int64, check utils.FrameCheck) (io.Reader, error) {
+	firstFrame := int64(chunkNumber) * utils.FramesPerChunk(chunkSize)
+	if s.version == utils.EncryptionVersionClient {
+		return s.encrypt(r, plainSize, firstFrame)
+	}
+	return utils.NewCheckedEncryptingReader(r, s.key, s.version, plainSize, firstFrame, check)
+}
+
+// encrypt returns a reader over the frames sealing plainSize bytes from r, numbered from
+// firstFrame. A client-sealed object is not encrypted again, but its bytes are held to
+// the declared length all the same, since the object's length was computed from it.
+func (s objectSeal) encrypt(r io.Reader, plainSize, firstFrame int64) (io.Reader, error) {
+	if s.version == utils.EncryptionVersionClient {
+		return &exactReader{r: r, remaining: plainSize}, nil
+	}
+	return utils.NewEncryptingReader(r, s.key, s.version, plainSize, firstFrame)
+}
+
+// exactReader reads exactly remaining bytes from r, failing with utils.ErrShortSource
+// if r ends before them, just as an encrypting reader does.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF {
+		if e.remaining > 0 {
+			return n, utils.ErrShortSource
+		}
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// encryptHashing returns a reader over the sealed object holding the next size bytes of
+// r, header and all, and the hash those plaintext bytes go through on the way in.
+// Hashing and encrypting in the same pass is what lets a single upload be stored without
+// first being read whole: its content address is known once the last frame has been
+// written.
+func encryptHashing(r io.Reader, seal objectSeal, size int64) (io.Reader, hash.Hash, error) {
+	sum := sha256.New()
+	encrypted, err := seal.encrypt(io.TeeReader(r, sum), size, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.MultiReader(bytes.NewReader(seal.header), encrypted), sum, nil
+}
+
+func hexSum(sum hash.Hash) string {
+	return hex.EncodeToString(sum.Sum(nil))
+}
@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/nuuner/bindle-server/internal/config"
 	"github.com/nuuner/bindle-server/pkg/utils"
@@ -23,14 +30,34 @@ type fsUpload struct {
 	// abandoned session never leaves a half-written file at the real path.
 	tempPath    string
 	finalPath   string
+	filePath    string
 	totalChunks int
 	chunkSize   int64
 	// received records chunk indexes rather than counting them: chunks arrive
 	// concurrently and may be retried, and a retry must not count twice.
 	received map[int]bool
-	mu       sync.Mutex
+	// journal is where received is kept durably, one index per line, so an upload
+	// can be picked up again after a restart.
+	journal *os.File
+	// lastChunkSize is the plaintext length of the final chunk, which together with
+	// the layout gives the file's.
+	lastChunkSize int64
+	hasher        *uploadHasher
+	// objectKey is what the chunks are sealed with, and seal is it opened.
+	objectKey ObjectKey
+	seal      objectSeal
+	frames    *frameLedger
+	mu        sync.Mutex
 }
 
+// partSuffix marks a chunked upload that has not been finalized yet. Finished files
+// never carry it, which is what lets a directory listing tell the two apart.
+const partSuffix = ".part"
+
+// journalSuffix names the journal kept next to a chunked upload's temp file. It is added
+// after partSuffix, so the journal is never itself taken for an upload.
+const journalSuffix = ".chunks"
+
 type FilesystemStorage struct {
 	config       config.Config
 	uploads      map[string]*fsUpload
@@ -44,34 +71,41 @@ func NewFilesystemStorage(config config.Config) (*FilesystemStorage, error) {
 	}, nil
 }
 
-func (s *FilesystemStorage) SaveFile(file *multipart.FileHeader, filePath string) (string, error) {
+// SaveFile writes to a temp file in the storage directory itself, so promoting it is a
+// rename. The name carries partSuffix: one left behind by a crash is then an incomplete
+// upload, and the startup sweep removes it.
+func (s *FilesystemStorage) SaveFile(r io.Reader, size int64, key ObjectKey) (string, string, error) {
 	if err := utils.EnsureFileDirectory(s.config); err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	src, err := file.Open()
+	seal, err := key.seal(&s.config)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	defer src.Close()
-
-	encrypted, err := utils.NewEncryptingReader(src, s.config.EncryptionKey, file.Size, 0)
+	encrypted, sum, err := encryptHashing(r, seal, size)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	fullPath := s.config.FilesystemPath + "/" + filePath
-	out, err := os.Create(fullPath)
+	out, err := os.CreateTemp(s.config.FilesystemPath, "upload-*"+partSuffix)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, encrypted); err != nil {
-		return "", err
+	_, err = io.Copy(out, encrypted)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
 	}
 
-	return fullPath, nil
+	return filepath.Base(out.Name()), hexSum(sum), nil
+}
+
+func (s *FilesystemStorage) PromoteFile(tempPath, filePath string) error {
+	return os.Rename(s.config.FilesystemPath+"/"+tempPath, s.config.FilesystemPath+"/"+filePath)
 }
 
 // GetFileStream returns a streaming reader over the decrypted file, holding at most one
@@ -99,24 +133,74 @@ func (s *FilesystemStorage) GetFileStream(filePath string, file StoredFile) (io.
 	return reader, size, nil
 }
 
+// GetFileRange seeks straight to the frames covering the range, so reading the end of a
+// large file costs no more than reading its start.
+func (s *FilesystemStorage) GetFileRange(filePath string, file StoredFile, offset, length int64) (io.ReadCloser, error) {
+	fullPath := s.config.FilesystemPath + "/" + filePath
+
+	return decryptRange(&s.config, file, offset, length,
+		func(sealedOffset, sealedLength int64) (io.ReadCloser, error) {
+			f, err := os.Open(fullPath)
+			if err != nil {
+				return nil, err
+			}
+			return &sectionReadCloser{
+				Reader: io.NewSectionReader(f, sealedOffset, sealedLength),
+				Closer: f,
+			}, nil
+		},
+		func() (io.ReadCloser, int64, error) {
+			return s.GetFileStream(filePath, file)
+		})
+}
+
+// DeleteFile treats a file that is already gone as deleted, the way S3 does, so a
+// cleanup that failed halfway can simply be run again.
 func (s *FilesystemStorage) DeleteFile(filePath string) error {
 	fullPath := s.config.FilesystemPath + "/" + filePath
-	return os.Remove(fullPath)
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FilesystemStorage) ModTime(filePath string) (time.Time, error) {
+	info, err := os.Stat(s.config.FilesystemPath + "/" + filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
 }
 
 // Chunked upload
 
-func (s *FilesystemStorage) InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64) error {
+func (s *FilesystemStorage) InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64, key ObjectKey) (string, error) {
+	seal, err := key.seal(&s.config)
+	if err != nil {
+		return "", err
+	}
+
 	if err := utils.EnsureFileDirectory(s.config); err != nil {
-		return err
+		return "", err
 	}
 
 	finalPath := s.config.FilesystemPath + "/" + filePath
-	tempPath := finalPath + ".part"
+	tempPath := finalPath + partSuffix
 
 	file, err := os.Create(tempPath)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if _, err := file.Write(seal.header); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return "", err
+	}
+	journal, err := os.OpenFile(tempPath+journalSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return "", err
 	}
 
 	s.uploadsMutex.Lock()
@@ -124,16 +208,119 @@ func (s *FilesystemStorage) InitChunkedUpload(sessionID string, filePath string,
 		file:        file,
 		tempPath:    tempPath,
 		finalPath:   finalPath,
+		filePath:    filePath,
 		totalChunks: totalChunks,
 		chunkSize:   chunkSize,
 		received:    make(map[int]bool, totalChunks),
+		journal:     journal,
+		hasher:      newUploadHasher(chunkSize),
+		objectKey:   key,
+		seal:        seal,
+		frames:      seal.ledger(),
 	}
 	s.uploadsMutex.Unlock()
 
 	log.Printf("Initialized chunked upload session %s at %s (%d chunks)\n", sessionID, tempPath, totalChunks)
+	return filepath.Base(tempPath), nil
+}
+
+// ResumeChunkedUpload reopens the temp file where it stands and reads back from the
+// journal which chunks it holds.
+func (s *FilesystemStorage) ResumeChunkedUpload(resumed ResumedUpload) error {
+	if resumed.UploadID == "" || resumed.UploadID != filepath.Base(resumed.UploadID) {
+		return fmt.Errorf("%w: no temp file recorded for session %s", ErrUploadGone, resumed.SessionID)
+	}
+	tempPath := s.config.FilesystemPath + "/" + resumed.UploadID
+	seal, err := resumed.Key.seal(&s.config)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(tempPath, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrUploadGone, tempPath)
+		}
+		return err
+	}
+
+	received, err := readChunkJournal(tempPath+journalSuffix, resumed.TotalChunks)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	journal, err := os.OpenFile(tempPath+journalSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	upload := &fsUpload{
+		file:          file,
+		tempPath:      tempPath,
+		finalPath:     s.config.FilesystemPath + "/" + resumed.FilePath,
+		filePath:      resumed.FilePath,
+		totalChunks:   resumed.TotalChunks,
+		chunkSize:     resumed.ChunkSize,
+		received:      received,
+		journal:       journal,
+		lastChunkSize: resumed.FileSize - int64(resumed.TotalChunks-1)*resumed.ChunkSize,
+		hasher:        newResumedUploadHasher(),
+		objectKey:     resumed.Key,
+		seal:          seal,
+		frames:        seal.ledger(),
+	}
+	if upload.frames != nil {
+		upload.frames.stored = upload.storedFrame
+	}
+	s.uploadsMutex.Lock()
+	s.uploads[resumed.SessionID] = upload
+	s.uploadsMutex.Unlock()
+
+	log.Printf("Resumed chunked upload session %s at %s (%d of %d chunks)\n",
+		resumed.SessionID, tempPath, len(received), resumed.TotalChunks)
 	return nil
 }
 
+// readChunkJournal returns the chunk indexes recorded in a journal. A missing journal
+// records nothing, and a line cut short by a crash is skipped: that chunk is sent again.
+func readChunkJournal(path string, totalChunks int) (map[int]bool, error) {
+	received := make(map[int]bool, totalChunks)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return received, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	// Lines are read up to their newline, since an unterminated one may be a longer
+	// index cut short.
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A leading "-" retracts a chunk that an earlier line recorded; see SaveChunk.
+		index, retracted := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "-")
+		chunkNumber, err := strconv.Atoi(index)
+		if err != nil || chunkNumber < 0 || chunkNumber >= totalChunks {
+			continue
+		}
+		if retracted {
+			delete(received, chunkNumber)
+		} else {
+			received[chunkNumber] = true
+		}
+	}
+}
+
 func (s *FilesystemStorage) SaveChunk(sessionID string, chunkNumber int, r io.Reader, plainSize int64) error {
 	s.uploadsMutex.RLock()
 	upload, exists := s.uploads[sessionID]
@@ -146,25 +333,108 @@ func (s *FilesystemStorage) SaveChunk(sessionID string, chunkNumber int, r io.Re
 	// where it belongs in the file - follows from its index alone. Writing each chunk
 	// straight to its final offset is what removes the assembly pass at the end;
 	// concurrent chunks land at disjoint offsets, which WriteAt handles directly.
-	offset := int64(chunkNumber) * utils.EncryptedSize(upload.chunkSize)
+	// The header, if the format has one, was written when the upload was opened.
+	offset := upload.seal.chunkOffset(chunkNumber, upload.chunkSize)
 
-	encrypted, err := utils.NewEncryptingReader(
-		r, s.config.EncryptionKey, plainSize, int64(chunkNumber)*utils.FramesPerChunk(upload.chunkSize))
+	r, hashed := upload.hasher.tee(chunkNumber, r)
+	encrypted, err := upload.seal.encryptChunk(r, chunkNumber, upload.chunkSize, plainSize, upload.frames.check)
 	if err != nil {
+		hashed(false)
 		return err
 	}
 
 	if _, err := io.Copy(io.NewOffsetWriter(upload.file, offset), encrypted); err != nil {
+		hashed(false)
+		// The chunk is written in place, so a failed retry of one that was already
+		// stored - cut short, or refused for not matching its digest - has overwritten
+		// part of it. It has to be sent again. One refused by the ledger has only had
+		// the same bytes written back over it, and stays.
+		if !errors.Is(err, ErrChunkConflict) {
+			upload.retract(chunkNumber)
+		}
 		return fmt.Errorf("failed to write chunk %d: %w", chunkNumber, err)
 	}
+	hashed(true)
+
+	// The chunk has to be on disk before the journal says so, or a crash could leave
+	// the journal vouching for a hole. The journal line itself is not synced: losing it
+	// only means the chunk is sent again.
+	if err := upload.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync chunk %d: %w", chunkNumber, err)
+	}
 
 	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if _, err := fmt.Fprintf(upload.journal, "%d\n", chunkNumber); err != nil {
+		return fmt.Errorf("failed to record chunk %d: %w", chunkNumber, err)
+	}
 	upload.received[chunkNumber] = true
-	upload.mu.Unlock()
+	if chunkNumber == upload.totalChunks-1 {
+		upload.lastChunkSize = plainSize
+	}
 
 	return nil
 }
 
+// retract forgets a chunk that was recorded as stored, in memory and in the journal.
+func (u *fsUpload) retract(chunkNumber int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.received[chunkNumber] {
+		return
+	}
+	delete(u.received, chunkNumber)
+	if _, err := fmt.Fprintf(u.journal, "-%d\n", chunkNumber); err != nil {
+		log.Printf("Warning: failed to retract chunk %d in %s: %v\n", chunkNumber, u.journal.Name(), err)
+	}
+}
+
+// storedFrame reads frame frameIndex back out of the temp file, for the ledger of an
+// upload resumed after a restart. A frame never written reads as zeros, or not at all
+// past the end of the file. One that is there but does not open was cut short, and
+// whatever it held cannot be matched against, so its chunk can no longer be written.
+func (u *fsUpload) storedFrame(frameIndex int64, plainSize int) ([]byte, error) {
+	file, err := os.Open(u.tempPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sealed := make([]byte, utils.EncryptedSize(u.seal.version, int64(plainSize)))
+	offset := int64(len(u.seal.header)) + utils.EncryptedSize(u.seal.version, frameIndex*utils.FrameSize)
+	n, err := file.ReadAt(sealed, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(bytes.Trim(sealed[:n], "\x00")) == 0 {
+		return nil, nil
+	}
+	plain, err := utils.OpenFrame(u.seal.key, u.seal.version, frameIndex, sealed[:n])
+	if err != nil {
+		return nil, fmt.Errorf("%w: frame %d was left unreadable (%v)", ErrChunkConflict, frameIndex, err)
+	}
+	return plain, nil
+}
+
+func (s *FilesystemStorage) ReceivedChunks(sessionID string) ([]int, error) {
+	s.uploadsMutex.RLock()
+	upload, exists := s.uploads[sessionID]
+	s.uploadsMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: session %s", ErrUploadGone, sessionID)
+	}
+
+	upload.mu.Lock()
+	received := make([]int, 0, len(upload.received))
+	for chunkNumber := range upload.received {
+		received = append(received, chunkNumber)
+	}
+	upload.mu.Unlock()
+
+	sort.Ints(received)
+	return received, nil
+}
+
 func (s *FilesystemStorage) FinalizeChunkedUpload(sessionID string) (string, error) {
 	s.uploadsMutex.RLock()
 	upload, exists := s.uploads[sessionID]
@@ -182,6 +452,12 @@ func (s *FilesystemStorage) FinalizeChunkedUpload(sessionID string) (string, err
 			ErrIncompleteUpload, upload.totalChunks-missing, upload.totalChunks)
 	}
 
+	// The journal goes first: a crash before the rename then leaves a temp file with no
+	// record of its chunks, which are sent again, rather than a journal nothing cleans up.
+	upload.journal.Close()
+	if err := os.Remove(upload.tempPath + journalSuffix); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
 	if err := upload.file.Close(); err != nil {
 		return "", err
 	}
@@ -194,7 +470,9 @@ func (s *FilesystemStorage) FinalizeChunkedUpload(sessionID string) (string, err
 	s.uploadsMutex.Unlock()
 
 	log.Printf("Finalized chunked upload session %s at %s\n", sessionID, upload.finalPath)
-	return upload.finalPath, nil
+
+	plainSize := int64(upload.totalChunks-1)*upload.chunkSize + upload.lastChunkSize
+	return finishUploadHash(upload.hasher, upload.filePath, upload.objectKey, upload.chunkSize, plainSize, s.GetFileRange), nil
 }
 
 func (s *FilesystemStorage) AbortChunkedUpload(sessionID string) error {
@@ -210,8 +488,9 @@ func (s *FilesystemStorage) AbortChunkedUpload(sessionID string) error {
 		return nil
 	}
 
+	upload.journal.Close()
 	upload.file.Close()
-	if err := os.Remove(upload.tempPath); err != nil && !os.IsNotExist(err) {
+	if err := removeChunkedUpload(upload.tempPath); err != nil {
 		log.Printf("Warning: failed to remove %s: %v\n", upload.tempPath, err)
 		return err
 	}
@@ -219,3 +498,53 @@ func (s *FilesystemStorage) AbortChunkedUpload(sessionID string) error {
 	log.Printf("Aborted chunked upload session %s\n", sessionID)
 	return nil
 }
+
+// ListIncompleteUploads finds every temp file in the storage directory. A crash or a
+// restart drops the in-memory session that owned one, so the directory is the only
+// record of it.
+func (s *FilesystemStorage) ListIncompleteUploads() ([]IncompleteUpload, error) {
+	entries, err := os.ReadDir(s.config.FilesystemPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var uploads []IncompleteUpload
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), partSuffix) {
+			continue
+		}
+		uploads = append(uploads, IncompleteUpload{
+			FilePath: strings.TrimSuffix(entry.Name(), partSuffix),
+			ID:       filepath.Join(s.config.FilesystemPath, entry.Name()),
+		})
+	}
+	return uploads, nil
+}
+
+func (s *FilesystemStorage) AbortIncompleteUpload(upload IncompleteUpload) error {
+	if err := removeChunkedUpload(upload.ID); err != nil {
+		return err
+	}
+	log.Printf("Removed abandoned upload %s\n", upload.ID)
+	return nil
+}
+
+// removeChunkedUpload deletes a chunked upload's temp file and its journal, journal first
+// for the same reason FinalizeChunkedUpload removes it first.
+func removeChunkedUpload(tempPath string) error {
+	for _, path := range []string{tempPath + journalSuffix, tempPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionReadCloser pairs a bounded view of a file with the file it has to close.
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -2,8 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
+	"os"
 	"sync"
 	"testing"
 
@@ -46,7 +49,7 @@ func TestChunksUploadedConcurrentlyReassemble(t *testing.T) {
 	totalChunks := 3
 	const path = "concurrent.bin"
 
-	if err := st.InitChunkedUpload("session", path, totalChunks, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", path, totalChunks, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 
@@ -107,7 +110,7 @@ func TestRetriedChunkDoesNotCountTwice(t *testing.T) {
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
 	chunk := testPayload(int(chunkSize))
 
-	if err := st.InitChunkedUpload("session", "retried.bin", 2, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", "retried.bin", 2, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 
@@ -129,7 +132,7 @@ func TestAbortLeavesNoFile(t *testing.T) {
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
 	const path = "aborted.bin"
 
-	if err := st.InitChunkedUpload("session", path, 2, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", path, 2, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 	if err := st.SaveChunk("session", 0, bytes.NewReader(testPayload(int(chunkSize))), chunkSize); err != nil {
@@ -146,3 +149,185 @@ func TestAbortLeavesNoFile(t *testing.T) {
 		t.Error("the destination is readable after the upload was aborted")
 	}
 }
+
+// Ranges are served from the frames covering them, for both the streaming format and the
+// legacy one, which has no frame grid and is skipped through from the start instead.
+func TestRangeReadsReturnTheRequestedBytes(t *testing.T) {
+	st := newTestStorage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 70000)
+	const path = "ranged.bin"
+
+	if _, err := st.InitChunkedUpload("session", path, 2, chunkSize, ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+	if err := st.SaveChunk("session", 1, bytes.NewReader(plain[chunkSize:]), int64(len(plain))-chunkSize); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if _, err := st.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	legacy, err := utils.EncryptFile(&st.config, plain)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	if err := os.WriteFile(st.config.FilesystemPath+"/legacy.bin", legacy, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	files := map[string]StoredFile{
+		path:         {EncryptionVersion: utils.EncryptionVersionStream, PlainSize: int64(len(plain))},
+		"legacy.bin": {PlainSize: int64(len(plain))},
+	}
+
+	for name, file := range files {
+		for _, r := range []struct{ offset, length int64 }{
+			{0, 100},
+			{chunkSize - 50, 100}, // across the chunk boundary
+			{int64(len(plain)) - 1, 1},
+		} {
+			reader, err := st.GetFileRange(name, file, r.offset, r.length)
+			if err != nil {
+				t.Fatalf("%s: GetFileRange(%d, %d): %v", name, r.offset, r.length, err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("%s: read back: %v", name, err)
+			}
+			if !bytes.Equal(got, plain[r.offset:r.offset+r.length]) {
+				t.Errorf("%s: range %d+%d read back different bytes", name, r.offset, r.length)
+			}
+		}
+	}
+}
+
+// A single upload that was saved but never promoted - the server died in between - is
+// what the startup sweep lists and removes.
+func TestUnpromotedUploadIsIncomplete(t *testing.T) {
+	st := newTestStorage(t)
+
+	tempPath, _, err := st.SaveFile(bytes.NewReader(testPayload(1000)), 1000, ObjectKey{})
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	uploads, err := st.ListIncompleteUploads()
+	if err != nil {
+		t.Fatalf("ListIncompleteUploads: %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].ID != st.config.FilesystemPath+"/"+tempPath {
+		t.Fatalf("listed %+v, want the unpromoted upload at %s", uploads, tempPath)
+	}
+	if err := st.AbortIncompleteUpload(uploads[0]); err != nil {
+		t.Fatalf("AbortIncompleteUpload: %v", err)
+	}
+	if _, err := os.Stat(st.config.FilesystemPath + "/" + tempPath); !os.IsNotExist(err) {
+		t.Errorf("the unpromoted upload is still there: %v", err)
+	}
+}
+
+// A restart empties the map of open uploads. The temp file and its journal are all that
+// is left, and they have to be enough to carry on from the chunks already written.
+func TestChunkedUploadResumesAfterRestart(t *testing.T) {
+	st := newTestStorage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(2*chunkSize) + 4096)
+	const path = "resumed.bin"
+	chunk := func(i int) []byte {
+		return plain[int64(i)*chunkSize : min(int64(i+1)*chunkSize, int64(len(plain)))]
+	}
+
+	uploadID, err := st.InitChunkedUpload("session", path, 3, chunkSize, ObjectKey{})
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	for _, i := range []int{2, 0} {
+		if err := st.SaveChunk("session", i, bytes.NewReader(chunk(i)), int64(len(chunk(i)))); err != nil {
+			t.Fatalf("SaveChunk(%d): %v", i, err)
+		}
+	}
+
+	restarted, err := NewFilesystemStorage(st.config)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	err = restarted.ResumeChunkedUpload(ResumedUpload{
+		SessionID:   "session",
+		FilePath:    path,
+		UploadID:    uploadID,
+		TotalChunks: 3,
+		ChunkSize:   chunkSize,
+		FileSize:    int64(len(plain)),
+	})
+	if err != nil {
+		t.Fatalf("ResumeChunkedUpload: %v", err)
+	}
+
+	if _, err := restarted.FinalizeChunkedUpload("session"); !errors.Is(err, ErrIncompleteUpload) {
+		t.Fatalf("finalizing with chunk 1 missing gave %v, want ErrIncompleteUpload", err)
+	}
+	if err := restarted.SaveChunk("session", 1, bytes.NewReader(chunk(1)), int64(len(chunk(1)))); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	hash, err := restarted.FinalizeChunkedUpload("session")
+	if err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	if sum := sha256.Sum256(plain); hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("the resumed upload hashed to %s", hash)
+	}
+	reader, _, err := restarted.GetFileStream(path, StoredFile{
+		EncryptionVersion: utils.EncryptionVersionStream,
+		PlainSize:         int64(len(plain)),
+	})
+	if err != nil {
+		t.Fatalf("GetFileStream: %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, plain) {
+		t.Error("the file read back differs from what was uploaded")
+	}
+	if entries, _ := os.ReadDir(st.config.FilesystemPath); len(entries) != 1 {
+		t.Errorf("storage holds %d files, want just the finished one", len(entries))
+	}
+}
+
+// A journal line cut short by a crash may be the start of a longer index, and must not
+// vouch for a chunk that was never recorded.
+func TestChunkJournalSkipsAnUnfinishedLine(t *testing.T) {
+	path := t.TempDir() + "/upload.part" + journalSuffix
+	if err := os.WriteFile(path, []byte("0\n2\nbogus\n1"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	received, err := readChunkJournal(path, 12)
+	if err != nil {
+		t.Fatalf("readChunkJournal: %v", err)
+	}
+	if len(received) != 2 || !received[0] || !received[2] {
+		t.Errorf("read %v from the journal, want chunks 0 and 2", received)
+	}
+}
+
+func TestChunkJournalHonoursRetractions(t *testing.T) {
+	path := t.TempDir() + "/upload.part" + journalSuffix
+	if err := os.WriteFile(path, []byte("0\n1\n-0\n2\n-2\n2\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	received, err := readChunkJournal(path, 3)
+	if err != nil {
+		t.Fatalf("readChunkJournal: %v", err)
+	}
+	if len(received) != 2 || !received[1] || !received[2] {
+		t.Errorf("read %v from the journal, want chunks 1 and 2", received)
+	}
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// frameLedger keeps a chunked upload whose nonces are its frame indexes from sealing any
+// frame twice over different bytes, which would give away the XOR of the two plaintexts
+// to whoever saw both ciphertexts - the store, for one. It remembers the digest of every
+// frame it lets through, and lets a frame at the same index through again only with the
+// same plaintext, which seals to the same ciphertext as before. The chunk holding any
+// other frame fails with ErrChunkConflict before that frame is sealed.
+//
+// A frame counts from the moment it is let through, whether or not its chunk is then
+// stored: a chunk that fails partway may have left some of its frames in the store
+// already, or sent them to it.
+type frameLedger struct {
+	mu     sync.Mutex
+	sealed map[int64][sha256.Size]byte
+	// stored reads back the plaintext of a frame sealed before this process took the
+	// upload over, or returns nil if it holds none at that index. It is set for uploads
+	// resumed after a restart, since whatever they sealed before it is not in sealed.
+	stored func(frameIndex int64, plainSize int) ([]byte, error)
+	// record, when set, writes a frame's digest to a FrameJournal before the frame is
+	// let through, for a backend that has no stored to fall back on.
+	record func(frameIndex int64, sum [sha256.Size]byte) error
+}
+
+// FrameJournal keeps what a frameLedger goes by outside the process, for a backend that
+// cannot read back what it sealed. S3 lists the parts an upload holds but not the ones a
+// restart cut short, which may have reached the bucket all the same; an upload there is
+// resumed from the digests the journal holds instead.
+type FrameJournal interface {
+	// RecordFrame notes frame frameIndex of session sessionID as sealed over plaintext
+	// with SHA-256 sum. The frame is only sealed once it has returned.
+	RecordFrame(sessionID string, frameIndex int64, sum [sha256.Size]byte) error
+	// SealedFrames returns every frame recorded for sessionID.
+	SealedFrames(sessionID string) (map[int64][sha256.Size]byte, error)
+}
+
+// ledger returns a frameLedger for a chunked upload sealed with s, or nil if its nonces
+// are drawn at random or it is not sealed here at all, in which case nothing is checked.
+func (s objectSeal) ledger() *frameLedger {
+	if s.version != utils.EncryptionVersionSubkey {
+		return nil
+	}
+	return &frameLedger{sealed: make(map[int64][sha256.Size]byte)}
+}
+
+// journaled keeps l in journal under sessionID, starting from what journal already
+// holds for the session. It does nothing for a nil l.
+func (l *frameLedger) journaled(journal FrameJournal, sessionID string) error {
+	if l == nil {
+		return nil
+	}
+	sealed, err := journal.SealedFrames(sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to read the sealed frames of session %s: %w", sessionID, err)
+	}
+	for frameIndex, sum := range sealed {
+		l.sealed[frameIndex] = sum
+	}
+	l.record = func(frameIndex int64, sum [sha256.Size]byte) error {
+		return journal.RecordFrame(sessionID, frameIndex, sum)
+	}
+	return nil
+}
+
+// check is the utils.FrameCheck chunks are sealed through.
+func (l *frameLedger) check(frameIndex int64, plain []byte) error {
+	if l == nil {
+		return nil
+	}
+	sum := sha256.Sum256(plain)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	earlier, seen := l.sealed[frameIndex]
+	if !seen && l.stored != nil {
+		stored, err := l.stored(frameIndex, len(plain))
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			earlier, seen = sha256.Sum256(stored), true
+			l.sealed[frameIndex] = earlier
+		}
+	}
+	if seen {
+		if earlier != sum {
+			return fmt.Errorf("%w: frame %d", ErrChunkConflict, frameIndex)
+		}
+		return nil
+	}
+	if l.record != nil {
+		if err := l.record(frameIndex, sum); err != nil {
+			return fmt.Errorf("failed to record frame %d: %w", frameIndex, err)
+		}
+	}
+	l.sealed[frameIndex] = sum
+	return nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// Under frame-index nonces a chunk may be sent again only as it was: the same bytes
+// are let through, whether the chunk was stored or cut short, and other bytes are
+// refused before they are sealed, leaving what was stored as it was. A restart does not
+// lose track, since the frames already written are read back.
+func TestChunkSentAgainMustMatchWhatWasSealed(t *testing.T) {
+	st := newTestStorage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(2*chunkSize) + 3000)
+	const path = "sealed-once.bin"
+	chunk := func(i int) []byte {
+		return plain[int64(i)*chunkSize : min(int64(i+1)*chunkSize, int64(len(plain)))]
+	}
+	altered := func(i int, at int) []byte {
+		changed := bytes.Clone(chunk(i))
+		changed[at] ^= 1
+		return changed
+	}
+	save := func(st *FilesystemStorage, i int, r io.Reader) error {
+		return st.SaveChunk("session", i, r, int64(len(chunk(i))))
+	}
+
+	key, err := NewObjectKey(&st.config)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	uploadID, err := st.InitChunkedUpload("session", path, 3, chunkSize, key)
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+
+	if err := save(st, 0, bytes.NewReader(chunk(0))); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+	if err := save(st, 0, bytes.NewReader(chunk(0))); err != nil {
+		t.Errorf("sending chunk 0 again unchanged gave %v", err)
+	}
+	if err := save(st, 0, bytes.NewReader(altered(0, utils.FrameSize+10))); !errors.Is(err, ErrChunkConflict) {
+		t.Errorf("sending chunk 0 again changed gave %v, want ErrChunkConflict", err)
+	}
+	if received, _ := st.ReceivedChunks("session"); len(received) != 1 {
+		t.Errorf("after a refused resend storage holds chunks %v, want [0]", received)
+	}
+
+	// Two frames of chunk 1 go out before the connection drops.
+	cut := io.MultiReader(bytes.NewReader(chunk(1)[:2*utils.FrameSize+5]), iotest.ErrReader(errors.New("connection reset")))
+	if err := save(st, 1, cut); err == nil {
+		t.Fatal("a chunk cut short was stored")
+	}
+	if err := save(st, 1, bytes.NewReader(altered(1, 100))); !errors.Is(err, ErrChunkConflict) {
+		t.Errorf("sending a cut chunk again changed gave %v, want ErrChunkConflict", err)
+	}
+
+	restarted, err := NewFilesystemStorage(st.config)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	err = restarted.ResumeChunkedUpload(ResumedUpload{
+		SessionID:   "session",
+		FilePath:    path,
+		UploadID:    uploadID,
+		TotalChunks: 3,
+		ChunkSize:   chunkSize,
+		FileSize:    int64(len(plain)),
+		Key:         key,
+	})
+	if err != nil {
+		t.Fatalf("ResumeChunkedUpload: %v", err)
+	}
+	if err := save(restarted, 0, bytes.NewReader(altered(0, 5))); !errors.Is(err, ErrChunkConflict) {
+		t.Errorf("after a restart, sending chunk 0 again changed gave %v, want ErrChunkConflict", err)
+	}
+	if err := save(restarted, 1, bytes.NewReader(altered(1, utils.FrameSize+1))); !errors.Is(err, ErrChunkConflict) {
+		t.Errorf("after a restart, sending the cut chunk again changed gave %v, want ErrChunkConflict", err)
+	}
+	for i := 1; i < 3; i++ {
+		if err := save(restarted, i, bytes.NewReader(chunk(i))); err != nil {
+			t.Fatalf("SaveChunk(%d) after the restart: %v", i, err)
+		}
+	}
+	if _, err := restarted.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	file := StoredFile{EncryptionVersion: utils.EncryptionVersionSubkey, PlainSize: int64(len(plain)), Key: key}
+	reader, _, err := restarted.GetFileStream(path, file)
+	if err != nil {
+		t.Fatalf("GetFileStream: %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, plain) {
+		t.Error("the file read back differs from what was uploaded")
+	}
+}
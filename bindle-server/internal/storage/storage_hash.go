@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"hash"
+	"io"
+	"log"
+	"sync"
+)
+
+// maxWaitingBytes caps the plaintext an upload keeps in memory for chunks that arrived
+// ahead of the hash. Both first-party clients keep four chunks in flight, which at the
+// default 10 MB chunk size puts at most three of them ahead of the one being hashed.
+const maxWaitingBytes = 64 << 20
+
+// uploadHasher computes the SHA-256 of a chunked upload's plaintext as its chunks arrive.
+// SHA-256 only runs forwards, so a chunk streams straight into the hash only when every
+// chunk before it already has. One that arrives ahead of its turn, as concurrent chunks
+// do, is copied into memory on the way to storage and hashed once the chunks before it
+// are in. Whatever could not be hashed either way - a client far ahead of itself, or a
+// hash given up on - is read back from the finished object when the upload is finalized.
+type uploadHasher struct {
+	mu        sync.Mutex
+	sum       hash.Hash
+	chunkSize int64
+	// Chunks [0, next) are in sum. While active, chunk next is streaming into it.
+	next   int
+	active bool
+	// waiting has the chunks after next that have arrived, or are arriving, and
+	// reserved is the memory set aside for them.
+	waiting  map[int]*waitingChunk
+	reserved int64
+	// stalled is set once a chunk ahead of next was stored without being kept, so sum
+	// cannot get past it.
+	stalled bool
+	// abandoned is set once the hash can no longer be built as chunks arrive; finish
+	// then hashes the whole object.
+	abandoned bool
+}
+
+// waitingChunk is a chunk that arrived ahead of the hash. data is nil for one there was
+// no room to keep.
+type waitingChunk struct {
+	data   *bytes.Buffer
+	stored bool
+}
+
+func newUploadHasher(chunkSize int64) *uploadHasher {
+	return &uploadHasher{sum: sha256.New(), chunkSize: chunkSize, waiting: make(map[int]*waitingChunk)}
+}
+
+// tee returns r, hashing what is read through it when chunkNumber is next in line and
+// keeping a copy for later when it is ahead. done must be called once the chunk has
+// been stored or has failed.
+//
+// A chunk sent again after it was hashed or kept - a retry, or two copies racing - may
+// not carry the same bytes, and whichever copy is written last is what the object
+// holds. The hash then cannot be trusted to describe the object, and it is what
+// deduplication matches uploads on, so it is abandoned and computed from the object at
+// finalize instead.
+func (h *uploadHasher) tee(chunkNumber int, r io.Reader) (io.Reader, func(stored bool)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.waiting[chunkNumber]; ok || chunkNumber < h.next || (chunkNumber == h.next && h.active) {
+		h.abandon()
+	}
+	if h.abandoned || h.stalled {
+		return r, func(bool) {}
+	}
+	if chunkNumber != h.next {
+		return h.keep(chunkNumber, r)
+	}
+
+	// A chunk that fails partway has fed part of itself into sum, so the state from
+	// before it is kept to return to.
+	snapshot, err := h.sum.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		h.abandon()
+		return r, func(bool) {}
+	}
+	h.active = true
+
+	return io.TeeReader(r, h.sum), func(stored bool) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.abandoned {
+			return
+		}
+		h.active = false
+		if !stored {
+			if h.sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(snapshot) != nil {
+				h.abandon()
+			}
+			return
+		}
+		h.next++
+		h.catchUp()
+	}
+}
+
+// keep copies chunk chunkNumber, which is ahead of the hash, into memory as it is read,
+// or only notes its arrival when there is no room left for it. Called with mu held.
+func (h *uploadHasher) keep(chunkNumber int, r io.Reader) (io.Reader, func(stored bool)) {
+	chunk := &waitingChunk{}
+	h.waiting[chunkNumber] = chunk
+	if h.reserved+h.chunkSize <= maxWaitingBytes {
+		chunk.data = new(bytes.Buffer)
+		h.reserved += h.chunkSize
+		r = io.TeeReader(r, chunk.data)
+	}
+
+	return r, func(stored bool) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.abandoned {
+			return
+		}
+		if !stored {
+			h.release(chunkNumber)
+			return
+		}
+		chunk.stored = true
+		h.catchUp()
+	}
+}
+
+// catchUp hashes the kept chunks that are now next in line. Called with mu held.
+func (h *uploadHasher) catchUp() {
+	for !h.active && !h.stalled {
+		chunk, ok := h.waiting[h.next]
+		if !ok || !chunk.stored {
+			return
+		}
+		if chunk.data == nil {
+			h.stalled = true
+			return
+		}
+		h.sum.Write(chunk.data.Bytes())
+		h.release(h.next)
+		h.next++
+	}
+}
+
+func (h *uploadHasher) release(chunkNumber int) {
+	if chunk := h.waiting[chunkNumber]; chunk != nil && chunk.data != nil {
+		h.reserved -= h.chunkSize
+	}
+	delete(h.waiting, chunkNumber)
+}
+
+// newResumedUploadHasher returns the hasher for an upload picked up after a restart.
+// What was hashed before it went with the process, so the whole object is read back at
+// finalize.
+func newResumedUploadHasher() *uploadHasher {
+	h := newUploadHasher(0)
+	h.abandon()
+	return h
+}
+
+func (h *uploadHasher) abandon() {
+	h.abandoned = true
+	h.active = false
+	h.next = 0
+	h.waiting, h.reserved = nil, 0
+}
+
+// finish completes the hash of a chunkSize-chunked upload of plainSize bytes. read opens
+// the plaintext of the finished object from an offset to its end, for the chunks that
+// were not hashed as they arrived; with every chunk in, that is only ever the case when
+// the hash stalled or was abandoned.
+func (h *uploadHasher) finish(chunkSize, plainSize int64,
+	read func(offset, length int64) (io.ReadCloser, error)) (string, error) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.abandoned {
+		h.sum = sha256.New()
+	}
+	h.waiting, h.reserved = nil, 0
+	if offset := int64(h.next) * chunkSize; offset < plainSize {
+		reader, err := read(offset, plainSize-offset)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		if _, err := io.Copy(h.sum, reader); err != nil {
+			return "", err
+		}
+	}
+	return hexSum(h.sum), nil
+}
+
+// finishUploadHash completes the hash of a chunked upload just published at filePath,
+// reading back through getRange what was not hashed on the way in. A failure is logged
+// and reported as no hash rather than failing an upload that has already been published.
+func finishUploadHash(h *uploadHasher, filePath string, key ObjectKey, chunkSize, plainSize int64,
+	getRange func(filePath string, file StoredFile, offset, length int64) (io.ReadCloser, error)) string {
+
+	stored := StoredFile{EncryptionVersion: key.EncryptionVersion(), PlainSize: plainSize, Key: key}
+	sum, err := h.finish(chunkSize, plainSize, func(offset, length int64) (io.ReadCloser, error) {
+		return getRange(filePath, stored, offset, length)
+	})
+	if err != nil {
+		log.Printf("Warning: could not hash %s, it will not be deduplicated: %v\n", filePath, err)
+		return ""
+	}
+	return sum
+}
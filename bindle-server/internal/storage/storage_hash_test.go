@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// However the chunks arrive, the hash finalize returns has to be that of the object it
+// published: it is what uploads are deduplicated on, and a wrong one would point a new
+// record at contents other than its own.
+func TestChunkedUploadHashesWhatItStored(t *testing.T) {
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(2*chunkSize) + 4096)
+	sum := sha256.Sum256(plain)
+	want := hex.EncodeToString(sum[:])
+
+	chunk := func(i int) []byte {
+		return plain[int64(i)*chunkSize : min(int64(i+1)*chunkSize, int64(len(plain)))]
+	}
+
+	tests := []struct {
+		name  string
+		sends []int
+		// garbled is sent, with the right length but other bytes, before the sends.
+		garbled int
+	}{
+		{name: "in order", sends: []int{0, 1, 2}, garbled: -1},
+		{name: "out of order", sends: []int{2, 0, 1}, garbled: -1},
+		{name: "retried", sends: []int{0, 1, 1, 2}, garbled: -1},
+		{name: "overwritten after hashing", sends: []int{1, 2, 0}, garbled: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestStorage(t)
+			if _, err := st.InitChunkedUpload("session", "hashed.bin", 3, chunkSize, ObjectKey{}); err != nil {
+				t.Fatalf("InitChunkedUpload: %v", err)
+			}
+			if tt.garbled >= 0 {
+				data := chunk(tt.garbled)
+				if err := st.SaveChunk("session", tt.garbled, bytes.NewReader(make([]byte, len(data))), int64(len(data))); err != nil {
+					t.Fatalf("SaveChunk(%d): %v", tt.garbled, err)
+				}
+			}
+			for _, i := range tt.sends {
+				data := chunk(i)
+				if err := st.SaveChunk("session", i, bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatalf("SaveChunk(%d): %v", i, err)
+				}
+			}
+
+			got, err := st.FinalizeChunkedUpload("session")
+			if err != nil {
+				t.Fatalf("FinalizeChunkedUpload: %v", err)
+			}
+			if got != want {
+				t.Errorf("hash is %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// Chunks sent a few at a time arrive out of order, and are hashed from memory once the
+// ones before them are in, so finalizing reads nothing back. A client further ahead
+// than memory allows is still hashed right, by reading back from where the hash stopped.
+func TestUploadHasherKeepsChunksThatArriveEarly(t *testing.T) {
+	const chunkSize = 1024
+	plain := testPayload(5*chunkSize + 100)
+	sum := sha256.Sum256(plain)
+	want := hex.EncodeToString(sum[:])
+	chunk := func(i int) []byte {
+		return plain[i*chunkSize : min((i+1)*chunkSize, len(plain))]
+	}
+	send := func(h *uploadHasher, i int) func(bool) {
+		r, done := h.tee(i, bytes.NewReader(chunk(i)))
+		io.Copy(io.Discard, r)
+		return done
+	}
+
+	h := newUploadHasher(chunkSize)
+	// 0 is still streaming while 1 and 3 finish, and 2 finishes after 0.
+	done0 := send(h, 0)
+	send(h, 1)(true)
+	send(h, 3)(true)
+	done0(true)
+	send(h, 2)(true)
+	// A failed chunk is forgotten, and its retry kept again.
+	send(h, 5)(false)
+	send(h, 5)(true)
+	send(h, 4)(true)
+
+	got, err := h.finish(chunkSize, int64(len(plain)), func(offset, length int64) (io.ReadCloser, error) {
+		t.Fatalf("finish read back %d bytes from %d", length, offset)
+		return nil, nil
+	})
+	if err != nil || got != want {
+		t.Errorf("hash is %s (%v), want %s", got, err, want)
+	}
+
+	// Room for one more chunk: 2 is kept and 1 is not.
+	h = newUploadHasher(chunkSize)
+	h.reserved = maxWaitingBytes - chunkSize
+	send(h, 2)(true)
+	send(h, 1)(true)
+	send(h, 0)(true)
+	var readFrom int64 = -1
+	got, err = h.finish(chunkSize, int64(len(plain)), func(offset, length int64) (io.ReadCloser, error) {
+		readFrom = offset
+		return io.NopCloser(bytes.NewReader(plain[offset:])), nil
+	})
+	if err != nil || got != want {
+		t.Errorf("hash with no room to keep chunks is %s (%v), want %s", got, err, want)
+	}
+	if readFrom != chunkSize {
+		t.Errorf("finish read back from %d, want the chunk that could not be kept", readFrom)
+	}
+}
@@ -3,7 +3,7 @@ package storage
 import (
 	"errors"
 	"io"
-	"mime/multipart"
+	"time"
 )
 
 // ErrIncompleteUpload reports a finalize attempt on a session that is missing chunks.
@@ -12,10 +12,19 @@ import (
 // that actually holds them knows which indexes are present.
 var ErrIncompleteUpload = errors.New("upload is missing chunks")
 
+// ErrUploadGone reports that the backend does not hold a session's upload, so the
+// session can never be finished.
+var ErrUploadGone = errors.New("upload no longer exists in storage")
+
+// ErrChunkConflict reports a chunk sent again with other bytes than storage already
+// sealed for it. What was stored before is left as it was.
+var ErrChunkConflict = errors.New("chunk differs from the one already stored")
+
 // StoredFile describes how an object was encrypted so a reader can be built for it.
 type StoredFile struct {
-	// EncryptionVersion is utils.EncryptionVersionStream for the framed streaming
-	// format and 0 for everything written before it.
+	// EncryptionVersion is utils.EncryptionVersionSubkey or utils.EncryptionVersionStream
+	// for the framed streaming formats, utils.EncryptionVersionClient for an object
+	// stored as its uploader sealed it, and 0 for everything written before them.
 	EncryptionVersion int
 	// ChunkCount is meaningful only at version 0: 0 means the whole file was sealed in
 	// one call, greater than 0 means it was sealed one upload chunk at a time.
@@ -23,23 +32,85 @@ type StoredFile struct {
 	// PlainSize is the decrypted length. The framed format needs it to place frame
 	// boundaries, and it is the length served to the client.
 	PlainSize int64
+	// Key is the key the object was sealed with.
+	Key ObjectKey
+}
+
+// IncompleteUpload is a chunked upload the backend still holds open. These are found by
+// listing the store rather than from session state, so they include uploads a restart
+// has forgotten - which are exactly the ones nothing else would ever clean up.
+type IncompleteUpload struct {
+	// FilePath is the destination the upload was opened against.
+	FilePath string
+	// ID identifies the upload within the backend: the multipart upload id on S3, the
+	// temp file on the filesystem.
+	ID string
+}
+
+// ResumedUpload is what a session recorded about its upload, which is enough for the
+// backend to pick it back up after a restart has emptied its memory.
+type ResumedUpload struct {
+	SessionID string
+	FilePath  string
+	// UploadID is what InitChunkedUpload returned for the upload.
+	UploadID    string
+	TotalChunks int
+	ChunkSize   int64
+	// FileSize is the plaintext length of the whole upload.
+	FileSize int64
+	// Key is what InitChunkedUpload was given. The chunks still to come are sealed
+	// with it too, whatever the active master key is now.
+	Key ObjectKey
 }
 
 type Storage interface {
-	SaveFile(file *multipart.FileHeader, filePath string) (string, error)
+	// SaveFile encrypts size bytes from r with key into a temporary object, hashing the
+	// plaintext on the way through, and returns where it put it and the hex SHA-256 of
+	// the contents. The caller decides from the hash whether the object is needed: it is
+	// published with PromoteFile, or dropped with DeleteFile when the same contents are
+	// already stored.
+	SaveFile(r io.Reader, size int64, key ObjectKey) (tempPath string, hash string, err error)
+	// PromoteFile moves an object written by SaveFile to its content-addressed path.
+	PromoteFile(tempPath, filePath string) error
 	// GetFileStream returns a reader over the decrypted file and its plaintext length.
 	// Nothing larger than one frame is held in memory at any point.
 	GetFileStream(filePath string, file StoredFile) (io.ReadCloser, int64, error)
+	// GetFileRange returns a reader over plaintext bytes [offset, offset+length). For the
+	// framed format only the frames covering the range are fetched; older formats cannot
+	// be entered in the middle, so they are decrypted from the start and skipped.
+	GetFileRange(filePath string, file StoredFile, offset, length int64) (io.ReadCloser, error)
 	DeleteFile(filePath string) error
+	// ModTime returns when the object at filePath was written.
+	ModTime(filePath string) (time.Time, error)
 
 	// Chunked upload. The session is opened against its final destination up front so
 	// that no byte has to be moved, copied or re-encrypted once the last chunk lands.
-	InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64) error
+	// Its chunks are sealed with key, which the caller keeps to resume it with.
+	// The returned id is the backend's name for the upload - the multipart upload id on
+	// S3, the temp file on the filesystem - and is what ResumeChunkedUpload needs back.
+	InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64, key ObjectKey) (uploadID string, err error)
+	// ResumeChunkedUpload reopens an upload that was opened before a restart, finding
+	// out from the backend which chunks it already holds. It returns ErrUploadGone when
+	// the upload no longer exists.
+	ResumeChunkedUpload(upload ResumedUpload) error
 	// SaveChunk encrypts exactly plainSize bytes from r and stores them as chunk
 	// chunkNumber. r is the request body, so the chunk is never held whole in memory.
+	// A chunk sent again has to match what was stored for it, or it fails with
+	// ErrChunkConflict; see frameLedger.
 	SaveChunk(sessionID string, chunkNumber int, r io.Reader, plainSize int64) error
+	// ReceivedChunks returns the indexes of the chunks stored so far, in ascending order,
+	// so a client that lost track can send just the rest. It returns ErrUploadGone for a
+	// session the backend does not hold.
+	ReceivedChunks(sessionID string) ([]int, error)
 	// FinalizeChunkedUpload publishes the session at the path it was opened with, and
-	// returns ErrIncompleteUpload if any chunk is missing.
-	FinalizeChunkedUpload(sessionID string) (string, error)
+	// returns ErrIncompleteUpload if any chunk is missing. It returns the hex SHA-256 of
+	// the contents, or "" if that could not be worked out; the upload is published
+	// either way, as the hash is only needed to deduplicate it.
+	FinalizeChunkedUpload(sessionID string) (hash string, err error)
 	AbortChunkedUpload(sessionID string) error
+
+	// ListIncompleteUploads reports every upload the backend holds open, whether or not
+	// this process opened it, so that ones with no session left can be released.
+	ListIncompleteUploads() ([]IncompleteUpload, error)
+	AbortIncompleteUpload(upload IncompleteUpload) error
 }
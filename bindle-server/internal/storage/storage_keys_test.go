@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// rotatedConfig is cfg after a new key has been made the active one, with the old key
+// kept under the ID "" to read what it sealed.
+func rotatedConfig(cfg config.Config) config.Config {
+	newKey := bytes.Repeat([]byte{0x42}, 32)
+	cfg.EncryptionKeys = map[string][]byte{"": cfg.EncryptionKey, "next": newKey}
+	cfg.EncryptionKey, cfg.EncryptionKeyID = newKey, "next"
+	return cfg
+}
+
+func readAll(t *testing.T, st Storage, filePath string, file StoredFile) []byte {
+	t.Helper()
+	reader, _, err := st.GetFileStream(filePath, file)
+	if err != nil {
+		t.Fatalf("GetFileStream(%s): %v", filePath, err)
+	}
+	defer reader.Close()
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %s: %v", filePath, err)
+	}
+	return got
+}
+
+func newObjectKey(t *testing.T, cfg *config.Config) ObjectKey {
+	t.Helper()
+	key, err := NewObjectKey(cfg)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	return key
+}
+
+// After a master key change, objects in every format are read with the key they were
+// sealed with, and a chunked upload opened before the change carries on with its own.
+func TestObjectsAreReadWithTheirOwnKey(t *testing.T) {
+	st := newTestStorage(t)
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 5000)
+
+	framedKey, chunkedKey := newObjectKey(t, &st.config), newObjectKey(t, &st.config)
+	if bytes.Equal(framedKey.Wrapped, chunkedKey.Wrapped) {
+		t.Fatal("two objects were given the same data key")
+	}
+	tempPath, _, err := st.SaveFile(bytes.NewReader(plain), int64(len(plain)), framedKey)
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	if err := st.PromoteFile(tempPath, "framed.bin"); err != nil {
+		t.Fatalf("PromoteFile: %v", err)
+	}
+	sealed, err := utils.EncryptFile(&st.config, plain)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	if err := os.WriteFile(st.config.FilesystemPath+"/legacy.bin", sealed, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	uploadID, err := st.InitChunkedUpload("session", "chunked.bin", 2, chunkSize, chunkedKey)
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+
+	rotated, err := NewFilesystemStorage(rotatedConfig(st.config))
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+	err = rotated.ResumeChunkedUpload(ResumedUpload{
+		SessionID:   "session",
+		FilePath:    "chunked.bin",
+		UploadID:    uploadID,
+		TotalChunks: 2,
+		ChunkSize:   chunkSize,
+		FileSize:    int64(len(plain)),
+		Key:         chunkedKey,
+	})
+	if err != nil {
+		t.Fatalf("ResumeChunkedUpload: %v", err)
+	}
+	if err := rotated.SaveChunk("session", 1, bytes.NewReader(plain[chunkSize:]), int64(len(plain))-chunkSize); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if _, err := rotated.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	framed := StoredFile{EncryptionVersion: utils.EncryptionVersionSubkey, PlainSize: int64(len(plain)), Key: framedKey}
+	chunked := framed
+	chunked.Key = chunkedKey
+	for path, file := range map[string]StoredFile{"framed.bin": framed, "chunked.bin": chunked, "legacy.bin": {}} {
+		if got := readAll(t, rotated, path, file); !bytes.Equal(got, plain) {
+			t.Errorf("%s does not read back under its old key", path)
+		}
+	}
+	if reader, err := rotated.GetFileRange("framed.bin", framed, chunkSize, 100); err != nil {
+		t.Errorf("a range of framed.bin failed: %v", err)
+	} else {
+		got, _ := io.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(got, plain[chunkSize:chunkSize+100]) {
+			t.Error("a range of framed.bin does not read back under its old key")
+		}
+	}
+
+	// The data key is the only way in: not the master key, and not another object's.
+	for _, key := range []ObjectKey{{}, chunkedKey} {
+		wrong := framed
+		wrong.Key = key
+		if reader, _, err := rotated.GetFileStream("framed.bin", wrong); err == nil {
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Error("framed.bin read back without its own data key")
+			}
+			reader.Close()
+		}
+	}
+
+	unknown := framed
+	unknown.Key.KeyID = "gone"
+	if _, _, err := rotated.GetFileStream("framed.bin", unknown); !errors.Is(err, config.ErrUnknownKey) {
+		t.Errorf("reading with a key the server lacks gave %v, want ErrUnknownKey", err)
+	}
+}
@@ -1,20 +1,24 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/google/uuid"
 	localconfig "github.com/nuuner/bindle-server/internal/config"
 	"github.com/nuuner/bindle-server/pkg/utils"
 )
@@ -35,6 +39,14 @@ type s3Upload struct {
 	// ascending part numbers, and a retried chunk has to replace its earlier ETag
 	// instead of adding a duplicate.
 	parts map[int32]types.CompletedPart
+	// lastChunkSize is the plaintext length of the final chunk, which together with
+	// the layout gives the file's.
+	lastChunkSize int64
+	hasher        *uploadHasher
+	// objectKey is what the chunks are sealed with, and seal is it opened.
+	objectKey ObjectKey
+	seal      objectSeal
+	frames    *frameLedger
 }
 
 type S3Storage struct {
@@ -43,9 +55,13 @@ type S3Storage struct {
 	config       localconfig.Config
 	uploads      map[string]*s3Upload // sessionID -> upload
 	uploadsMutex sync.RWMutex
+	// journal keeps the frame ledgers of chunked uploads across restarts.
+	journal FrameJournal
 }
 
-func NewS3Storage(cfg localconfig.Config) (*S3Storage, error) {
+// NewS3Storage connects to the bucket in cfg. journal is where chunked uploads sealed
+// under frame-index nonces record their frames, so they can be resumed after a restart.
+func NewS3Storage(cfg localconfig.Config, journal FrameJournal) (*S3Storage, error) {
 	var options []func(*s3.Options)
 
 	if cfg.S3Endpoint != "" {
@@ -73,32 +89,58 @@ func NewS3Storage(cfg localconfig.Config) (*S3Storage, error) {
 		bucket:  cfg.S3Bucket,
 		config:  cfg,
 		uploads: make(map[string]*s3Upload),
+		journal: journal,
 	}, nil
 }
 
-func (s *S3Storage) SaveFile(file *multipart.FileHeader, filePath string) (string, error) {
-	src, err := file.Open()
+// stagingPrefix is where single uploads are written before their content address is
+// known.
+const stagingPrefix = "staging/"
+
+// SaveFile streams the upload to a staging key. S3 cannot rename, so PromoteFile costs a
+// server-side copy; single uploads are bounded by the request size limit, far below the
+// 5 GB where CopyObject stops working.
+func (s *S3Storage) SaveFile(r io.Reader, size int64, objectKey ObjectKey) (string, string, error) {
+	seal, err := objectKey.seal(&s.config)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %w", err)
+		return "", "", err
 	}
-	defer src.Close()
-
-	encrypted, err := utils.NewEncryptingReader(src, s.config.EncryptionKey, file.Size, 0)
+	encrypted, sum, err := encryptHashing(r, seal, size)
 	if err != nil {
-		return "", fmt.Errorf("failed to set up encryption: %w", err)
+		return "", "", fmt.Errorf("failed to set up encryption: %w", err)
 	}
 
+	key := stagingPrefix + uuid.NewString()
 	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket:        aws.String(s.bucket),
-		Key:           aws.String(filePath),
+		Key:           aws.String(key),
 		Body:          encrypted,
-		ContentLength: aws.Int64(utils.EncryptedSize(file.Size)),
+		ContentLength: aws.Int64(seal.encryptedSize(size)),
+	}, func(o *s3.Options) {
+		// The body is the client's upload and cannot be rewound for a retry.
+		o.RetryMaxAttempts = 1
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to upload file to S3: %w", err)
+		return "", "", fmt.Errorf("failed to upload file to S3: %w", err)
 	}
 
-	return filePath, nil
+	return key, hexSum(sum), nil
+}
+
+func (s *S3Storage) PromoteFile(tempPath, filePath string) error {
+	_, err := s.client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(filePath),
+		CopySource: aws.String(s.bucket + "/" + tempPath),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s at %s: %w", tempPath, filePath, err)
+	}
+
+	if err := s.DeleteFile(tempPath); err != nil {
+		log.Printf("Warning: published %s but could not remove it: %v\n", tempPath, err)
+	}
+	return nil
 }
 
 // GetFileStream returns a streaming reader over the decrypted object. S3 hands back a
@@ -123,6 +165,26 @@ func (s *S3Storage) GetFileStream(filePath string, file StoredFile) (io.ReadClos
 	return reader, size, nil
 }
 
+// GetFileRange asks S3 for just the sealed bytes of the frames covering the range, so
+// seeking in a video or resuming a download does not pull the object from the start.
+func (s *S3Storage) GetFileRange(filePath string, file StoredFile, offset, length int64) (io.ReadCloser, error) {
+	return decryptRange(&s.config, file, offset, length,
+		func(sealedOffset, sealedLength int64) (io.ReadCloser, error) {
+			result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(filePath),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-%d", sealedOffset, sealedOffset+sealedLength-1)),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get file range from S3: %w", err)
+			}
+			return result.Body, nil
+		},
+		func() (io.ReadCloser, int64, error) {
+			return s.GetFileStream(filePath, file)
+		})
+}
+
 func (s *S3Storage) DeleteFile(filePath string) error {
 	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -135,9 +197,32 @@ func (s *S3Storage) DeleteFile(filePath string) error {
 	return nil
 }
 
+func (s *S3Storage) ModTime(filePath string) (time.Time, error) {
+	result, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to look up %s in S3: %w", filePath, err)
+	}
+	if result.LastModified == nil {
+		return time.Time{}, fmt.Errorf("S3 gave no modification time for %s", filePath)
+	}
+	return *result.LastModified, nil
+}
+
 // Chunked upload
 
-func (s *S3Storage) InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64) error {
+func (s *S3Storage) InitChunkedUpload(sessionID string, filePath string, totalChunks int, chunkSize int64, objectKey ObjectKey) (string, error) {
+	seal, err := objectKey.seal(&s.config)
+	if err != nil {
+		return "", err
+	}
+	frames := seal.ledger()
+	if err := frames.journaled(s.journal, sessionID); err != nil {
+		return "", err
+	}
+
 	// Opened here rather than lazily on the first chunk: chunks now arrive
 	// concurrently, and creating the multipart upload up front keeps the first
 	// arrivals from queueing behind one another to do it.
@@ -146,7 +231,7 @@ func (s *S3Storage) InitChunkedUpload(sessionID string, filePath string, totalCh
 		Key:    aws.String(filePath),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create multipart upload: %w", err)
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
 	}
 
 	s.uploadsMutex.Lock()
@@ -156,11 +241,83 @@ func (s *S3Storage) InitChunkedUpload(sessionID string, filePath string, totalCh
 		totalChunks: totalChunks,
 		chunkSize:   chunkSize,
 		parts:       make(map[int32]types.CompletedPart, totalChunks),
+		hasher:      newUploadHasher(chunkSize),
+		objectKey:   objectKey,
+		seal:        seal,
+		frames:      frames,
 	}
 	s.uploadsMutex.Unlock()
 
 	log.Printf("Initialized S3 multipart upload %s for session %s at %s (%d parts)\n",
 		*createResp.UploadId, sessionID, filePath, totalChunks)
+	return *createResp.UploadId, nil
+}
+
+// ResumeChunkedUpload takes the parts from ListParts rather than from anything kept
+// alongside the upload: the bucket only lists a part once it has been stored in full,
+// and completing the upload needs the ETags it reports.
+//
+// What the frame ledger goes by comes from the journal instead. The bucket has seen
+// every part the server started sending, listed or not, and only the journal says what
+// the frames in the ones cut short by the restart held.
+func (s *S3Storage) ResumeChunkedUpload(resumed ResumedUpload) error {
+	if resumed.UploadID == "" {
+		return fmt.Errorf("%w: no multipart upload recorded for session %s", ErrUploadGone, resumed.SessionID)
+	}
+	seal, err := resumed.Key.seal(&s.config)
+	if err != nil {
+		return err
+	}
+	frames := seal.ledger()
+	if err := frames.journaled(s.journal, resumed.SessionID); err != nil {
+		return err
+	}
+
+	parts := make(map[int32]types.CompletedPart, resumed.TotalChunks)
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(resumed.FilePath),
+		UploadId: aws.String(resumed.UploadID),
+	}
+	for {
+		result, err := s.client.ListParts(context.TODO(), input)
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+				return fmt.Errorf("%w: multipart upload %s", ErrUploadGone, resumed.UploadID)
+			}
+			return fmt.Errorf("failed to list parts of multipart upload %s: %w", resumed.UploadID, err)
+		}
+		for _, part := range result.Parts {
+			number := aws.ToInt32(part.PartNumber)
+			if number < 1 || int(number) > resumed.TotalChunks {
+				continue
+			}
+			parts[number] = types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)}
+		}
+		if !aws.ToBool(result.IsTruncated) {
+			break
+		}
+		input.PartNumberMarker = result.NextPartNumberMarker
+	}
+
+	s.uploadsMutex.Lock()
+	s.uploads[resumed.SessionID] = &s3Upload{
+		key:           resumed.FilePath,
+		uploadID:      resumed.UploadID,
+		totalChunks:   resumed.TotalChunks,
+		chunkSize:     resumed.ChunkSize,
+		parts:         parts,
+		lastChunkSize: resumed.FileSize - int64(resumed.TotalChunks-1)*resumed.ChunkSize,
+		hasher:        newResumedUploadHasher(),
+		objectKey:     resumed.Key,
+		seal:          seal,
+		frames:        frames,
+	}
+	s.uploadsMutex.Unlock()
+
+	log.Printf("Resumed S3 multipart upload %s for session %s (%d of %d parts)\n",
+		resumed.UploadID, resumed.SessionID, len(parts), resumed.TotalChunks)
 	return nil
 }
 
@@ -176,13 +333,19 @@ func (s *S3Storage) SaveChunk(sessionID string, chunkNumber int, r io.Reader, pl
 	// before a byte is read. That is what lets the chunk go straight from the request
 	// body into the S3 request: encryption happens as the SDK pulls, and back pressure
 	// from S3 reaches the client's socket instead of a buffer growing in between.
-	encrypted, err := utils.NewEncryptingReader(
-		r, s.config.EncryptionKey, plainSize, int64(chunkNumber)*utils.FramesPerChunk(upload.chunkSize))
+	r, hashed := upload.hasher.tee(chunkNumber, r)
+	encrypted, err := upload.seal.encryptChunk(r, chunkNumber, upload.chunkSize, plainSize, upload.frames.check)
 	if err != nil {
+		hashed(false)
 		return fmt.Errorf("failed to set up encryption: %w", err)
 	}
 
-	encryptedSize := utils.EncryptedSize(plainSize)
+	// The object's header, if the format has one, leads the first part.
+	encryptedSize := utils.EncryptedSize(upload.seal.version, plainSize)
+	if chunkNumber == 0 && len(upload.seal.header) > 0 {
+		encrypted = io.MultiReader(bytes.NewReader(upload.seal.header), encrypted)
+		encryptedSize += int64(len(upload.seal.header))
+	}
 	// Part numbers are 1-indexed in S3.
 	partNumber := int32(chunkNumber + 1)
 
@@ -194,6 +357,7 @@ func (s *S3Storage) SaveChunk(sessionID string, chunkNumber int, r io.Reader, pl
 	// whole in memory.
 	spool, err := os.CreateTemp("", "bindle-part-")
 	if err != nil {
+		hashed(false)
 		return fmt.Errorf("failed to create spool file: %w", err)
 	}
 	defer func() {
@@ -208,6 +372,7 @@ func (s *S3Storage) SaveChunk(sessionID string, chunkNumber int, r io.Reader, pl
 
 		uploadResp, err = s.uploadPartFromSpool(upload, partNumber, spool, encryptedSize)
 		if err != nil {
+			hashed(false)
 			// The original failure stays in the chain rather than the spool's: when the
 			// body ended early it is the one that says so, and the handler answers that
 			// with a 400 instead of reporting a storage fault.
@@ -216,11 +381,18 @@ func (s *S3Storage) SaveChunk(sessionID string, chunkNumber int, r io.Reader, pl
 		}
 	}
 
+	// A part that was replayed from the spool was still read from the client in full
+	// the first time, which is when it was hashed.
+	hashed(true)
+
 	s.uploadsMutex.Lock()
 	upload.parts[partNumber] = types.CompletedPart{
 		ETag:       uploadResp.ETag,
 		PartNumber: aws.Int32(partNumber),
 	}
+	if chunkNumber == upload.totalChunks-1 {
+		upload.lastChunkSize = plainSize
+	}
 	s.uploadsMutex.Unlock()
 
 	return nil
@@ -269,6 +441,25 @@ func (s *S3Storage) uploadPartFromSpool(upload *s3Upload, partNumber int32,
 	return s.uploadPart(upload, partNumber, spool, size, true)
 }
 
+// ReceivedChunks answers from the parts this process has seen stored, which after a
+// restart starts from what ListParts reported.
+func (s *S3Storage) ReceivedChunks(sessionID string) ([]int, error) {
+	s.uploadsMutex.RLock()
+	defer s.uploadsMutex.RUnlock()
+
+	upload, exists := s.uploads[sessionID]
+	if !exists {
+		return nil, fmt.Errorf("%w: session %s", ErrUploadGone, sessionID)
+	}
+
+	received := make([]int, 0, len(upload.parts))
+	for partNumber := range upload.parts {
+		received = append(received, int(partNumber)-1)
+	}
+	sort.Ints(received)
+	return received, nil
+}
+
 func (s *S3Storage) FinalizeChunkedUpload(sessionID string) (string, error) {
 	s.uploadsMutex.Lock()
 	upload, exists := s.uploads[sessionID]
@@ -282,6 +473,7 @@ func (s *S3Storage) FinalizeChunkedUpload(sessionID string) (string, error) {
 		parts = append(parts, part)
 	}
 	key, uploadID, totalChunks := upload.key, upload.uploadID, upload.totalChunks
+	plainSize := int64(totalChunks-1)*upload.chunkSize + upload.lastChunkSize
 	s.uploadsMutex.Unlock()
 
 	if len(parts) != totalChunks {
@@ -309,7 +501,7 @@ func (s *S3Storage) FinalizeChunkedUpload(sessionID string) (string, error) {
 	s.uploadsMutex.Unlock()
 
 	log.Printf("Completed S3 multipart upload for session %s at %s (%d parts)\n", sessionID, key, totalChunks)
-	return key, nil
+	return finishUploadHash(upload.hasher, key, upload.objectKey, upload.chunkSize, plainSize, s.GetFileRange), nil
 }
 
 func (s *S3Storage) AbortChunkedUpload(sessionID string) error {
@@ -339,3 +531,43 @@ func (s *S3Storage) AbortChunkedUpload(sessionID string) error {
 	log.Printf("Aborted S3 multipart upload %s for session %s\n", upload.uploadID, sessionID)
 	return nil
 }
+
+// ListIncompleteUploads lists the multipart uploads open in the bucket. An upload whose
+// session is gone keeps its parts billed until it is aborted, and after a restart
+// nothing in memory remembers it, so the bucket has to be asked.
+func (s *S3Storage) ListIncompleteUploads() ([]IncompleteUpload, error) {
+	var uploads []IncompleteUpload
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(s.bucket)}
+
+	for {
+		result, err := s.client.ListMultipartUploads(context.TODO(), input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range result.Uploads {
+			uploads = append(uploads, IncompleteUpload{
+				FilePath: aws.ToString(upload.Key),
+				ID:       aws.ToString(upload.UploadId),
+			})
+		}
+		if !aws.ToBool(result.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker = result.NextKeyMarker
+		input.UploadIdMarker = result.NextUploadIdMarker
+	}
+}
+
+func (s *S3Storage) AbortIncompleteUpload(upload IncompleteUpload) error {
+	_, err := s.client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(upload.FilePath),
+		UploadId: aws.String(upload.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload %s: %w", upload.ID, err)
+	}
+
+	log.Printf("Aborted abandoned S3 multipart upload %s at %s\n", upload.ID, upload.FilePath)
+	return nil
+}
@@ -2,14 +2,18 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 
@@ -48,6 +52,13 @@ type fakeS3 struct {
 	// bucket returns, so the recovery path can be exercised.
 	failFirstAttempt bool
 	attempts         map[int32]int
+	// ranges records the Range header of every GET, so a test can check a ranged read
+	// asked for just the frames it needed rather than the whole object.
+	ranges []string
+	// open is uploadID -> key for every multipart upload not yet completed or aborted,
+	// which is what ListMultipartUploads reports.
+	open    map[string]string
+	created int
 }
 
 func newFakeS3() *fakeS3 {
@@ -58,6 +69,7 @@ func newFakeS3() *fakeS3 {
 		partEncoding:       make(map[int32][]string),
 		attempts:           make(map[int32]int),
 		objects:            make(map[string][]byte),
+		open:               make(map[string]string),
 	}
 }
 
@@ -79,10 +91,38 @@ func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case r.Method == http.MethodPost && q.Has("uploads"):
-		f.parts["upload-1"] = make(map[int32][]byte)
+		f.created++
+		id := fmt.Sprintf("upload-%d", f.created)
+		f.parts[id] = make(map[int32][]byte)
+		f.open[id] = key
 		writeXML(w, fmt.Sprintf(
-			`<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`,
-			testBucket, key))
+			`<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`,
+			testBucket, key, id))
+
+	case r.Method == http.MethodGet && q.Has("uploads"):
+		var uploads string
+		for id, key := range f.open {
+			uploads += fmt.Sprintf(`<Upload><Key>%s</Key><UploadId>%s</UploadId></Upload>`, key, id)
+		}
+		writeXML(w, fmt.Sprintf(
+			`<ListMultipartUploadsResult><Bucket>%s</Bucket><IsTruncated>false</IsTruncated>%s</ListMultipartUploadsResult>`,
+			testBucket, uploads))
+
+	case r.Method == http.MethodGet && uploadID != "":
+		if _, ok := f.open[uploadID]; !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, xml.Header+`<Error><Code>NoSuchUpload</Code><Message>no such upload</Message></Error>`)
+			return
+		}
+		var parts string
+		for number, body := range f.parts[uploadID] {
+			parts += fmt.Sprintf(`<Part><PartNumber>%d</PartNumber><ETag>"etag-%d"</ETag><Size>%d</Size></Part>`,
+				number, number, len(body))
+		}
+		writeXML(w, fmt.Sprintf(
+			`<ListPartsResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>%s</ListPartsResult>`,
+			testBucket, key, uploadID, parts))
 
 	case r.Method == http.MethodPut && uploadID != "":
 		partNumber, _ := strconv.Atoi(q.Get("partNumber"))
@@ -124,24 +164,60 @@ func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			assembled = append(assembled, f.parts[uploadID][part.PartNumber]...)
 		}
 		f.objects[key] = assembled
+		delete(f.open, uploadID)
 		writeXML(w, fmt.Sprintf(
 			`<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"final"</ETag></CompleteMultipartUploadResult>`,
 			testBucket, key))
 
 	case r.Method == http.MethodDelete && uploadID != "":
 		f.aborted = append(f.aborted, uploadID)
+		delete(f.open, uploadID)
 		w.WriteHeader(http.StatusNoContent)
 
 	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
 		f.copies++
+		source, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		object, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), testBucket+"/")]
+		if !ok {
+			http.Error(w, "no such source "+source, http.StatusNotFound)
+			return
+		}
+		f.objects[key] = object
 		writeXML(w, `<CopyObjectResult><ETag>"copied"</ETag></CopyObjectResult>`)
 
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", `"put"`)
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
 	case r.Method == http.MethodGet:
 		object, ok := f.objects[key]
 		if !ok {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		if spec := r.Header.Get("Range"); spec != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(spec, "bytes=%d-%d", &start, &end); err != nil || end >= len(object) {
+				http.Error(w, "bad range "+spec, http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(object[start : end+1])
+			return
+		}
 		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
 		w.WriteHeader(http.StatusOK)
 		w.Write(object)
@@ -188,9 +264,48 @@ func newFakeS3Storage(t *testing.T) (*S3Storage, *fakeS3) {
 		bucket:  testBucket,
 		config:  cfg,
 		uploads: make(map[string]*s3Upload),
+		journal: &memoryJournal{frames: make(map[string]map[int64][sha256.Size]byte)},
 	}, fake
 }
 
+// restartS3 is st as a restart leaves it: the same bucket and database, and nothing in
+// memory.
+func restartS3(st *S3Storage) *S3Storage {
+	return &S3Storage{
+		client:  st.client,
+		bucket:  st.bucket,
+		config:  st.config,
+		uploads: make(map[string]*s3Upload),
+		journal: st.journal,
+	}
+}
+
+// memoryJournal is a FrameJournal that outlives an S3Storage the way the database does.
+type memoryJournal struct {
+	mu     sync.Mutex
+	frames map[string]map[int64][sha256.Size]byte
+}
+
+func (j *memoryJournal) RecordFrame(sessionID string, frameIndex int64, sum [sha256.Size]byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.frames[sessionID] == nil {
+		j.frames[sessionID] = make(map[int64][sha256.Size]byte)
+	}
+	j.frames[sessionID][frameIndex] = sum
+	return nil
+}
+
+func (j *memoryJournal) SealedFrames(sessionID string) (map[int64][sha256.Size]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	sealed := make(map[int64][sha256.Size]byte, len(j.frames[sessionID]))
+	for frameIndex, sum := range j.frames[sessionID] {
+		sealed[frameIndex] = sum
+	}
+	return sealed, nil
+}
+
 // The whole S3 path in one pass: parts stream out of the request body with a declared
 // length, arrive out of order, get listed in ascending order at completion, land at the
 // final key without a copy, and read back byte for byte.
@@ -202,7 +317,7 @@ func TestS3ChunkedUploadRoundTrip(t *testing.T) {
 	totalChunks := 3
 	const path = "abc123.bin"
 
-	if err := st.InitChunkedUpload("session", path, totalChunks, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", path, totalChunks, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 
@@ -226,7 +341,7 @@ func TestS3ChunkedUploadRoundTrip(t *testing.T) {
 		if end > int64(len(plain)) {
 			end = int64(len(plain))
 		}
-		want := utils.EncryptedSize(end - start)
+		want := utils.EncryptedSize(utils.EncryptionVersionStream, end-start)
 		if got := fake.partContentLengths[int32(i+1)]; got != want {
 			t.Errorf("part %d arrived with Content-Length %d, want %d", i+1, got, want)
 		}
@@ -288,7 +403,7 @@ func TestS3FinalizeRefusesMissingParts(t *testing.T) {
 	st, _ := newFakeS3Storage(t)
 
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
-	if err := st.InitChunkedUpload("session", "hole.bin", 2, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", "hole.bin", 2, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 	if err := st.SaveChunk("session", 0, bytes.NewReader(testPayload(int(chunkSize))), chunkSize); err != nil {
@@ -308,7 +423,7 @@ func TestS3RetriedChunkReplacesItsPart(t *testing.T) {
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
 	chunk := testPayload(int(chunkSize))
 
-	if err := st.InitChunkedUpload("session", "retried.bin", 2, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", "retried.bin", 2, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 	for i := 0; i < 3; i++ {
@@ -337,7 +452,7 @@ func TestS3AbortReleasesTheUpload(t *testing.T) {
 	st, fake := newFakeS3Storage(t)
 
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
-	if err := st.InitChunkedUpload("session", "aborted.bin", 2, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", "aborted.bin", 2, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 	if err := st.SaveChunk("session", 0, bytes.NewReader(testPayload(int(chunkSize))), chunkSize); err != nil {
@@ -373,7 +488,7 @@ func TestS3PartRecoversFromTransientFailureWithoutTheClient(t *testing.T) {
 	totalChunks := 2
 	const path = "flaky.bin"
 
-	if err := st.InitChunkedUpload("session", path, totalChunks, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", path, totalChunks, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 
@@ -426,7 +541,7 @@ func TestS3PartialBodyIsNotReplayed(t *testing.T) {
 	fake.failFirstAttempt = true
 
 	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
-	if err := st.InitChunkedUpload("session", "short.bin", 1, chunkSize); err != nil {
+	if _, err := st.InitChunkedUpload("session", "short.bin", 1, chunkSize, ObjectKey{}); err != nil {
 		t.Fatalf("InitChunkedUpload: %v", err)
 	}
 
@@ -449,3 +564,298 @@ func TestS3PartialBodyIsNotReplayed(t *testing.T) {
 		t.Errorf("a truncated chunk recorded %d parts, want 0", parts)
 	}
 }
+
+// A ranged read has to reach S3 as a ranged GET for just the frames covering it - the
+// point is that seeking near the end of a large video does not pull the object from the
+// start.
+func TestS3RangeFetchesOnlyTheFramesItNeeds(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 3000)
+	const path = "ranged.bin"
+
+	if _, err := st.InitChunkedUpload("session", path, 2, chunkSize, ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+	if err := st.SaveChunk("session", 1, bytes.NewReader(plain[chunkSize:]), int64(len(plain))-chunkSize); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if _, err := st.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	offset, length := int64(len(plain))-2000, int64(1500)
+	reader, err := st.GetFileRange(path, StoredFile{
+		EncryptionVersion: utils.EncryptionVersionStream,
+		PlainSize:         int64(len(plain)),
+	}, offset, length)
+	if err != nil {
+		t.Fatalf("GetFileRange: %v", err)
+	}
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read back: %v", err)
+	}
+	if !bytes.Equal(got, plain[offset:offset+length]) {
+		t.Error("the range read back differs from the uploaded bytes")
+	}
+
+	_, sealedOffset, sealedLength := utils.FrameSpan(utils.EncryptionVersionStream, int64(len(plain)), offset, length)
+	want := fmt.Sprintf("bytes=%d-%d", sealedOffset, sealedOffset+sealedLength-1)
+	if len(fake.ranges) != 1 || fake.ranges[0] != want {
+		t.Errorf("the read asked S3 for %q, want a single %q", fake.ranges, want)
+	}
+}
+
+// A restart forgets every multipart upload in flight, so the bucket's own listing is the
+// only way to find the ones left open and stop paying for their parts.
+func TestS3IncompleteUploadsAreListedAndAborted(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	if _, err := st.InitChunkedUpload("session", "left-open.bin", 2, chunkSize, ObjectKey{}); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+
+	// A fresh backend, as after a restart: nothing in memory knows about the upload.
+	restarted := restartS3(st)
+
+	uploads, err := restarted.ListIncompleteUploads()
+	if err != nil {
+		t.Fatalf("ListIncompleteUploads: %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].FilePath != "left-open.bin" {
+		t.Fatalf("listed %+v, want the one upload left open", uploads)
+	}
+
+	if err := restarted.AbortIncompleteUpload(uploads[0]); err != nil {
+		t.Fatalf("AbortIncompleteUpload: %v", err)
+	}
+	if len(fake.open) != 0 {
+		t.Errorf("%d multipart uploads are still open after the abort", len(fake.open))
+	}
+}
+
+// A single upload goes to a staging key while it is hashed, and is copied to its content
+// address once the hash is known; the staging object does not outlive that.
+func TestS3SingleUploadIsPublishedAtItsHash(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+	plain := testPayload(2*utils.FrameSize + 99)
+
+	tempPath, hash, err := st.SaveFile(bytes.NewReader(plain), int64(len(plain)), ObjectKey{})
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	if sum := sha256.Sum256(plain); hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("SaveFile reported hash %s, want the SHA-256 of the contents", hash)
+	}
+
+	path := hash + ".bin"
+	if err := st.PromoteFile(tempPath, path); err != nil {
+		t.Fatalf("PromoteFile: %v", err)
+	}
+	if keys := keysOf(fake.objects); len(keys) != 1 || keys[0] != path {
+		t.Errorf("the bucket holds %v, want just %s", keys, path)
+	}
+
+	reader, _, err := st.GetFileStream(path, StoredFile{
+		EncryptionVersion: utils.EncryptionVersionStream,
+		PlainSize:         int64(len(plain)),
+	})
+	if err != nil {
+		t.Fatalf("GetFileStream: %v", err)
+	}
+	defer reader.Close()
+	if got, err := io.ReadAll(reader); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("the published object did not read back as the upload: %v", err)
+	}
+}
+
+// After a restart the bucket is asked which parts the upload holds, and the ETags it
+// lists are what completing the upload needs.
+func TestS3ChunkedUploadResumesAfterRestart(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 4096)
+	const path = "resumed.bin"
+
+	uploadID, err := st.InitChunkedUpload("session", path, 2, chunkSize, ObjectKey{})
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+
+	restarted := restartS3(st)
+	resumed := ResumedUpload{
+		SessionID:   "session",
+		FilePath:    path,
+		UploadID:    uploadID,
+		TotalChunks: 2,
+		ChunkSize:   chunkSize,
+		FileSize:    int64(len(plain)),
+	}
+	if err := restarted.ResumeChunkedUpload(resumed); err != nil {
+		t.Fatalf("ResumeChunkedUpload: %v", err)
+	}
+	if err := restarted.SaveChunk("session", 1, bytes.NewReader(plain[chunkSize:]), int64(len(plain))-chunkSize); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	hash, err := restarted.FinalizeChunkedUpload("session")
+	if err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	if sum := sha256.Sum256(plain); hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("the resumed upload hashed to %s", hash)
+	}
+	if fmt.Sprint(fake.completeOrder) != "[1 2]" {
+		t.Errorf("completed with parts %v, want [1 2]", fake.completeOrder)
+	}
+	reader, _, err := restarted.GetFileStream(path, StoredFile{
+		EncryptionVersion: utils.EncryptionVersionStream,
+		PlainSize:         int64(len(plain)),
+	})
+	if err != nil {
+		t.Fatalf("GetFileStream: %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, plain) {
+		t.Error("the object read back differs from what was uploaded")
+	}
+
+	// Completed, the upload is gone, and a session still pointing at it cannot resume.
+	if err := restarted.ResumeChunkedUpload(resumed); !errors.Is(err, ErrUploadGone) {
+		t.Errorf("resuming a completed upload gave %v, want ErrUploadGone", err)
+	}
+}
+
+// Under frame-index nonces a resend has to match what the bucket was sent before. The
+// journal says what that was across a restart, so the upload is resumed, still refuses
+// a chunk sent again with other bytes, and can be finished.
+func TestS3SubkeyUploadResumesAfterRestart(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 4096)
+	const path = "salted.bin"
+	key, err := NewObjectKey(&st.config)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+	uploadID, err := st.InitChunkedUpload("session", path, 2, chunkSize, key)
+	if err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+
+	restarted := restartS3(st)
+	err = restarted.ResumeChunkedUpload(ResumedUpload{
+		SessionID:   "session",
+		FilePath:    path,
+		UploadID:    uploadID,
+		TotalChunks: 2,
+		ChunkSize:   chunkSize,
+		FileSize:    int64(len(plain)),
+		Key:         key,
+	})
+	if err != nil {
+		t.Fatalf("ResumeChunkedUpload: %v", err)
+	}
+	if len(fake.aborted) != 0 {
+		t.Errorf("aborted %v, want the upload kept", fake.aborted)
+	}
+
+	changed := bytes.Clone(plain[:chunkSize])
+	changed[0] ^= 1
+	if err := restarted.SaveChunk("session", 0, bytes.NewReader(changed), chunkSize); !errors.Is(err, ErrChunkConflict) {
+		t.Errorf("sending chunk 0 again changed after the restart gave %v, want ErrChunkConflict", err)
+	}
+	if err := restarted.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Errorf("sending chunk 0 again unchanged after the restart: %v", err)
+	}
+	rest := plain[chunkSize:]
+	if err := restarted.SaveChunk("session", 1, bytes.NewReader(rest), int64(len(rest))); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if _, err := restarted.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	file := StoredFile{EncryptionVersion: utils.EncryptionVersionSubkey, PlainSize: int64(len(plain)), Key: key}
+	if got := readAll(t, restarted, path, file); !bytes.Equal(got, plain) {
+		t.Error("the resumed upload does not read back as it was sent")
+	}
+}
+
+// A version 3 object's salt leads its first part, and a ranged read fetches it before
+// the frames it needs.
+func TestS3SubkeyObjectCarriesItsSaltInTheFirstPart(t *testing.T) {
+	st, fake := newFakeS3Storage(t)
+
+	const chunkSize = int64(testChunkSizeMB * 1024 * 1024)
+	plain := testPayload(int(chunkSize) + 3000)
+	const path = "salted.bin"
+	key, err := NewObjectKey(&st.config)
+	if err != nil {
+		t.Fatalf("NewObjectKey: %v", err)
+	}
+
+	if _, err := st.InitChunkedUpload("session", path, 2, chunkSize, key); err != nil {
+		t.Fatalf("InitChunkedUpload: %v", err)
+	}
+	if err := st.SaveChunk("session", 1, bytes.NewReader(plain[chunkSize:]), int64(len(plain))-chunkSize); err != nil {
+		t.Fatalf("SaveChunk(1): %v", err)
+	}
+	if err := st.SaveChunk("session", 0, bytes.NewReader(plain[:chunkSize]), chunkSize); err != nil {
+		t.Fatalf("SaveChunk(0): %v", err)
+	}
+	if _, err := st.FinalizeChunkedUpload("session"); err != nil {
+		t.Fatalf("FinalizeChunkedUpload: %v", err)
+	}
+
+	version := utils.EncryptionVersionSubkey
+	if want := utils.StreamSaltSize + utils.EncryptedSize(version, chunkSize); fake.partContentLengths[1] != want {
+		t.Errorf("part 1 arrived with Content-Length %d, want %d", fake.partContentLengths[1], want)
+	}
+	if want := utils.EncryptedSize(version, int64(len(plain))-chunkSize); fake.partContentLengths[2] != want {
+		t.Errorf("part 2 arrived with Content-Length %d, want %d", fake.partContentLengths[2], want)
+	}
+
+	file := StoredFile{EncryptionVersion: version, PlainSize: int64(len(plain)), Key: key}
+	if got := readAll(t, st, path, file); !bytes.Equal(got, plain) {
+		t.Error("the object does not read back as the uploaded bytes")
+	}
+
+	offset, length := int64(len(plain))-2000, int64(1500)
+	fake.mu.Lock()
+	fake.ranges = nil
+	fake.mu.Unlock()
+	reader, err := st.GetFileRange(path, file, offset, length)
+	if err != nil {
+		t.Fatalf("GetFileRange: %v", err)
+	}
+	got, _ := io.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(got, plain[offset:offset+length]) {
+		t.Error("the range read back differs from the uploaded bytes")
+	}
+	_, sealedOffset, sealedLength := utils.FrameSpan(version, int64(len(plain)), offset, length)
+	want := []string{
+		fmt.Sprintf("bytes=0-%d", utils.StreamSaltSize-1),
+		fmt.Sprintf("bytes=%d-%d", sealedOffset, sealedOffset+sealedLength-1),
+	}
+	if fmt.Sprint(fake.ranges) != fmt.Sprint(want) {
+		t.Errorf("the read asked S3 for %q, want %q", fake.ranges, want)
+	}
+}
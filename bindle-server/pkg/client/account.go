@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Me is the account and its upload quota, as GET /api/me reports them.
+type Me struct {
+	User struct {
+		AccountId string    `json:"accountId"`
+		LastLogin time.Time `json:"lastLogin"`
+		Files     []File    `json:"files"`
+	} `json:"user"`
+	UploadedBytes    int64 `json:"uploadedBytes"`
+	UploadLimitBytes int64 `json:"uploadLimitBytes"`
+	MaxFileSizeBytes int64 `json:"maxFileSizeBytes"`
+	LimitsUnlocked   bool  `json:"limitsUnlocked"`
+	UnlockAvailable  bool  `json:"unlockAvailable"`
+}
+
+// Me returns the account, its files and its upload quota.
+func (c *Client) Me(ctx context.Context) (*Me, error) {
+	var me Me
+	if err := c.do(ctx, "GET", "/api/me", nil, &me); err != nil {
+		return nil, err
+	}
+	return &me, nil
+}
+
+// CreateAccount has the server create an account and makes it the client's. The ID in
+// AccountID is the only way back into the account, so keep it.
+func (c *Client) CreateAccount(ctx context.Context) (*Me, error) {
+	if c.AccountID != "" {
+		return nil, errors.New("bindle: the client already has an account")
+	}
+	me, err := c.Me(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.AccountID = me.User.AccountId
+	return me, nil
+}
+
+// DeleteAccount deletes the account and every file in it.
+func (c *Client) DeleteAccount(ctx context.Context) error {
+	return c.do(ctx, "DELETE", "/api/me", nil, nil)
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// AdminStats returns the totals for the whole server.
+func (c *Client) AdminStats(ctx context.Context) (*AdminStats, error) {
+	var stats AdminStats
+	if err := c.do(ctx, "GET", "/api/admin/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// AdminUsers lists every account with its files and storage.
+func (c *Client) AdminUsers(ctx context.Context) ([]AdminUser, error) {
+	var users []AdminUser
+	if err := c.do(ctx, "GET", "/api/admin/users", nil, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AdminFiles lists every file on the server.
+func (c *Client) AdminFiles(ctx context.Context) ([]AdminFile, error) {
+	var files []AdminFile
+	if err := c.do(ctx, "GET", "/api/admin/files", nil, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ExpiringAccounts lists the accounts the next expiration run would delete, or, with
+// withinDays, those that will have expired that many days from now.
+func (c *Client) ExpiringAccounts(ctx context.Context, withinDays int) (*ExpiringAccounts, error) {
+	var expiring ExpiringAccounts
+	path := fmt.Sprintf("/api/admin/accounts/expiring?withinDays=%d", withinDays)
+	if err := c.do(ctx, "GET", path, nil, &expiring); err != nil {
+		return nil, err
+	}
+	return &expiring, nil
+}
+
+// AdminDeleteFile deletes a file, whoever owns it.
+func (c *Client) AdminDeleteFile(ctx context.Context, fileID string) error {
+	return c.do(ctx, "DELETE", "/api/admin/files/"+url.PathEscape(fileID), nil, nil)
+}
+
+// AdminDeleteUserFiles deletes every file of an account and returns how many there were.
+func (c *Client) AdminDeleteUserFiles(ctx context.Context, accountID string) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, "DELETE", "/api/admin/users/"+url.PathEscape(accountID)+"/files", nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// AdminDeleteAllFiles deletes every file on the server and returns how many records
+// that removed.
+func (c *Client) AdminDeleteAllFiles(ctx context.Context) (int, error) {
+	var result struct {
+		RecordsDeleted int `json:"recordsDeleted"`
+	}
+	if err := c.do(ctx, "DELETE", "/api/admin/files", nil, &result); err != nil {
+		return 0, err
+	}
+	return result.RecordsDeleted, nil
+}
@@ -0,0 +1,168 @@
+// Package client talks to a Bindle server: accounts, resumable uploads, downloads, file
+// management and the admin endpoints.
+//
+//	c := client.New("https://files.example.com", accountID)
+//	file, err := c.Upload(ctx, r, size, client.UploadOptions{FileName: "report.pdf"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/handlers"
+	"github.com/nuuner/bindle-server/internal/models"
+)
+
+// The server's own types, under names this package's users can import.
+type (
+	File             = models.UploadedFileDTO
+	Share            = models.ShareDTO
+	DownloadEntry    = handlers.DownloadDTO
+	UploadStatus     = handlers.ChunkedUploadStatus
+	AdminStats       = handlers.AdminStatsDTO
+	AdminUser        = handlers.AdminUserDTO
+	AdminFile        = handlers.AdminFileDTO
+	ExpiringAccounts = handlers.ExpiringAccountsDTO
+)
+
+// Client sends requests to one Bindle server as one account, or as its admin. Its
+// methods may be called concurrently, except CreateAccount, which sets AccountID.
+type Client struct {
+	// BaseURL is the server, such as https://files.example.com.
+	BaseURL string
+	// AccountID is sent in the Authorization header of account requests. The server
+	// creates a new account for a request without one; see CreateAccount.
+	AccountID string
+	// AdminPassword is sent with the admin endpoints, in X-Admin-Password.
+	AdminPassword string
+	// HTTPClient sends the requests. It should not have an overall timeout, since an
+	// upload chunk or a download takes as long as the link needs; use contexts instead.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, acting as accountID.
+func New(baseURL, accountID string) *Client {
+	return &Client{
+		BaseURL:   strings.TrimSuffix(baseURL, "/"),
+		AccountID: accountID,
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 2 * time.Minute,
+			MaxIdleConnsPerHost:   16,
+		}},
+	}
+}
+
+// Error is a request the server refused, with the message from its error body.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bindle: server answered %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("bindle: server answered %d: %s", e.StatusCode, e.Message)
+}
+
+// IsStatus reports whether err is the server answering with one of statuses.
+func IsStatus(err error, statuses ...int) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, status := range statuses {
+		if apiErr.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// URL resolves a path, or a URL the server handed out, against BaseURL. File URLs are
+// relative when the server is configured with a relative FILE_HOST.
+func (c *Client) URL(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// newRequest builds a request to the API. Account routes carry the account ID and admin
+// routes the admin password.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(path, "/api/admin") {
+		if c.AdminPassword == "" {
+			return nil, errors.New("bindle: the admin endpoints need an AdminPassword")
+		}
+		req.Header.Set("X-Admin-Password", c.AdminPassword)
+	} else if c.AccountID != "" {
+		req.Header.Set("Authorization", c.AccountID)
+	}
+	return req, nil
+}
+
+// send performs req and decodes a JSON answer into out, when out is not nil.
+func (c *Client) send(req *http.Request, out any) error {
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return readError(res)
+	}
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// do sends in as JSON, when it is not nil, and decodes the answer into out.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+// readError turns a refused request into an *Error. The server answers with
+// {"error": "..."}; anything else it sends is kept as the message.
+func readError(res *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if json.Unmarshal(data, &body) != nil {
+		body.Error = strings.TrimSpace(string(data))
+	}
+	return &Error{StatusCode: res.StatusCode, Message: body.Error}
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/nuuner/bindle-server/internal/config"
+	"github.com/nuuner/bindle-server/internal/models"
+	"github.com/nuuner/bindle-server/internal/server"
+	"github.com/nuuner/bindle-server/internal/storage"
+	"github.com/nuuner/bindle-server/pkg/utils"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const testChunkSize = 1024 * 1024
+
+// newTestServer runs the server's routes in-process on a loopback port, over a
+// database and filesystem storage of the test's own, and returns a client for it.
+func newTestServer(t *testing.T) *Client {
+	t.Helper()
+
+	key := bytes.Repeat([]byte{0x3c}, 32)
+	// What config.GetConfig insists on, for the handlers that read it themselves.
+	t.Setenv("REQUEST_SIZE_LIMIT_MB", "100")
+	t.Setenv("ACCOUNT_EXPIRATION_DAYS", "30")
+	t.Setenv("ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("FILE_HOST", "/files/")
+	t.Setenv("ADMIN_PASSWORD", "admin")
+
+	cfg := &config.Config{
+		FileHost:              "/files/",
+		ClientOrigin:          "http://localhost",
+		RequestSizeLimitMB:    100,
+		FilesystemPath:        t.TempDir(),
+		AccountExpirationDays: 30,
+		UploadLimitMBPerDay:   1000,
+		ChunkSizeMB:           testChunkSize / 1024 / 1024,
+		MaxFileSizeMB:         100,
+		EncryptionKey:         key,
+	}
+	st, err := storage.NewFilesystemStorage(*cfg)
+	if err != nil {
+		t.Fatalf("NewFilesystemStorage: %v", err)
+	}
+
+	// Chunks arrive on several connections at once, so the database is a file rather
+	// than an in-memory one, which each connection would get a private copy of.
+	dsn := filepath.Join(t.TempDir(), "bindle.db") + "?_journal_mode=WAL&_busy_timeout=5000"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.UploadedFile{}, &models.User{},
+		&models.AccountIpConnection{}, &models.UploadSession{}, &models.Share{}, &models.Download{}); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+
+	app, err := server.NewApp(db, cfg, st, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	return New("http://"+ln.Addr().String(), "")
+}
+
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*13 + i/251)
+	}
+	return data
+}
+
+// failingReader hands out its first n bytes and then fails, like a source that went away.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("source went away")
+	}
+	p = p[:min(len(p), f.n)]
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestUploadResumesAndDownloads(t *testing.T) {
+	c := newTestServer(t)
+	ctx := context.Background()
+
+	if _, err := c.CreateAccount(ctx); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if c.AccountID == "" {
+		t.Fatal("CreateAccount did not keep the account ID")
+	}
+
+	plain := testContent(3*testChunkSize + 12345)
+	var sessionID string
+	opts := UploadOptions{
+		FileName:    "data.bin",
+		Concurrency: 3,
+		OnSession:   func(id string) { sessionID = id },
+	}
+
+	// The source fails partway into the third chunk; the first two are sent.
+	_, err := c.Upload(ctx, &failingReader{r: bytes.NewReader(plain), n: 2*testChunkSize + 10}, int64(len(plain)), opts)
+	if err == nil {
+		t.Fatal("an upload whose source failed succeeded")
+	}
+	status, err := c.UploadStatus(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("UploadStatus: %v", err)
+	}
+	if len(status.ReceivedChunks) != 2 {
+		t.Fatalf("the server holds chunks %v, want the first two", status.ReceivedChunks)
+	}
+
+	opts.SessionID = sessionID
+	var progress int64
+	opts.OnProgress = func(sent, total int64) { progress = sent }
+	file, err := c.Upload(ctx, bytes.NewReader(plain), int64(len(plain)), opts)
+	if err != nil {
+		t.Fatalf("resumed Upload: %v", err)
+	}
+	if progress != int64(len(plain)) {
+		t.Errorf("progress ended at %d, want %d", progress, len(plain))
+	}
+	if file.FileName != "data.bin" || file.Size != int64(len(plain)) || file.SHA256 == "" {
+		t.Errorf("got file %+v", file)
+	}
+
+	download, err := c.Download(ctx, file.URL, DownloadOptions{})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	got, err := io.ReadAll(download.Body)
+	download.Body.Close()
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("downloaded %d bytes (%v), want the %d uploaded", len(got), err, len(plain))
+	}
+	if download.FileName != "data.bin" || download.SHA256 == nil {
+		t.Errorf("got name %q and digest %x", download.FileName, download.SHA256)
+	}
+
+	part, err := c.Download(ctx, file.URL, DownloadOptions{Range: &Range{Start: testChunkSize - 5, End: testChunkSize + 4}})
+	if err != nil {
+		t.Fatalf("ranged Download: %v", err)
+	}
+	got, err = io.ReadAll(part.Body)
+	part.Body.Close()
+	if err != nil || !bytes.Equal(got, plain[testChunkSize-5:testChunkSize+5]) {
+		t.Errorf("the range came back as %x (%v)", got, err)
+	}
+	if part.Offset != testChunkSize-5 || part.Length != 10 || part.Size != int64(len(plain)) {
+		t.Errorf("got offset %d, length %d and size %d", part.Offset, part.Length, part.Size)
+	}
+}
+
+func TestFileManagement(t *testing.T) {
+	c := newTestServer(t)
+	ctx := context.Background()
+	if _, err := c.CreateAccount(ctx); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	plain := testContent(1000)
+	file, err := c.Upload(ctx, bytes.NewReader(plain), int64(len(plain)),
+		UploadOptions{FileName: "notes.txt", MaxDownloads: 5, Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	renamed, err := c.RenameFile(ctx, file.FileId, "renamed.txt")
+	if err != nil {
+		t.Fatalf("RenameFile: %v", err)
+	}
+	if renamed.FileName != "renamed.txt" || renamed.MaxDownloads != 5 || !renamed.PasswordProtected {
+		t.Errorf("renaming changed more than the name: %+v", renamed)
+	}
+
+	if _, err := c.Download(ctx, file.URL, DownloadOptions{}); !IsStatus(err, http.StatusUnauthorized) {
+		t.Errorf("a download without the password got %v, want a 401", err)
+	}
+	download, err := c.Download(ctx, file.URL, DownloadOptions{Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Download with the password: %v", err)
+	}
+	download.Body.Close()
+
+	share, err := c.CreateShare(ctx, file.FileId, ShareOptions{Label: "for review"})
+	if err != nil {
+		t.Fatalf("CreateShare: %v", err)
+	}
+	shares, err := c.Shares(ctx, file.FileId)
+	if err != nil || len(shares) != 2 {
+		t.Fatalf("Shares: %d shares (%v), want 2", len(shares), err)
+	}
+	if err := c.RevokeShare(ctx, file.FileId, share.ShareId); err != nil {
+		t.Fatalf("RevokeShare: %v", err)
+	}
+
+	entries, err := c.Downloads(ctx, file.FileId, 10, 0)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Downloads: %d entries (%v), want 1", len(entries), err)
+	}
+
+	c.AdminPassword = "admin"
+	stats, err := c.AdminStats(ctx)
+	if err != nil || stats.FileRecords != 1 {
+		t.Errorf("AdminStats: %+v (%v)", stats, err)
+	}
+
+	if err := c.DeleteFile(ctx, file.FileId); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	var notFound *FileNotFoundError
+	if _, err := c.File(ctx, file.FileId); !errors.As(err, &notFound) {
+		t.Errorf("File after DeleteFile: got %v", err)
+	}
+
+	c.AdminPassword = "wrong"
+	var apiErr *Error
+	if _, err := c.AdminUsers(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized ||
+		apiErr.Message != "Invalid admin password" {
+		t.Errorf("AdminUsers with a wrong password: got %v", err)
+	}
+}
+
+func TestDownloadFailsOnAMismatchedDigest(t *testing.T) {
+	plain := []byte("the contents of the file")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte("some other contents"))
+		w.Header().Set("Repr-Digest", utils.FormatDigest(sum[:]))
+		w.Write(plain)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	download, err := New("http://"+ln.Addr().String(), "").Download(context.Background(), "/files/x", DownloadOptions{})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	defer download.Body.Close()
+	if _, err := io.ReadAll(download.Body); !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Errorf("reading a mismatched download: got %v, want ErrDigestMismatch", err)
+	}
+}
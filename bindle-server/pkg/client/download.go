@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/nuuner/bindle-server/pkg/filepassword"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// DownloadOptions are what a download sends besides its URL.
+type DownloadOptions struct {
+	// Password unlocks a password-protected file.
+	Password string
+	// Range asks for part of the file rather than all of it.
+	Range *Range
+}
+
+// Range is the bytes from Start to End, both included. An End of -1 reads to the end
+// of the file.
+type Range struct {
+	Start, End int64
+}
+
+// Download is a file being downloaded. Close Body when done with it.
+type Download struct {
+	// Body is the file, or the range asked for. When it is the whole file, reading it
+	// fails with utils.ErrDigestMismatch if it does not match the file's SHA-256.
+	Body io.ReadCloser
+	// FileName and MimeType are what the server sends the file as.
+	FileName string
+	MimeType string
+	// Size is the size of the whole file, and Offset where Body starts in it.
+	Size   int64
+	Offset int64
+	// Length is how many bytes Body holds.
+	Length int64
+	// SHA256 is the digest of the whole file, nil when the server did not send one.
+	SHA256 []byte
+}
+
+// Download fetches the file at a share URL, such as a File's URL. Share URLs are
+// public, so the account ID is not sent with it.
+func (c *Client) Download(ctx context.Context, url string, opts DownloadOptions) (*Download, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL(url), nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		req.Header.Set(filepassword.HeaderName, opts.Password)
+	}
+	if opts.Range != nil {
+		if opts.Range.End < 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", opts.Range.Start))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", opts.Range.Start, opts.Range.End))
+		}
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	download := &Download{
+		Body:     res.Body,
+		MimeType: res.Header.Get("Content-Type"),
+		Size:     res.ContentLength,
+		Length:   res.ContentLength,
+	}
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		download.FileName = params["filename"]
+	}
+	if download.FileName == "" {
+		download.FileName = path.Base(res.Request.URL.Path)
+	}
+
+	download.SHA256, err = utils.ParseContentDigest(res.Header.Get("Repr-Digest"))
+	if err != nil && !errors.Is(err, utils.ErrUnsupportedDigest) {
+		res.Body.Close()
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusPartialContent {
+		var end int64
+		_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &download.Offset, &end, &download.Size)
+		if err != nil {
+			res.Body.Close()
+			return nil, fmt.Errorf("bindle: unexpected Content-Range %q", res.Header.Get("Content-Range"))
+		}
+		download.Length = end - download.Offset + 1
+	} else if download.SHA256 != nil && download.Length >= 0 {
+		download.Body = verifiedBody{utils.NewDigestVerifier(res.Body, download.SHA256, download.Length), res.Body}
+	}
+	return download, nil
+}
+
+// verifiedBody reads through the digest check and closes the response underneath.
+type verifiedBody struct {
+	io.Reader
+	io.Closer
+}
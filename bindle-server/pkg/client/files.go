@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// FileNotFoundError is what File returns for an ID that is not among the account's files.
+type FileNotFoundError struct {
+	FileID string
+}
+
+func (e *FileNotFoundError) Error() string {
+	return fmt.Sprintf("bindle: no file %s in this account", e.FileID)
+}
+
+// Files lists the account's files.
+func (c *Client) Files(ctx context.Context) ([]File, error) {
+	me, err := c.Me(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return me.User.Files, nil
+}
+
+// File looks one of the account's files up by its ID.
+func (c *Client) File(ctx context.Context, fileID string) (*File, error) {
+	files, err := c.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if files[i].FileId == fileID {
+			return &files[i], nil
+		}
+	}
+	return nil, &FileNotFoundError{FileID: fileID}
+}
+
+// UpdateFile replaces a file's name and limits with those in file. Every limit is
+// replaced, so change a file fetched with File rather than building one: a nil
+// ExpiresAt or a zero MaxDownloads clears that limit. A password is kept while
+// PasswordProtected is true, replaced by a non-empty Password, and removed otherwise.
+func (c *Client) UpdateFile(ctx context.Context, file File) (*File, error) {
+	var updated File
+	if err := c.do(ctx, "PUT", "/api/file", file, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// RenameFile changes a file's name, leaving its limits as they are.
+func (c *Client) RenameFile(ctx context.Context, fileID, name string) (*File, error) {
+	file, err := c.File(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	file.FileName = name
+	return c.UpdateFile(ctx, *file)
+}
+
+// DeleteFile deletes one of the account's files.
+func (c *Client) DeleteFile(ctx context.Context, fileID string) error {
+	return c.do(ctx, "DELETE", "/api/file/"+url.PathEscape(fileID), nil, nil)
+}
+
+// RotateFileURL revokes every link to a file and gives it a new one, which the
+// returned file carries.
+func (c *Client) RotateFileURL(ctx context.Context, fileID string) (*File, error) {
+	var file File
+	if err := c.do(ctx, "POST", "/api/file/"+url.PathEscape(fileID)+"/rotate", nil, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ShareOptions are the label and limits of a new link to a file.
+type ShareOptions struct {
+	Label        string     `json:"label"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads"`
+	Password     string     `json:"password"`
+}
+
+// Shares lists the links to a file.
+func (c *Client) Shares(ctx context.Context, fileID string) ([]Share, error) {
+	var shares []Share
+	if err := c.do(ctx, "GET", "/api/file/"+url.PathEscape(fileID)+"/shares", nil, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// CreateShare adds a link to a file, with limits of its own.
+func (c *Client) CreateShare(ctx context.Context, fileID string, opts ShareOptions) (*Share, error) {
+	var share Share
+	if err := c.do(ctx, "POST", "/api/file/"+url.PathEscape(fileID)+"/shares", opts, &share); err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// RevokeShare deletes one link to a file.
+func (c *Client) RevokeShare(ctx context.Context, fileID, shareID string) error {
+	return c.do(ctx, "DELETE", "/api/file/"+url.PathEscape(fileID)+"/shares/"+url.PathEscape(shareID), nil, nil)
+}
+
+// Downloads returns a file's download log, newest first: up to limit entries, or the
+// server's default for 0, older than the entry before, or from the newest for 0.
+func (c *Client) Downloads(ctx context.Context, fileID string, limit int, before uint) ([]DownloadEntry, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", fmt.Sprint(limit))
+	}
+	if before > 0 {
+		query.Set("before", fmt.Sprint(before))
+	}
+	path := "/api/file/" + url.PathEscape(fileID) + "/downloads"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var entries []DownloadEntry
+	if err := c.do(ctx, "GET", path, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nuuner/bindle-server/internal/handlers"
+	"github.com/nuuner/bindle-server/pkg/utils"
+)
+
+// UploadOptions describe a file to Upload and how to send it.
+type UploadOptions struct {
+	// FileName names the file. MimeType defaults to what its extension says.
+	FileName string
+	MimeType string
+
+	// The limits the file is created with; see UpdateFile for changing them later.
+	ExpiresAt    *time.Time
+	MaxDownloads int
+	Password     string
+
+	// Concurrency is how many chunks are sent at once, 4 when it is 0. Each one holds a
+	// chunk in memory.
+	Concurrency int
+	// Retries is how many times a chunk the server did not take is sent again, with a
+	// growing pause in between.
+	Retries int
+
+	// SessionID resumes the upload session a previous Upload of the same contents opened
+	// and did not finish. The chunks the server already has are read from the reader but
+	// not sent. A session the server no longer has is replaced by a new one.
+	SessionID string
+	// OnSession is called with the session the upload goes into, before any chunk is
+	// sent. Keep it to resume the upload if it fails.
+	OnSession func(sessionID string)
+	// OnProgress is called as chunks arrive, with the bytes the server holds so far.
+	// It may be called from several goroutines, though never at once.
+	OnProgress func(sent, total int64)
+}
+
+// Upload sends size bytes read from r as a chunked upload and returns the file it
+// becomes. Chunks are sent with their SHA-256, and the upload is completed with the
+// SHA-256 of everything read, so the file is only published if the server stored what
+// r produced. On failure the session is left open for UploadOptions.SessionID.
+func (c *Client) Upload(ctx context.Context, r io.Reader, size int64, opts UploadOptions) (*File, error) {
+	if size <= 0 {
+		return nil, errors.New("bindle: cannot upload an empty file")
+	}
+
+	session, received, err := c.openUploadSession(ctx, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OnSession != nil {
+		opts.OnSession(session.SessionID)
+	}
+
+	hash, err := c.sendChunks(ctx, r, size, session, received, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	err = c.do(ctx, "POST", "/api/file/chunk/"+url.PathEscape(session.SessionID)+"/complete",
+		handlers.CompleteChunkedUploadRequest{SHA256: hash}, &file)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// UploadStatus reports how far an upload session has got.
+func (c *Client) UploadStatus(ctx context.Context, sessionID string) (*UploadStatus, error) {
+	var status UploadStatus
+	if err := c.do(ctx, "GET", "/api/file/chunk/"+url.PathEscape(sessionID), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// AbortUpload gives up an upload session, releasing what the server holds for it.
+func (c *Client) AbortUpload(ctx context.Context, sessionID string) error {
+	return c.do(ctx, "DELETE", "/api/file/chunk/"+url.PathEscape(sessionID), nil, nil)
+}
+
+// openUploadSession returns the session to upload into and the chunks it already has:
+// opts.SessionID if the server still has it for a file of this size, otherwise a new one.
+func (c *Client) openUploadSession(ctx context.Context, size int64,
+	opts UploadOptions) (*handlers.InitChunkedUploadResponse, map[int]bool, error) {
+
+	if opts.SessionID != "" {
+		status, err := c.UploadStatus(ctx, opts.SessionID)
+		if err != nil && !IsStatus(err, http.StatusNotFound, http.StatusGone) {
+			return nil, nil, err
+		}
+		if err == nil && status.FileSize == size {
+			received := make(map[int]bool, len(status.ReceivedChunks))
+			for _, chunkNumber := range status.ReceivedChunks {
+				received[chunkNumber] = true
+			}
+			session := &handlers.InitChunkedUploadResponse{
+				SessionID:   status.SessionID,
+				ChunkSize:   status.ChunkSize,
+				TotalChunks: status.TotalChunks,
+			}
+			return session, received, nil
+		}
+	}
+
+	mimeType := opts.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(opts.FileName))
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	req := handlers.InitChunkedUploadRequest{
+		FileName:     opts.FileName,
+		FileSize:     size,
+		MimeType:     mimeType,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+		Password:     opts.Password,
+	}
+
+	var session handlers.InitChunkedUploadResponse
+	if err := c.do(ctx, "POST", "/api/file/chunk/init", req, &session); err != nil {
+		return nil, nil, err
+	}
+	return &session, nil, nil
+}
+
+// sendChunks reads r chunk by chunk and sends the ones not yet received, Concurrency
+// at a time, returning the hex SHA-256 of everything read. The first failure stops any
+// more chunks from going out, but the ones already on their way are let finish, so a
+// resumed upload does not have to send them again.
+func (c *Client) sendChunks(ctx context.Context, r io.Reader, size int64,
+	session *handlers.InitChunkedUploadResponse, received map[int]bool, opts UploadOptions) (string, error) {
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		once    sync.Once
+		stop    = make(chan struct{})
+		failure error
+		sent    int64
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			close(stop)
+		})
+	}
+	progress := func(n int64) {
+		mu.Lock()
+		sent += n
+		if opts.OnProgress != nil {
+			opts.OnProgress(sent, size)
+		}
+		mu.Unlock()
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	buffers := make(chan []byte, concurrency)
+	for i := 0; i < concurrency; i++ {
+		buffers <- nil
+	}
+
+	sum := sha256.New()
+read:
+	for chunkNumber := 0; chunkNumber < session.TotalChunks; chunkNumber++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-stop:
+			break read
+		case <-ctx.Done():
+			fail(ctx.Err())
+			break read
+		}
+		// A buffer comes back from a failed chunk as well; the failure goes first.
+		select {
+		case <-stop:
+			break read
+		default:
+		}
+
+		n := min(session.ChunkSize, size-int64(chunkNumber)*session.ChunkSize)
+		if int64(cap(buf)) < n {
+			buf = make([]byte, session.ChunkSize)
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			fail(fmt.Errorf("bindle: reading chunk %d: %w", chunkNumber, err))
+			break read
+		}
+		sum.Write(chunk)
+
+		if received[chunkNumber] {
+			buffers <- buf
+			progress(n)
+			continue
+		}
+
+		wg.Add(1)
+		go func(chunkNumber int) {
+			defer wg.Done()
+			defer func() { buffers <- buf }()
+			if err := c.sendChunk(ctx, session.SessionID, chunkNumber, chunk, opts.Retries, stop); err != nil {
+				fail(fmt.Errorf("bindle: chunk %d: %w", chunkNumber, err))
+				return
+			}
+			progress(n)
+		}(chunkNumber)
+	}
+	wg.Wait()
+
+	if failure != nil {
+		return "", failure
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// sendChunk posts one chunk with its digest, retrying with a growing pause until the
+// upload is stopped. A session the server no longer has is not retried.
+func (c *Client) sendChunk(ctx context.Context, sessionID string, chunkNumber int, chunk []byte,
+	retries int, stop <-chan struct{}) error {
+
+	digest := sha256.Sum256(chunk)
+	path := fmt.Sprintf("/api/file/chunk/%s/%d", url.PathEscape(sessionID), chunkNumber)
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-stop:
+				return err
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		var req *http.Request
+		req, err = c.newRequest(ctx, "POST", path, bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Digest", utils.FormatDigest(digest[:]))
+		if err = c.send(req, nil); err == nil {
+			return nil
+		}
+		if IsStatus(err, http.StatusNotFound, http.StatusGone) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
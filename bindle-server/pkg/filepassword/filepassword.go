@@ -0,0 +1,164 @@
+// Package filepassword implements passwords on individual files. The owner sets one at
+// upload or later; a download then has to present it, either directly in a header or
+// through a short-lived cookie the server hands out once the password has been typed
+// into the challenge page.
+package filepassword
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nuuner/bindle-server/internal/config"
+)
+
+// HeaderName carries the password on requests from clients that cannot show a form.
+const HeaderName = "X-File-Password"
+
+// CookieName is the same for every file; each cookie is scoped to its file's URL by its
+// Path, so the browser only ever sends the one that belongs to the file being fetched.
+const CookieName = "bindle_file_access"
+
+// TokenLifetime is how long a typed-in password keeps working in the browser that typed
+// it. Short, because unlike the unlock cookie this one grants access to content, and
+// a shared machine should not keep that for weeks.
+const TokenLifetime = 12 * time.Hour
+
+// iterations is the PBKDF2 work factor. It is stored in every hash, so raising it only
+// affects passwords set afterwards, and the header path - which verifies on each
+// request - is why it is not higher.
+const iterations = 100_000
+
+const (
+	saltSize   = 16
+	hashPrefix = "pbkdf2-sha256"
+)
+
+// Hash derives the value stored for password: a fresh random salt and a PBKDF2 key,
+// as "pbkdf2-sha256$<iterations>$<salt>$<key>". The salt means two files with the same
+// password do not share a stored value, and the work factor makes a leaked database
+// expensive to guess passwords from.
+func Hash(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		hashPrefix,
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// Matches reports whether password is the one hash was made from.
+func Matches(hash, password string) bool {
+	if hash == "" || password == "" {
+		return false
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashPrefix {
+		return false
+	}
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	got, err := pbkdf2.Key(sha256.New, password, salt, rounds, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Token layout: "<expiryUnix>.<hex HMAC-SHA256>", the same shape as the unlock cookie.
+// The MAC is keyed with the server's secret and covers the share slug and the stored
+// hash along with the expiry, so a token opens only the link it was issued for, and
+// changing or removing the password - which always produces a new hash - invalidates
+// every token issued under the old one.
+func sign(secret []byte, slug, hash string, expiry int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(slug + "\x00" + hash + "\x00" + strconv.FormatInt(expiry, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func IssueToken(secret []byte, slug, hash string, expiresAt time.Time) string {
+	expiry := expiresAt.Unix()
+	return strconv.FormatInt(expiry, 10) + "." + sign(secret, slug, hash, expiry)
+}
+
+func TokenIsValid(secret []byte, slug, hash, token string, now time.Time) bool {
+	if len(secret) == 0 || hash == "" || token == "" {
+		return false
+	}
+
+	expiryStr, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(sign(secret, slug, hash, expiry))) != 1 {
+		return false
+	}
+
+	return now.Unix() < expiry
+}
+
+// Granted reports whether a request through the share slug, protected by hash, has
+// shown the password: in the header, or through a cookie issued for this link.
+func Granted(c *fiber.Ctx, cfg *config.Config, slug, hash string) bool {
+	if hash == "" {
+		return true
+	}
+	if TokenIsValid(cfg.MACKey, slug, hash, c.Cookies(CookieName), time.Now()) {
+		return true
+	}
+	return Matches(hash, c.Get(HeaderName))
+}
+
+// SetCookie grants the browser access to the file at urlPath for TokenLifetime.
+func SetCookie(c *fiber.Ctx, cfg *config.Config, urlPath, slug, hash string) {
+	expiresAt := time.Now().Add(TokenLifetime)
+	c.Cookie(&fiber.Cookie{
+		Name:     CookieName,
+		Value:    IssueToken(cfg.MACKey, slug, hash, expiresAt),
+		Path:     urlPath,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https" || strings.HasPrefix(cfg.FileHost, "https://"),
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
@@ -0,0 +1,100 @@
+package filepassword
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = bytes.Repeat([]byte{0x71}, 32)
+
+// Stored hashes are PBKDF2-HMAC-SHA256, so ones built from the known vectors - RFC 7914
+// section 11 and the widely used set derived from RFC 6070 - have to match their
+// passwords.
+func TestMatchesKnownVectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		rounds         int
+		key            string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+	}
+
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		hash := strings.Join([]string{
+			hashPrefix,
+			strconv.Itoa(tt.rounds),
+			base64.RawStdEncoding.EncodeToString([]byte(tt.salt)),
+			base64.RawStdEncoding.EncodeToString(key),
+		}, "$")
+		if !Matches(hash, tt.password) {
+			t.Errorf("%q with salt %q and %d rounds does not match its vector", tt.password, tt.salt, tt.rounds)
+		}
+		if Matches(hash, tt.password+"x") {
+			t.Errorf("the vector for %q matches another password", tt.password)
+		}
+	}
+}
+
+func TestHashMatchesOnlyItsPassword(t *testing.T) {
+	hash, err := Hash("hunter2")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	if !Matches(hash, "hunter2") {
+		t.Error("the password a hash was made from does not match it")
+	}
+	if Matches(hash, "hunter3") || Matches(hash, "") {
+		t.Error("a different password matched")
+	}
+}
+
+// Two files protected with the same password must not share a stored value, or one
+// leaked hash would say which other files it also opens.
+func TestHashIsSalted(t *testing.T) {
+	first, _ := Hash("same")
+	second, _ := Hash("same")
+	if first == second {
+		t.Error("hashing the same password twice gave the same value")
+	}
+}
+
+func TestTokenOpensOnlyItsFile(t *testing.T) {
+	hash, _ := Hash("hunter2")
+	token := IssueToken(secret, "aSlug", hash, time.Now().Add(time.Hour))
+
+	if !TokenIsValid(secret, "aSlug", hash, token, time.Now()) {
+		t.Error("a fresh token was rejected")
+	}
+	if TokenIsValid(secret, "bSlug", hash, token, time.Now()) {
+		t.Error("a token opened a file it was not issued for")
+	}
+	if TokenIsValid(secret, "aSlug", hash, token, time.Now().Add(2*time.Hour)) {
+		t.Error("an expired token was accepted")
+	}
+
+	// A new password is a new hash, which retires every token issued under the old one.
+	rehashed, _ := Hash("hunter2")
+	if TokenIsValid(secret, "aSlug", rehashed, token, time.Now()) {
+		t.Error("a token survived the password being set again")
+	}
+}
+
+func TestForgedTokenExpiryIsRejected(t *testing.T) {
+	hash, _ := Hash("hunter2")
+	token := IssueToken(secret, "aSlug", hash, time.Now().Add(time.Hour))
+	_, signature, _ := strings.Cut(token, ".")
+
+	forged := "99999999999." + signature
+	if TokenIsValid(secret, "aSlug", hash, forged, time.Now()) {
+		t.Error("a token with a rewritten expiry was accepted")
+	}
+}
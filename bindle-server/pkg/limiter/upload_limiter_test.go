@@ -213,7 +213,7 @@ func TestUnlockCookieLiftsTheQuota(t *testing.T) {
 	cfg := &config.Config{UploadLimitMBPerDay: 10, UnlockPassword: "s3cret"}
 	valid := &fiber.Cookie{
 		Name:  unlock.CookieName,
-		Value: unlock.IssueToken(cfg.UnlockPassword, time.Now().Add(time.Hour)),
+		Value: unlock.IssueToken(unlock.Secret(cfg), time.Now().Add(time.Hour)),
 	}
 
 	if throttleWithCookie(t, cfg, valid) {
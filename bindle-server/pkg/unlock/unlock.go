@@ -23,9 +23,10 @@ const CookieName = "bindle_unlock"
 const TokenLifetime = 30 * 24 * time.Hour
 
 // Token layout: "<expiryUnix>.<hex HMAC-SHA256 of expiryUnix>". The MAC is keyed with
-// the password itself, which gives two things for free: the raw password never sits in
-// the cookie, and changing UNLOCK_PASSWORD invalidates every token handed out under the
-// old one without the server having to remember which tokens it issued.
+// a secret derived from the password (see Secret), which gives two things for
+// free: the raw password never sits in the cookie, and changing UNLOCK_PASSWORD
+// invalidates every token handed out under the old one without the server having to
+// remember which tokens it issued.
 func sign(secret string, expiry int64) string {
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write([]byte(strconv.FormatInt(expiry, 10)))
@@ -72,7 +73,20 @@ func PasswordMatches(secret, provided string) bool {
 // An empty UnlockPassword disables the feature outright, so a deployment that never sets
 // one cannot be unlocked by any cookie.
 func IsUnlocked(c *fiber.Ctx, cfg *config.Config) bool {
-	return TokenIsValid(cfg.UnlockPassword, c.Cookies(CookieName), time.Now())
+	return TokenIsValid(Secret(cfg), c.Cookies(CookieName), time.Now())
+}
+
+// Secret is the secret the server's tokens are signed with: the password, mixed
+// with the server's MAC key so that a cookie lifted from a browser is no use for
+// guessing the password offline. Changing the password still changes it. An empty
+// password stays empty, which TokenIsValid takes as the feature being off.
+func Secret(cfg *config.Config) string {
+	if cfg.UnlockPassword == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, cfg.MACKey)
+	mac.Write([]byte("unlock\x00" + cfg.UnlockPassword))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 // cookieIsSecure marks the cookie https-only when the deployment is served over https.
@@ -85,7 +99,7 @@ func cookieIsSecure(c *fiber.Ctx, cfg *config.Config) bool {
 func SetCookie(c *fiber.Ctx, cfg *config.Config, expiresAt time.Time) {
 	c.Cookie(&fiber.Cookie{
 		Name:  CookieName,
-		Value: IssueToken(cfg.UnlockPassword, expiresAt),
+		Value: IssueToken(Secret(cfg), expiresAt),
 		Path:  "/",
 		// Expires rather than session-only: the point of the cookie is that unlocking
 		// survives closing the tab.
@@ -1,10 +1,13 @@
 package unlock
 
 import (
+	"bytes"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/nuuner/bindle-server/internal/config"
 )
 
 const secret = "correct horse battery staple"
@@ -88,3 +91,34 @@ func TestPasswordMatches(t *testing.T) {
 		t.Error("expected a prefix of the password to be rejected")
 	}
 }
+
+// Cookies are signed under the MAC key, which stays put when the encryption key is
+// rotated, and a new password still revokes them.
+func TestSecretFollowsThePasswordAndTheMACKey(t *testing.T) {
+	cfg := &config.Config{
+		UnlockPassword: secret,
+		EncryptionKey:  bytes.Repeat([]byte{1}, 32),
+		MACKey:         bytes.Repeat([]byte{2}, 32),
+	}
+	token := IssueToken(Secret(cfg), time.Now().Add(time.Hour))
+
+	rotated := *cfg
+	rotated.EncryptionKey = bytes.Repeat([]byte{3}, 32)
+	if !TokenIsValid(Secret(&rotated), token, time.Now()) {
+		t.Error("expected a token to survive a new encryption key")
+	}
+
+	changed := *cfg
+	changed.UnlockPassword = "a different password"
+	if TokenIsValid(Secret(&changed), token, time.Now()) {
+		t.Error("expected a token to be rejected after a password change")
+	}
+	if TokenIsValid(secret, token, time.Now()) {
+		t.Error("expected the password alone not to verify a token")
+	}
+
+	changed.UnlockPassword = ""
+	if Secret(&changed) != "" {
+		t.Error("expected no secret without a password")
+	}
+}
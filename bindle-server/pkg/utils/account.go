@@ -15,9 +15,12 @@ func AccountIdIsValid(accountId string) bool {
 }
 
 func GenerateAccountId() string {
+	return randomBase62(22)
+}
+
+func randomBase62(length int) string {
 	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	charsLength := big.NewInt(int64(len(chars)))
-	length := 22
 
 	result := make([]byte, length)
 
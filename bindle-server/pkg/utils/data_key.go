@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Envelope encryption.
+//
+// Every object is sealed with a data key of its own, drawn at random when the object is
+// written, and the database keeps that key wrapped - sealed with AES-GCM - under the
+// master key. The object is then only as durable as its wrapped key: once the row
+// holding it is gone, copies the storage backend keeps after a delete (old versions,
+// snapshots, backups) cannot be read by anyone, master key or not. It also means a new
+// master key only has to rewrap these keys, not re-encrypt the objects.
+//
+// Wrapped layout: [nonce(12)][sealed data key(32)][tag(16)]
+const (
+	// DataKeySize is the length of a data key: AES-256, like the master key.
+	DataKeySize = 32
+
+	// WrappedDataKeySize is the length of a wrapped data key.
+	WrappedDataKeySize = frameNonceSize + DataKeySize + frameTagSize
+)
+
+// ErrBadWrappedKey reports a wrapped data key that does not open under the master key
+// it was handed: the wrong key, or a value that was damaged.
+var ErrBadWrappedKey = errors.New("wrapped data key does not open under this master key")
+
+// dataKeyAAD binds a wrapped key to its purpose, so nothing else sealed with the master
+// key can be passed off as one.
+var dataKeyAAD = []byte("bindle data key")
+
+// NewDataKey returns a fresh random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapDataKey seals dataKey under masterKey for keeping in the database.
+func WrapDataKey(masterKey, dataKey []byte) ([]byte, error) {
+	gcm, err := newFrameGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, frameNonceSize, WrappedDataKeySize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, dataKeyAAD), nil
+}
+
+// UnwrapDataKey opens a key sealed by WrapDataKey.
+func UnwrapDataKey(masterKey, wrapped []byte) ([]byte, error) {
+	if len(wrapped) != WrappedDataKeySize {
+		return nil, ErrBadWrappedKey
+	}
+	gcm, err := newFrameGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := gcm.Open(nil, wrapped[:frameNonceSize], wrapped[frameNonceSize:], dataKeyAAD)
+	if err != nil {
+		return nil, ErrBadWrappedKey
+	}
+	return dataKey, nil
+}
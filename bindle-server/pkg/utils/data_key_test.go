@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A wrapped key opens under the master key it was wrapped with and under no other, and
+// a damaged one does not open at all.
+func TestDataKeyUnwrapsOnlyUnderItsMasterKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey: %v", err)
+	}
+	wrapped, err := WrapDataKey(testKey, dataKey)
+	if err != nil {
+		t.Fatalf("WrapDataKey: %v", err)
+	}
+	if len(wrapped) != WrappedDataKeySize || bytes.Contains(wrapped, dataKey) {
+		t.Fatalf("got a %d byte wrapped key holding the data key in the clear", len(wrapped))
+	}
+
+	unwrapped, err := UnwrapDataKey(testKey, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("unwrapping gave %v", err)
+	}
+
+	if _, err := UnwrapDataKey(bytes.Repeat([]byte{0x2c}, 32), wrapped); !errors.Is(err, ErrBadWrappedKey) {
+		t.Errorf("unwrapping under another master key gave %v", err)
+	}
+	damaged := bytes.Clone(wrapped)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := UnwrapDataKey(testKey, damaged); !errors.Is(err, ErrBadWrappedKey) {
+		t.Errorf("unwrapping a damaged key gave %v", err)
+	}
+}
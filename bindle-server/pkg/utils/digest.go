@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Integrity digests, in the form RFC 9530 gives them: a Content-Digest header on each
+// chunk covering the bytes of that request, checked while the chunk streams to storage,
+// and Content-Digest and Repr-Digest on downloads. A transfer that flips a bit is
+// otherwise encrypted and stored faithfully, and nothing would notice until someone
+// opened the file.
+
+// ErrDigestMismatch reports a body whose bytes do not hash to the digest sent with it.
+var ErrDigestMismatch = errors.New("body does not match its digest")
+
+// ErrUnsupportedDigest reports a digest header that names no algorithm the server
+// checks. It is refused rather than ignored, since a client that asked for its bytes to
+// be checked must not be left believing they were.
+var ErrUnsupportedDigest = errors.New("no sha-256 digest")
+
+// ParseContentDigest returns the SHA-256 a Content-Digest header declares, or nil when
+// the header is empty. The header is a structured-field dictionary of algorithm to
+// base64 byte sequence, e.g. "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:".
+func ParseContentDigest(header string) ([]byte, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+
+	for _, member := range strings.Split(header, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || strings.ToLower(strings.TrimSpace(algorithm)) != "sha-256" {
+			continue
+		}
+		value, _, _ = strings.Cut(value, ";")
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("sha-256 digest %q is not a byte sequence", value)
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("sha-256 digest %q is not a SHA-256", value)
+		}
+		return sum, nil
+	}
+	return nil, ErrUnsupportedDigest
+}
+
+// FormatDigest renders a SHA-256 the way Content-Digest and Repr-Digest carry it.
+func FormatDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// NewDigestVerifier returns r, checked against the SHA-256 want over its first size
+// bytes. The check happens on the read that would hand out the last of them, and a
+// mismatch withholds those bytes and fails with ErrDigestMismatch instead. Readers that
+// stop at a declared length never ask for the end of the stream, so an error there
+// would come too late: a chunk would be whole by the time it was raised.
+func NewDigestVerifier(r io.Reader, want []byte, size int64) io.Reader {
+	return &digestVerifier{src: r, want: want, remaining: size, sum: sha256.New()}
+}
+
+type digestVerifier struct {
+	src       io.Reader
+	want      []byte
+	remaining int64
+	sum       hash.Hash
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	if v.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+
+	n, err := v.src.Read(p)
+	v.sum.Write(p[:n])
+	v.remaining -= int64(n)
+
+	if v.remaining == 0 && !bytes.Equal(v.sum.Sum(nil), v.want) {
+		return 0, ErrDigestMismatch
+	}
+	if v.remaining == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestParseContentDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		header  string
+		want    []byte
+		wantErr bool
+	}{
+		{"absent", "", nil, false},
+		{"sha-256", "sha-256=:" + encoded + ":", sum[:], false},
+		{"among others", "sha-512=:AAAA:, SHA-256=:" + encoded + ":;x=1", sum[:], false},
+		{"only other algorithms", "sha-512=:AAAA:", nil, true},
+		{"not a byte sequence", "sha-256=" + encoded, nil, true},
+		{"wrong length", "sha-256=:AAAA:", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContentDigest(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseContentDigest(%q) error = %v, want error %v", tt.header, err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ParseContentDigest(%q) = %x, want %x", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// The encrypting reader stops at the declared length without asking for more, so the
+// verifier has to fail on the read that completes the body - before the last frame is
+// sealed - and not wait for an EOF that never comes.
+func TestDigestVerifierFailsBeforeTheLastFrame(t *testing.T) {
+	plain := randomish(2*FrameSize + 100)
+	sum := sha256.Sum256(plain)
+
+	r, err := NewEncryptingReader(NewDigestVerifier(bytes.NewReader(plain), sum[:], int64(len(plain))),
+		testKey, EncryptionVersionStream, int64(len(plain)), 0)
+	if err != nil {
+		t.Fatalf("NewEncryptingReader: %v", err)
+	}
+	if sealed, err := io.ReadAll(r); err != nil || int64(len(sealed)) != EncryptedSize(EncryptionVersionStream, int64(len(plain))) {
+		t.Fatalf("a matching body gave %d sealed bytes and %v", len(sealed), err)
+	}
+
+	flipped := bytes.Clone(plain)
+	flipped[len(flipped)-1] ^= 1
+	r, err = NewEncryptingReader(NewDigestVerifier(bytes.NewReader(flipped), sum[:], int64(len(plain))),
+		testKey, EncryptionVersionStream, int64(len(plain)), 0)
+	if err != nil {
+		t.Fatalf("NewEncryptingReader: %v", err)
+	}
+	sealed, err := io.ReadAll(r)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("a flipped bit gave %v, want ErrDigestMismatch", err)
+	}
+	if want := 2 * (FrameSize + FrameOverhead); len(sealed) != want {
+		t.Errorf("a mismatching body sealed %d bytes before failing, want the %d of its full frames", len(sealed), want)
+	}
+}
@@ -1,10 +1,6 @@
 package utils
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"io"
-	"mime/multipart"
 	"os"
 	"strings"
 
@@ -32,22 +28,6 @@ func GetFileType(mimeType string) models.FileType {
 	}
 }
 
-func GetFileHash(file *multipart.FileHeader) (string, error) {
-	hash := sha256.New()
-	multipartFile, err := file.Open()
-	if err != nil {
-		return "", err
-	}
-	fileBytes, err := io.ReadAll(multipartFile)
-	if err != nil {
-		return "", err
-	}
-	defer multipartFile.Close()
-
-	hash.Write(fileBytes)
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
 func BytesToMimeType(fileBytes []byte) string {
 	mimeType := mimetype.Detect(fileBytes)
 	return mimeType.String()
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// ShareSlugLength gives a slug about 95 bits of randomness: far past guessing, and
+// still short enough to paste.
+const ShareSlugLength = 16
+
+// GenerateShareSlug returns a new random slug for a share URL.
+func GenerateShareSlug() string {
+	return randomBase62(ShareSlugLength)
+}
+
+// ShareSlugFromPath takes the slug out of the last segment of a share URL. The
+// extension after it is only there so browsers and players guess the type from the URL;
+// it is not part of the slug and is ignored.
+func ShareSlugFromPath(path string) string {
+	slug, _, _ := strings.Cut(path, ".")
+	return slug
+}
+
+// DeletionTokenLength gives a deletion token about 131 bits of randomness, so it can be
+// handed to a screenshot tool in a URL and still not be guessed.
+const DeletionTokenLength = 22
+
+// GenerateDeletionToken returns a new random token that deletes one file.
+func GenerateDeletionToken() string {
+	return randomBase62(DeletionTokenLength)
+}
+
+// HashDeletionToken is what is stored for a deletion token. The token is random, so a
+// plain SHA-256 is enough to keep a copy of the database from deleting files; there is
+// nothing to salt or stretch against.
+func HashDeletionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -3,7 +3,9 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -30,6 +32,25 @@ import (
 // Each frame is authenticated against its absolute index, so frames cannot be reordered
 // within a file or spliced in from another one, and a reader stops at the declared
 // plaintext length, so a truncated object fails instead of decoding short.
+//
+// Per-object subkeys - encryption version 3.
+//
+// Version 2 draws a random 96-bit nonce for every frame, all under one key. Random GCM
+// nonces are only safe up to about 2^32 messages per key, and a deployment seals that
+// many frames over its life. Version 3 seals each object's frames with a subkey of its
+// own, derived by HKDF-SHA256 from the object's key and a random salt, and numbers the
+// nonces by frame index rather than drawing them: a nonce then never repeats under a
+// subkey, and a subkey never repeats either, as long as salts do not. The salt is the
+// object's header, so frames no longer carry a nonce.
+//
+// Object layout: [salt(32)] then frames of [ciphertext(<=FrameSize)][tag(16)]
+//
+// A frame index must therefore never be sealed twice over different bytes under one
+// subkey: anyone who saw both ciphertexts would learn the XOR of the two plaintexts, and
+// could forge frames under that nonce. A chunk sent again seals its frames at the same
+// indexes, so chunked uploads check every frame before it is sealed, with
+// NewCheckedEncryptingReader, and refuse one that differs from what was sealed there
+// before. Sent again unchanged, a frame seals to the same ciphertext as the first time.
 const (
 	// FrameSize is the plaintext covered by one frame. It sets the buffer both
 	// directions hold: large enough that the per-frame overhead and the AEAD call
@@ -39,29 +60,65 @@ const (
 	frameNonceSize = 12
 	frameTagSize   = 16
 
-	// FrameOverhead is what each frame adds on top of its plaintext.
+	// FrameOverhead is what each version 2 frame adds on top of its plaintext.
 	FrameOverhead = frameNonceSize + frameTagSize
 
+	// StreamSaltSize is the length of a version 3 object's salt, which is its header.
+	StreamSaltSize = 32
+
 	// EncryptionVersionStream marks a file stored in the framed format described above.
 	// Files written before it carry version 0 and are read by the v1 paths.
 	EncryptionVersionStream = 2
+
+	// EncryptionVersionSubkey marks a file stored framed under a subkey of its own.
+	EncryptionVersionSubkey = 3
+
+	// EncryptionVersionClient marks a file the uploader's browser encrypted before
+	// sending it. The server holds no key for it: its object is the ciphertext exactly
+	// as it arrived, with no frames or header of the server's, and is read back as is.
+	EncryptionVersionClient = 4
 )
 
+// subkeyInfo binds derived subkeys to their purpose, so that the same key and salt fed
+// to HKDF anywhere else give a different key.
+const subkeyInfo = "bindle stream subkey v3"
+
 // ErrShortSource reports a source that ended before the plaintext length it declared.
 // Chunk uploads declare their length up front so the encrypted length can be computed
 // before any byte is read, which means a client that sends less has to be rejected
 // rather than silently stored.
 var ErrShortSource = errors.New("source ended before the declared length")
 
-// EncryptedSize returns how many bytes plainSize occupies once framed and sealed.
-// Callers need this before reading anything: S3 wants the part length up front, and the
-// filesystem backend places each chunk at a computed offset.
-func EncryptedSize(plainSize int64) int64 {
+// StreamHeaderSize returns how many bytes come before the first frame of an object in
+// the given framed version.
+func StreamHeaderSize(version int) int64 {
+	if version == EncryptionVersionSubkey {
+		return StreamSaltSize
+	}
+	return 0
+}
+
+func frameOverhead(version int) int64 {
+	switch version {
+	case EncryptionVersionSubkey:
+		return frameTagSize
+	case EncryptionVersionClient:
+		return 0
+	}
+	return FrameOverhead
+}
+
+// EncryptedSize returns how many bytes plainSize occupies once framed and sealed in the
+// given version, not counting the object's header - plainSize itself at
+// EncryptionVersionClient, which the server stores unframed. Callers need this before reading
+// anything: S3 wants the part length up front, and the filesystem backend places each
+// chunk at a computed offset.
+func EncryptedSize(version int, plainSize int64) int64 {
 	if plainSize <= 0 {
 		return 0
 	}
 	frames := (plainSize + FrameSize - 1) / FrameSize
-	return plainSize + frames*FrameOverhead
+	return plainSize + frames*frameOverhead(version)
 }
 
 // FramesPerChunk returns how many frames a full chunk seals, which is also the stride
@@ -70,6 +127,45 @@ func FramesPerChunk(chunkSize int64) int64 {
 	return chunkSize / FrameSize
 }
 
+// FrameSpan locates the frames holding plaintext bytes [offset, offset+length) of a
+// plainSize-byte file. It returns the index of the first of them and the byte range they
+// occupy in the sealed object, header included, which is all a ranged read needs besides
+// the header itself: frames are sealed independently, so a reader can start at any frame
+// boundary without touching the frames before it. length must be at least 1 and the
+// range must lie within the file.
+func FrameSpan(version int, plainSize, offset, length int64) (firstFrame, sealedOffset, sealedLength int64) {
+	firstFrame = offset / FrameSize
+	lastFrame := (offset + length - 1) / FrameSize
+
+	// Every frame before the last one in the file is full, so both ends of the span
+	// follow from their frame index alone.
+	spanEnd := (lastFrame + 1) * FrameSize
+	if spanEnd > plainSize {
+		spanEnd = plainSize
+	}
+
+	framesOffset := firstFrame * (FrameSize + frameOverhead(version))
+	return firstFrame, StreamHeaderSize(version) + framesOffset, EncryptedSize(version, spanEnd) - framesOffset
+}
+
+// NewStreamSalt draws the salt of a new version 3 object.
+func NewStreamSalt() ([]byte, error) {
+	salt := make([]byte, StreamSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DeriveSubkey returns the key a version 3 object's frames are sealed with: key is the
+// object's own key, salt its header.
+func DeriveSubkey(key, salt []byte) ([]byte, error) {
+	if len(salt) != StreamSaltSize {
+		return nil, fmt.Errorf("stream salt is %d bytes, want %d", len(salt), StreamSaltSize)
+	}
+	return hkdf.Key(sha256.New, key, salt, subkeyInfo, 32)
+}
+
 func newFrameGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -84,33 +180,60 @@ func frameAAD(frameIndex int64) []byte {
 	return aad
 }
 
+// indexNonce sets nonce to the frame index, as version 3 frames are sealed with.
+func indexNonce(nonce []byte, frameIndex int64) {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce[frameNonceSize-8:], uint64(frameIndex))
+}
+
 // encryptingReader seals src frame by frame as the consumer pulls.
 type encryptingReader struct {
 	src        io.Reader
 	gcm        cipher.AEAD
+	version    int
+	nonce      []byte // the nonce of the frame being emitted; in buf at version 2
 	buf        []byte // holds the frame being emitted: [nonce][ciphertext][tag]
 	out        []byte // the part of buf not yet handed to the caller
 	remaining  int64  // plaintext bytes still to seal
 	frameIndex int64  // absolute index of the next frame
+	check      FrameCheck
 	err        error
 }
 
-// NewEncryptingReader wraps src so that reading it yields the sealed form of the next
-// plainSize bytes. firstFrameIndex is where this reader sits in the file's frame grid:
-// 0 for a whole file, chunkNumber*FramesPerChunk(chunkSize) for one chunk of a chunked
-// upload.
-func NewEncryptingReader(src io.Reader, key []byte, plainSize, firstFrameIndex int64) (io.Reader, error) {
+// NewEncryptingReader wraps src so that reading it yields the frames sealing the next
+// plainSize bytes in the given version; the header, if the version has one, is the
+// caller's to write. key is the subkey at version 3. firstFrameIndex is where this reader
+// sits in the file's frame grid: 0 for a whole file, chunkNumber*FramesPerChunk(chunkSize)
+// for one chunk of a chunked upload.
+func NewEncryptingReader(src io.Reader, key []byte, version int, plainSize, firstFrameIndex int64) (io.Reader, error) {
+	return NewCheckedEncryptingReader(src, key, version, plainSize, firstFrameIndex, nil)
+}
+
+// FrameCheck is shown each frame's absolute index and plaintext before the frame is
+// sealed. An error stops the encryption with nothing of that frame emitted.
+type FrameCheck func(frameIndex int64, plain []byte) error
+
+// NewCheckedEncryptingReader is NewEncryptingReader with every frame passed through check
+// first, if it is not nil.
+func NewCheckedEncryptingReader(src io.Reader, key []byte, version int, plainSize, firstFrameIndex int64, check FrameCheck) (io.Reader, error) {
 	gcm, err := newFrameGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	return &encryptingReader{
+	r := &encryptingReader{
 		src:        src,
 		gcm:        gcm,
+		version:    version,
 		buf:        make([]byte, frameNonceSize+FrameSize+frameTagSize),
 		remaining:  plainSize,
 		frameIndex: firstFrameIndex,
-	}, nil
+		check:      check,
+	}
+	r.nonce = r.buf[:frameNonceSize]
+	if version == EncryptionVersionSubkey {
+		r.nonce, r.buf = make([]byte, frameNonceSize), r.buf[frameNonceSize:]
+	}
+	return r, nil
 }
 
 func (r *encryptingReader) Read(p []byte) (int, error) {
@@ -141,30 +264,61 @@ func (r *encryptingReader) sealNextFrame() error {
 
 	// Seal in place: dst is plaintext[:0], which cipher.AEAD permits and which keeps
 	// the whole frame in the single buffer allocated for this reader.
-	plain := r.buf[frameNonceSize : frameNonceSize+n]
+	start := len(r.buf) - FrameSize - frameTagSize
+	plain := r.buf[start : start+int(n)]
 	if _, err := io.ReadFull(r.src, plain); err != nil {
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return fmt.Errorf("%w: %d bytes missing", ErrShortSource, r.remaining)
 		}
 		return err
 	}
+	if r.check != nil {
+		if err := r.check(r.frameIndex, plain); err != nil {
+			return err
+		}
+	}
 
-	nonce := r.buf[:frameNonceSize]
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if r.version == EncryptionVersionSubkey {
+		indexNonce(r.nonce, r.frameIndex)
+	} else if _, err := io.ReadFull(rand.Reader, r.nonce); err != nil {
 		return err
 	}
 
-	sealed := r.gcm.Seal(plain[:0], nonce, plain, frameAAD(r.frameIndex))
-	r.out = r.buf[:frameNonceSize+len(sealed)]
+	sealed := r.gcm.Seal(plain[:0], r.nonce, plain, frameAAD(r.frameIndex))
+	r.out = r.buf[:start+len(sealed)]
 	r.remaining -= n
 	r.frameIndex++
 	return nil
 }
 
+// OpenFrame opens a single sealed frame, the one at frameIndex in its object's grid.
+func OpenFrame(key []byte, version int, frameIndex int64, frame []byte) ([]byte, error) {
+	gcm, err := newFrameGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, frameNonceSize)
+	if version == EncryptionVersionSubkey {
+		indexNonce(nonce, frameIndex)
+	} else {
+		if len(frame) < frameNonceSize {
+			return nil, fmt.Errorf("frame %d is truncated", frameIndex)
+		}
+		nonce, frame = frame[:frameNonceSize], frame[frameNonceSize:]
+	}
+	plain, err := gcm.Open(nil, nonce, frame, frameAAD(frameIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt frame %d: %w", frameIndex, err)
+	}
+	return plain, nil
+}
+
 // decryptingReader opens a framed object frame by frame as the consumer pulls.
 type decryptingReader struct {
 	src        io.ReadCloser
 	gcm        cipher.AEAD
+	version    int
+	nonce      []byte // only at version 3; at version 2 it is read with each frame
 	buf        []byte
 	out        []byte
 	remaining  int64
@@ -173,20 +327,46 @@ type decryptingReader struct {
 	closed     bool
 }
 
-// NewDecryptingReader wraps a framed object so that reading it yields plainSize bytes of
-// plaintext. plainSize is what pins the frame boundaries, so it must be the size
-// recorded when the file was stored.
-func NewDecryptingReader(src io.ReadCloser, key []byte, plainSize int64) (io.ReadCloser, error) {
+// NewDecryptingReader wraps the frames of an object in the given version so that reading
+// them yields plainSize bytes of plaintext. src starts after the header, and key is the
+// subkey at version 3. plainSize is what pins the frame boundaries, so it must be the
+// size recorded when the file was stored.
+func NewDecryptingReader(src io.ReadCloser, key []byte, version int, plainSize int64) (io.ReadCloser, error) {
+	return newDecryptingReader(src, key, version, plainSize, 0)
+}
+
+// NewRangeDecryptingReader yields plaintext bytes [offset, offset+length) of a framed
+// object. src must start at the sealed offset FrameSpan reports for the same range and
+// hold at least the span it reports; the frames are opened against their absolute
+// indexes, so a span fetched from the wrong place fails rather than decoding as
+// something else.
+func NewRangeDecryptingReader(src io.ReadCloser, key []byte, version int, plainSize, offset, length int64) (io.ReadCloser, error) {
+	firstFrame, _, _ := FrameSpan(version, plainSize, offset, length)
+
+	reader, err := newDecryptingReader(src, key, version, plainSize-firstFrame*FrameSize, firstFrame)
+	if err != nil {
+		return nil, err
+	}
+	return NewSectionReadCloser(reader, offset-firstFrame*FrameSize, length)
+}
+
+func newDecryptingReader(src io.ReadCloser, key []byte, version int, plainSize, firstFrameIndex int64) (io.ReadCloser, error) {
 	gcm, err := newFrameGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	return &decryptingReader{
-		src:       src,
-		gcm:       gcm,
-		buf:       make([]byte, frameNonceSize+FrameSize+frameTagSize),
-		remaining: plainSize,
-	}, nil
+	r := &decryptingReader{
+		src:        src,
+		gcm:        gcm,
+		version:    version,
+		buf:        make([]byte, frameNonceSize+FrameSize+frameTagSize),
+		remaining:  plainSize,
+		frameIndex: firstFrameIndex,
+	}
+	if version == EncryptionVersionSubkey {
+		r.nonce, r.buf = make([]byte, frameNonceSize), r.buf[frameNonceSize:]
+	}
+	return r, nil
 }
 
 func (r *decryptingReader) Read(p []byte) (int, error) {
@@ -219,7 +399,7 @@ func (r *decryptingReader) openNextFrame() error {
 		n = r.remaining
 	}
 
-	frame := r.buf[:frameNonceSize+n+frameTagSize]
+	frame := r.buf[:len(r.buf)-FrameSize+int(n)]
 	if _, err := io.ReadFull(r.src, frame); err != nil {
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return fmt.Errorf("frame %d is truncated: %w", r.frameIndex, err)
@@ -228,6 +408,10 @@ func (r *decryptingReader) openNextFrame() error {
 	}
 
 	nonce, sealed := frame[:frameNonceSize], frame[frameNonceSize:]
+	if r.version == EncryptionVersionSubkey {
+		nonce, sealed = r.nonce, frame
+		indexNonce(nonce, r.frameIndex)
+	}
 	plain, err := r.gcm.Open(sealed[:0], nonce, sealed, frameAAD(r.frameIndex))
 	if err != nil {
 		return fmt.Errorf("failed to decrypt frame %d: %w", r.frameIndex, err)
@@ -250,3 +434,23 @@ func (r *decryptingReader) Close() error {
 	}
 	return nil
 }
+
+// sectionReadCloser serves a window of a stream that cannot seek.
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewSectionReadCloser discards the first skip bytes of r and then yields at most length
+// more. It is how a range is cut out of a stream that can only be read from the front:
+// the discarded bytes are read and dropped rather than buffered, so skipping costs time
+// but no memory.
+func NewSectionReadCloser(r io.ReadCloser, skip, length int64) (io.ReadCloser, error) {
+	if skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return &sectionReadCloser{Reader: io.LimitReader(r, length), Closer: r}, nil
+}
@@ -19,7 +19,7 @@ func randomish(n int) []byte {
 
 func sealAll(t *testing.T, plain []byte, firstFrameIndex int64) []byte {
 	t.Helper()
-	r, err := NewEncryptingReader(bytes.NewReader(plain), testKey, int64(len(plain)), firstFrameIndex)
+	r, err := NewEncryptingReader(bytes.NewReader(plain), testKey, EncryptionVersionStream, int64(len(plain)), firstFrameIndex)
 	if err != nil {
 		t.Fatalf("NewEncryptingReader: %v", err)
 	}
@@ -32,7 +32,7 @@ func sealAll(t *testing.T, plain []byte, firstFrameIndex int64) []byte {
 
 func openAll(t *testing.T, sealed []byte, plainSize int64) ([]byte, error) {
 	t.Helper()
-	r, err := NewDecryptingReader(io.NopCloser(bytes.NewReader(sealed)), testKey, plainSize)
+	r, err := NewDecryptingReader(io.NopCloser(bytes.NewReader(sealed)), testKey, EncryptionVersionStream, plainSize)
 	if err != nil {
 		t.Fatalf("NewDecryptingReader: %v", err)
 	}
@@ -53,9 +53,9 @@ func TestRoundTrip(t *testing.T) {
 		plain := randomish(size)
 		sealed := sealAll(t, plain, 0)
 
-		if int64(len(sealed)) != EncryptedSize(int64(size)) {
+		if int64(len(sealed)) != EncryptedSize(EncryptionVersionStream, int64(size)) {
 			t.Errorf("size %d sealed to %d bytes, EncryptedSize says %d",
-				size, len(sealed), EncryptedSize(int64(size)))
+				size, len(sealed), EncryptedSize(EncryptionVersionStream, int64(size)))
 		}
 
 		got, err := openAll(t, sealed, int64(size))
@@ -103,8 +103,8 @@ func TestChunkedSealSizesArePredictable(t *testing.T) {
 	const chunkSize = int64(4 * FrameSize)
 
 	sealed := sealAll(t, randomish(int(chunkSize)), 0)
-	if int64(len(sealed)) != EncryptedSize(chunkSize) {
-		t.Errorf("full chunk sealed to %d bytes, offsets assume %d", len(sealed), EncryptedSize(chunkSize))
+	if int64(len(sealed)) != EncryptedSize(EncryptionVersionStream, chunkSize) {
+		t.Errorf("full chunk sealed to %d bytes, offsets assume %d", len(sealed), EncryptedSize(EncryptionVersionStream, chunkSize))
 	}
 }
 
@@ -148,7 +148,7 @@ func TestTruncatedObjectIsRejected(t *testing.T) {
 // A chunk declares its length before its body is read, so a body that ends early has to
 // fail rather than be stored short.
 func TestShortSourceIsReported(t *testing.T) {
-	r, err := NewEncryptingReader(bytes.NewReader(randomish(100)), testKey, 500, 0)
+	r, err := NewEncryptingReader(bytes.NewReader(randomish(100)), testKey, EncryptionVersionStream, 500, 0)
 	if err != nil {
 		t.Fatalf("NewEncryptingReader: %v", err)
 	}
@@ -164,7 +164,7 @@ func TestReadsSurviveSmallBuffers(t *testing.T) {
 	plain := randomish(FrameSize + 777)
 	sealed := sealAll(t, plain, 0)
 
-	r, err := NewDecryptingReader(io.NopCloser(bytes.NewReader(sealed)), testKey, int64(len(plain)))
+	r, err := NewDecryptingReader(io.NopCloser(bytes.NewReader(sealed)), testKey, EncryptionVersionStream, int64(len(plain)))
 	if err != nil {
 		t.Fatalf("NewDecryptingReader: %v", err)
 	}
@@ -201,3 +201,144 @@ func TestFrameSizeDividesEveryChunkSize(t *testing.T) {
 		}
 	}
 }
+
+// A ranged read opens only the frames covering the range, starting mid-object, and has
+// to agree with the plaintext byte for byte wherever the range falls against the grid.
+func TestRangeReadsMatchThePlaintext(t *testing.T) {
+	plain := randomish(3*FrameSize + 1000)
+	size := int64(len(plain))
+	sealed := sealAll(t, plain, 0)
+
+	ranges := []struct{ offset, length int64 }{
+		{0, 1},
+		{0, size},
+		{10, 100},                      // inside the first frame
+		{FrameSize - 5, 10},            // straddles a frame boundary
+		{FrameSize, FrameSize},         // exactly one whole frame
+		{2*FrameSize + 7, FrameSize},   // runs into the short last frame
+		{size - 1, 1},                  // the final byte
+		{FrameSize / 2, 2 * FrameSize}, // spans three frames
+	}
+
+	for _, r := range ranges {
+		_, sealedOffset, sealedLength := FrameSpan(EncryptionVersionStream, size, r.offset, r.length)
+		span := sealed[sealedOffset : sealedOffset+sealedLength]
+
+		reader, err := NewRangeDecryptingReader(io.NopCloser(bytes.NewReader(span)), testKey, EncryptionVersionStream, size, r.offset, r.length)
+		if err != nil {
+			t.Fatalf("range %d+%d: %v", r.offset, r.length, err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("range %d+%d: read failed: %v", r.offset, r.length, err)
+		}
+		if !bytes.Equal(got, plain[r.offset:r.offset+r.length]) {
+			t.Errorf("range %d+%d read back different bytes", r.offset, r.length)
+		}
+	}
+}
+
+// The span has to be exactly the frames the range touches: short and the read fails,
+// long and a ranged read pulls bytes it never uses.
+func TestFrameSpanCoversOnlyTheFramesTouched(t *testing.T) {
+	const size = 4 * FrameSize
+	frame := int64(FrameSize + FrameOverhead)
+
+	firstFrame, offset, length := FrameSpan(EncryptionVersionStream, size, FrameSize+1, 10)
+	if firstFrame != 1 || offset != frame || length != frame {
+		t.Errorf("a range inside frame 1 spans frame %d at %d+%d, want frame 1 at %d+%d",
+			firstFrame, offset, length, frame, frame)
+	}
+
+	firstFrame, offset, length = FrameSpan(EncryptionVersionStream, size, FrameSize-1, 2)
+	if firstFrame != 0 || offset != 0 || length != 2*frame {
+		t.Errorf("a range across the first boundary spans frame %d at %d+%d, want frame 0 at 0+%d",
+			firstFrame, offset, length, 2*frame)
+	}
+}
+
+// sealSubkeyObject writes plain as a version 3 object, header and frames, one chunkSize
+// chunk at a time as a chunked upload does.
+func sealSubkeyObject(t *testing.T, salt, plain []byte, chunkSize int64) []byte {
+	t.Helper()
+	subkey, err := DeriveSubkey(testKey, salt)
+	if err != nil {
+		t.Fatalf("DeriveSubkey: %v", err)
+	}
+	object := bytes.NewBuffer(bytes.Clone(salt))
+	for offset, chunkNumber := int64(0), int64(0); offset < int64(len(plain)); chunkNumber++ {
+		end := min(offset+chunkSize, int64(len(plain)))
+		r, err := NewEncryptingReader(bytes.NewReader(plain[offset:end]), subkey, EncryptionVersionSubkey,
+			end-offset, chunkNumber*FramesPerChunk(chunkSize))
+		if err != nil {
+			t.Fatalf("NewEncryptingReader: %v", err)
+		}
+		if _, err := io.Copy(object, r); err != nil {
+			t.Fatalf("read sealed: %v", err)
+		}
+		offset = end
+	}
+	return object.Bytes()
+}
+
+// A version 3 object is its salt followed by frames without nonces, sealed under a
+// subkey no other salt derives, and reads back whole or by range like version 2.
+func TestSubkeyObjectsReadBackUnderTheirOwnSubkey(t *testing.T) {
+	const chunkSize = int64(2 * FrameSize)
+	plain := randomish(int(2*chunkSize) + 1000)
+	size := int64(len(plain))
+	salt, err := NewStreamSalt()
+	if err != nil {
+		t.Fatalf("NewStreamSalt: %v", err)
+	}
+	object := sealSubkeyObject(t, salt, plain, chunkSize)
+
+	if want := StreamHeaderSize(EncryptionVersionSubkey) + EncryptedSize(EncryptionVersionSubkey, size); int64(len(object)) != want {
+		t.Fatalf("sealed to %d bytes, want %d", len(object), want)
+	}
+	if EncryptedSize(EncryptionVersionSubkey, size) >= EncryptedSize(EncryptionVersionStream, size) {
+		t.Error("version 3 frames still carry a nonce")
+	}
+
+	subkey, _ := DeriveSubkey(testKey, salt)
+	for _, r := range []struct{ offset, length int64 }{{0, size}, {FrameSize - 5, 10}, {chunkSize + 3, FrameSize}, {size - 1, 1}} {
+		_, sealedOffset, sealedLength := FrameSpan(EncryptionVersionSubkey, size, r.offset, r.length)
+		span := io.NopCloser(bytes.NewReader(object[sealedOffset : sealedOffset+sealedLength]))
+		reader, err := NewRangeDecryptingReader(span, subkey, EncryptionVersionSubkey, size, r.offset, r.length)
+		if err != nil {
+			t.Fatalf("range %d+%d: %v", r.offset, r.length, err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, plain[r.offset:r.offset+r.length]) {
+			t.Errorf("range %d+%d read back different bytes (%v)", r.offset, r.length, err)
+		}
+	}
+
+	otherSalt, _ := NewStreamSalt()
+	otherKey, _ := DeriveSubkey(testKey, otherSalt)
+	frames := io.NopCloser(bytes.NewReader(object[StreamSaltSize:]))
+	reader, _ := NewDecryptingReader(frames, otherKey, EncryptionVersionSubkey, size)
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("the frames opened under a subkey from another salt")
+	}
+}
+
+// Nonces are the frame indexes, so the same bytes under the same salt seal the same way,
+// and only the salt tells two objects' subkeys apart.
+func TestSubkeyNoncesAreFrameIndexes(t *testing.T) {
+	plain := randomish(FrameSize + 10)
+	salt, _ := NewStreamSalt()
+	first := sealSubkeyObject(t, salt, plain, 4*FrameSize)
+	if !bytes.Equal(first, sealSubkeyObject(t, salt, plain, 4*FrameSize)) {
+		t.Error("sealing the same bytes under the same salt gave different objects")
+	}
+	otherSalt, _ := NewStreamSalt()
+	if bytes.Equal(first[StreamSaltSize:], sealSubkeyObject(t, otherSalt, plain, 4*FrameSize)[StreamSaltSize:]) {
+		t.Error("two salts sealed the same frames")
+	}
+	if _, err := DeriveSubkey(testKey, salt[:16]); err == nil {
+		t.Error("a short salt derived a subkey")
+	}
+}